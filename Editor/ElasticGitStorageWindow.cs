@@ -54,7 +54,7 @@ namespace Frostebite.ElasticGitStorage.Editor
         // Section 3 — Configuration (editable form)
         string _storagePath = "";
         string _pushPath    = "";
-        int    _compressionIndex; // 0 = none, 1 = zip, 2 = lz4
+        int    _compressionIndex; // 0 = none, 1 = zip, 2 = lz4, 3 = zstd
         bool   _pullMain;
         bool   _pushMain;
         bool   _writeAll;
@@ -73,7 +73,7 @@ namespace Frostebite.ElasticGitStorage.Editor
         // Download async state
         UnityWebRequest _activeRequest;
 
-        static readonly string[] k_CompressionOptions = { "none", "zip", "lz4" };
+        static readonly string[] k_CompressionOptions = { "none", "zip", "lz4", "zstd" };
 
         // -----------------------------------------------------------------
         // Menu item
@@ -32,6 +32,7 @@ type TransferError struct {
 type Request struct {
 	Event               string  `json:"event"`
 	Operation           string  `json:"operation"`
+	Remote              string  `json:"remote"`
 	Concurrent          bool    `json:"concurrent"`
 	ConcurrentTransfers int     `json:"concurrenttransfers"`
 	Oid                 string  `json:"oid"`
@@ -83,7 +84,7 @@ func SendTransferError(oid string, code int, message string, writer, errWriter *
 	resp := &TransferResponse{"complete", oid, "", &TransferError{code, message}}
 	err := SendResponse(resp, writer, errWriter)
 	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send transfer error: %v\n", err), errWriter)
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to send transfer error: %v\n", err), errWriter)
 	}
 }
 
@@ -92,6 +93,6 @@ func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer, errW
 	resp := &ProgressResponse{"progress", oid, bytesSoFar, bytesSinceLast}
 	err := SendResponse(resp, writer, errWriter)
 	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send progress update: %v\n", err), errWriter)
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to send progress update: %v\n", err), errWriter)
 	}
 }
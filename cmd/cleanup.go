@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup [basedir...]",
+	Short: "Remove temp files left behind by interrupted transfers",
+	Run:   cleanupCommand,
+}
+
+func cleanupUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage cleanup [options] [basedir...]
+
+Removes the temp files that interrupted transfers leave in folder stores and in
+the repository's .git/lfs/tmp folder (or --temp-dir), once they are older than
+--temp-max-age.
+Base directories use the same syntax as for transfers; rclone remotes, URLs and
+scripts are skipped. Without arguments the git config lfs.folderstore.pull and
+lfs.folderstore.push locations are cleaned.
+
+Options:
+  --temp-max-age D
+               Only remove temp files last written longer ago than D, so
+               transfers still running elsewhere are left alone (default 24h)
+  --temp-dir DIR
+               Also clean the download folder DIR given for transfers
+  --git-dir DIR
+               The repository whose .git/lfs/tmp folder is cleaned
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func cleanupCommand(cmd *cobra.Command, args []string) {
+	maxAge := resolveTempMaxAge(cmd)
+	if maxAge == 0 {
+		os.Stderr.WriteString("--temp-max-age must be greater than zero for cleanup\n")
+		os.Exit(1)
+	}
+
+	baseDirs := args
+	if len(baseDirs) == 0 {
+		for _, key := range []string{"lfs.folderstore.pull", "lfs.folderstore.push"} {
+			if dir := strings.TrimSpace(getGitConfig(key)); dir != "" {
+				baseDirs = append(baseDirs, dir)
+			}
+		}
+	}
+	if len(baseDirs) == 0 {
+		os.Stderr.WriteString("Required: base directory (as an argument or git config lfs.folderstore.pull)\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	service.SetGitDir(gitDirPath)
+	if tempDir == "" {
+		tempDir = getGitConfig("lfs.folderstore.tempdir")
+	}
+	if err := service.SetTempDir(tempDir); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(1)
+	}
+	if err := service.CleanupTempFiles(baseDirs, maxAge, os.Stderr); err != nil {
+		os.Exit(2)
+	}
+}
+
+// resolveTempMaxAge returns the --temp-max-age flag, or the git config
+// lfs.folderstore.tempmaxage if the flag wasn't given.
+func resolveTempMaxAge(cmd *cobra.Command) time.Duration {
+	if !cmd.Flags().Changed("temp-max-age") {
+		if v := getGitConfig("lfs.folderstore.tempmaxage"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				return d
+			}
+			os.Stderr.WriteString(fmt.Sprintf("Warning: invalid lfs.folderstore.tempmaxage %q, using default\n", v))
+		}
+	}
+	return tempMaxAge
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var cpJobs int
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copy every stored object from one store to another",
+	Run:   cpCommand,
+}
+
+func init() {
+	cpCmd.Flags().IntVar(&cpJobs, "jobs", runtime.NumCPU(), "Number of objects to copy at once")
+}
+
+func cpUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage cp [options] <source> <destination>
+
+Copies every object from the source stores to the destination stores without
+going through git-lfs, for example to move to new storage. Both use the same
+base directory syntax as for transfers. Sources must be folders or rclone
+remotes; destinations can be any kind of store. Objects are checked to hash
+to their OID before being stored.
+
+Destinations given a --compression option are stored in that format, for
+example "--compression=lz4 remote:archive"; otherwise each object keeps the
+compression it had. Objects already in the destination at the same size are
+skipped, so an interrupted copy can be run again to resume it.
+
+Options:
+  --jobs N     Number of objects to copy at once (default: number of CPUs)
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func cpCommand(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		os.Stderr.WriteString("Required: source and destination base directories\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+	configureExternalCompression()
+	configureOidHash(cmd)
+	if _, err := service.CopyStores(args[0], args[1], cpJobs, os.Stderr); err != nil {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var lsJSON bool
+
+var lsCmd = &cobra.Command{
+	Use:   "ls [basedir...]",
+	Short: "List stored objects with their sizes",
+	Run:   lsCommand,
+}
+
+func init() {
+	lsCmd.Flags().BoolVar(&lsJSON, "json", false, "Print the listing as JSON")
+}
+
+func lsUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage ls [options] [basedir...]
+
+Lists every object in the given stores with its OID, stored size and
+compression, followed by totals. Objects are found in any layout, and their
+compression is taken from their extension.
+Base directories use the same syntax as for transfers; folders and rclone
+remotes are listed, scripts, S3 and HTTP stores are skipped. Without
+arguments the git config lfs.folderstore.pull and lfs.folderstore.push
+locations are listed.
+
+Options:
+  --json       Print a JSON document with an "objects" array and "count" and
+               "size" totals instead
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func lsCommand(cmd *cobra.Command, args []string) {
+	baseDirs := args
+	if len(baseDirs) == 0 {
+		for _, key := range []string{"lfs.folderstore.pull", "lfs.folderstore.push"} {
+			if dir := strings.TrimSpace(getGitConfig(key)); dir != "" {
+				baseDirs = append(baseDirs, dir)
+			}
+		}
+	}
+	if len(baseDirs) == 0 {
+		os.Stderr.WriteString("Required: base directory (as an argument or git config lfs.folderstore.pull)\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	objects, listErr := service.ListStores(baseDirs, os.Stderr)
+	var total int64
+	counts := make(map[string]int)
+	for _, o := range objects {
+		total += o.Size
+		counts[o.Compression]++
+	}
+
+	if lsJSON {
+		if objects == nil {
+			objects = []service.ObjectInfo{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Objects []service.ObjectInfo `json:"objects"`
+			Count   int                  `json:"count"`
+			Size    int64                `json:"size"`
+		}{objects, len(objects), total})
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, o := range objects {
+			fmt.Fprintf(w, "%v\t%d\t%v\t%v\n", o.OID, o.Size, o.Compression, o.Path)
+		}
+		w.Flush()
+		var formats []string
+		for c, n := range counts {
+			formats = append(formats, fmt.Sprintf("%d %v", n, c))
+		}
+		sort.Strings(formats)
+		summary := fmt.Sprintf("%d object(s), %d bytes", len(objects), total)
+		if len(formats) > 0 {
+			summary += " (" + strings.Join(formats, ", ") + ")"
+		}
+		fmt.Println(summary)
+	}
+	if listErr != nil {
+		os.Exit(2)
+	}
+}
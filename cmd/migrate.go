@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateTo     string
+	migrateJobs   int
+	migrateDryRun bool
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate --to <compression> [basedir...]",
+	Short: "Rewrite stored objects in another compression format",
+	Run:   migrateCommand,
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "Compression to rewrite objects in: none, lz4, zip, zstd, gzip, xz or external")
+	migrateCmd.Flags().IntVar(&migrateJobs, "jobs", runtime.NumCPU(), "Number of objects to rewrite at once")
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "List the objects that would be rewritten without changing them")
+}
+
+func migrateUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage migrate --to <compression> [options] [basedir...]
+
+Rewrites every object in the given stores in another compression format, in
+the folder it was found in. Each object is checked to decompress to its OID
+before and after rewriting, and the original is only removed once the new
+copy is in place. Objects already in the target format are skipped.
+Base directories use the same syntax as for transfers, though --compression
+options are ignored since each object's format is taken from its extension;
+folders and rclone remotes are migrated, scripts, S3 and HTTP stores are
+skipped. Without arguments the git config lfs.folderstore.pull and
+lfs.folderstore.push locations are migrated.
+
+Remember to set --compression to match in the base directories used for
+transfers afterwards, or new uploads will be stored in the old format.
+
+Options:
+  --to C       Compression to rewrite objects in: none, lz4, zip, zstd, gzip,
+               xz or external, which uses the commands in git config
+               lfs.folderstore.compresscmd and lfs.folderstore.decompresscmd
+  --jobs N     Number of objects to rewrite at once (default: number of CPUs)
+  --dry-run    List the objects that would be rewritten without changing them
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func migrateCommand(cmd *cobra.Command, args []string) {
+	if migrateTo == "" {
+		os.Stderr.WriteString("Required: --to compression\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	baseDirs := args
+	if len(baseDirs) == 0 {
+		for _, key := range []string{"lfs.folderstore.pull", "lfs.folderstore.push"} {
+			if dir := strings.TrimSpace(getGitConfig(key)); dir != "" {
+				baseDirs = append(baseDirs, dir)
+			}
+		}
+	}
+	if len(baseDirs) == 0 {
+		os.Stderr.WriteString("Required: base directory (as an argument or git config lfs.folderstore.pull)\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	configureExternalCompression()
+	configureOidHash(cmd)
+	if _, err := service.MigrateStores(baseDirs, migrateTo, migrateJobs, migrateDryRun, os.Stderr); err != nil {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneFile    string
+	pruneMaxSize int64
+	pruneDryRun  bool
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune [basedir...]",
+	Short: "Remove stored objects that aren't in a list of live OIDs or haven't been used lately",
+	Run:   pruneCommand,
+}
+
+func init() {
+	pruneCmd.Flags().StringVar(&pruneFile, "oids", "-", "File listing the OIDs to keep, or - for stdin")
+	pruneCmd.Flags().Int64Var(&pruneMaxSize, "max-size", 0, "Evict the least recently used objects until each folder store holds at most this many bytes")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "List the objects that would be removed without removing them")
+}
+
+func pruneUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage prune [options] [basedir...]
+
+Removes every object from the given stores whose OID isn't in a list of live
+OIDs, whatever its compression. The list has one OID per line, as printed by
+git lfs ls-files --all --long; short OIDs protect every object starting with
+them, so plain git lfs ls-files --all output is safe to use too.
+Base directories use the same syntax as for transfers; folders and rclone
+remotes are pruned, scripts, S3 and HTTP stores are skipped. Without
+arguments the git config lfs.folderstore.pull and lfs.folderstore.push
+locations are pruned.
+
+With --max-size, the least recently used objects left in each folder store
+are then evicted until it holds no more than the given number of bytes.
+Objects count as used when downloaded by an adapter run with --track-access,
+or else when they were stored. The OID list is only read with --max-size if
+--oids is given too.
+
+Examples:
+  git lfs ls-files --all --long | elastic-git-storage prune --dry-run
+  elastic-git-storage prune --max-size 500000000000 /mnt/cache
+
+Options:
+  --oids FILE  File listing the OIDs to keep (default: read from stdin)
+  --max-size N Evict least recently used objects until each folder store
+               holds at most N bytes
+  --dry-run    List the objects that would be removed without removing them
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func pruneCommand(cmd *cobra.Command, args []string) {
+	baseDirs := args
+	if len(baseDirs) == 0 {
+		for _, key := range []string{"lfs.folderstore.pull", "lfs.folderstore.push"} {
+			if dir := strings.TrimSpace(getGitConfig(key)); dir != "" {
+				baseDirs = append(baseDirs, dir)
+			}
+		}
+	}
+	if len(baseDirs) == 0 {
+		os.Stderr.WriteString("Required: base directory (as an argument or git config lfs.folderstore.pull)\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	if pruneMaxSize < 0 {
+		os.Stderr.WriteString("--max-size can't be negative\n")
+		os.Exit(1)
+	}
+
+	// A size limit alone keeps every object it has room for
+	var live service.OIDSet
+	if pruneMaxSize == 0 || cmd.Flags().Changed("oids") {
+		var r io.Reader = os.Stdin
+		if pruneFile != "-" {
+			f, err := os.Open(pruneFile)
+			if err != nil {
+				os.Stderr.WriteString(fmt.Sprintf("Unable to read OIDs: %v\n", err))
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		live, err = service.ReadOIDs(r)
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Unable to read OIDs: %v\n", err))
+			os.Exit(1)
+		}
+		if len(live) == 0 {
+			os.Stderr.WriteString("No live OIDs given, refusing to remove every object\n")
+			os.Exit(1)
+		}
+	}
+
+	if _, err := service.PruneStores(baseDirs, live, pruneMaxSize, pruneDryRun, os.Stderr); err != nil {
+		os.Exit(2)
+	}
+}
@@ -21,10 +21,15 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sinbad/lfs-folderstore/service"
 	"github.com/sinbad/lfs-folderstore/util"
@@ -38,6 +43,64 @@ var (
 	pullMain     bool
 	pushMain     bool
 	writeAll     bool
+	mirror       bool
+	distribute   bool
+	rcloneProcs  int
+	compressLvl  int
+	compressJobs int
+	compressAll  bool
+	compressCmd  string
+	decompCmd    string
+	verifyUpload bool
+	verifyExist  bool
+	resumeUpload bool
+	metadata     bool
+	trackAccess  bool
+	objectTTL    time.Duration
+	ttlDelete    bool
+	linkUploads  bool
+	reflink      bool
+	rcloneRcat   bool
+	rcloneRcd    bool
+	rcloneMove   bool
+	rcloneArgs   []string
+	cacheDir     string
+	cacheMax     int64
+	minSize      int64
+	maxSize      int64
+	maxBandwidth int64
+	blockSize    int
+	progInterval time.Duration
+	progBytes    int64
+	maxLine      int
+	exitCode     bool
+	dryRun       bool
+	httpRetries  int
+	httpTimeout  time.Duration
+	httpProxy    string
+	caCert       string
+	insecureTLS  bool
+	scriptTmout  time.Duration
+	scriptOut    bool
+	checkScripts bool
+	scriptShell  string
+	fsRetries    int
+	durable      bool
+	fileMode     string
+	dirMode      string
+	readOnly     bool
+	writeOnly    bool
+	logFile      string
+	logFormat    string
+	tempMaxAge   time.Duration
+	tempDir      string
+	gitDirPath   string
+	shardDepth   int
+	flatLayout   bool
+	normCase     bool
+	oidHash      string
+	verbose      int
+	quiet        bool
 	printVersion bool
 )
 
@@ -61,7 +124,8 @@ func init() {
 		as the remote store for all LFS object data. Upload and download functions
 		are turned into simple file copies to destinations determined by the id
 		of the object.`,
-		Run: rootCommand,
+		Args: cobra.ArbitraryArgs,
+		Run:  rootCommand,
 	}
 
 	RootCmd.Flags().StringVarP(&baseDir, "basedir", "d", "", "Base directory for all file operations")
@@ -70,15 +134,89 @@ func init() {
 	RootCmd.Flags().BoolVar(&pullMain, "pullmain", false, "Allow fallback pulling from main LFS remote")
 	RootCmd.Flags().BoolVar(&pushMain, "pushmain", false, "Also push to main LFS remote")
 	RootCmd.Flags().BoolVar(&writeAll, "writeall", false, "Write to all push destinations instead of stopping on first success")
+	RootCmd.Flags().BoolVar(&mirror, "mirror", false, "Write to all push destinations and fail unless every write succeeds")
+	RootCmd.Flags().BoolVar(&distribute, "distribute", false, "Spread objects across destinations by OID; downloads look in the same place first")
+	RootCmd.Flags().IntVar(&rcloneProcs, "rclone-max-procs", 0, "Maximum number of concurrent rclone processes (0 = unlimited)")
+	RootCmd.Flags().IntVar(&compressLvl, "compress-level", -1, "lz4 compression level for uploads, 0 (fast) to 9 (best)")
+	RootCmd.Flags().BoolVar(&compressAll, "compress-always", false, "Compress uploads to folders even when their start shows compression won't help")
+	RootCmd.Flags().StringVar(&compressCmd, "compress-cmd", "", "Command compressing objects from stdin to stdout for stores with --compression=external")
+	RootCmd.Flags().StringVar(&decompCmd, "decompress-cmd", "", "Command decompressing objects from stdin to stdout for stores with --compression=external")
+	RootCmd.Flags().IntVar(&compressJobs, "compress-jobs", 0, "Number of lz4 blocks compressed at once for uploads (default: number of CPUs)")
+	RootCmd.Flags().BoolVar(&verifyUpload, "verify-uploads", false, "Check uploaded content hashes to its OID before storing")
+	RootCmd.Flags().BoolVar(&verifyExist, "verify-existing", false, "Check objects already stored at the right size hash to their OID before skipping their upload")
+	RootCmd.Flags().BoolVar(&resumeUpload, "resume-uploads", false, "Carry on uploads to folders from the temp file an interrupted attempt left")
+	RootCmd.Flags().BoolVar(&trackAccess, "track-access", false, "Record when objects are downloaded from folder stores in <oid>.atime files, for prune --max-size")
+	RootCmd.Flags().DurationVar(&objectTTL, "ttl", 0, "Fetch objects stored in folders longer ago than this through the LFS action instead, when it's used (0 = never)")
+	RootCmd.Flags().BoolVar(&ttlDelete, "ttl-delete", false, "Delete objects older than --ttl from folder stores when they're passed over")
+	RootCmd.Flags().BoolVar(&metadata, "metadata", false, "Write a <oid>.meta file with the original size, compression and time stored next to objects stored in folders")
+	RootCmd.Flags().BoolVar(&linkUploads, "link", false, "Hardlink uploads into local stores on the same filesystem instead of copying")
+	RootCmd.Flags().BoolVar(&reflink, "reflink", false, "Clone uploads with copy-on-write reflinks where the filesystem supports it")
+	RootCmd.Flags().BoolVar(&rcloneRcat, "rclone-rcat", false, "Stream compressed rclone uploads with rclone rcat instead of staging a temp file")
+	RootCmd.Flags().StringArrayVar(&rcloneArgs, "rclone-arg", nil, "Extra argument for every rclone command, e.g. --rclone-arg=--fast-list (repeatable)")
+	RootCmd.Flags().BoolVar(&rcloneMove, "rclone-move", false, "Move staged rclone uploads with rclone moveto, and remove verified upload sources outside the git-lfs object store")
+	RootCmd.Flags().BoolVar(&rcloneRcd, "rclone-rcd", false, "Run one rclone rcd daemon per session for rclone transfers instead of a process per object")
+	RootCmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Local read-through cache directory for rclone downloads")
+	RootCmd.Flags().Int64Var(&cacheMax, "cache-max-bytes", 0, "Maximum cache size in bytes before least recently used objects are evicted (0 = unlimited)")
+	RootCmd.Flags().Int64Var(&minSize, "min-size", 0, "Only use the stores for objects of at least this many bytes; smaller ones go to the LFS remote (0 = no limit)")
+	RootCmd.Flags().Int64Var(&maxSize, "max-size", 0, "Only use the stores for objects of at most this many bytes; bigger ones go to the LFS remote (0 = no limit)")
+	RootCmd.Flags().Int64Var(&maxBandwidth, "max-bandwidth", 0, "Limit the combined rate of all transfers to this many bytes per second (0 = unlimited)")
+	RootCmd.Flags().IntVar(&blockSize, "block-size", service.DefaultBlockSize, "Size in bytes of each read when copying objects, 4096 to 67108864")
+	RootCmd.Flags().DurationVar(&progInterval, "progress-interval", service.DefaultProgressInterval, "Minimum time between progress events for a transfer (0 = every block)")
+	RootCmd.Flags().Int64Var(&progBytes, "progress-bytes", 0, "Also report progress whenever this many more bytes have been transferred (0 = time only)")
+	RootCmd.Flags().IntVar(&maxLine, "max-line", service.DefaultMaxLine, "Longest request line in bytes accepted from git-lfs")
+	RootCmd.Flags().BoolVar(&exitCode, "exit-code", false, "Exit with status 2 if any transfer or the session failed, for scripts driving the adapter themselves")
+	RootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Log where each upload would be stored and report it done, without writing anything")
+	RootCmd.Flags().IntVar(&httpRetries, "http-retries", 3, "Number of times to retry HTTP transfers after network errors, 5xx or 429 responses")
+	RootCmd.Flags().DurationVar(&httpTimeout, "http-timeout", 10*time.Minute, "Time limit for each HTTP request including the transfer itself (0 = no limit)")
+	RootCmd.Flags().StringVar(&httpProxy, "http-proxy", "", "Proxy URL for HTTP transfers; defaults to HTTPS_PROXY / HTTP_PROXY")
+	RootCmd.Flags().StringVar(&caCert, "ca-cert", "", "PEM file of extra certificate authorities to trust for HTTPS transfers")
+	RootCmd.Flags().BoolVar(&insecureTLS, "insecure-skip-verify", false, "Don't verify HTTPS certificates (unsafe, for self-signed internal servers only)")
+	RootCmd.Flags().DurationVar(&scriptTmout, "script-timeout", 0, "Kill transfer scripts that run longer than this, with any processes they started (0 = no limit)")
+	RootCmd.Flags().BoolVar(&scriptOut, "script-output", false, "Copy the output of transfer scripts to stderr for debugging")
+	RootCmd.Flags().BoolVar(&checkScripts, "check-scripts", false, "Read each upload back through the script that stored it, failing it if missing or the wrong size")
+	RootCmd.Flags().StringVar(&scriptShell, "script-shell", "", "Interpreter for transfer scripts, e.g. bash or pwsh, or a command line such as \"python3 -c\"")
+	RootCmd.Flags().IntVar(&fsRetries, "fs-retries", 3, "Number of times to retry transient filesystem errors such as EBUSY when writing to folder stores")
+	RootCmd.Flags().BoolVar(&durable, "durable", true, "Fsync objects written to folder stores before renaming them into place")
+	RootCmd.Flags().StringVar(&fileMode, "file-mode", "", "Octal permissions for objects stored in folders, e.g. 0644; defaults to those of the uploaded file")
+	RootCmd.Flags().StringVar(&dirMode, "dir-mode", "", "Octal permissions for folders created in folder stores, e.g. 0775 (default 0755 less the umask)")
+	RootCmd.Flags().BoolVar(&readOnly, "readonly", false, "Refuse uploads, so the adapter never writes to the stores")
+	RootCmd.Flags().BoolVar(&writeOnly, "writeonly", false, "Refuse downloads, so the adapter only ever writes to the stores")
+	RootCmd.Flags().StringVar(&logFile, "log-file", "", "Append a record of each transfer to this file")
+	RootCmd.Flags().StringVar(&logFormat, "log-format", "text", "Format of --log-file records: text or json")
+	RootCmd.PersistentFlags().DurationVar(&tempMaxAge, "temp-max-age", service.DefaultTempMaxAge, "Age after which temp files left by interrupted transfers are removed (0 = keep)")
+	RootCmd.PersistentFlags().StringVar(&tempDir, "temp-dir", "", "Folder to download objects to before git-lfs moves them into place; defaults to .git/lfs/tmp")
+	RootCmd.PersistentFlags().StringVar(&gitDirPath, "git-dir", "", "Repository's .git folder; defaults to $GIT_DIR, then asking git")
+	RootCmd.PersistentFlags().IntVar(&shardDepth, "shard-depth", service.DefaultShardDepth, "Number of two-character folder levels objects are stored under (0 = flat)")
+	RootCmd.PersistentFlags().BoolVar(&flatLayout, "flat", false, "Store objects directly in the base directory with no sharding folders (same as --shard-depth 0)")
+	RootCmd.Flags().BoolVar(&normCase, "normalize-case", false, "Store objects under lower case paths and find them in folders of any case")
+	RootCmd.PersistentFlags().StringVar(&oidHash, "oid-hash", service.DefaultOidHash, "Hash OIDs are computed with, checked against objects' content: "+strings.Join(service.OidHashes(), ", "))
+	RootCmd.Flags().CountVarP(&verbose, "verbose", "v", "Write more detail to stderr: -v where each transfer goes, -vv also the rclone commands run")
+	RootCmd.Flags().BoolVar(&quiet, "quiet", false, "Only write warnings and errors to stderr")
 	RootCmd.Flags().BoolVarP(&printVersion, "version", "", false, "Print version")
 	RootCmd.SetUsageFunc(usageCommand)
 
+	cleanupCmd.SetUsageFunc(cleanupUsage)
+	RootCmd.AddCommand(cleanupCmd)
+	verifyCmd.SetUsageFunc(verifyUsage)
+	RootCmd.AddCommand(verifyCmd)
+	pruneCmd.SetUsageFunc(pruneUsage)
+	RootCmd.AddCommand(pruneCmd)
+	migrateCmd.SetUsageFunc(migrateUsage)
+	RootCmd.AddCommand(migrateCmd)
+	lsCmd.SetUsageFunc(lsUsage)
+	RootCmd.AddCommand(lsCmd)
+	cpCmd.SetUsageFunc(cpUsage)
+	RootCmd.AddCommand(cpCmd)
+	selftestCmd.SetUsageFunc(selftestUsage)
+	RootCmd.AddCommand(selftestCmd)
+
 }
 
 func usageCommand(cmd *cobra.Command) error {
 	usage := `
 Usage:
   elastic-git-storage [options] <basedir>
+  elastic-git-storage cleanup [options] [basedir...]
 
 Arguments:
   basedir      Base directory for the object store (required)
@@ -89,6 +227,174 @@ Options:
   --pullmain   Allow fallback pulling from main LFS remote
   --pushmain   Also push to main LFS remote
   --writeall   Write to all push destinations instead of stopping on first success
+  --mirror     Write to all push destinations and fail unless every write succeeds
+  --distribute Spread objects across destinations by OID; downloads look in
+               the same place first
+  --rclone-max-procs N
+               Maximum number of concurrent rclone processes (0 = unlimited)
+  --compress-level N
+               lz4 compression level for uploads, 0 (fast) to 9 (best)
+  --compress-jobs N
+               Number of lz4 blocks compressed at once for uploads
+               (default: number of CPUs)
+  --compress-always
+               Compress uploads to folders with compression even when their
+               start shows it won't help; otherwise they're stored as they are
+  --compress-cmd CMD
+               Command run through the script shell to compress objects for
+               stores with --compression=external, reading stdin and writing
+               stdout; objects are stored as <oid>.z
+  --decompress-cmd CMD
+               Command reversing --compress-cmd when downloading
+  --verify-uploads
+               Check uploaded content hashes to its OID before storing
+  --verify-existing
+               Hash objects already stored at the right size before skipping
+               their upload, replacing them if they don't match their OID
+  --resume-uploads
+               Carry on uncompressed uploads to folders from the temp file an
+               interrupted attempt left instead of copying them again. Temp
+               files are kept when uploads fail, and resumed ones are hashed
+  --metadata   Write a <oid>.meta JSON file next to each object stored in a
+               folder, with its original size, compression and time stored
+  --track-access
+               Touch a <oid>.atime file next to each object downloaded from
+               a folder, so prune --max-size evicts the least recently used
+  --ttl D      Treat objects stored in folders longer ago than D (e.g. 720h)
+               as missing and fetch them through the LFS action instead, when
+               --pullmain or the action fallback applies (default 0 = never)
+  --ttl-delete Delete objects older than --ttl from folder stores as they're
+               passed over
+  --link       Hardlink uploads into local stores on the same filesystem
+               instead of copying
+  --reflink    Clone uploads with copy-on-write reflinks where the filesystem
+               supports it (Btrfs, XFS, APFS)
+  --rclone-rcat
+               Stream compressed rclone uploads with rclone rcat instead of
+               staging a temp file
+  --rclone-arg ARG
+               Extra argument for every rclone command, after the subcommand,
+               such as --rclone-arg=--config=/path/rclone.conf (repeatable)
+  --rclone-move
+               Send staged rclone uploads with rclone moveto, and with
+               --verify-uploads remove each upload's source once stored,
+               unless it's in the git-lfs object store
+  --rclone-rcd Start one rclone rcd daemon per session and send rclone
+               uploads, downloads and listings to it rather than running
+               rclone for each object
+  --cache-dir  Local read-through cache directory for rclone downloads
+  --cache-max-bytes N
+               Maximum cache size before least recently used objects are
+               evicted (0 = unlimited)
+  --min-size N Only use the stores for objects of at least N bytes; smaller
+               ones go straight to the LFS remote (0 = no limit)
+  --max-size N Only use the stores for objects of at most N bytes; bigger
+               ones go straight to the LFS remote (0 = no limit)
+  --max-bandwidth N
+               Limit all transfers together to N bytes per second (0 = unlimited)
+  --block-size N
+               Bytes read at a time when copying objects, and so how often
+               progress is reported, 4 KiB to 64 MiB (default 65536)
+  --progress-interval D
+               Report progress to git-lfs at most this often (default 100ms,
+               0 = every block)
+  --progress-bytes N
+               Also report progress whenever N more bytes have been
+               transferred (default 0 = time only)
+  --max-line N Longest request line in bytes accepted from git-lfs, at
+               least 4096 (default 1048576)
+  --exit-code  Exit with status 2 once the session ends if any transfer
+               failed, init failed or requests couldn't all be read, for
+               scripts that drive the adapter themselves rather than
+               through git-lfs
+  --dry-run    Log where each upload would be stored, or that it's already
+               stored there, and report it to git-lfs as done without
+               writing anything
+  --http-retries N
+               Number of times to retry HTTP transfers after network errors,
+               5xx or 429 responses (default 3)
+  --http-timeout D
+               Time limit for each HTTP request including the transfer
+               itself, e.g. 30s or 1h (default 10m, 0 = no limit)
+  --http-proxy URL
+               Proxy for HTTP transfers; defaults to the HTTPS_PROXY and
+               HTTP_PROXY environment variables
+  --ca-cert FILE
+               PEM file of extra certificate authorities to trust for HTTPS
+  --insecure-skip-verify
+               Don't verify HTTPS certificates; only for self-signed
+               internal servers
+  --script-timeout D
+               Kill transfer scripts running longer than D, e.g. 5m, along
+               with any processes they started (default 0 = no limit)
+  --script-output
+               Copy the stdout and stderr of transfer scripts to stderr,
+               prefixed with [script], for debugging
+  --check-scripts
+               Read each upload back through the script that stored it, and
+               fail it if the object is missing or the wrong size
+  --script-shell SHELL
+               Interpreter for transfer scripts: sh, bash, zsh, dash, ksh,
+               cmd, pwsh or powershell, or a full command line such as
+               "python3 -c" to which the script is appended
+               (default sh -c, or cmd /C on Windows)
+  --fs-retries N
+               Number of times to retry transient filesystem errors, such as
+               a busy file on a network share, when writing to folder stores
+               (default 3)
+  --durable    Fsync objects written to folder stores, and their folder,
+               before and after renaming them into place so a crash can't
+               leave a truncated object (default true; --durable=false is
+               faster on slow network shares)
+  --file-mode MODE
+               Octal permissions given to objects stored in folders, e.g.
+               0664, regardless of the umask (default: those of the
+               uploaded file)
+  --dir-mode MODE
+               Octal permissions given to folders created in folder stores,
+               e.g. 0775, regardless of the umask (default 0755 less the
+               umask)
+  --readonly   Refuse upload requests with an error, so the adapter never
+               writes to the stores, e.g. on CI runners
+  --writeonly  Refuse download requests with an error
+  --log-file FILE
+               Append a record of each transfer (time, level, event, OID,
+               bytes, duration and any error) to FILE
+  --log-format FORMAT
+               Format of the --log-file records, text or json (default text)
+  --temp-max-age D
+               Remove download temp files in .git/lfs/tmp left by
+               interrupted transfers once they are older than D
+               (default 24h, 0 = keep them); see also the cleanup command
+  --temp-dir DIR
+               Download objects to DIR before git-lfs moves them into place,
+               instead of .git/lfs/tmp. It must be writable, and should be
+               on the same volume as the repository so git-lfs can rename
+               downloads into place. Outside a repository the system temp
+               folder is used by default
+  --shard-depth N
+               Store objects under N levels of two-character folders taken
+               from the OID, 0 to 32 (default 2, as git-lfs does). Every
+               client of a store must use the same depth
+  --flat       Store objects directly in the base directory with no
+               sharding folders, the same as --shard-depth 0. Suits small
+               stores on object storage, where folders are only overhead
+  --normalize-case
+               Store objects under lower case folders and names whatever the
+               case of the OID, and find objects in local folders that differ
+               only in case, for stores shared with case-insensitive systems
+  --oid-hash H Hash OIDs are computed with and content is verified against:
+               sha256 (default, as git-lfs uses), blake3, sha1 or sha512,
+               for git-lfs builds using another hash. OIDs of another
+               length are refused
+  --git-dir DIR
+               The repository's .git folder, to avoid running git to find
+               it (default $GIT_DIR, then git rev-parse --git-dir)
+  -v, --verbose
+               Write more detail to stderr: -v adds the store path and
+               backend each transfer uses, -vv also the rclone commands run
+  --quiet      Only write warnings and errors to stderr, not the messages
+               for each object
   --version    Report the version number and exit
 
 Note:
@@ -108,6 +414,23 @@ func rootCommand(cmd *cobra.Command, args []string) {
 		os.Exit(0)
 	}
 
+	if quiet && verbose > 0 {
+		os.Stderr.WriteString("--quiet and --verbose can't be combined\n")
+		os.Exit(3)
+	}
+	if !quiet && verbose == 0 {
+		// -1 is quiet, 1 and 2 the same as -v and -vv
+		if n, ok := getGitConfigInt("lfs.folderstore.verbosity"); ok {
+			quiet, verbose = n < 0, n
+		}
+	}
+	switch {
+	case quiet:
+		util.SetStderrLevel(util.LevelWarn)
+	case verbose > 0:
+		util.SetStderrLevel(util.LevelInfo + util.Level(verbose))
+	}
+
 	// pull directory: flag > arg > git config
 	pullDir := strings.TrimSpace(baseDir)
 	if pullDir == "" && len(args) > 0 {
@@ -121,8 +444,8 @@ func rootCommand(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 		os.Exit(1)
 	}
-	if !util.IsRclonePath(pullDir) && !strings.ContainsAny(pullDir, "|;") && !strings.Contains(pullDir, "--compression=") {
-		stat, err := os.Stat(pullDir)
+	if dir, ok := service.LocalDir(pullDir); ok {
+		stat, err := os.Stat(dir)
 		if err != nil || !stat.IsDir() {
 			os.Stderr.WriteString(fmt.Sprintf("%q does not exist or is not a directory", pullDir))
 			cmd.Usage()
@@ -138,8 +461,8 @@ func rootCommand(cmd *cobra.Command, args []string) {
 	if push == "" {
 		push = pullDir
 	}
-	if !util.IsRclonePath(push) && !strings.ContainsAny(push, "|;") && !strings.Contains(push, "--compression=") {
-		stat, err := os.Stat(push)
+	if dir, ok := service.LocalDir(push); ok {
+		stat, err := os.Stat(dir)
 		if err != nil || !stat.IsDir() {
 			os.Stderr.WriteString(fmt.Sprintf("%q does not exist or is not a directory", push))
 			cmd.Usage()
@@ -168,28 +491,539 @@ func rootCommand(cmd *cobra.Command, args []string) {
 			}
 		}
 	}
+	if !mirror {
+		if b, ok := getGitConfigBool("lfs.folderstore.mirror"); ok {
+			mirror = b
+		}
+	}
+
+	if rcloneProcs == 0 {
+		if n, ok := getGitConfigInt("lfs.folderstore.rclonemaxprocs"); ok {
+			rcloneProcs = n
+		}
+	}
+	service.SetRcloneMaxProcs(rcloneProcs)
+	service.SetMirrorUploads(mirror)
+
+	if !distribute {
+		if b, ok := getGitConfigBool("lfs.folderstore.distribute"); ok {
+			distribute = b
+		}
+	}
+	service.SetDistributeUploads(distribute)
+
+	if !flatLayout {
+		if b, ok := getGitConfigBool("lfs.folderstore.flat"); ok {
+			flatLayout = b
+		}
+	}
+	if flatLayout {
+		if cmd.Flags().Changed("shard-depth") && shardDepth != 0 {
+			os.Stderr.WriteString("Invalid storage layout: --flat conflicts with --shard-depth\n")
+			os.Exit(3)
+		}
+		shardDepth = 0
+	} else if !cmd.Flags().Changed("shard-depth") {
+		if n, ok := getGitConfigInt("lfs.folderstore.sharddepth"); ok {
+			shardDepth = n
+		}
+	}
+	if err := service.SetShardDepth(shardDepth); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid storage layout: %v\n", err))
+		os.Exit(3)
+	}
+
+	if !normCase {
+		if b, ok := getGitConfigBool("lfs.folderstore.normalizecase"); ok {
+			normCase = b
+		}
+	}
+	service.SetNormalizeCase(normCase)
+	configureOidHash(cmd)
+
+	levelSet := cmd.Flags().Changed("compress-level")
+	if !levelSet {
+		if n, ok := getGitConfigInt("lfs.folderstore.compresslevel"); ok {
+			compressLvl = n
+			levelSet = true
+		}
+	}
+	if levelSet {
+		if err := service.SetCompressLevel(compressLvl); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Warning: %v, using default\n", err))
+		}
+	}
+
+	if !compressAll {
+		if b, ok := getGitConfigBool("lfs.folderstore.compressalways"); ok {
+			compressAll = b
+		}
+	}
+	service.SetCompressAlways(compressAll)
+
+	configureExternalCompression()
+
+	if compressJobs == 0 {
+		if n, ok := getGitConfigInt("lfs.folderstore.compressjobs"); ok {
+			compressJobs = n
+		}
+	}
+	if compressJobs != 0 {
+		if err := service.SetCompressJobs(compressJobs); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("Warning: %v, using default\n", err))
+		}
+	}
+
+	if !verifyUpload {
+		if b, ok := getGitConfigBool("lfs.folderstore.verifyuploads"); ok {
+			verifyUpload = b
+		}
+	}
+	service.SetVerifyUploads(verifyUpload)
+
+	if !verifyExist {
+		if b, ok := getGitConfigBool("lfs.folderstore.verifyexisting"); ok {
+			verifyExist = b
+		}
+	}
+	service.SetVerifyExisting(verifyExist)
+
+	if !resumeUpload {
+		if b, ok := getGitConfigBool("lfs.folderstore.resumeuploads"); ok {
+			resumeUpload = b
+		}
+	}
+	service.SetResumeUploads(resumeUpload)
+
+	if !metadata {
+		if b, ok := getGitConfigBool("lfs.folderstore.metadata"); ok {
+			metadata = b
+		}
+	}
+	service.SetStoreMetadata(metadata)
+
+	if !trackAccess {
+		if b, ok := getGitConfigBool("lfs.folderstore.trackaccess"); ok {
+			trackAccess = b
+		}
+	}
+	service.SetTrackAccess(trackAccess)
+
+	if objectTTL == 0 {
+		if v := getGitConfig("lfs.folderstore.ttl"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				objectTTL = d
+			} else {
+				os.Stderr.WriteString(fmt.Sprintf("Warning: invalid lfs.folderstore.ttl %q, ignoring\n", v))
+			}
+		}
+	}
+	if !ttlDelete {
+		if b, ok := getGitConfigBool("lfs.folderstore.ttldelete"); ok {
+			ttlDelete = b
+		}
+	}
+	service.SetObjectTTL(objectTTL, ttlDelete)
+
+	if !linkUploads {
+		if b, ok := getGitConfigBool("lfs.folderstore.link"); ok {
+			linkUploads = b
+		}
+	}
+	service.SetLinkUploads(linkUploads)
+
+	if !reflink {
+		if b, ok := getGitConfigBool("lfs.folderstore.reflink"); ok {
+			reflink = b
+		}
+	}
+	service.SetReflinkUploads(reflink)
+
+	if !rcloneRcat {
+		if b, ok := getGitConfigBool("lfs.folderstore.rclonercat"); ok {
+			rcloneRcat = b
+		}
+	}
+	service.SetRcloneStreamUploads(rcloneRcat)
+
+	if !rcloneRcd {
+		if b, ok := getGitConfigBool("lfs.folderstore.rclonercd"); ok {
+			rcloneRcd = b
+		}
+	}
+	service.SetRcloneDaemon(rcloneRcd)
+
+	if !rcloneMove {
+		if b, ok := getGitConfigBool("lfs.folderstore.rclonemove"); ok {
+			rcloneMove = b
+		}
+	}
+	service.SetMoveUploads(rcloneMove)
+
+	if len(rcloneArgs) == 0 {
+		rcloneArgs = strings.Fields(getGitConfig("lfs.folderstore.rcloneargs"))
+	}
+	service.SetRcloneArgs(rcloneArgs)
+
+	if cacheDir == "" {
+		cacheDir = getGitConfig("lfs.folderstore.cachedir")
+	}
+	if cacheMax == 0 {
+		if n, ok := getGitConfigInt64("lfs.folderstore.cachemaxbytes"); ok {
+			cacheMax = n
+		}
+	}
+	service.SetCache(strings.Trim(cacheDir, "'"), cacheMax)
+
+	if minSize == 0 {
+		if n, ok := getGitConfigInt64("lfs.folderstore.minsize"); ok {
+			minSize = n
+		}
+	}
+	if maxSize == 0 {
+		if n, ok := getGitConfigInt64("lfs.folderstore.maxsize"); ok {
+			maxSize = n
+		}
+	}
+	if err := service.SetSizeRange(minSize, maxSize); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid object size range: %v\n", err))
+		os.Exit(3)
+	}
+
+	if maxBandwidth == 0 {
+		if n, ok := getGitConfigInt64("lfs.folderstore.maxbandwidth"); ok {
+			maxBandwidth = n
+		}
+	}
+	service.SetMaxBandwidth(maxBandwidth)
+
+	if !cmd.Flags().Changed("block-size") {
+		if n, ok := getGitConfigInt("lfs.folderstore.blocksize"); ok {
+			blockSize = n
+		}
+	}
+	if err := service.SetBlockSize(blockSize); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid block size: %v\n", err))
+		os.Exit(3)
+	}
+
+	if !cmd.Flags().Changed("progress-interval") {
+		if v := getGitConfig("lfs.folderstore.progressinterval"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				progInterval = d
+			} else {
+				os.Stderr.WriteString(fmt.Sprintf("Warning: invalid lfs.folderstore.progressinterval %q, using default\n", v))
+			}
+		}
+	}
+	if progBytes == 0 {
+		if n, ok := getGitConfigInt64("lfs.folderstore.progressbytes"); ok {
+			progBytes = n
+		}
+	}
+	service.SetProgressInterval(progInterval, progBytes)
+
+	if !cmd.Flags().Changed("max-line") {
+		if n, ok := getGitConfigInt("lfs.folderstore.maxline"); ok {
+			maxLine = n
+		}
+	}
+	if err := service.SetMaxLine(maxLine); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid max line: %v\n", err))
+		os.Exit(3)
+	}
+
+	if !cmd.Flags().Changed("http-retries") {
+		if n, ok := getGitConfigInt("lfs.folderstore.httpretries"); ok {
+			httpRetries = n
+		}
+	}
+	service.SetHTTPRetries(httpRetries)
+
+	if !cmd.Flags().Changed("http-timeout") {
+		if v := getGitConfig("lfs.folderstore.httptimeout"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				httpTimeout = d
+			} else {
+				os.Stderr.WriteString(fmt.Sprintf("Warning: invalid lfs.folderstore.httptimeout %q, using default\n", v))
+			}
+		}
+	}
+	service.SetHTTPTimeout(httpTimeout)
+
+	if httpProxy == "" {
+		httpProxy = getGitConfig("lfs.folderstore.httpproxy")
+	}
+	if caCert == "" {
+		caCert = getGitConfig("lfs.folderstore.cacert")
+	}
+	if !insecureTLS {
+		if b, ok := getGitConfigBool("lfs.folderstore.insecureskipverify"); ok {
+			insecureTLS = b
+		}
+	}
+	if insecureTLS {
+		os.Stderr.WriteString("WARNING: HTTPS certificate verification is disabled; transfers are open to interception. Use --ca-cert to trust a private CA instead.\n")
+	}
+	if err := service.SetHTTPTransport(httpProxy, caCert, insecureTLS); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid HTTP settings: %v\n", err))
+		os.Exit(3)
+	}
+
+	if !cmd.Flags().Changed("script-timeout") {
+		if v := getGitConfig("lfs.folderstore.scripttimeout"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				scriptTmout = d
+			} else {
+				os.Stderr.WriteString(fmt.Sprintf("Warning: invalid lfs.folderstore.scripttimeout %q, ignoring\n", v))
+			}
+		}
+	}
+	service.SetScriptTimeout(scriptTmout)
+
+	if !scriptOut {
+		if b, ok := getGitConfigBool("lfs.folderstore.scriptoutput"); ok {
+			scriptOut = b
+		}
+	}
+	service.SetScriptOutput(scriptOut)
+
+	if !checkScripts {
+		if b, ok := getGitConfigBool("lfs.folderstore.checkscripts"); ok {
+			checkScripts = b
+		}
+	}
+	service.SetCheckScripts(checkScripts)
+
+	if scriptShell == "" {
+		scriptShell = getGitConfig("lfs.folderstore.scriptshell")
+	}
+	if err := service.SetScriptShell(scriptShell); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(3)
+	}
+
+	if !cmd.Flags().Changed("fs-retries") {
+		if n, ok := getGitConfigInt("lfs.folderstore.fsretries"); ok {
+			fsRetries = n
+		}
+	}
+	service.SetFSRetries(fsRetries)
+
+	if !cmd.Flags().Changed("durable") {
+		if b, ok := getGitConfigBool("lfs.folderstore.durable"); ok {
+			durable = b
+		}
+	}
+	service.SetDurableWrites(durable)
+
+	if fileMode == "" {
+		fileMode = getGitConfig("lfs.folderstore.filemode")
+	}
+	if dirMode == "" {
+		dirMode = getGitConfig("lfs.folderstore.dirmode")
+	}
+	fm, err := parseFileMode(fileMode)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid --file-mode: %v\n", err))
+		os.Exit(3)
+	}
+	dm, err := parseFileMode(dirMode)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid --dir-mode: %v\n", err))
+		os.Exit(3)
+	}
+	service.SetStoreModes(fm, dm)
+
+	if !readOnly {
+		if b, ok := getGitConfigBool("lfs.folderstore.readonly"); ok {
+			readOnly = b
+		}
+	}
+	if !writeOnly {
+		if b, ok := getGitConfigBool("lfs.folderstore.writeonly"); ok {
+			writeOnly = b
+		}
+	}
+	if err := service.SetAccessMode(readOnly, writeOnly); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(3)
+	}
+
+	if logFile == "" {
+		logFile = getGitConfig("lfs.folderstore.logfile")
+	}
+	if !cmd.Flags().Changed("log-format") {
+		if v := getGitConfig("lfs.folderstore.logformat"); v != "" {
+			logFormat = v
+		}
+	}
+	if err := service.SetLogFile(logFile, logFormat); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Unable to open log file: %v\n", err))
+		os.Exit(3)
+	}
+
+	service.SetTempMaxAge(resolveTempMaxAge(cmd))
+	service.SetGitDir(gitDirPath)
+	if tempDir == "" {
+		tempDir = getGitConfig("lfs.folderstore.tempdir")
+	}
+	if err := service.SetTempDir(tempDir); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(3)
+	}
+
+	if !exitCode {
+		if b, ok := getGitConfigBool("lfs.folderstore.exitcode"); ok {
+			exitCode = b
+		}
+	}
+	if !dryRun {
+		if b, ok := getGitConfigBool("lfs.folderstore.dryrun"); ok {
+			dryRun = b
+		}
+	}
+	service.SetDryRun(dryRun)
 
-	service.Serve(pullDir, push, pullMain, pushMain, writeAll, os.Stdin, os.Stdout, os.Stderr)
+	// SIGINT and SIGTERM stop the session, which cancels the transfers and
+	// removes their temp files; a second signal kills the adapter outright
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	// Each failure has already been reported, to git-lfs and on stderr
+	err = service.ServeContext(ctx, pullDir, push, pullMain, pushMain, writeAll, os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, context.Canceled) {
+		os.Exit(interruptedExitCode)
+	}
+	if err != nil && exitCode {
+		os.Stderr.WriteString(fmt.Sprintf("%v\n", err))
+		os.Exit(2)
+	}
 }
 
-func getGitConfig(key string) string {
-	cmd := util.NewCmd("git", "config", "--get", key)
+// interruptedExitCode is the status the adapter exits with once stopped by
+// a signal, the one shells use for Ctrl-C.
+const interruptedExitCode = 128 + int(syscall.SIGINT)
+
+// configureExternalCompression sets the commands of the external compression
+// mode from the flags, or else git config.
+func configureExternalCompression() {
+	if compressCmd == "" {
+		compressCmd = getGitConfig("lfs.folderstore.compresscmd")
+	}
+	if decompCmd == "" {
+		decompCmd = getGitConfig("lfs.folderstore.decompresscmd")
+	}
+	service.SetExternalCompression(compressCmd, decompCmd)
+}
+
+// configureOidHash sets the OID hash from --oid-hash or git config,
+// exiting if it is unknown, since no object would verify.
+func configureOidHash(cmd *cobra.Command) {
+	if !cmd.Flags().Changed("oid-hash") {
+		if h := getGitConfig("lfs.folderstore.oidhash"); h != "" {
+			oidHash = h
+		}
+	}
+	if err := service.SetOidHash(oidHash); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("Invalid OID hash: %v\n", err))
+		os.Exit(3)
+	}
+}
+
+// gitConfigCache holds the lfs.folderstore settings from git config, read
+// with a single git command the first time one is looked up.
+var gitConfigCache map[string]string
+
+// gitConfigValues returns the lfs.folderstore settings from git config, by
+// lower-cased name, reading them on first use. Where a setting is given more
+// than once the last wins, as for git config --get.
+func gitConfigValues() map[string]string {
+	if gitConfigCache != nil {
+		return gitConfigCache
+	}
+	gitConfigCache = make(map[string]string)
+	cmd := util.NewCmd("git", "config", "-z", "--get-regexp", `^lfs\.folderstore\.`)
 	out, err := cmd.Output()
 	if err != nil {
-		return ""
+		return gitConfigCache
+	}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		key, value, found := strings.Cut(entry, "\n")
+		if key == "" {
+			continue
+		}
+		// A name with no value at all is true, as git reads it
+		if !found {
+			value = "true"
+		}
+		gitConfigCache[strings.ToLower(key)] = value
 	}
-	return strings.TrimSpace(string(out))
+	return gitConfigCache
+}
+
+func getGitConfig(key string) string {
+	return strings.TrimSpace(gitConfigValues()[strings.ToLower(key)])
 }
 
 func getGitConfigBool(key string) (bool, bool) {
-	cmd := util.NewCmd("git", "config", "--bool", "--get", key)
-	out, err := cmd.Output()
-	if err != nil {
+	v, ok := gitConfigValues()[strings.ToLower(key)]
+	if !ok {
 		return false, false
 	}
-	b, err := strconv.ParseBool(strings.TrimSpace(string(out)))
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0", "":
+		return false, true
+	}
+	return false, false
+}
+
+// parseFileMode parses octal permission bits such as "0664", returning 0
+// for an empty string.
+func parseFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n == 0 || n > 0777 {
+		return 0, fmt.Errorf("%q is not an octal mode between 0001 and 0777", s)
+	}
+	return os.FileMode(n), nil
+}
+
+func getGitConfigInt(key string) (int, bool) {
+	n, ok := getGitConfigInt64(key)
+	return int(n), ok
+}
+
+// getGitConfigInt64 reads an integer setting, with git's k, m and g
+// suffixes for multiples of 1024.
+func getGitConfigInt64(key string) (int64, bool) {
+	v := getGitConfig(key)
+	if v == "" {
+		return 0, false
+	}
+	var scale int64 = 1
+	switch v[len(v)-1] {
+	case 'k', 'K':
+		scale = 1 << 10
+	case 'm', 'M':
+		scale = 1 << 20
+	case 'g', 'G':
+		scale = 1 << 30
+	}
+	if scale > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
 	if err != nil {
-		return false, false
+		return 0, false
 	}
-	return b, true
+	return n * scale, true
 }
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitConfigReadOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	scriptDir := t.TempDir()
+	logPath := filepath.Join(scriptDir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %q\n", logPath) +
+		`printf 'lfs.folderstore.pull\n/mnt/a\0lfs.folderstore.verify\nyes\0lfs.folderstore.retries\n5\0` +
+		`lfs.folderstore.blocksize\n2k\0lfs.folderstore.mirror\0lfs.folderstore.pull\n/mnt/b\0'` + "\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(scriptDir, "git"), []byte(script), 0755))
+	t.Setenv("PATH", scriptDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	gitConfigCache = nil
+	defer func() { gitConfigCache = nil }()
+
+	// The last value given wins
+	assert.Equal(t, "/mnt/b", getGitConfig("lfs.folderstore.pull"))
+	assert.Equal(t, "", getGitConfig("lfs.folderstore.push"))
+	b, ok := getGitConfigBool("lfs.folderstore.verify")
+	assert.True(t, ok)
+	assert.True(t, b)
+	b, ok = getGitConfigBool("lfs.folderstore.mirror")
+	assert.True(t, ok)
+	assert.True(t, b)
+	_, ok = getGitConfigBool("lfs.folderstore.dryrun")
+	assert.False(t, ok)
+	n, ok := getGitConfigInt("lfs.folderstore.retries")
+	assert.True(t, ok)
+	assert.Equal(t, 5, n)
+	n64, ok := getGitConfigInt64("lfs.folderstore.blockSize")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2048), n64)
+
+	// Every lookup was answered from one git command
+	calls, err := os.ReadFile(logPath)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, `config -z --get-regexp ^lfs\.folderstore\.`, lines[0])
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest [basedir...]",
+	Short: "Store and retrieve a test object through every configured store",
+	Run:   selftestCommand,
+}
+
+func selftestUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage selftest [basedir...]
+
+Stores a small random object in every store of the given base directories and
+reads it back, printing a line for each store saying whether it passed, and
+what to check if it didn't. Folders, rclone remotes and S3 buckets are tested
+in a temporary folder of their own, which is removed afterwards, so the
+objects already stored are never touched. Scripts are given the test object
+like any other; HTTP stores are read-only and only have to answer. The @main
+entry is skipped, as git-lfs only provides the LFS action during transfers.
+The command exits with status 2 if any store fails. Without arguments the git
+config lfs.folderstore.pull and lfs.folderstore.push locations are tested.
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func selftestCommand(cmd *cobra.Command, args []string) {
+	baseDirs := args
+	if len(baseDirs) == 0 {
+		for _, key := range []string{"lfs.folderstore.pull", "lfs.folderstore.push"} {
+			if dir := strings.TrimSpace(getGitConfig(key)); dir != "" {
+				baseDirs = append(baseDirs, dir)
+			}
+		}
+	}
+	if len(baseDirs) == 0 {
+		os.Stderr.WriteString("Required: base directory (as an argument or git config lfs.folderstore.pull)\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	configureExternalCompression()
+	configureOidHash(cmd)
+	if failed := service.SelfTest(baseDirs, os.Stdout); failed > 0 {
+		os.Stderr.WriteString(fmt.Sprintf("%d store(s) failed\n", failed))
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/service"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyJobs int
+	verifyFix  bool
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [basedir...]",
+	Short: "Check every stored object against its OID",
+	Run:   verifyCommand,
+}
+
+func init() {
+	verifyCmd.Flags().IntVar(&verifyJobs, "jobs", runtime.NumCPU(), "Number of objects to check at once")
+	verifyCmd.Flags().BoolVar(&verifyFix, "fix", false, "Move corrupt objects into a .quarantine folder in their store")
+}
+
+func verifyUsage(cmd *cobra.Command) error {
+	usage := `
+Usage:
+  elastic-git-storage verify [options] [basedir...]
+
+Reads every object in the given stores, decompressing it as needed, and checks
+that its content hashes to the OID it is stored under. Corrupt or unreadable
+objects are listed and the command exits with status 2 if there are any.
+Base directories use the same syntax as for transfers; folders and rclone
+remotes are verified, scripts, S3 and HTTP stores are skipped. Without
+arguments the git config lfs.folderstore.pull and lfs.folderstore.push
+locations are verified.
+
+Options:
+  --jobs N     Number of objects to check at once (default: number of CPUs)
+  --fix        Move corrupt objects into a .quarantine folder at the root of
+               their store, keeping their path, so they are no longer served
+               and can be uploaded again
+`
+	fmt.Fprint(os.Stderr, usage)
+	return nil
+}
+
+func verifyCommand(cmd *cobra.Command, args []string) {
+	baseDirs := args
+	if len(baseDirs) == 0 {
+		for _, key := range []string{"lfs.folderstore.pull", "lfs.folderstore.push"} {
+			if dir := strings.TrimSpace(getGitConfig(key)); dir != "" {
+				baseDirs = append(baseDirs, dir)
+			}
+		}
+	}
+	if len(baseDirs) == 0 {
+		os.Stderr.WriteString("Required: base directory (as an argument or git config lfs.folderstore.pull)\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	configureExternalCompression()
+	configureOidHash(cmd)
+	bad, err := service.VerifyStores(baseDirs, verifyJobs, verifyFix, os.Stderr)
+	if bad > 0 {
+		os.Stderr.WriteString(fmt.Sprintf("%d corrupt object(s) found\n", bad))
+	}
+	if bad > 0 || err != nil {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// accessExt is the extension of the file whose modification time records
+// when an object in a folder store was last downloaded, <oid>.atime next to
+// the object. Network shares are often mounted noatime, so the object's own
+// access time can't be relied on.
+const accessExt = ".atime"
+
+// trackAccess enables recording when objects are downloaded from folders.
+var trackAccess bool
+
+// SetTrackAccess enables touching a <oid>.atime file next to each object
+// downloaded from a folder store, which prune uses to evict the least
+// recently used objects.
+func SetTrackAccess(enabled bool) {
+	trackAccess = enabled
+}
+
+// accessRecorder is implemented by backends that can record when an object
+// was downloaded.
+type accessRecorder interface {
+	recordAccess(oid string) error
+}
+
+// recordAccess touches the access file of oid, in whichever layout the
+// object was found.
+func (b *dirBackend) recordAccess(oid string) error {
+	for _, p := range layoutPaths(b.dir, oid) {
+		if _, err := os.Stat(p + compressionExt(b.compression)); err != nil {
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+		}
+		return touch(accessPath(p, oid))
+	}
+	return nil
+}
+
+// accessPath returns the access file of oid stored at objectPath.
+func accessPath(objectPath, oid string) string {
+	return filepath.Join(filepath.Dir(objectPath), oid+accessExt)
+}
+
+// touch sets the modification time of path to now, creating it if needed.
+func touch(path string) error {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// lastAccess returns when the object was last downloaded, if that was
+// recorded, or else when it was stored.
+func (o storedObject) lastAccess() time.Time {
+	p := filepath.Join(o.root, filepath.FromSlash(o.rel))
+	if stat, err := os.Stat(accessPath(p, o.oid)); err == nil {
+		return stat.ModTime()
+	}
+	if stat, err := os.Stat(p); err == nil {
+		return stat.ModTime()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackAccess(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	SetTrackAccess(true)
+	defer SetTrackAccess(false)
+
+	download := func() {
+		var stdout, stderr bytes.Buffer
+		Serve(setup.remotepath, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+		for _, file := range setup.files {
+			assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","path"`)
+		}
+	}
+	accessed := func(file testFile) time.Time {
+		stat, err := os.Stat(filepath.Join(filepath.Dir(file.path), file.oid+".atime"))
+		if !assert.Nil(t, err) {
+			return time.Time{}
+		}
+		return stat.ModTime()
+	}
+
+	download()
+	past := time.Now().Add(-time.Hour)
+	for _, file := range setup.files {
+		assert.WithinDuration(t, time.Now(), accessed(file), time.Minute)
+		assert.Nil(t, os.Chtimes(filepath.Join(filepath.Dir(file.path), file.oid+".atime"), past, past))
+	}
+
+	// Each download moves it on again
+	download()
+	for _, file := range setup.files {
+		assert.True(t, accessed(file).After(past.Add(time.Minute)))
+	}
+
+	// Listing still only finds the objects
+	infos, err := ListStores([]string{setup.remotepath}, ioutil.Discard)
+	assert.Nil(t, err)
+	assert.Len(t, infos, len(setup.files))
+}
+
+func TestPruneMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Four 1000 byte objects, used an hour apart, the first most recently
+	var paths []string
+	for i := 0; i < 4; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		sum := sha256.Sum256(content)
+		oid := hex.EncodeToString(sum[:])
+		b := &dirBackend{dir: dir, compression: "none"}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+		p := storagePath(dir, oid)
+		used := time.Now().Add(-time.Duration(i) * time.Hour)
+		assert.Nil(t, touch(accessPath(p, oid)))
+		assert.Nil(t, os.Chtimes(accessPath(p, oid), used, used))
+		paths = append(paths, p)
+	}
+	// Without an access file, the time stored counts
+	old := time.Now().Add(-10 * time.Hour)
+	assert.Nil(t, os.Remove(accessPath(paths[1], filepath.Base(paths[1]))))
+	assert.Nil(t, os.Chtimes(paths[1], old, old))
+
+	var out bytes.Buffer
+	n, err := PruneStores([]string{dir}, nil, 2500, true, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Contains(t, out.String(), "Would evict "+filepath.ToSlash(paths[1]))
+	assert.Contains(t, out.String(), "Would evict "+filepath.ToSlash(paths[3]))
+
+	out.Reset()
+	n, err = PruneStores([]string{dir}, nil, 2500, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.FileExists(t, paths[0])
+	assert.FileExists(t, paths[2])
+	assert.NoFileExists(t, paths[1])
+	assert.NoFileExists(t, paths[3])
+	assert.NoFileExists(t, accessPath(paths[3], filepath.Base(paths[3])))
+	assert.Contains(t, out.String(), "Pruned 2 of 4 object(s)")
+}
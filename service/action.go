@@ -0,0 +1,178 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+// actionBackend transfers objects through the href of a git-lfs action,
+// used as a last resort when the configured providers fail.
+type actionBackend struct {
+	reporter
+	action *api.Action
+}
+
+func (b *actionBackend) withReporter(r reporter) Backend {
+	c := *b
+	c.reporter = r
+	return &c
+}
+
+func (b *actionBackend) newRequest(method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(b.context(), method, b.action.Href, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range b.action.Header {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+func (b *actionBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	req, err := b.newRequest("GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedReader{resp.Body, resp.ContentLength}, nil
+}
+
+func (b *actionBackend) resumesDownloads() {}
+
+// getFile downloads oid to dest. A partial file left at dest by an earlier
+// failed attempt is resumed with a Range request; if the server ignores the
+// range the object is downloaded again in full. A partial file is kept when
+// the transfer is interrupted so the next attempt can resume it, but removed
+// if the completed content doesn't match oid.
+func (b *actionBackend) getFile(oid string, size int64, dest string) error {
+	var offset int64
+	if stat, err := os.Stat(dest); err == nil && size > 0 && stat.Size() < size {
+		offset = stat.Size()
+	}
+
+	req, err := b.newRequest("GET", nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := getWithRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		if resp.StatusCode == http.StatusPartialContent {
+			if contentRangeStart(resp) != offset {
+				// Not the range we asked for, start again from scratch
+				resp.Body.Close()
+				if err := os.Remove(dest); err != nil {
+					return err
+				}
+				return b.getFile(oid, size, dest)
+			}
+			flags = os.O_WRONLY | os.O_APPEND
+		} else {
+			offset = 0
+		}
+	}
+
+	hasher := newOidHash()
+	if offset > 0 {
+		if err := hashPrefix(hasher, dest, offset); err != nil {
+			return err
+		}
+		if b.progress != nil {
+			b.progress(size, offset, int(offset))
+		}
+	}
+
+	f, err := os.OpenFile(dest, flags, 0644)
+	if err != nil {
+		return err
+	}
+	cb := func(totalSize, readSoFar int64, readSinceLast int) error {
+		if b.progress != nil {
+			return b.progress(size, offset+readSoFar, readSinceLast)
+		}
+		return nil
+	}
+	err = copyReader(size-offset, io.TeeReader(throttle(resp.Body), hasher), f, cb)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != oid {
+		os.Remove(dest)
+		return fmt.Errorf("%w: expected %v, got %v", errHashMismatch, oid, sum)
+	}
+	return nil
+}
+
+// contentRangeStart returns the first byte position of a 206 response's
+// Content-Range header, or -1 if it is missing or malformed.
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d", &start, &end); err != nil {
+		return -1
+	}
+	return start
+}
+
+// hashPrefix feeds the first n bytes of the file at path to h.
+func hashPrefix(h hash.Hash, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+// Put uploads r with a PUT to the action's href, reporting progress as the
+// body is sent. Failed attempts are retried like downloads, re-reading the
+// content from the start each time.
+func (b *actionBackend) Put(oid string, r io.Reader, size int64) error {
+	path, cleanup, err := sourcePath(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	resp, err := doWithRetry(b.context(), func() (*http.Request, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		body := &readCloser{&progressReader{r: throttle(f), size: size, cb: b.progress}, f.Close}
+		req, err := b.newRequest("PUT", body)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		req.ContentLength = size
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
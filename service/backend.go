@@ -0,0 +1,414 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// Backend is a storage provider that objects can be fetched from and stored
+// to. Each entry in a base directory string becomes one Backend, and
+// transfers walk them in order.
+type Backend interface {
+	// Get returns a reader over the uncompressed content of oid. size is the
+	// size git-lfs expects, or 0 when unknown.
+	Get(oid string, size int64) (io.ReadCloser, error)
+	// Put stores size bytes read from r as oid. It returns errAlreadyStored
+	// when an identical copy is already present and nothing was written.
+	Put(oid string, r io.Reader, size int64) error
+}
+
+// errAlreadyStored is returned by Backend.Put when the object is already
+// present, so callers can report it as skipped rather than uploaded.
+var errAlreadyStored = errors.New("already stored")
+
+// reporter carries per-transfer state into a backend: the context that
+// cancels it, and the progress callback and stderr writer for work that
+// doesn't flow through the streams of Get and Put (rclone copyto, scripts,
+// links). The zero value never cancels and discards progress and warnings.
+type reporter struct {
+	ctx       context.Context
+	progress  copyCallback
+	errWriter *bufio.Writer
+}
+
+func (r reporter) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// session describes the git-lfs session a transfer belongs to, from the
+// init message.
+type session struct {
+	operation string
+	remote    string
+}
+
+type sessionKey struct{}
+
+// withSession returns a copy of ctx carrying s.
+func withSession(ctx context.Context, s session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// session returns the git-lfs session the transfer belongs to, if known.
+func (r reporter) session() session {
+	s, _ := r.context().Value(sessionKey{}).(session)
+	return s
+}
+
+func (r reporter) warn(msg string) {
+	if r.errWriter != nil {
+		util.WriteToStderrAt(util.LevelWarn, msg, r.errWriter)
+	}
+}
+
+func (r reporter) info(msg string) {
+	if r.errWriter != nil {
+		util.WriteToStderr(msg, r.errWriter)
+	}
+}
+
+// reportingBackend is implemented by backends that use the transfer context
+// or report progress or warnings themselves. withReporter returns a copy
+// bound to r, so a shared backend can serve concurrent transfers.
+type reportingBackend interface {
+	withReporter(r reporter) Backend
+}
+
+// fileGetter is implemented by backends that download straight to a local
+// file rather than producing a stream, avoiding an extra copy.
+type fileGetter interface {
+	getFile(oid string, size int64, dest string) error
+}
+
+// resumingGetter is implemented by fileGetters that carry on from a partial
+// file an earlier attempt left at dest, which is then kept when they fail.
+type resumingGetter interface {
+	resumesDownloads()
+}
+
+// statBackend is implemented by remote backends that can report the stored
+// size of an object without fetching it, which Exists uses.
+type statBackend interface {
+	stat(oid string) (int64, error)
+}
+
+// writableBackend is implemented by backends that can check cheaply whether
+// objects can be stored, which is done when an upload session starts.
+type writableBackend interface {
+	checkWritable() error
+}
+
+// writeCheckName is the prefix of the file created and removed to check that
+// a store is writable.
+const writeCheckName = ".elastic-git-storage-write-check"
+
+// checkWritable returns an error if uploads to providers are bound to fail:
+// none of them is writable, or when mirroring, any one isn't. Providers that
+// can't be checked are assumed writable.
+func checkWritable(providers []provider) error {
+	var failed []string
+	var lastErr error
+	for _, p := range providers {
+		wb, ok := p.backend.(writableBackend)
+		if !ok {
+			continue
+		}
+		if err := wb.checkWritable(); err != nil {
+			failed = append(failed, p.cfg.path)
+			lastErr = err
+		}
+	}
+	if len(failed) == 0 || (!mirrorUploads && len(failed) < len(providers)) {
+		return nil
+	}
+	return fmt.Errorf("cannot write to %v: %v", strings.Join(failed, ", "), lastErr)
+}
+
+// sizedReader is returned by Get when the backend knows the uncompressed
+// size of the object, which is used if git-lfs did not supply one.
+type sizedReader struct {
+	io.ReadCloser
+	size int64
+}
+
+// readCloser pairs a reader with a custom close function.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// progressReader reports the bytes read through it to cb.
+type progressReader struct {
+	r     io.Reader
+	size  int64
+	soFar int64
+	cb    copyCallback
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.cb != nil {
+		p.soFar += int64(n)
+		p.cb(p.size, p.soFar, n)
+	}
+	return n, err
+}
+
+// provider pairs a backend with the base directory entry it was built from,
+// which is used in messages and the download summary.
+type provider struct {
+	cfg     baseDirConfig
+	backend Backend
+}
+
+// newProviders builds the ordered list of backends for a base directory
+// string.
+func newProviders(baseDir string) []provider {
+	var providers []provider
+	for _, cfg := range parseBaseDirs(baseDir) {
+		if cfg.main {
+			providers = append(providers, provider{cfg: cfg})
+			continue
+		}
+		providers = append(providers, provider{cfg, newBackend(cfg)})
+	}
+	return providers
+}
+
+// errNoAction is the failure of the main entry when git-lfs gave no action
+// for the object.
+var errNoAction = errors.New("no LFS action given for the main server")
+
+// backendFor returns the backend of p, or for the main entry, the action a,
+// nil if there is none.
+func (p provider) backendFor(a *api.Action) Backend {
+	if !p.cfg.main {
+		return p.backend
+	}
+	if a == nil {
+		return nil
+	}
+	return &actionBackend{action: a}
+}
+
+// hasMain returns whether providers include the main entry.
+func hasMain(providers []provider) bool {
+	for _, p := range providers {
+		if p.cfg.main {
+			return true
+		}
+	}
+	return false
+}
+
+// withMain returns providers with the main entry at the end, unless it has a
+// place already.
+func withMain(providers []provider) []provider {
+	if hasMain(providers) {
+		return providers
+	}
+	main := provider{cfg: baseDirConfig{path: mainEntry, compression: "none", main: true}}
+	return append(providers[:len(providers):len(providers)], main)
+}
+
+func newBackend(cfg baseDirConfig) Backend {
+	switch {
+	case cfg.script:
+		return &scriptBackend{script: cfg.path, compression: cfg.compression}
+	case cfg.layout == "lfs":
+		return newLfsObjectsBackend(cfg.path)
+	case util.URLScheme(cfg.path) == "s3":
+		return newS3Backend(cfg.path, cfg.compression)
+	case util.URLScheme(cfg.path) == "http", util.URLScheme(cfg.path) == "https":
+		return &httpBackend{base: cfg.path, compression: cfg.compression}
+	case util.IsRclonePath(cfg.path):
+		return &rcloneBackend{remote: cfg.path, compression: cfg.compression}
+	}
+	return &dirBackend{dir: cfg.path, compression: cfg.compression}
+}
+
+// describeBackend names the kind of b and where it keeps oid, for
+// diagnostics.
+func describeBackend(b Backend, oid string) string {
+	switch b := b.(type) {
+	case *dirBackend:
+		return "folder " + storagePath(b.dir, oid) + compressionExt(b.compression)
+	case *rcloneBackend:
+		return "rclone " + storagePath(b.remote, oid) + compressionExt(b.compression)
+	case *s3Backend:
+		return fmt.Sprintf("s3 s3://%s/%s", b.bucket, b.key(oid))
+	case *httpBackend:
+		return "http " + b.url(oid)
+	case *lfsObjectsBackend:
+		return "git-lfs objects " + b.path(oid)
+	case *scriptBackend:
+		return "script " + b.script
+	case *actionBackend:
+		return "LFS action " + b.action.Href
+	}
+	return fmt.Sprintf("%T", b)
+}
+
+// bind returns b configured with the transfer's context and to report
+// through cb and errWriter, if it makes use of them.
+func bind(ctx context.Context, b Backend, cb copyCallback, errWriter *bufio.Writer) Backend {
+	if rb, ok := b.(reportingBackend); ok {
+		return rb.withReporter(reporter{ctx, cb, errWriter})
+	}
+	return b
+}
+
+// fetch downloads oid from b into the git-lfs temp area, reporting progress
+// and completion to git-lfs.
+func fetch(ctx context.Context, b Backend, gitDir, oid string, size int64, writer, errWriter *bufio.Writer) error {
+	path, err := download(ctx, b, gitDir, oid, size, writer, errWriter)
+	if err != nil {
+		return err
+	}
+	sendComplete(oid, path, writer, errWriter)
+	return nil
+}
+
+// download fetches oid from b into the git-lfs temp area, reporting progress
+// to git-lfs, and returns the path of the downloaded file.
+func download(ctx context.Context, b Backend, gitDir, oid string, size int64, writer, errWriter *bufio.Writer) (string, error) {
+	progress := newProgressReporter(oid, writer, errWriter)
+	b = bind(ctx, b, progress.callback, errWriter)
+
+	if fg, ok := b.(fileGetter); ok {
+		tempPath, err := downloadTempPath(gitDir, oid)
+		if err != nil {
+			return "", err
+		}
+		// Each attempt writes a file of its own, renamed to the object's
+		// temp name once complete. A partial download to carry on from is
+		// claimed by renaming it, so only one attempt can take it.
+		// If interrupted, a partial download that can be carried on from
+		// goes back to the object's temp name for the next attempt.
+		partPath := partTempPath(tempPath)
+		_, resumes := b.(resumingGetter)
+		var untrack func()
+		if resumes {
+			untrack, err = tempsFor(ctx).trackResumableAs(partPath, tempPath)
+		} else {
+			untrack, err = tempsFor(ctx).track(partPath)
+		}
+		if err != nil {
+			return "", err
+		}
+		if resumes {
+			os.Rename(tempPath, partPath)
+		}
+		err = fg.getFile(oid, size, partPath)
+		if err == nil {
+			// What was written isn't the object, so there's nothing to resume
+			if err = checkDownload(partPath, oid, size); err != nil {
+				os.Remove(partPath)
+			}
+		}
+		if err == nil {
+			err = os.Rename(partPath, tempPath)
+		}
+		untrack()
+		if err != nil {
+			if resumes {
+				os.Rename(partPath, tempPath)
+			} else {
+				os.Remove(partPath)
+			}
+			return "", err
+		}
+		stat, err := os.Stat(tempPath)
+		if err != nil {
+			return "", err
+		}
+		progress.finish(stat.Size())
+		return tempPath, nil
+	}
+
+	rc, err := b.Get(oid, size)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if sr, ok := rc.(*sizedReader); ok && size == 0 && sr.size > 0 {
+		size = sr.size
+	}
+	return saveToTempFromReader(ctx, &contextReader{ctx, rc}, size, gitDir, oid, writer, errWriter)
+}
+
+// checkDownload checks that the file a fileGetter wrote at path is oid: that
+// it is exactly size bytes, when size is known, and hashes to oid.
+func checkDownload(path, oid string, size int64) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if size > 0 && stat.Size() < size {
+		return fmt.Errorf("short read: received %d bytes, expected %d", stat.Size(), size)
+	}
+	if size > 0 && stat.Size() > size {
+		return fmt.Errorf("received more data than expected: %d bytes, expected %d", stat.Size(), size)
+	}
+	sum, err := fileHash(path)
+	if err != nil {
+		return err
+	}
+	if sum != oid {
+		return fmt.Errorf("%w: expected %v, got %v", errHashMismatch, oid, sum)
+	}
+	return nil
+}
+
+// put uploads the file at fromPath to b. The file itself is passed to Put so
+// backends which work from paths can use it in place.
+func put(ctx context.Context, b Backend, oid, fromPath string, size int64, cb copyCallback, errWriter *bufio.Writer) error {
+	if dryRun {
+		return dryRunPut(b, oid, fromPath, size, errWriter)
+	}
+	f, err := os.Open(fromPath)
+	if err != nil {
+		return fmt.Errorf("Cannot read data from %q: %w", fromPath, err)
+	}
+	defer f.Close()
+	return bind(ctx, b, cb, errWriter).Put(oid, f, size)
+}
+
+// sourcePath returns a local file holding the content of r, for backends
+// that hand files to external tools. Files are used in place; other readers
+// are staged to a temp file which the returned cleanup removes.
+func sourcePath(r io.Reader) (string, func(), error) {
+	if f, ok := r.(*os.File); ok {
+		return f.Name(), func() {}, nil
+	}
+	tmp, err := os.CreateTemp("", "elastic-git-storage")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
@@ -0,0 +1,730 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+func testObject() ([]byte, string) {
+	content := []byte("backend round trip content")
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+// roundTrip stores content through b from a plain (non-file) reader and
+// checks Get returns it unchanged.
+func roundTrip(t *testing.T, b Backend) {
+	content, oid := testObject()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	rc, err := b.Get(oid, int64(len(content)))
+	if assert.Nil(t, err) {
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, content, data)
+	}
+}
+
+func TestDirBackend(t *testing.T) {
+	for _, compression := range []string{"none", "zip", "lz4", "zstd", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dirbackend")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			roundTrip(t, &dirBackend{dir: dir, compression: compression})
+		})
+	}
+
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := &dirBackend{dir: dir, compression: "none"}
+	content, oid := testObject()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Equal(t, errAlreadyStored, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	_, err = b.Get("0000000000000000000000000000000000000000000000000000000000000000", 0)
+	assert.NotNil(t, err)
+}
+
+func TestDirBackendFreeSpace(t *testing.T) {
+	defer func(f func(string) (uint64, error)) { freeSpace = f }(freeSpace)
+
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content, oid := testObject()
+	b := &dirBackend{dir: dir, compression: "none"}
+
+	// A full disk fails before anything is written
+	freeSpace = func(string) (uint64, error) { return 1024, nil }
+	err = b.Put(oid, bytes.NewReader(content), int64(len(content)))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "insufficient space")
+	}
+	assert.NoFileExists(t, storagePath(dir, oid)+".tmp")
+	assert.NoFileExists(t, storagePath(dir, oid))
+
+	// The margin is required on top of the object size
+	freeSpace = func(string) (uint64, error) { return uint64(len(content)) + freeSpaceMargin - 1, nil }
+	assert.NotNil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	freeSpace = func(string) (uint64, error) { return uint64(len(content)) + freeSpaceMargin, nil }
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	// If the space can't be queried the store goes ahead
+	os.RemoveAll(dir)
+	freeSpace = func(string) (uint64, error) { return 0, fmt.Errorf("unsupported") }
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+}
+
+// gatedReader signals started on its first Read and then blocks until
+// release is closed.
+type gatedReader struct {
+	r       io.Reader
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	g.once.Do(func() {
+		close(g.started)
+		<-g.release
+	})
+	return g.r.Read(p)
+}
+
+func TestDirBackendConcurrentPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content, oid := testObject()
+	b := &dirBackend{dir: dir, compression: "none"}
+
+	first := &gatedReader{r: bytes.NewReader(content), started: make(chan struct{}), release: make(chan struct{})}
+	firstErr := make(chan error, 1)
+	go func() { firstErr <- b.Put(oid, first, int64(len(content))) }()
+	<-first.started
+	lockPath := filepath.Join(dir, lockDir, oid+".lock")
+	assert.FileExists(t, lockPath)
+
+	// The second writer waits for the first, then finds the object stored
+	secondErr := make(chan error, 1)
+	go func() { secondErr <- b.Put(oid, bytes.NewReader(content), int64(len(content))) }()
+	time.Sleep(50 * time.Millisecond)
+	close(first.release)
+
+	assert.Nil(t, <-firstErr)
+	assert.Equal(t, errAlreadyStored, <-secondErr)
+	assert.FileExists(t, storagePath(dir, oid))
+	assert.NoFileExists(t, lockPath)
+	assert.NoFileExists(t, storagePath(dir, oid)+".tmp")
+	entries, err := os.ReadDir(filepath.Dir(storagePath(dir, oid)))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "nothing but the object is left beside it")
+
+	// A failed store releases the lock for the next one
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+	os.Remove(storagePath(dir, oid))
+	wrong := bytes.ToUpper(content)
+	assert.NotNil(t, b.Put(oid, bytes.NewReader(wrong), int64(len(wrong))))
+	assert.NoFileExists(t, lockPath)
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+}
+
+func TestFlatLayout(t *testing.T) {
+	assert.Nil(t, SetShardDepth(0))
+	defer SetShardDepth(DefaultShardDepth)
+
+	script := "#!/bin/sh\ncase \"$1\" in\n  copyto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; cp \"$2\" \"$dest\" ;;\n  cat) cat \"${2#*:}\" ;;\n  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, script)
+
+	_, oid := testObject()
+	for _, compression := range []string{"none", "lz4"} {
+		t.Run(compression, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "flat")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			roundTrip(t, &dirBackend{dir: dir, compression: compression})
+			assert.FileExists(t, filepath.Join(dir, oid+compressionExt(compression)))
+
+			remote, err := ioutil.TempDir("", "flat-remote")
+			assert.Nil(t, err)
+			defer os.RemoveAll(remote)
+			roundTrip(t, &rcloneBackend{remote: "dummy:" + remote, compression: compression})
+			assert.FileExists(t, filepath.Join(remote, oid+compressionExt(compression)))
+		})
+	}
+}
+
+func TestNormalizeCase(t *testing.T) {
+	SetNormalizeCase(true)
+	defer SetNormalizeCase(false)
+	content, oid := testObject()
+	size := int64(len(content))
+	upper := strings.ToUpper(oid)
+
+	for _, seed := range []string{
+		filepath.Join(oid[0:2], oid[2:4], oid),
+		filepath.Join(upper[0:2], upper[2:4], oid),
+		filepath.Join(upper[0:2], oid[2:4], oid),
+	} {
+		t.Run(seed[:5], func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "normalizecase")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			seeded := filepath.Join(dir, seed)
+			assert.Nil(t, os.MkdirAll(filepath.Dir(seeded), 0755))
+			assert.Nil(t, ioutil.WriteFile(seeded, content, 0644))
+
+			b := &dirBackend{dir: dir, compression: "none"}
+			for _, id := range []string{oid, upper} {
+				rc, err := b.Get(id, size)
+				if assert.Nil(t, err, id) {
+					got, _ := ioutil.ReadAll(rc)
+					rc.Close()
+					assert.Equal(t, content, got)
+				}
+			}
+		})
+	}
+
+	// Uploads converge on the lower case path, whatever the case asked for
+	dir, err := ioutil.TempDir("", "normalizecase")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := &dirBackend{dir: dir, compression: "none"}
+	assert.Nil(t, b.Put(upper, bytes.NewReader(content), size))
+	assert.FileExists(t, filepath.Join(dir, oid[0:2], oid[2:4], oid))
+	assert.Equal(t, errAlreadyStored, b.Put(oid, bytes.NewReader(content), size))
+
+	// Off, folders of another case are somewhere else
+	SetNormalizeCase(false)
+	if runtime.GOOS == "linux" {
+		os.RemoveAll(filepath.Join(dir, oid[0:2]))
+		seeded := filepath.Join(dir, upper[0:2], upper[2:4], oid)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(seeded), 0755))
+		assert.Nil(t, ioutil.WriteFile(seeded, content, 0644))
+		_, err = b.Get(oid, size)
+		assert.ErrorIs(t, err, errNotFound)
+	}
+}
+
+func TestZipMultipleEntries(t *testing.T) {
+	content, oid := testObject()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range []struct{ name, data string }{
+		{"manifest.json", `{"objects":1}`},
+		{"objects/", ""},
+		{"objects/" + oid, string(content)},
+	} {
+		w, err := zw.Create(entry.name)
+		assert.Nil(t, err)
+		w.Write([]byte(entry.data))
+	}
+	assert.Nil(t, zw.Close())
+
+	dir, err := ioutil.TempDir("", "zipentries")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := storagePath(dir, oid) + ".zip"
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+
+	// The entry named after the OID is picked, from files and streams alike
+	rc, err := (&dirBackend{dir: dir, compression: "zip"}).Get(oid, int64(len(content)))
+	if assert.Nil(t, err) {
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, content, data)
+	}
+	rc, err = decompressStream("zip", ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 0, oid)
+	if assert.Nil(t, err) {
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, content, data)
+	}
+
+	// Without a match the first file is used; directories never are
+	rc, err = decompressStream("zip", ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 0, "other")
+	if assert.Nil(t, err) {
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, `{"objects":1}`, string(data))
+	}
+
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	zw.Create("objects/")
+	assert.Nil(t, zw.Close())
+	_, err = decompressStream("zip", ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 0, oid)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no entry for "+oid)
+	}
+}
+
+func TestZipCorruptEntry(t *testing.T) {
+	content, oid := testObject()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: oid, Method: zip.Store})
+	assert.Nil(t, err)
+	w.Write(content)
+	assert.Nil(t, zw.Close())
+	// Stored uncompressed, so flipping a byte of content leaves the archive
+	// readable but the entry's CRC-32 wrong
+	data := buf.Bytes()
+	i := bytes.Index(data, content)
+	assert.True(t, i > 0)
+	data[i] ^= 0xff
+
+	dir, err := ioutil.TempDir("", "zipcorrupt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := storagePath(dir, oid) + ".zip"
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+	b := &dirBackend{dir: dir, compression: "zip"}
+	_, err = download(context.Background(), b, dir, oid, int64(len(content)), writer, errWriter)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "corrupt")
+	}
+	tempPath, _ := downloadTempPath(dir, oid)
+	assert.NoFileExists(t, tempPath)
+
+	rc, err := decompressStream("zip", ioutil.NopCloser(bytes.NewReader(data)), 0, oid)
+	if assert.Nil(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		assert.ErrorIs(t, err, zip.ErrChecksum)
+	}
+}
+
+func TestDirBackendModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+	defer SetStoreModes(0, 0)
+
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content, oid := testObject()
+	src := filepath.Join(dir, "upload")
+	assert.Nil(t, ioutil.WriteFile(src, content, 0600))
+	assert.Nil(t, os.Chmod(src, 0600))
+	store := filepath.Join(dir, "store")
+
+	// By default the uploaded file's mode carries over
+	f, err := os.Open(src)
+	assert.Nil(t, err)
+	assert.Nil(t, (&dirBackend{dir: store, compression: "none"}).Put(oid, f, int64(len(content))))
+	f.Close()
+	stat, err := os.Stat(storagePath(store, oid))
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	}
+
+	// Configured modes are applied exactly, whatever the umask
+	os.RemoveAll(store)
+	SetStoreModes(0664, 0775)
+	f, err = os.Open(src)
+	assert.Nil(t, err)
+	assert.Nil(t, (&dirBackend{dir: store, compression: "lz4"}).Put(oid, f, int64(len(content))))
+	f.Close()
+	stat, err = os.Stat(storagePath(store, oid) + ".lz4")
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0664), stat.Mode().Perm())
+	}
+	for _, d := range []string{store, filepath.Join(store, oid[0:2]), filepath.Join(store, oid[0:2], oid[2:4])} {
+		stat, err := os.Stat(d)
+		if assert.Nil(t, err) {
+			assert.Equal(t, os.FileMode(0775), stat.Mode().Perm(), d)
+		}
+	}
+	stat, err = os.Stat(dir)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0700), stat.Mode().Perm(), "existing folders are left alone")
+	}
+}
+
+func TestDirBackendResume(t *testing.T) {
+	SetResumeUploads(true)
+	defer SetResumeUploads(false)
+
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content := bytes.Repeat([]byte("resumable upload content "), 40000)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	size := int64(len(content))
+	src := filepath.Join(dir, "upload")
+	assert.Nil(t, ioutil.WriteFile(src, content, 0644))
+	past := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(src, past, past))
+	store := filepath.Join(dir, "store")
+	destPath := storagePath(store, oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(destPath), 0755))
+
+	// put uploads src with tempContent left by an earlier attempt, returning
+	// how many bytes were read from src
+	put := func(tempContent []byte) (int64, error) {
+		os.Remove(destPath)
+		if tempContent != nil {
+			assert.Nil(t, ioutil.WriteFile(destPath+".tmp", tempContent, 0644))
+		}
+		var read int64
+		cb := func(_, _ int64, readSinceLast int) error {
+			read += int64(readSinceLast)
+			return nil
+		}
+		f, err := os.Open(src)
+		assert.Nil(t, err)
+		defer f.Close()
+		err = bind(context.Background(), &dirBackend{dir: store, compression: "none"}, cb, nil).Put(oid, f, size)
+		return read, err
+	}
+
+	// A truncated temp file is carried on from, not copied again
+	half := size / 2
+	read, err := put(content[:half])
+	assert.Nil(t, err)
+	assert.Equal(t, size-half, read)
+	got, err := ioutil.ReadFile(destPath)
+	assert.Nil(t, err)
+	assert.Equal(t, content, got)
+	assert.NoFileExists(t, destPath+".tmp")
+
+	// A partial temp file that doesn't match is caught by the hash, and
+	// removed so the next attempt starts again
+	corrupt := append([]byte{}, content[:half]...)
+	corrupt[0] ^= 0xff
+	_, err = put(corrupt)
+	assert.ErrorIs(t, err, errHashMismatch)
+	assert.NoFileExists(t, destPath)
+	assert.NoFileExists(t, destPath+".tmp")
+	read, err = put(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, size, read)
+
+	// A source changed since the temp file was written starts again
+	assert.Nil(t, os.Chtimes(src, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	read, err = put(content[:half])
+	assert.Nil(t, err)
+	assert.Equal(t, size, read)
+
+	// Without resuming, the temp file is discarded
+	SetResumeUploads(false)
+	read, err = put(content[:half])
+	assert.Nil(t, err)
+	assert.Equal(t, size, read)
+}
+
+func TestScriptBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scriptbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	roundTrip(t, &scriptBackend{
+		script: fmt.Sprintf("if [ -n \"$FROM\" ]; then cp \"$FROM\" %[1]s/$OID; else cp %[1]s/$OID \"$DEST\"; fi", dir),
+	})
+
+	failing := &scriptBackend{script: "exit 1"}
+	_, err = failing.Get("abc", 0)
+	assert.NotNil(t, err)
+}
+
+func TestActionBackend(t *testing.T) {
+	stored := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		switch r.Method {
+		case "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			stored[r.URL.Path] = data
+		case "GET":
+			data, ok := stored[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	a := &api.Action{Href: server.URL + "/object", Header: map[string]string{"Authorization": "secret"}}
+	roundTrip(t, &actionBackend{action: a})
+
+	missing := &actionBackend{action: &api.Action{Href: server.URL + "/missing", Header: a.Header}}
+	_, err := missing.Get("abc", 0)
+	assert.NotNil(t, err)
+}
+
+func TestNewProviders(t *testing.T) {
+	providers := newProviders("/local/store;--compression=lz4 remote:bucket;|cp \"$FROM\" /dest")
+	if assert.Len(t, providers, 3) {
+		assert.IsType(t, &dirBackend{}, providers[0].backend)
+		assert.IsType(t, &rcloneBackend{}, providers[1].backend)
+		assert.Equal(t, "lz4", providers[1].backend.(*rcloneBackend).compression)
+		assert.IsType(t, &scriptBackend{}, providers[2].backend)
+		assert.Equal(t, "/local/store", providers[0].cfg.path)
+	}
+}
+
+func TestMainEntry(t *testing.T) {
+	providers := newProviders("/local/store;@main;remote:bucket")
+	if assert.Len(t, providers, 3) {
+		assert.True(t, providers[1].cfg.main)
+		assert.Nil(t, providers[1].backendFor(nil))
+		assert.IsType(t, &actionBackend{}, providers[1].backendFor(&api.Action{}))
+	}
+	// Utilities working on the stores alone never see it
+	assert.Len(t, splitBaseDirs("/local/store;@main;remote:bucket"), 2)
+	// and --pullmain only adds it if it has no place yet
+	assert.Len(t, withMain(providers), 3)
+	assert.True(t, withMain(providers[:1])[1].cfg.main)
+}
+
+func TestMainEntryOrder(t *testing.T) {
+	content, oid := testObject()
+	var mu sync.Mutex
+	var gets, puts int
+	found := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET":
+			gets++
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(content)
+		case "PUT":
+			puts++
+			io.Copy(ioutil.Discard, r.Body)
+		}
+	}))
+	defer server.Close()
+	a := &api.Action{Href: server.URL + "/" + oid}
+
+	var dirs [3]string
+	for i := range dirs {
+		d, err := ioutil.TempDir("", "main-order")
+		assert.Nil(t, err)
+		defer os.RemoveAll(d)
+		dirs[i] = d
+	}
+	empty, full, gitDir := dirs[0], dirs[1], dirs[2]
+	assert.Nil(t, (&dirBackend{dir: full, compression: "none"}).Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	var stdout, stderr bytes.Buffer
+	writer, errWriter := bufio.NewWriter(&stdout), bufio.NewWriter(&stderr)
+	retrieveFrom := func(baseDir string) string {
+		mu.Lock()
+		gets = 0
+		mu.Unlock()
+		path, tier, _, err := retrieveFile(context.Background(), newProviders(baseDir), gitDir, oid, int64(len(content)), false, a, writer, errWriter)
+		assert.Nil(t, err, baseDir)
+		os.Remove(path)
+		return tier
+	}
+
+	// The main server is tried where it's placed: before the folder holding
+	// the object, it serves it
+	assert.Equal(t, "LFS action", retrieveFrom(empty+";@main;"+full))
+	assert.Equal(t, 1, gets)
+	// after it, it isn't asked at all
+	assert.Equal(t, "local cache", retrieveFrom(empty+";"+full+";@main"))
+	assert.Equal(t, 0, gets)
+	// and when it doesn't have the object, the folders after it are tried
+	mu.Lock()
+	found = false
+	mu.Unlock()
+	assert.Equal(t, "local cache", retrieveFrom(empty+";@main;"+full))
+	assert.Equal(t, 1, gets)
+
+	storeTo := func(baseDir string) {
+		mu.Lock()
+		puts = 0
+		mu.Unlock()
+		fromPath := filepath.Join(gitDir, "upload")
+		assert.Nil(t, ioutil.WriteFile(fromPath, content, 0644))
+		os.RemoveAll(empty)
+		os.Mkdir(empty, 0755)
+		assert.Nil(t, store(context.Background(), newProviders(baseDir), oid, int64(len(content)), false, false, a, fromPath, writer, errWriter), baseDir)
+	}
+
+	// Uploads stop at the first destination to take the object
+	storeTo("@main;" + empty)
+	assert.Equal(t, 1, puts)
+	assert.NoFileExists(t, storagePath(empty, oid))
+	storeTo(empty + ";@main")
+	assert.Equal(t, 0, puts)
+	assert.FileExists(t, storagePath(empty, oid))
+}
+
+func TestSizeRange(t *testing.T) {
+	content, oid := testObject()
+	size := int64(len(content))
+	var mu sync.Mutex
+	var gets, puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET":
+			gets++
+			w.Write(content)
+		case "PUT":
+			puts++
+			io.Copy(ioutil.Discard, r.Body)
+		}
+	}))
+	defer server.Close()
+	a := &api.Action{Href: server.URL + "/" + oid}
+
+	dir, err := ioutil.TempDir("", "size-range")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	folder := filepath.Join(dir, "folder")
+	assert.Nil(t, os.Mkdir(folder, 0755))
+	fromPath := filepath.Join(dir, "upload")
+
+	var stdout, stderr bytes.Buffer
+	writer, errWriter := bufio.NewWriter(&stdout), bufio.NewWriter(&stderr)
+	// transfer stores and then retrieves the object, returning where it was
+	// retrieved from and how many requests were made of the LFS remote
+	transfer := func(useAction bool, a *api.Action) (string, int, int) {
+		mu.Lock()
+		gets, puts = 0, 0
+		mu.Unlock()
+		os.RemoveAll(folder)
+		assert.Nil(t, os.Mkdir(folder, 0755))
+		assert.Nil(t, ioutil.WriteFile(fromPath, content, 0644))
+		assert.Nil(t, store(context.Background(), newProviders(folder), oid, size, useAction, false, a, fromPath, writer, errWriter))
+		path, tier, _, err := retrieveFile(context.Background(), newProviders(folder), dir, oid, size, useAction, a, writer, errWriter)
+		if assert.Nil(t, err) {
+			assert.Equal(t, oid, calculateFileHash(t, path))
+			os.Remove(path)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return tier, gets, puts
+	}
+	defer SetSizeRange(0, 0)
+
+	// Objects too small for the folder go straight to the LFS remote
+	assert.Nil(t, SetSizeRange(size+1, 0))
+	tier, gets, puts := transfer(true, a)
+	assert.Equal(t, "LFS action", tier)
+	assert.Equal(t, 1, gets)
+	assert.Equal(t, 1, puts)
+	assert.NoFileExists(t, storagePath(folder, oid))
+	// as do ones too big, with the main entry placed explicitly too
+	assert.Nil(t, SetSizeRange(0, size-1))
+	mu.Lock()
+	gets, puts = 0, 0
+	mu.Unlock()
+	assert.Nil(t, store(context.Background(), newProviders(folder+";@main"), oid, size, false, false, a, fromPath, writer, errWriter))
+	assert.Equal(t, 1, puts)
+	assert.NoFileExists(t, storagePath(folder, oid))
+
+	// Those in range use the folder, the LFS remote too for uploads when
+	// asked to
+	assert.Nil(t, SetSizeRange(size, size))
+	tier, gets, puts = transfer(true, a)
+	assert.Equal(t, "local cache", tier)
+	assert.Equal(t, 0, gets)
+	assert.Equal(t, 1, puts)
+	assert.Nil(t, SetSizeRange(1, 0))
+	tier, gets, puts = transfer(false, a)
+	assert.Equal(t, "local cache", tier)
+	assert.Equal(t, 0, gets)
+	assert.Equal(t, 0, puts)
+
+	// Without an action to use, the folder is used after all
+	assert.Nil(t, SetSizeRange(size+1, 0))
+	for _, useAction := range []bool{false, true} {
+		tier, _, _ = transfer(useAction, nil)
+		assert.Equal(t, "local cache", tier)
+	}
+	tier, gets, puts = transfer(false, a)
+	assert.Equal(t, "local cache", tier)
+	assert.Equal(t, 0, gets+puts)
+
+	assert.NotNil(t, SetSizeRange(-1, 0))
+	assert.NotNil(t, SetSizeRange(10, 5))
+	assert.Equal(t, size+1, minSize)
+}
+
+func TestMaxBandwidth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bandwidth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	defer SetMaxBandwidth(0)
+
+	const rate = 256 * 1024
+	content := bytes.Repeat([]byte("throttled "), rate/20)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	b := &dirBackend{dir: dir, compression: "none"}
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	// Half a second's worth each way
+	SetMaxBandwidth(rate)
+	start := time.Now()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	_, err = download(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter)
+	assert.Nil(t, err)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 800*time.Millisecond, "took %v", elapsed)
+	assert.True(t, elapsed < 3*time.Second, "took %v", elapsed)
+
+	SetMaxBandwidth(0)
+	start = time.Now()
+	_, err = download(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+
+	SetMaxBandwidth(1000)
+	assert.Equal(t, []string{"cat", "remote:x", "--bwlimit=1000B"}, bwlimitArgs("cat", "remote:x"))
+	SetMaxBandwidth(0)
+	assert.Equal(t, []string{"cat", "remote:x"}, bwlimitArgs("cat", "remote:x"))
+}
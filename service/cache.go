@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheDir, when set, is a local read-through cache for objects fetched from
+// rclone remotes. Objects are held uncompressed in the usual sharded layout.
+var cacheDir string
+
+// cacheMaxBytes is the total size the cache may grow to before the least
+// recently used objects are evicted. Zero means unlimited.
+var cacheMaxBytes int64
+
+// cacheMu serialises eviction, and opening cached copies, so concurrent
+// transfers don't race to delete objects or remove ones about to be served.
+var cacheMu sync.Mutex
+
+// SetCache configures the local cache placed in front of rclone remotes.
+// An empty dir disables caching.
+func SetCache(dir string, maxBytes int64) {
+	cacheDir = dir
+	cacheMaxBytes = maxBytes
+}
+
+// openThroughCache serves an rclone object from the local cache when a copy
+// of the right size is present, otherwise fetches it from the remote, stores
+// it in the cache and serves it from there.
+func openThroughCache(ctx context.Context, base, oid string, size int64, compression string) (io.ReadCloser, error) {
+	cachePath := storagePath(cacheDir, oid)
+	// The cache lock is held from finding the file until it's open, so
+	// another transfer's eviction can't remove it in between. An open file
+	// can still be read once removed.
+	cacheMu.Lock()
+	f, err := openCached(cachePath, size)
+	cacheMu.Unlock()
+	if err != nil {
+		atomic.AddInt64(&cacheMisses, 1)
+		tmpPath, err := fillCache(ctx, base, oid, size, compression, cachePath)
+		if err != nil {
+			return nil, err
+		}
+		// Made visible under the lock too, so it can't be evicted before
+		// it's open
+		cacheMu.Lock()
+		err = os.Rename(tmpPath, cachePath)
+		if err == nil {
+			evictCache(cachePath)
+			f, err = openCached(cachePath, size)
+		}
+		cacheMu.Unlock()
+		if err != nil {
+			os.Remove(tmpPath)
+			return nil, err
+		}
+	} else {
+		atomic.AddInt64(&cacheHits, 1)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Access time is tracked via mtime since atime is often disabled.
+	now := time.Now()
+	os.Chtimes(cachePath, now, now)
+	return &sizedReader{f, stat.Size()}, nil
+}
+
+// openCached opens the cached copy at cachePath, failing if it is missing or
+// isn't size bytes, when size is known.
+func openCached(cachePath string, size int64) (*os.File, error) {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err == nil && size > 0 && stat.Size() != size {
+		err = fmt.Errorf("cached copy is %d bytes, expected %d", stat.Size(), size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// fillCache downloads an object from the remote into a temp file beside
+// cachePath, verifying its hash, and returns the temp file's path for the
+// caller to rename into place.
+func fillCache(ctx context.Context, base, oid string, size int64, compression, cachePath string) (string, error) {
+	rc, size, err := openRclone(ctx, base, oid, size, compression)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), oid+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	hasher := newOidHash()
+	if err := copyReader(size, io.TeeReader(rc, hasher), tmp, nil); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != oid {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("%w: expected %v, got %v", errHashMismatch, oid, sum)
+	}
+	return tmp.Name(), nil
+}
+
+// evictCache removes the least recently used objects until the cache fits
+// within cacheMaxBytes. keep is never evicted since it is about to be served.
+// The caller must hold cacheMu.
+func evictCache(keep string) {
+	if cacheMaxBytes <= 0 {
+		return
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if total <= cacheMaxBytes {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, e := range entries {
+		if total <= cacheMaxBytes {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		if err := os.Remove(e.path); err == nil {
+			total -= e.size
+		}
+	}
+}
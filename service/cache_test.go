@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// installCountingRclone puts a fake rclone on PATH which supports cat and
+// appends a line to the returned log file on every invocation.
+func installCountingRclone(t *testing.T) string {
+	logPath := filepath.Join(t.TempDir(), "calls")
+	installFakeRclone(t, fmt.Sprintf("#!/bin/sh\necho \"$1\" >> %q\nif [ \"$1\" = \"cat\" ]; then\n  cat \"${2#*:}\"\nfi\n", logPath))
+	return logPath
+}
+
+func countCalls(t *testing.T, logPath string) int {
+	data, err := ioutil.ReadFile(logPath)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	assert.Nil(t, err)
+	return strings.Count(string(data), "\n")
+}
+
+func TestDownloadRcloneCache(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	logPath := installCountingRclone(t)
+
+	cache, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cache)
+	SetCache(cache, 0)
+	defer SetCache("", 0)
+
+	base := "dummy:" + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	// One listing of the remote, then one fetch per object
+	assert.Equal(t, len(setup.files)+1, countCalls(t, logPath))
+	for _, file := range setup.files {
+		assert.FileExists(t, filepath.Join(cache, file.oid[0:2], file.oid[2:4], file.oid))
+	}
+
+	// Second pass must be served entirely from the cache
+	stdout.Reset()
+	stderr.Reset()
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	assert.Equal(t, len(setup.files)+1, countCalls(t, logPath))
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		tempPath, ok := paths[file.oid]
+		assert.True(t, ok)
+		assert.Equal(t, file.oid, calculateFileHash(t, tempPath))
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	installCountingRclone(t)
+
+	cache, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cache)
+
+	// Room for the largest object only, so each fill evicts the previous ones
+	var largest int64
+	for _, file := range setup.files {
+		if file.size > largest {
+			largest = file.size
+		}
+	}
+	SetCache(cache, largest)
+	defer SetCache("", 0)
+
+	base := "dummy:" + setup.remotepath
+	for i, file := range setup.files {
+		var commandBuf bytes.Buffer
+		initDownload(&commandBuf)
+		addDownload(t, &commandBuf, file.oid, file.size)
+		finishDownload(&commandBuf)
+
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		Serve(base, base, false, false, false, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+		assert.Contains(t, stdout.String(), `"path"`)
+
+		cachePath := filepath.Join(cache, file.oid[0:2], file.oid[2:4], file.oid)
+		assert.FileExists(t, cachePath)
+		// Ensure later entries are strictly newer than earlier ones
+		past := time.Now().Add(time.Duration(i-len(setup.files)) * time.Minute)
+		os.Chtimes(cachePath, past, past)
+	}
+
+	var total int64
+	filepath.Walk(cache, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	assert.LessOrEqual(t, total, largest)
+	last := setup.files[len(setup.files)-1]
+	assert.FileExists(t, filepath.Join(cache, last.oid[0:2], last.oid[2:4], last.oid))
+}
+
+func TestCacheEvictionDuringOpen(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	installCountingRclone(t)
+
+	cache, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cache)
+	// So small that every fill evicts every other object
+	SetCache(cache, 1)
+	defer SetCache("", 0)
+
+	// Transfers hitting the cache while others fill it and evict still get
+	// the whole object
+	base := "dummy:" + setup.remotepath
+	var wg sync.WaitGroup
+	for round := 0; round < 5; round++ {
+		for _, file := range setup.files {
+			wg.Add(1)
+			go func(oid string, size int64) {
+				defer wg.Done()
+				rc, err := openThroughCache(context.Background(), base, oid, size, "none")
+				if !assert.Nil(t, err, oid) {
+					return
+				}
+				defer rc.Close()
+				hasher := newOidHash()
+				n, err := io.Copy(hasher, rc)
+				assert.Nil(t, err)
+				assert.Equal(t, size, n)
+				assert.Equal(t, oid, hex.EncodeToString(hasher.Sum(nil)))
+			}(file.oid, file.size)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// DefaultTempMaxAge is how old a temp file must be before it is considered
+// abandoned and removed.
+const DefaultTempMaxAge = 24 * time.Hour
+
+// tempMaxAge is the age limit applied by the sweep of the git temp dir when
+// the adapter starts; zero disables the sweep.
+var tempMaxAge = DefaultTempMaxAge
+
+// SetTempMaxAge sets how old a temp file left by an earlier transfer must be
+// before it is removed. Zero or negative values disable removal at startup.
+func SetTempMaxAge(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	tempMaxAge = d
+}
+
+// tempFileName matches the temp files this adapter creates: an OID, any
+// compression extension, then ".tmp". Other files, such as git-lfs's own
+// temp files, are never touched.
+var tempFileName = regexp.MustCompile(`^[0-9a-f]{40,128}(\.[a-z0-9]+)?\.tmp$`)
+
+// removeStaleTemps removes temp files last modified more than maxAge ago
+// from dir and, if recursive, its subdirectories. Files still being written
+// by another adapter keep a recent modification time and are left alone.
+// It returns the number of files removed.
+func removeStaleTemps(dir string, maxAge time.Duration, recursive bool) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// Skip unreadable subfolders rather than abandoning the sweep
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !tempFileName.MatchString(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err == nil {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// cleanDownloadTemp sweeps stale download temp files from the folder
+// downloads are written to, if tempMaxAge allows. The system temp dir used
+// outside a repository is left alone.
+func cleanDownloadTemp(gitDir string, errWriter *bufio.Writer) {
+	if tempMaxAge == 0 || (gitDir == "" && tempDir == "") {
+		return
+	}
+	tmp := downloadTempDir(gitDir)
+	n, err := removeStaleTemps(tmp, tempMaxAge, false)
+	if err == nil && n > 0 {
+		util.WriteToStderr(fmt.Sprintf("Removed %d stale temp file(s) from %v\n", n, tmp), errWriter)
+	}
+}
+
+// CleanupTempFiles removes temp files older than maxAge, left behind by
+// interrupted transfers, from every local folder store in each base dir
+// string and from the download temp dir: the one set by SetTempDir, or else
+// the git-lfs temp dir of the current repository, if there is one. rclone
+// remotes, URLs and scripts are skipped. Progress is written to out. It
+// returns an error if any store couldn't be swept.
+func CleanupTempFiles(baseDirs []string, maxAge time.Duration, out io.Writer) error {
+	var lastErr error
+	seen := make(map[string]bool)
+	sweep := func(dir string, recursive bool) {
+		if seen[dir] {
+			return
+		}
+		seen[dir] = true
+		n, err := removeStaleTemps(dir, maxAge, recursive)
+		if err != nil {
+			fmt.Fprintf(out, "Unable to clean %v: %v\n", dir, err)
+			lastErr = err
+			return
+		}
+		fmt.Fprintf(out, "Removed %d stale temp file(s) from %v\n", n, dir)
+	}
+	for _, baseDir := range baseDirs {
+		for _, cfg := range splitBaseDirs(baseDir) {
+			if cfg.script || cfg.layout == "lfs" || util.IsRemotePath(cfg.path) {
+				continue
+			}
+			sweep(cfg.path, true)
+		}
+	}
+	// Outside a repository only an explicit temp dir is swept, never the
+	// system one
+	if gitDir, err := gitDir(); err == nil || tempDir != "" {
+		if tmp := downloadTempDir(gitDir); dirExists(tmp) {
+			sweep(tmp, false)
+		}
+	}
+	return lastErr
+}
+
+func dirExists(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
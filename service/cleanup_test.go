@@ -0,0 +1,66 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupTempFiles(t *testing.T) {
+	store, err := ioutil.TempDir("", "cleanup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(store)
+
+	_, oid := testObject()
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(name string, modTime time.Time) string {
+		path := filepath.Join(store, oid[0:2], oid[2:4], name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte("data"), 0644))
+		assert.Nil(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+	oldTemp := write(oid+".tmp", old)
+	oldZipTemp := write(oid+".zip.tmp", old)
+	newTemp := write("1"+oid[1:]+".tmp", time.Now())
+	object := write(oid, old)
+	otherTemp := write("notes.tmp", old)
+
+	var out bytes.Buffer
+	assert.Nil(t, CleanupTempFiles([]string{"--compression=zip " + store + ";remote:bucket;|true"}, 24*time.Hour, &out))
+	assert.NoFileExists(t, oldTemp)
+	assert.NoFileExists(t, oldZipTemp)
+	assert.FileExists(t, newTemp, "recent temp files may belong to a running transfer")
+	assert.FileExists(t, object)
+	assert.FileExists(t, otherTemp, "only the adapter's own temp files are removed")
+	assert.Contains(t, out.String(), "Removed 2 stale temp file(s) from "+store)
+
+	assert.NotNil(t, CleanupTempFiles([]string{filepath.Join(store, "missing")}, time.Hour, &out))
+}
+
+func TestRemoveStaleTempsNotRecursive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleanup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, oid := testObject()
+	old := time.Now().Add(-48 * time.Hour)
+	top := filepath.Join(dir, oid+".tmp")
+	nested := filepath.Join(dir, "sub", oid+".tmp")
+	for _, path := range []string{top, nested} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte("data"), 0644))
+		assert.Nil(t, os.Chtimes(path, old, old))
+	}
+
+	n, err := removeStaleTemps(dir, 24*time.Hour, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoFileExists(t, top)
+	assert.FileExists(t, nested)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// copyTarget is one destination of CopyStores.
+type copyTarget struct {
+	baseDirConfig
+	// keep stores objects in the compression they had in the source, as no
+	// --compression was given for the destination.
+	keep bool
+}
+
+// copyTargets parses a destination base dir string for CopyStores.
+func copyTargets(dest string) []copyTarget {
+	var targets []copyTarget
+	for _, part := range strings.Split(dest, ";") {
+		for _, cfg := range splitBaseDirs(part) {
+			keep := !strings.HasPrefix(strings.TrimSpace(part), "--compression=")
+			targets = append(targets, copyTarget{cfg, keep})
+		}
+	}
+	return targets
+}
+
+// compressionFor returns the compression o is stored with in t.
+func (t copyTarget) compressionFor(o storedObject) string {
+	if t.keep {
+		return o.compression
+	}
+	return t.compression
+}
+
+// present returns the stored size of each object already held by t, in the
+// compression it would be copied in.
+func (t copyTarget) present(objects []storedObject) map[string]int64 {
+	sizes := make(map[string]int64)
+	if t.script {
+		return sizes
+	}
+	byCompression := make(map[string][]string)
+	for _, o := range objects {
+		c := t.compressionFor(o)
+		byCompression[c] = append(byCompression[c], o.oid)
+	}
+	for c, oids := range byCompression {
+		for oid, info := range Exists(fmt.Sprintf("--compression=%v %v", c, t.path), oids) {
+			sizes[oid] = info.Size
+		}
+	}
+	return sizes
+}
+
+// copyTo stores the object in t, after checking it hashes to its OID.
+func (o storedObject) copyTo(t copyTarget) error {
+	src, size, err := o.extract()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	cfg := t.baseDirConfig
+	cfg.compression = t.compressionFor(o)
+	if err := newBackend(cfg).Put(o.oid, src, size); err != nil && !errors.Is(err, errAlreadyStored) {
+		return err
+	}
+	return nil
+}
+
+// CopyStores copies every object in the local folder stores and rclone
+// remotes of the base dir string src to each store of the base dir string
+// dest, which may be any kind of store. Destinations given a --compression
+// option are stored in that format, otherwise each object keeps the
+// compression it had. Objects the destination already holds in the same
+// compression and at the same size are skipped, so an interrupted copy can
+// simply be run again; when converting, any copy already present is kept.
+// Each object is checked to hash to its OID before being stored. jobs objects
+// are copied at once. Progress and problems are written to out. It returns
+// the number of objects copied, and the last error encountered.
+func CopyStores(src, dest string, jobs int, out io.Writer) (int, error) {
+	targets := copyTargets(dest)
+	if len(targets) == 0 {
+		err := errors.New("no destination given")
+		fmt.Fprintln(out, err)
+		return 0, err
+	}
+
+	var lastErr error
+	copied := 0
+	err := eachStore([]string{src}, "copied from", out, func(root string, objects []storedObject) {
+		for _, t := range targets {
+			present := t.present(objects)
+			var pending []storedObject
+			for _, o := range objects {
+				size, ok := present[o.oid]
+				if ok && (size == o.size || t.compressionFor(o) != o.compression) {
+					continue
+				}
+				pending = append(pending, o)
+			}
+
+			var mu sync.Mutex
+			n, done := 0, 0
+			eachObject(pending, jobs, func(o storedObject) {
+				err := o.copyTo(t)
+				mu.Lock()
+				defer mu.Unlock()
+				done++
+				if err != nil {
+					fmt.Fprintf(out, "[%d/%d] Unable to copy %v to %v: %v\n", done, len(pending), o, t.path, err)
+					lastErr = err
+					return
+				}
+				n++
+				fmt.Fprintf(out, "[%d/%d] Copied %v\n", done, len(pending), o)
+			})
+			copied += n
+			fmt.Fprintf(out, "Copied %d object(s) from %v to %v, %d already present\n",
+				n, root, t.path, len(objects)-len(pending))
+		}
+	})
+	if err != nil {
+		lastErr = err
+	}
+	return copied, lastErr
+}
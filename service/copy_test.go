@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyStores(t *testing.T) {
+	src, err := ioutil.TempDir("", "copy-src")
+	assert.Nil(t, err)
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "copy-dest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dest)
+
+	contents := make(map[string][]byte)
+	compressions := []string{"none", "lz4", "zip", "none", "zstd"}
+	for i, compression := range compressions {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 2000+i)
+		sum := sha256.Sum256(content)
+		oid := hex.EncodeToString(sum[:])
+		contents[oid] = content
+		b := &dirBackend{dir: src, compression: compression}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	}
+
+	// Hash what the destination serves for every object
+	assertCopied := func(compression string) {
+		for oid, content := range contents {
+			b := &dirBackend{dir: dest, compression: compression}
+			rc, err := b.Get(oid, int64(len(content)))
+			if !assert.Nil(t, err) {
+				continue
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			assert.Nil(t, err)
+			sum := sha256.Sum256(data)
+			assert.Equal(t, oid, hex.EncodeToString(sum[:]))
+		}
+	}
+
+	var out bytes.Buffer
+	n, err := CopyStores(src, "--compression=lz4 "+dest, 2, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, len(contents), n)
+	assert.Contains(t, out.String(), "[5/5] Copied")
+	assertCopied("lz4")
+
+	// Resuming skips what is already there
+	out.Reset()
+	n, err = CopyStores(src, "--compression=lz4 "+dest, 2, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, out.String(), "5 already present")
+
+	// Without --compression each object keeps its format, and a truncated
+	// copy is replaced
+	os.RemoveAll(dest)
+	n, err = CopyStores(src, dest, 3, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, len(contents), n)
+	for oid := range contents {
+		var found int
+		for _, c := range []string{"none", "lz4", "zip", "zstd"} {
+			if _, err := os.Stat(storagePath(dest, oid) + compressionExt(c)); err == nil {
+				found++
+			}
+		}
+		assert.Equal(t, 1, found)
+	}
+	for oid := range contents {
+		p := storagePath(dest, oid)
+		if _, err := os.Stat(p); err == nil {
+			assert.Nil(t, os.Truncate(p, 10))
+			break
+		}
+	}
+	out.Reset()
+	n, err = CopyStores(src, dest, 3, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	// Corrupt sources aren't copied
+	content, oid := testObject()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, oid), content[1:], 0644))
+	n, err = CopyStores(src, filepath.Join(dest, "other"), 1, &out)
+	assert.NotNil(t, err)
+	assert.Equal(t, len(contents), n)
+	assert.NoFileExists(t, storagePath(filepath.Join(dest, "other"), oid))
+}
+
+func TestCopyStoresRawArchive(t *testing.T) {
+	src, err := ioutil.TempDir("", "copy-src")
+	assert.Nil(t, err)
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "copy-dest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dest)
+
+	// Assets which are themselves archives, stored as they are
+	contents := make(map[string][]byte)
+	for _, compression := range []string{"gzip", "zip", "zstd", "lz4"} {
+		content, oid := archiveObject(t, compression)
+		contents[oid] = content
+		b := &dirBackend{dir: src, compression: "none"}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	}
+
+	var out bytes.Buffer
+	n, err := CopyStores(src, dest, 2, &out)
+	assert.Nil(t, err, out.String())
+	assert.Equal(t, len(contents), n)
+	for oid, content := range contents {
+		got, err := ioutil.ReadFile(storagePath(dest, oid))
+		assert.Nil(t, err)
+		assert.Equal(t, content, got)
+	}
+}
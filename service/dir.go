@@ -0,0 +1,549 @@
+package service
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// dirBackend stores objects in a local or mounted directory, in the same
+// sharded layout git-lfs uses, optionally compressed.
+type dirBackend struct {
+	reporter
+	dir         string
+	compression string
+}
+
+func (b *dirBackend) withReporter(r reporter) Backend {
+	c := *b
+	c.reporter = r
+	return &c
+}
+
+func (b *dirBackend) checkWritable() error {
+	f, err := os.CreateTemp(b.dir, writeCheckName+"-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (b *dirBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	// A store part way through a change of layout may still hold the object
+	// in the old one, so the other layouts are tried after the configured one
+	paths := layoutPaths(b.dir, oid)
+	for _, filePath := range paths {
+		rc, found, err := b.open(filePath, size)
+		if found {
+			return rc, err
+		}
+	}
+	return nil, fmt.Errorf("%s %w", paths[0], errNotFound)
+}
+
+// open opens the object stored at filePath. The object matching the
+// configured compression is probed first, so the lookup for a given provider
+// is deterministic: zip -> <oid>.zip, lz4 -> <oid>.lz4, zstd -> <oid>.zst,
+// gzip -> <oid>.gz, bzip2 -> <oid>.bz2, xz -> <oid>.xz, external -> <oid>.z,
+// anything else -> <oid>. Failing that, a plain <oid> is
+// read as openPlain describes. found is false if there is no such object.
+func (b *dirBackend) open(filePath string, size int64) (rc io.ReadCloser, found bool, err error) {
+	switch b.compression {
+	case "zip":
+		if _, err := os.Stat(filePath + ".zip"); err == nil {
+			rc, err := openZip(filePath+".zip", filepath.Base(filePath))
+			return rc, true, err
+		}
+	case "lz4":
+		if f, err := os.Open(filePath + ".lz4"); err == nil {
+			return &readCloser{lz4.NewReader(f), f.Close}, true, nil
+		}
+	case "zstd":
+		if f, err := os.Open(filePath + ".zst"); err == nil {
+			zr, err := zstd.NewReader(f)
+			if err != nil {
+				f.Close()
+				return nil, true, err
+			}
+			return &readCloser{zr, func() error {
+				zr.Close()
+				return f.Close()
+			}}, true, nil
+		}
+	case "gzip":
+		if f, err := os.Open(filePath + ".gz"); err == nil {
+			rc, err := decompressStream("gzip", f, 0, "")
+			return rc, true, err
+		}
+	case "bzip2", "xz":
+		if f, err := os.Open(filePath + compressionExt(b.compression)); err == nil {
+			rc, err := decompressStream(b.compression, f, 0, "")
+			return rc, true, err
+		}
+	case "external":
+		if f, err := os.Open(filePath + ".z"); err == nil {
+			rc, err := decompressExternal(f)
+			return rc, true, err
+		}
+	}
+	return b.openPlain(filePath, size)
+}
+
+// lockDir is the folder below a store root holding the lock files of
+// objects being stored, so they are never left among the objects, as they
+// can be on Windows, where a lock file still open elsewhere can't be
+// removed.
+const lockDir = ".locks"
+
+// lock takes the lock on storing oid to the store, blocking until it is
+// free, and returns the function releasing it.
+func (b *dirBackend) lock(oid string) (func(), error) {
+	dir := filepath.Join(b.dir, lockDir)
+	if err := makeStoreDirs(dir); err != nil {
+		return nil, err
+	}
+	return util.LockFile(filepath.Join(dir, oid+".lock"))
+}
+
+// openPlain opens an object stored without a compression extension. Unless
+// it is a raw object of the expected size, which stores with compression
+// hold for uploads that didn't compress, its first bytes are checked for a
+// known compression format, so that stores written by tools with other
+// naming conventions can still be read. A raw object of another size than a
+// known expected one is passed over, as if it wasn't there, so the next
+// store can be tried.
+func (b *dirBackend) openPlain(filePath string, size int64) (io.ReadCloser, bool, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil || !stat.Mode().IsRegular() {
+		return nil, false, nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, true, err
+	}
+	if size == stat.Size() || (b.compression == "none" && size == 0) {
+		return &sizedReader{f, stat.Size()}, true, nil
+	}
+	compression, err := sniffCompression(f)
+	if err != nil {
+		f.Close()
+		return nil, true, err
+	}
+	switch compression {
+	case "":
+		if size != 0 && size != stat.Size() {
+			f.Close()
+			b.warn(fmt.Sprintf("Passing over %v, it is %d bytes rather than %d\n", filePath, stat.Size(), size))
+			return nil, false, nil
+		}
+		return &sizedReader{f, stat.Size()}, true, nil
+	case "zip":
+		// Zip needs random access, which the file gives without buffering
+		f.Close()
+		rc, err := openZip(filePath, filepath.Base(filePath))
+		return rc, true, err
+	}
+	rc, err := decompressStream(compression, f, stat.Size(), "")
+	return rc, true, err
+}
+
+// openZip returns a reader over the entry for the object called name in the
+// zip archive at path, chosen as zipEntry does.
+func openZip(path, name string) (io.ReadCloser, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	zf, err := zipEntry(zr.File, name)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	return &sizedReader{&readCloser{&zipEntryReader{rc, zf.Name}, func() error {
+		rc.Close()
+		return zr.Close()
+	}}, int64(zf.UncompressedSize64)}, nil
+}
+
+// alreadyStored returns whether oid is stored uncompressed at destPath with
+// the given size, and with verifyExisting, whether it hashes to oid too.
+func (b *dirBackend) alreadyStored(destPath, oid string, size int64) bool {
+	if b.compression != "none" {
+		return false
+	}
+	stat, err := os.Stat(destPath)
+	if err != nil || stat.Size() != size {
+		return false
+	}
+	if !verifyExisting {
+		return true
+	}
+	sum, err := fileHash(destPath)
+	return err == nil && sum == oid
+}
+
+func (b *dirBackend) Put(oid string, r io.Reader, size int64) (err error) {
+	// External commands may do more than compress, so they always run
+	if b.compression != "none" && b.compression != "external" && !compressAlways {
+		var compressible bool
+		if r, compressible, err = sampleCompressible(r); err != nil {
+			return err
+		}
+		if !compressible {
+			// The plain name tells downloads, ls and verify it's stored as is
+			raw := *b
+			raw.compression = "none"
+			return raw.Put(oid, r, size)
+		}
+	}
+	destPath := storagePath(b.dir, oid) + compressionExt(b.compression)
+	if storeMetadata {
+		// Written once the object is in place, however it got there
+		defer func() {
+			if err == nil {
+				err = writeMetadata(metadataPath(destPath, oid), objectMetadata{oid, size, b.compression, time.Now().UTC()})
+			}
+		}()
+	}
+	if b.alreadyStored(destPath, oid, size) {
+		return errAlreadyStored
+	}
+
+	if err := makeStoreDirs(filepath.Dir(destPath)); err != nil {
+		return fmt.Errorf("Cannot create dir %q: %w", filepath.Dir(destPath), err)
+	}
+
+	// Another process may be storing the same object into this folder.
+	// Whoever gets the lock second finds the object already there.
+	locked := false
+	if unlock, err := b.lock(oid); err != nil {
+		b.warn(fmt.Sprintf("Cannot lock %v, storing without a lock: %v\n", oid, err))
+	} else {
+		defer unlock()
+		locked = true
+		if b.alreadyStored(destPath, oid, size) {
+			return errAlreadyStored
+		}
+	}
+
+	// Links and reflinks need the source file itself, not just its content
+	srcf, isFile := r.(*os.File)
+
+	if linkUploads && b.compression == "none" && isFile {
+		linked, err := linkToStore(oid, srcf.Name(), destPath)
+		if err != nil {
+			return err
+		}
+		if linked {
+			return nil
+		}
+	}
+
+	tempPath := fmt.Sprintf("%v.tmp", destPath)
+	// A partial temp file can only be carried on from while nobody else can
+	// be writing it, and when the source can be read from the same place
+	seeker, seekable := r.(io.Seeker)
+	resume := resumeUploads && b.compression == "none" && seekable && locked
+	temps := tempsFor(b.context())
+	track := temps.track
+	if resume {
+		track = temps.trackResumable
+	}
+	untrack, err := track(tempPath)
+	if err != nil {
+		return err
+	}
+	defer untrack()
+	var offset int64
+	if resume {
+		offset = resumeOffset(tempPath, r, size)
+	}
+	if offset > 0 {
+		b.info(fmt.Sprintf("Resuming upload of %v from %d of %d bytes\n", oid, offset, size))
+	} else if _, err := os.Stat(tempPath); err == nil {
+		if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot remove existing temp file %q: %w", tempPath, err)
+		}
+	}
+	// discard removes a failed attempt's temp file, unless the next one can
+	// carry on from it
+	discard := func() {
+		if !resume {
+			storeFS.Remove(tempPath)
+		}
+	}
+
+	if reflinkUploads && b.compression == "none" && isFile && offset == 0 {
+		err := reflinkToStore(oid, srcf.Name(), tempPath, destPath)
+		if err == nil {
+			return nil
+		}
+		// Only a filesystem that can't clone is worth copying on from; a
+		// hash mismatch or a failed rename is reported as it is
+		if !util.IsReflinkUnsupported(err) {
+			return err
+		}
+		b.warn(fmt.Sprintf("Reflink not supported for %v, copying instead: %v\n", oid, err))
+	}
+
+	if err := checkFreeSpace(filepath.Dir(destPath), size); err != nil {
+		return err
+	}
+
+	mode := storeFileMode
+	if mode == 0 {
+		mode = 0644
+		if isFile {
+			if stat, err := srcf.Stat(); err == nil {
+				mode = stat.Mode()
+			}
+		}
+	}
+	// Transient errors, common on network shares, retry from creating the
+	// temp file. The source is read again from the start, which needs it to
+	// be seekable once reading has begun.
+	// When resuming, each attempt carries on from what the one before
+	// wrote. A resumed object is always hashed, covering the part written
+	// before as well.
+	var hasher hash.Hash
+	var stored *byteCounter
+	verify := verifyUploads
+	started := false
+	err = retryFS(func() error {
+		if started && resume {
+			offset = resumeOffset(tempPath, r, size)
+		}
+		if started || offset > 0 {
+			if !seekable {
+				return fmt.Errorf("Cannot retry writing %q, source can't be reread", tempPath)
+			}
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("Cannot retry writing %q: %w", tempPath, err)
+			}
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if resume {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if offset > 0 {
+				flags = os.O_WRONLY | os.O_APPEND
+			}
+		}
+		dstf, err := storeFS.OpenFile(tempPath, flags, mode)
+		if err != nil {
+			return fmt.Errorf("Cannot open temp file for writing %q: %w", tempPath, err)
+		}
+		started = true
+		if storeFileMode != 0 {
+			// OpenFile's mode is filtered by the umask
+			if err := dstf.Chmod(storeFileMode); err != nil {
+				dstf.Close()
+				discard()
+				return fmt.Errorf("Cannot set mode of temp file %q: %w", tempPath, err)
+			}
+		}
+
+		src := throttle(&contextReader{b.context(), r})
+		hasher = newOidHash()
+		verify = verifyUploads || offset > 0
+		if offset > 0 {
+			if err := hashPrefix(hasher, tempPath, offset); err != nil {
+				dstf.Close()
+				return fmt.Errorf("Cannot read temp file %q: %w", tempPath, err)
+			}
+		}
+		if verify {
+			src = io.TeeReader(src, hasher)
+		}
+		progress := b.progress
+		if progress != nil && offset > 0 {
+			resumedAt := offset
+			progress = func(_, readSoFar int64, readSinceLast int) error {
+				return b.progress(size, resumedAt+readSoFar, readSinceLast)
+			}
+		}
+		stored = &byteCounter{w: dstf}
+		if err := compressStream(b.compression, src, stored, size-offset, oid, progress); err != nil {
+			dstf.Close()
+			discard()
+			return fmt.Errorf("Error writing temp file %q: %w", tempPath, err)
+		}
+		// Flush before the rename, or a crash could leave an empty or torn
+		// object under its final name
+		if durableWrites {
+			if err := storeFS.Sync(dstf); err != nil {
+				dstf.Close()
+				discard()
+				return fmt.Errorf("Error syncing temp file %q: %w", tempPath, err)
+			}
+		}
+		dstf.Close()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if verify {
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != oid {
+			storeFS.Remove(tempPath)
+			return fmt.Errorf("%w for %q: content hashes to %v", errHashMismatch, oid, sum)
+		}
+	}
+	if err := retryFS(func() error { return storeFS.Rename(tempPath, destPath) }); err != nil {
+		storeFS.Remove(tempPath)
+		return fmt.Errorf("Error moving temp file to final location: %w", err)
+	}
+	if durableWrites {
+		// Best effort: some network filesystems can't sync directories
+		storeFS.SyncDir(filepath.Dir(destPath))
+	}
+	if b.compression != "none" {
+		recordCompression(oid, size, stored.n, b.errWriter)
+	}
+	return nil
+}
+
+// resumeOffset returns how much of an upload of size bytes from src the
+// temp file at tempPath already holds, or 0 if it can't be carried on from:
+// when it is missing, empty or too big, or when src is a file changed since
+// the temp file was last written.
+func resumeOffset(tempPath string, src io.Reader, size int64) int64 {
+	stat, err := os.Stat(tempPath)
+	if err != nil || stat.Size() == 0 || stat.Size() > size {
+		return 0
+	}
+	if f, ok := src.(*os.File); ok {
+		srcStat, err := f.Stat()
+		if err != nil || srcStat.Size() != size || srcStat.ModTime().After(stat.ModTime()) {
+			return 0
+		}
+	}
+	return stat.Size()
+}
+
+// storeFileMode is the mode objects stored in folders are given, or 0 to
+// keep the mode of the uploaded file.
+var storeFileMode os.FileMode
+
+// storeDirMode is the mode folders are created with in folder stores, or 0
+// for the default of 0755 less the umask.
+var storeDirMode os.FileMode
+
+// SetStoreModes sets the permissions of objects and folders created in
+// folder stores, which are applied exactly, regardless of the umask, so a
+// shared store stays readable by everyone who needs it. A zero fileMode
+// keeps the mode of the uploaded file and a zero dirMode restores the
+// default. Hardlinked uploads always share the mode of the uploaded file.
+func SetStoreModes(fileMode, dirMode os.FileMode) {
+	storeFileMode = fileMode
+	storeDirMode = dirMode
+}
+
+// makeStoreDirs creates dir and any missing parents. With an explicit
+// storeDirMode, the folders created are given exactly that mode.
+func makeStoreDirs(dir string) error {
+	if storeDirMode == 0 {
+		return os.MkdirAll(dir, 0755)
+	}
+	var created []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		created = append(created, d)
+	}
+	if err := os.MkdirAll(dir, storeDirMode); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := os.Chmod(d, storeDirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// freeSpaceMargin is the space left free over the size of an object being
+// stored, so a store is never filled to the last byte.
+const freeSpaceMargin = 16 * 1024 * 1024
+
+// freeSpace reports the bytes available at a path; replaced in tests.
+var freeSpace = util.FreeSpace
+
+// checkFreeSpace fails if dir lacks room for an object of size bytes plus
+// freeSpaceMargin. Compressed objects are usually smaller, so this errs on
+// the side of caution. If the free space can't be determined the check is
+// skipped.
+func checkFreeSpace(dir string, size int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if needed := uint64(size) + freeSpaceMargin; free < needed {
+		return fmt.Errorf("%w in %q: %d bytes free, %d needed", errNoSpace, dir, free, needed)
+	}
+	return nil
+}
+
+// linkToStore attempts to hardlink fromPath into the store at destPath. It
+// returns false without error when linking is not possible (for example
+// across devices) so the caller can fall back to copying.
+func linkToStore(oid, fromPath, destPath string) (bool, error) {
+	if verifyUploads {
+		sum, err := fileHash(fromPath)
+		if err != nil {
+			return false, fmt.Errorf("Cannot read data from %q: %w", fromPath, err)
+		}
+		if sum != oid {
+			return false, fmt.Errorf("%w for %q: content hashes to %v", errHashMismatch, oid, sum)
+		}
+	}
+	if err := os.Link(fromPath, destPath); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// reflinkToStore clones fromPath into the store via a copy-on-write reflink
+// at tempPath, then renames it into place at destPath.
+func reflinkToStore(oid, fromPath, tempPath, destPath string) error {
+	if verifyUploads {
+		sum, err := fileHash(fromPath)
+		if err != nil {
+			return fmt.Errorf("Cannot read data from %q: %w", fromPath, err)
+		}
+		if sum != oid {
+			return fmt.Errorf("%w for %q: content hashes to %v", errHashMismatch, oid, sum)
+		}
+	}
+	if err := util.Reflink(fromPath, tempPath); err != nil {
+		return err
+	}
+	if storeFileMode != 0 {
+		if err := os.Chmod(tempPath, storeFileMode); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+	}
+	if err := os.Rename(tempPath, destPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// dryRun makes uploads report what they would store without storing it.
+var dryRun bool
+
+// SetDryRun sets whether uploads only log where each object would be
+// stored, or that it would be skipped as already stored there, and report
+// success to git-lfs without writing anything: no store, LFS action, script
+// or rclone remote is written to, and no source file is moved. Downloads
+// are unaffected.
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+// dryRunPut is put in a dry run: it logs what uploading oid to b would do,
+// returning errAlreadyStored if it would be skipped.
+func dryRunPut(b Backend, oid, fromPath string, size int64, errWriter *bufio.Writer) error {
+	if _, err := os.Stat(fromPath); err != nil {
+		return fmt.Errorf("Cannot read data from %q: %w", fromPath, err)
+	}
+	if wouldSkip(b, oid, size) {
+		util.WriteToStderr(fmt.Sprintf("Dry run: %s is already stored at %s\n", oid, describeBackend(b, oid)), errWriter)
+		return errAlreadyStored
+	}
+	util.WriteToStderr(fmt.Sprintf("Dry run: would upload %s to %s\n", oid, describeBackend(b, oid)), errWriter)
+	return nil
+}
+
+// wouldSkip reports whether an upload of oid to b would find it already
+// stored, looking without writing anything. Scripts and LFS actions can't
+// be asked, so are always assumed to need it.
+func wouldSkip(b Backend, oid string, size int64) bool {
+	switch b := b.(type) {
+	case *dirBackend:
+		return b.alreadyStored(storagePath(b.dir, oid)+compressionExt(b.compression), oid, size)
+	case *rcloneBackend:
+		if b.compression != "none" {
+			return false
+		}
+		stored, ok := rcloneListings.stat(storagePath(b.remote, oid), oid)
+		return ok && stored == size
+	case statBackend:
+		stored, err := b.stat(oid)
+		return err == nil && stored == size
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunUpload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	SetDryRun(true)
+	defer SetDryRun(false)
+	SetMoveUploads(true)
+	defer SetMoveUploads(false)
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	count := installListingRclone(t)
+
+	// The first object is already stored
+	stored := setup.files[0]
+	content, err := ioutil.ReadFile(stored.path)
+	assert.Nil(t, err)
+	storedPath := storagePath(setup.remotepath, stored.oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(storedPath), 0755))
+	assert.Nil(t, ioutil.WriteFile(storedPath, content, 0644))
+
+	ran := filepath.Join(setup.localpath, "ran")
+	bases := []string{
+		setup.remotepath,
+		"dummy:" + setup.remotepath,
+		fmt.Sprintf("|touch %s; cp \"$FROM\" %s/$OID", ran, setup.remotepath),
+	}
+	for _, base := range bases {
+		var stdout, stderr bytes.Buffer
+		assert.Nil(t, Serve(base, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr), base)
+		for _, file := range setup.files {
+			assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`, base)
+			assert.Contains(t, stdout.String(), `{"event":"progress","oid":"`+file.oid+`","bytesSoFar":`+fmt.Sprint(file.size), base)
+			assert.FileExists(t, file.path, "the source is kept")
+		}
+		assert.Contains(t, stderr.String(), "Dry run: would upload "+setup.files[1].oid, base)
+		if base[0] != '|' {
+			assert.Contains(t, stderr.String(), "Dry run: "+stored.oid+" is already stored", base)
+		}
+	}
+
+	// Nothing was written to the store, rclone only listed it, and the
+	// script never ran
+	var files []string
+	filepath.Walk(setup.remotepath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	assert.Equal(t, []string{storedPath}, files)
+	for command := range count() {
+		assert.Equal(t, "lsjson", command)
+	}
+	assert.NoFileExists(t, ran)
+}
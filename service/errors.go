@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"syscall"
+)
+
+// Transfer error codes for failures of a known kind, following the HTTP
+// statuses the git-lfs batch API uses for the same problems. Failures of
+// other kinds keep the code of the step that failed.
+const (
+	codeForbidden   = 403 // permission denied reading or writing a store
+	codeNotFound    = 404 // the object isn't in any store
+	codeCancelled   = 499 // the transfer was cancelled or interrupted
+	codeCorrupt     = 422 // the content doesn't hash to the OID
+	codeUnavailable = 503 // a remote store couldn't be reached
+	codeTimeout     = 504 // a remote store didn't answer in time
+	codeNoSpace     = 507 // a store or the temp dir is out of space
+)
+
+// Transfer error codes for problems the adapter finds with the session or
+// the request itself, before any store is tried.
+const (
+	codeNoBaseDir    = 9  // no base directory is configured (at init)
+	codeAccessMode   = 30 // the adapter is read-only or write-only
+	codeUnknownEvent = 31 // git-lfs sent an event the adapter doesn't know
+	codeNotWritable  = 32 // the push destinations aren't writable (at init)
+	codeInvalidOid   = 33 // the OID isn't a lowercase hex --oid-hash digest
+	codeUnexpected   = 34 // an unexpected error, such as a bug in the adapter
+)
+
+// errNotFound, errHashMismatch and errNoSpace are wrapped by the errors
+// backends return for missing objects, corrupt content and full disks.
+var (
+	errNotFound     = errors.New("not found")
+	errHashMismatch = errors.New("hash mismatch")
+	errNoSpace      = errors.New("insufficient space")
+)
+
+// ErrTransfersFailed is wrapped by the error Serve returns when any of the
+// session's transfers failed, and ErrInitFailed when git-lfs was told the
+// session couldn't start.
+var (
+	ErrTransfersFailed = errors.New("transfer(s) failed")
+	ErrInitFailed      = errors.New("session failed to initialise")
+)
+
+// httpStatusError is returned for an HTTP response with an error status.
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return "http error: " + e.status
+}
+
+// errorCode returns the transfer error code for err, or fallback if it
+// isn't of a kind with a code of its own.
+func errorCode(err error, fallback int) int {
+	// S3 and HTTP errors carry the status of the response
+	var status interface{ HTTPStatusCode() int }
+	var httpErr *httpStatusError
+	code := 0
+	if errors.As(err, &httpErr) {
+		code = httpErr.code
+	} else if errors.As(err, &status) {
+		code = status.HTTPStatusCode()
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errHashMismatch):
+		return codeCorrupt
+	case errors.Is(err, errNotFound), errors.Is(err, fs.ErrNotExist), code == 404, code == 410:
+		return codeNotFound
+	case errors.Is(err, fs.ErrPermission), code == 401, code == 403:
+		return codeForbidden
+	case errors.Is(err, errNoSpace), errors.Is(err, syscall.ENOSPC):
+		return codeNoSpace
+	case errors.Is(err, context.Canceled), errors.Is(err, errShuttingDown):
+		return codeCancelled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return codeTimeout
+	case errors.As(err, &netErr), errors.Is(err, syscall.ECONNREFUSED), code == 429, code >= 500:
+		return codeUnavailable
+	}
+	return fallback
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("object %w", errNotFound), codeNotFound},
+		{&fs.PathError{Op: "open", Path: "x", Err: fs.ErrNotExist}, codeNotFound},
+		{&httpStatusError{404, "404 Not Found"}, codeNotFound},
+		{fmt.Errorf("Cannot create dir: %w", &fs.PathError{Op: "mkdir", Path: "x", Err: syscall.EACCES}), codeForbidden},
+		{&httpStatusError{403, "403 Forbidden"}, codeForbidden},
+		{fmt.Errorf("%w for %q", errHashMismatch, "oid"), codeCorrupt},
+		{fmt.Errorf("write: %w", syscall.ENOSPC), codeNoSpace},
+		{context.Canceled, codeCancelled},
+		{context.DeadlineExceeded, codeTimeout},
+		{&httpStatusError{502, "502 Bad Gateway"}, codeUnavailable},
+		{fmt.Errorf("something else"), 20},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, errorCode(tt.err, 20), tt.err.Error())
+	}
+}
+
+func TestDownloadErrorCodes(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// One object is corrupt in the store, another is in a store that
+	// refuses access, and a third isn't anywhere
+	corrupt := setup.files[0]
+	assert.Nil(t, os.WriteFile(corrupt.path, bytes.Repeat([]byte{0}, int(corrupt.size)), 0644))
+	forbidden, missing := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, forbidden) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	forbiddenDir := filepath.Join(setup.remotepath, "empty")
+	assert.Nil(t, os.Mkdir(forbiddenDir, 0755))
+
+	codes := func(baseDir string, oids ...string) map[string]int {
+		var input bytes.Buffer
+		initDownload(&input)
+		for _, oid := range oids {
+			size := int64(10)
+			if oid == corrupt.oid {
+				size = corrupt.size
+			}
+			addDownload(t, &input, oid, size)
+		}
+		finishDownload(&input)
+		var stdout, stderr bytes.Buffer
+		Serve(baseDir, "", false, false, false, &input, &stdout, &stderr)
+		codes := make(map[string]int)
+		for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+			var resp api.TransferResponse
+			if json.Unmarshal([]byte(line), &resp) == nil && resp.Error != nil {
+				codes[resp.Oid] = resp.Error.Code
+			}
+		}
+		return codes
+	}
+
+	got := codes(setup.remotepath, corrupt.oid, missing)
+	assert.Equal(t, codeCorrupt, got[corrupt.oid])
+	assert.Equal(t, codeNotFound, got[missing])
+	got = codes(forbiddenDir+";"+server.URL, forbidden)
+	assert.Equal(t, codeForbidden, got[forbidden])
+}
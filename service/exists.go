@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// BackendInfo describes where an object is held and in what form.
+type BackendInfo struct {
+	// Backend is the human-readable provider name, as used in progress output.
+	Backend string `json:"backend"`
+	// Path is the base path of the provider holding the object.
+	Path string `json:"path"`
+	// Compression is the compression mode of the stored object.
+	Compression string `json:"compression"`
+	// Size is the stored (possibly compressed) size in bytes.
+	Size int64 `json:"size"`
+}
+
+// Exists reports which of the given OIDs are already present in the stores
+// described by baseDir, using the same syntax as the download path. Providers
+// are checked in order and the first match wins. Local stores are queried with
+// a stat per object, S3 buckets and web servers with a HEAD request per object
+// and each rclone remote with a single recursive listing.
+// Script providers cannot be queried and are skipped. OIDs that are not found
+// are absent from the result, as are malformed ones.
+func Exists(baseDir string, oids []string) map[string]BackendInfo {
+	found := make(map[string]BackendInfo)
+	for _, d := range splitBaseDirs(baseDir) {
+		if d.script {
+			continue
+		}
+		if len(found) == len(oids) {
+			break
+		}
+		ext := compressionExt(d.compression)
+		if sb, ok := newBackend(d).(statBackend); ok {
+			for _, oid := range oids {
+				if _, ok := found[oid]; ok || checkOid(oid) != nil {
+					continue
+				}
+				if size, err := sb.stat(oid); err == nil {
+					found[oid] = BackendInfo{tierName(d), d.path, d.compression, size}
+				}
+			}
+			continue
+		}
+		if util.IsRclonePath(d.path) {
+			sizes, err := listRclone(d.path)
+			if err != nil {
+				continue
+			}
+			for _, oid := range oids {
+				if _, ok := found[oid]; ok || checkOid(oid) != nil {
+					continue
+				}
+				rel := filepath.ToSlash(storagePath("", oid)) + ext
+				if size, ok := sizes[rel]; ok {
+					found[oid] = BackendInfo{tierName(d), d.path, d.compression, size}
+				}
+			}
+			continue
+		}
+		for _, oid := range oids {
+			if _, ok := found[oid]; ok || checkOid(oid) != nil {
+				continue
+			}
+			p := storagePath(d.path, oid)
+			if stat, err := os.Stat(p + ext); err == nil && stat.Mode().IsRegular() {
+				found[oid] = BackendInfo{tierName(d), d.path, d.compression, stat.Size()}
+			} else if stat, err := os.Stat(p); ext != "" && err == nil && stat.Mode().IsRegular() {
+				// Uploads that didn't compress are stored as they are
+				found[oid] = BackendInfo{tierName(d), d.path, "none", stat.Size()}
+			}
+		}
+	}
+	return found
+}
+
+// listRclone returns the size of every file below an rclone remote, keyed by
+// slash-separated path relative to the remote.
+func listRclone(remote string) (map[string]int64, error) {
+	if d := rcd; d != nil {
+		return d.list(remote)
+	}
+	release := acquireRclone()
+	defer release()
+	cmd := rcloneCommand("lsjson", "-R", "--files-only", remote)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Path string `json:"Path"`
+		Size int64  `json:"Size"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		sizes[e.Path] = e.Size
+	}
+	return sizes, nil
+}
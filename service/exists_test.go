@@ -0,0 +1,62 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExists(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	emptyDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-empty")
+	assert.Nil(t, err)
+	defer os.RemoveAll(emptyDir)
+
+	missing := "0000000000000000000000000000000000000000000000000000000000000000"
+	oids := []string{missing}
+	for _, file := range setup.files {
+		oids = append(oids, file.oid)
+	}
+
+	found := Exists(emptyDir+";"+setup.remotepath, oids)
+
+	assert.Len(t, found, len(setup.files))
+	assert.NotContains(t, found, missing)
+	for _, file := range setup.files {
+		info, ok := found[file.oid]
+		assert.True(t, ok)
+		assert.Equal(t, setup.remotepath, info.Path)
+		assert.Equal(t, "local cache", info.Backend)
+		assert.Equal(t, "none", info.Compression)
+		assert.Equal(t, file.size, info.Size)
+	}
+}
+
+func TestExistsRclone(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"lsjson\" ] && [ \"$2\" = \"-R\" ]; then\n  cd \"${4#*:}\" || exit 1\n  printf '['\n  sep=''\n  find . -type f | while read -r f; do\n    printf '%s{\"Path\":\"%s\",\"Size\":%s}' \"$sep\" \"${f#./}\" \"$(stat -c %s \"$f\")\"\n    sep=','\n  done\n  printf ']\\n'\nelse\n  exit 1\nfi\n"
+	installFakeRclone(t, scriptContent)
+
+	var oids []string
+	for _, file := range setup.files {
+		oids = append(oids, file.oid)
+	}
+
+	found := Exists("dummy:"+setup.remotepath, oids)
+
+	assert.Len(t, found, len(setup.files))
+	for _, file := range setup.files {
+		info, ok := found[file.oid]
+		assert.True(t, ok)
+		assert.Equal(t, "dummy", info.Backend)
+		assert.Equal(t, file.size, info.Size)
+	}
+}
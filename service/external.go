@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// compressCmd and decompressCmd are the commands of the "external"
+// compression mode.
+var compressCmd, decompressCmd string
+
+// SetExternalCompression sets the commands stores with the "external"
+// compression mode pipe objects through: compress when uploading, and
+// decompress when downloading. Each is run through the script shell, reading
+// the object on stdin and writing it transformed to stdout, and objects are
+// stored with a ".z" extension.
+func SetExternalCompression(compress, decompress string) {
+	compressCmd, decompressCmd = compress, decompress
+}
+
+// externalCommand returns the process running command, with its stderr kept
+// for error messages.
+func externalCommand(command string) (*exec.Cmd, *cappedBuffer) {
+	args := shellCommand(command)
+	cmd := util.NewCmd(args[0], args[1:]...)
+	stderr := &cappedBuffer{}
+	cmd.Stderr = stderr
+	return cmd, stderr
+}
+
+// externalError describes the failure of command, with what it wrote to
+// stderr.
+func externalError(command string, err error, stderr *cappedBuffer) error {
+	if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+		return fmt.Errorf("%q failed: %v: %v", command, err, msg)
+	}
+	return fmt.Errorf("%q failed: %v", command, err)
+}
+
+// compressExternal pipes src through the compress command into dst,
+// reporting the bytes fed to it to cb.
+func compressExternal(src io.Reader, dst io.Writer, size int64, cb copyCallback) error {
+	if compressCmd == "" {
+		return errors.New("external compression needs --compress-cmd")
+	}
+	cmd, stderr := externalCommand(compressCmd)
+	cmd.Stdout = dst
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return externalError(compressCmd, err, stderr)
+	}
+	copyErr := copyData(size, src, stdin, cb)
+	stdin.Close()
+	// A command that exits early breaks the pipe; its own error says why
+	if err := cmd.Wait(); err != nil {
+		return externalError(compressCmd, err, stderr)
+	}
+	return copyErr
+}
+
+// externalStream reads the output of the decompress command fed with an
+// object. Failure of the command is reported by Read in place of io.EOF.
+type externalStream struct {
+	cmd    *exec.Cmd
+	stderr *cappedBuffer
+	out    io.ReadCloser
+	src    io.Closer
+	done   bool
+	err    error
+}
+
+// decompressExternal returns a reader over rc piped through the decompress
+// command. Closing it closes rc.
+func decompressExternal(rc io.ReadCloser) (io.ReadCloser, error) {
+	if decompressCmd == "" {
+		rc.Close()
+		return nil, errors.New("external compression needs --decompress-cmd")
+	}
+	cmd, stderr := externalCommand(decompressCmd)
+	cmd.Stdin = rc
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		rc.Close()
+		return nil, externalError(decompressCmd, err, stderr)
+	}
+	return &externalStream{cmd: cmd, stderr: stderr, out: out, src: rc}, nil
+}
+
+func (s *externalStream) Read(p []byte) (int, error) {
+	n, err := s.out.Read(p)
+	if err == io.EOF {
+		if werr := s.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (s *externalStream) Close() error {
+	// A command still writing stops on the closed pipe
+	s.out.Close()
+	err := s.wait()
+	s.src.Close()
+	return err
+}
+
+func (s *externalStream) wait() error {
+	if !s.done {
+		s.done = true
+		if err := s.cmd.Wait(); err != nil {
+			s.err = externalError(decompressCmd, err, s.stderr)
+		}
+	}
+	return s.err
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExternalCompression(t *testing.T) {
+	SetExternalCompression("gzip -c", "gunzip -c")
+	defer SetExternalCompression("", "")
+
+	upload := setupUploadTest(t)
+	defer os.RemoveAll(upload.localpath)
+	defer os.RemoveAll(upload.remotepath)
+
+	base := "--compression=external " + upload.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(upload.inputBuffer.Bytes()), &stdout, &stderr)
+	for _, file := range upload.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		// Stored by the command, so readable by gzip itself
+		f, err := os.Open(storagePath(upload.remotepath, file.oid) + ".z")
+		if assert.Nil(t, err) {
+			gr, err := gzip.NewReader(f)
+			assert.Nil(t, err)
+			content, err := ioutil.ReadAll(gr)
+			assert.Nil(t, err)
+			sum := sha256.Sum256(content)
+			assert.Equal(t, file.oid, hex.EncodeToString(sum[:]))
+			f.Close()
+		}
+		assert.NoFileExists(t, storagePath(upload.remotepath, file.oid))
+	}
+
+	download := setupDownloadTest(t)
+	defer os.RemoveAll(download.localpath)
+	defer os.RemoveAll(download.remotepath)
+	for _, file := range download.files {
+		p := storagePath(download.remotepath, file.oid)
+		content, err := ioutil.ReadFile(p)
+		assert.Nil(t, err)
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(content)
+		gw.Close()
+		assert.Nil(t, ioutil.WriteFile(p+".z", buf.Bytes(), 0644))
+		assert.Nil(t, os.Remove(p))
+	}
+
+	base = "--compression=external " + download.remotepath
+	stdout.Reset()
+	stderr.Reset()
+	Serve(base, base, false, false, false, bytes.NewReader(download.inputBuffer.Bytes()), &stdout, &stderr)
+	paths := completionPaths(t, stdout.String())
+	for _, file := range download.files {
+		tempPath, ok := paths[file.oid]
+		if assert.True(t, ok) {
+			assert.Equal(t, file.oid, calculateFileHash(t, tempPath))
+		}
+		assert.Contains(t, stdout.String(), `{"event":"progress","oid":"`+file.oid+`"`)
+	}
+}
+
+func TestExternalCompressionFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := &dirBackend{dir: dir, compression: "external"}
+	content, oid := testObject()
+
+	// Without commands nothing is stored
+	SetExternalCompression("", "")
+	err = b.Put(oid, bytes.NewReader(content), int64(len(content)))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "--compress-cmd")
+	}
+
+	// A failing command fails the transfer, with what it said
+	SetExternalCompression("gzip -c", "echo broken >&2; exit 3")
+	defer SetExternalCompression("", "")
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	rc, err := b.Get(oid, int64(len(content)))
+	if assert.Nil(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "broken")
+		}
+		rc.Close()
+	}
+}
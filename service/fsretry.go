@@ -0,0 +1,96 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"time"
+)
+
+// fsRetries is how many times a store step is retried after a transient
+// filesystem error, such as a busy file on a network share.
+var fsRetries = 3
+
+// SetFSRetries sets the number of retries for transient filesystem errors
+// when storing to a directory. Negative values are treated as zero.
+func SetFSRetries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	fsRetries = n
+}
+
+// fsRetryDelay is the wait before the first retry; it doubles each time.
+var fsRetryDelay = 100 * time.Millisecond
+
+// fileSystem is the set of filesystem operations dirBackend stores through,
+// so tests can inject failures.
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	// Sync flushes f's content to stable storage.
+	Sync(f *os.File) error
+	// SyncDir flushes the directory entries of dir, making renames into it
+	// durable where the platform supports it.
+	SyncDir(dir string) error
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) Sync(f *os.File) error {
+	return f.Sync()
+}
+
+func (osFileSystem) SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Directories can't be opened for syncing; NTFS journals renames
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var storeFS fileSystem = osFileSystem{}
+
+// isTransientFSError reports whether err wraps one of the platform's
+// retryableFSErrors. Errors such as a full disk or denied access are not
+// transient and fail immediately.
+func isTransientFSError(err error) bool {
+	for _, target := range retryableFSErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryFS runs op, running it again up to fsRetries times with a doubling
+// delay while it fails with a transient filesystem error.
+func retryFS(op func() error) error {
+	delay := fsRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= fsRetries || !isTransientFSError(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
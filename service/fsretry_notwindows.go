@@ -0,0 +1,8 @@
+//go:build !windows
+
+package service
+
+import "syscall"
+
+// retryableFSErrors are the errors treated as transient by retryFS.
+var retryableFSErrors = []error{syscall.EBUSY, syscall.EAGAIN, syscall.EINTR, syscall.ETXTBSY}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyFS fails the first renames and opens with the given errors.
+type flakyFS struct {
+	osFileSystem
+	renameErrs  []error
+	openErrs    []error
+	renameCalls int
+	openCalls   int
+}
+
+func (f *flakyFS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f.openCalls++
+	if len(f.openErrs) > 0 {
+		err := f.openErrs[0]
+		f.openErrs = f.openErrs[1:]
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f.osFileSystem.OpenFile(name, flag, perm)
+}
+
+func (f *flakyFS) Rename(oldpath, newpath string) error {
+	f.renameCalls++
+	if len(f.renameErrs) > 0 {
+		err := f.renameErrs[0]
+		f.renameErrs = f.renameErrs[1:]
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return f.osFileSystem.Rename(oldpath, newpath)
+}
+
+func TestDirStoreRetriesTransientErrors(t *testing.T) {
+	if len(retryableFSErrors) == 0 {
+		t.Skip("no transient errors on this platform")
+	}
+	transient := retryableFSErrors[0]
+	defer func(fs fileSystem, d time.Duration) { storeFS, fsRetryDelay = fs, d }(storeFS, fsRetryDelay)
+	fsRetryDelay = time.Millisecond
+
+	content, oid := testObject()
+	newStore := func() (*dirBackend, func()) {
+		dir, err := ioutil.TempDir("", "fsretry")
+		assert.Nil(t, err)
+		return &dirBackend{dir: dir, compression: "none"}, func() { os.RemoveAll(dir) }
+	}
+
+	// A rename that fails once then succeeds
+	fs := &flakyFS{renameErrs: []error{transient}}
+	storeFS = fs
+	b, cleanup := newStore()
+	defer cleanup()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Equal(t, 2, fs.renameCalls)
+	data, err := ioutil.ReadFile(storagePath(b.dir, oid))
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+
+	// A temp file that can't be created at first
+	fs = &flakyFS{openErrs: []error{transient, transient}}
+	storeFS = fs
+	b, cleanup = newStore()
+	defer cleanup()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Equal(t, 3, fs.openCalls)
+
+	// Retries are bounded
+	fs = &flakyFS{renameErrs: []error{transient, transient, transient, transient, transient}}
+	storeFS = fs
+	b, cleanup = newStore()
+	defer cleanup()
+	assert.NotNil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Equal(t, fsRetries+1, fs.renameCalls)
+	assert.NoFileExists(t, storagePath(b.dir, oid)+".tmp")
+
+	// Permanent errors fail straight away
+	fs = &flakyFS{renameErrs: []error{syscall.ENOSPC}}
+	storeFS = fs
+	b, cleanup = newStore()
+	defer cleanup()
+	assert.NotNil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Equal(t, 1, fs.renameCalls)
+}
+
+func TestSetFSRetries(t *testing.T) {
+	defer SetFSRetries(3)
+	SetFSRetries(-1)
+	assert.Equal(t, 0, fsRetries)
+	SetFSRetries(5)
+	assert.Equal(t, 5, fsRetries)
+}
+
+// syncRecordingFS records the files and directories synced through it.
+type syncRecordingFS struct {
+	osFileSystem
+	syncedFiles []string
+	syncedDirs  []string
+}
+
+func (f *syncRecordingFS) Sync(file *os.File) error {
+	f.syncedFiles = append(f.syncedFiles, file.Name())
+	return f.osFileSystem.Sync(file)
+}
+
+func (f *syncRecordingFS) SyncDir(dir string) error {
+	f.syncedDirs = append(f.syncedDirs, dir)
+	return f.osFileSystem.SyncDir(dir)
+}
+
+func TestDirStoreDurableWrites(t *testing.T) {
+	defer func(fs fileSystem) { storeFS = fs }(storeFS)
+	defer SetDurableWrites(true)
+
+	content, oid := testObject()
+	for _, durable := range []bool{true, false} {
+		dir, err := ioutil.TempDir("", "durable")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		SetDurableWrites(durable)
+		fs := &syncRecordingFS{}
+		storeFS = fs
+		b := &dirBackend{dir: dir, compression: "none"}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+		destPath := storagePath(dir, oid)
+		if durable {
+			assert.Equal(t, []string{destPath + ".tmp"}, fs.syncedFiles, "temp file should be synced before the rename")
+			assert.Equal(t, []string{filepath.Dir(destPath)}, fs.syncedDirs)
+		} else {
+			assert.Empty(t, fs.syncedFiles)
+			assert.Empty(t, fs.syncedDirs)
+		}
+	}
+}
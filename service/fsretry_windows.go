@@ -0,0 +1,10 @@
+package service
+
+import "syscall"
+
+// retryableFSErrors are the errors treated as transient by retryFS: files
+// held open or locked by another process, common on SMB shares.
+var retryableFSErrors = []error{
+	syscall.Errno(32), // ERROR_SHARING_VIOLATION
+	syscall.Errno(33), // ERROR_LOCK_VIOLATION
+}
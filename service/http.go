@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// httpBackend reads objects from a plain web server ("https://host/lfs")
+// laid out like a local store. It is read-only; uploads fall through to the
+// next provider.
+type httpBackend struct {
+	reporter
+	base        string
+	compression string
+}
+
+func (b *httpBackend) withReporter(r reporter) Backend {
+	c := *b
+	c.reporter = r
+	return &c
+}
+
+// url returns the location of oid, matching storagePath.
+func (b *httpBackend) url(oid string) string {
+	return strings.TrimRight(b.base, "/") + "/" + filepath.ToSlash(storagePath("", oid)) + compressionExt(b.compression)
+}
+
+// stat returns the stored size of oid from a HEAD request.
+func (b *httpBackend) stat(oid string) (int64, error) {
+	req, err := http.NewRequestWithContext(b.context(), "HEAD", b.url(oid), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("http error: %v", resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+func (b *httpBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(b.context(), "GET", b.url(oid), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	return decompressStream(b.compression, resp.Body, resp.ContentLength, oid)
+}
+
+func (b *httpBackend) Put(oid string, r io.Reader, size int64) error {
+	return fmt.Errorf("%v is read-only", b.base)
+}
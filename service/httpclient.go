@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// httpRetries is how many times an idempotent request is retried after a network
+// error, a 5xx or a 429 response.
+var httpRetries = 3
+
+// SetHTTPRetries sets the number of retries for HTTP transfers. Negative
+// values are treated as zero.
+func SetHTTPRetries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	httpRetries = n
+}
+
+// defaultHTTPTimeout bounds each HTTP request, including reading the body.
+const defaultHTTPTimeout = 10 * time.Minute
+
+// httpClient is used for all HTTP transfers.
+var httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+
+// SetHTTPTimeout sets the time limit for each HTTP request, including reading
+// the response body. Zero removes the limit.
+func SetHTTPTimeout(d time.Duration) {
+	httpClient = &http.Client{Timeout: d, Transport: httpClient.Transport}
+}
+
+// SetHTTPTransport configures how HTTP transfers connect. A non-empty proxy
+// URL is used for every request in place of the HTTPS_PROXY / HTTP_PROXY
+// environment variables, which are honoured otherwise. caCert names a PEM
+// file of certificate authorities to trust in addition to the system ones.
+// insecure disables certificate verification altogether.
+func SetHTTPTransport(proxy, caCert string, insecure bool) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q", proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if caCert != "" || insecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+		if caCert != "" {
+			pem, err := os.ReadFile(caCert)
+			if err != nil {
+				return fmt.Errorf("unable to read CA certificates: %v", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %q", caCert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	httpClient = &http.Client{Timeout: httpClient.Timeout, Transport: transport}
+	return nil
+}
+
+// retryBaseDelay is the backoff before the first retry; it doubles on each
+// subsequent attempt up to retryMaxDelay.
+var retryBaseDelay = 500 * time.Millisecond
+
+const retryMaxDelay = 30 * time.Second
+
+// getWithRetry sends a GET request, retrying transient failures as
+// doWithRetry does.
+func getWithRetry(req *http.Request) (*http.Response, error) {
+	return doWithRetry(req.Context(), func() (*http.Request, error) {
+		return req, nil
+	})
+}
+
+// doWithRetry sends the request built by newRequest, retrying network errors,
+// 5xx and 429 responses with exponential backoff and jitter. It must only be
+// used for idempotent requests. newRequest is called for every attempt so
+// requests with a body can supply a fresh one. A Retry-After header from the
+// server takes precedence over the computed delay. Other 4xx responses are
+// not retried. On success the response has a 2xx status and the caller must
+// close its body. Cancelling ctx stops any further attempts.
+func doWithRetry(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		var wait time.Duration
+		if err == nil {
+			resp.Body.Close()
+			err = &httpStatusError{resp.StatusCode, resp.Status}
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return nil, err
+			}
+			wait = retryAfter(resp)
+		}
+		if attempt >= httpRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		if wait == 0 {
+			// Full jitter over the upper half of the window so concurrent
+			// transfers don't retry in lockstep
+			wait = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		}
+		if wait > retryMaxDelay {
+			wait = retryMaxDelay
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// retryAfter returns the delay requested by a Retry-After header, given in
+// either seconds or as an HTTP date, or 0 if there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
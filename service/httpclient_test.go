@@ -0,0 +1,456 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+func TestActionDownloadRetry(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	content, oid := testObject()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write(content)
+		}
+	}))
+	defer server.Close()
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	b := &actionBackend{action: &api.Action{Href: server.URL}}
+	assert.Nil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Contains(t, completionPaths(t, stdout.String()), oid)
+}
+
+func TestHTTPRetryLimits(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	var calls int32
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	// Client errors other than 429 are final
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := getWithRetry(req)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Server errors are retried up to the configured count
+	SetHTTPRetries(2)
+	defer SetHTTPRetries(3)
+	atomic.StoreInt32(&calls, 0)
+	status = http.StatusBadGateway
+	_, err = getWithRetry(req)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	assert.Equal(t, time.Duration(0), retryAfter(resp))
+	resp.Header.Set("Retry-After", "2")
+	assert.Equal(t, 2*time.Second, retryAfter(resp))
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, retryAfter(resp) > 59*time.Minute)
+}
+
+// stallingServer sends half of content and then stalls until the client
+// goes away.
+func stallingServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	SetHTTPTimeout(100 * time.Millisecond)
+	defer SetHTTPTimeout(defaultHTTPTimeout)
+	SetHTTPRetries(0)
+	defer SetHTTPRetries(3)
+
+	content, oid := testObject()
+	server := stallingServer(content)
+	defer server.Close()
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	start := time.Now()
+	b := &actionBackend{action: &api.Action{Href: server.URL}}
+	assert.NotNil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+	assert.True(t, time.Since(start) < 5*time.Second, "request should time out")
+
+	// The partial action download is kept, holding only what was received,
+	// so the next attempt can resume it
+	tempPath, err := downloadTempPath(gitDir, oid)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(tempPath)
+	assert.Nil(t, err)
+	assert.Equal(t, content[:len(data)], data)
+}
+
+func TestHTTPCancel(t *testing.T) {
+	SetHTTPTimeout(0)
+	defer SetHTTPTimeout(defaultHTTPTimeout)
+
+	content, oid := testObject()
+	server := stallingServer(content)
+	defer server.Close()
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	b := &httpBackend{base: server.URL, compression: "none"}
+	assert.NotNil(t, fetch(ctx, b, gitDir, oid, int64(len(content)), writer, errWriter))
+	assert.True(t, time.Since(start) < 5*time.Second, "cancel should abort the request")
+
+	tempPath, err := downloadTempPath(gitDir, oid)
+	assert.Nil(t, err)
+	assert.NoFileExists(t, tempPath)
+}
+
+func TestServeTerminateCancelsHTTP(t *testing.T) {
+	SetHTTPTimeout(0)
+	defer SetHTTPTimeout(defaultHTTPTimeout)
+	defer func(d time.Duration) { terminateGrace = d }(terminateGrace)
+	terminateGrace = 100 * time.Millisecond
+
+	content, oid := testObject()
+	server := stallingServer(content)
+	defer server.Close()
+
+	var input bytes.Buffer
+	initDownload(&input)
+	addDownload(t, &input, oid, int64(len(content)))
+	finishDownload(&input)
+
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	Serve(server.URL, "", false, false, false, &input, &stdout, &stderr)
+	assert.True(t, time.Since(start) < 5*time.Second, "terminate should cancel the stalled download")
+	assert.Contains(t, stdout.String(), `"error":{"code":499`)
+}
+
+func TestActionResume(t *testing.T) {
+	content := bytes.Repeat([]byte("resumable action content "), 1000)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	half := int64(len(content) / 2)
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantRange  string
+		wantServed int64
+	}{
+		{
+			name: "range supported",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+			},
+			wantRange:  fmt.Sprintf("bytes=%d-", half),
+			wantServed: int64(len(content)) - half,
+		},
+		{
+			name: "range ignored",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+			wantRange:  fmt.Sprintf("bytes=%d-", half),
+			wantServed: int64(len(content)),
+		},
+		{
+			name: "wrong range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+					w.WriteHeader(http.StatusPartialContent)
+				}
+				w.Write(content)
+			},
+			wantRange:  "",
+			wantServed: int64(len(content)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lastRange string
+			var served int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lastRange = r.Header.Get("Range")
+				cw := &countingWriter{ResponseWriter: w}
+				tt.handler(cw, r)
+				served = cw.n
+			}))
+			defer server.Close()
+
+			gitDir, err := ioutil.TempDir("", "gitdir")
+			assert.Nil(t, err)
+			defer os.RemoveAll(gitDir)
+			tempPath, err := downloadTempPath(gitDir, oid)
+			assert.Nil(t, err)
+			assert.Nil(t, ioutil.WriteFile(tempPath, content[:half], 0644))
+
+			var stdout, stderr bytes.Buffer
+			writer := bufio.NewWriter(&stdout)
+			errWriter := bufio.NewWriter(&stderr)
+
+			b := &actionBackend{action: &api.Action{Href: server.URL}}
+			assert.Nil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+			server.Close() // wait for the handler to finish counting
+			assert.Equal(t, tt.wantRange, lastRange)
+			assert.Equal(t, tt.wantServed, served)
+			data, err := ioutil.ReadFile(tempPath)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data)
+			assert.Contains(t, completionPaths(t, stdout.String()), oid)
+		})
+	}
+}
+
+func TestActionResumeAfterInterruption(t *testing.T) {
+	defer func(n int) { httpRetries = n }(httpRetries)
+	httpRetries = 0
+
+	content := bytes.Repeat([]byte("interrupted action content "), 1000)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	half := len(content) / 2
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// Promise the whole object but drop the connection halfway
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:half])
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	b := &actionBackend{action: &api.Action{Href: server.URL}}
+	assert.NotNil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+	tempPath, _ := downloadTempPath(gitDir, oid)
+	stat, err := os.Stat(tempPath)
+	if assert.Nil(t, err, "partial download should be kept") {
+		assert.Equal(t, int64(half), stat.Size())
+	}
+
+	assert.Nil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+	data, err := ioutil.ReadFile(tempPath)
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+}
+
+// countingWriter counts the body bytes written to a response.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func TestActionUploadProgress(t *testing.T) {
+	// Report every block so streaming progress is visible
+	SetProgressInterval(0, 0)
+	defer SetProgressInterval(DefaultProgressInterval, 0)
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	content := bytes.Repeat([]byte("action upload content "), 20000)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var calls int32
+	var received []byte
+	var contentLength int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received, contentLength = data, r.ContentLength
+	}))
+	defer server.Close()
+
+	srcDir, err := ioutil.TempDir("", "src")
+	assert.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+	fromPath := filepath.Join(srcDir, "object")
+	assert.Nil(t, ioutil.WriteFile(fromPath, content, 0644))
+	storeDir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storeDir)
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	a := &api.Action{Href: server.URL}
+	store(context.Background(), newProviders(storeDir), oid, int64(len(content)), true, false, a, fromPath, writer, errWriter)
+	writer.Flush()
+	server.Close()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "failed PUT should be retried")
+	assert.Equal(t, content, received)
+	assert.Equal(t, int64(len(content)), contentLength)
+
+	// Progress arrives while the action upload streams, and the retry and
+	// the store to the folder don't count any byte twice
+	output := stdout.String()
+	var events int
+	var soFar, total int64
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		var resp api.ProgressResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err == nil && resp.Event == "progress" {
+			events++
+			assert.True(t, resp.BytesSoFar > soFar, "progress should only move forward")
+			soFar = resp.BytesSoFar
+			total += int64(resp.BytesSinceLast)
+		}
+	}
+	assert.True(t, events > 1, "expected streaming progress, got %d events", events)
+	assert.Equal(t, int64(len(content)), soFar)
+	assert.Equal(t, int64(len(content)), total)
+	assert.Contains(t, output, `"event":"complete"`)
+}
+
+func TestHTTPTransportCACert(t *testing.T) {
+	defer SetHTTPTransport("", "", false)
+
+	content, oid := testObject()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cacert")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(t, ioutil.WriteFile(certPath, certPEM, 0644))
+
+	download := func() error {
+		gitDir, err := ioutil.TempDir("", "gitdir")
+		assert.Nil(t, err)
+		defer os.RemoveAll(gitDir)
+		var stdout, stderr bytes.Buffer
+		writer := bufio.NewWriter(&stdout)
+		errWriter := bufio.NewWriter(&stderr)
+		b := &actionBackend{action: &api.Action{Href: server.URL + "/object"}}
+		return fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter)
+	}
+
+	assert.Nil(t, SetHTTPTransport("", "", false))
+	assert.NotNil(t, download(), "self-signed server should not be trusted by default")
+
+	assert.Nil(t, SetHTTPTransport("", certPath, false))
+	assert.Nil(t, download())
+
+	assert.Nil(t, SetHTTPTransport("", "", true))
+	assert.Nil(t, download())
+
+	assert.NotNil(t, SetHTTPTransport("", filepath.Join(dir, "missing.pem"), false))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "empty.pem"), []byte("not a cert"), 0644))
+	assert.NotNil(t, SetHTTPTransport("", filepath.Join(dir, "empty.pem"), false))
+}
+
+func TestHTTPTransportProxy(t *testing.T) {
+	defer SetHTTPTransport("", "", false)
+
+	content, oid := testObject()
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxy is sent the absolute URL of the origin
+		proxiedHost = r.URL.Host
+		w.Write(content)
+	}))
+	defer proxy.Close()
+
+	assert.NotNil(t, SetHTTPTransport("not a url", "", false))
+	assert.Nil(t, SetHTTPTransport(proxy.URL, "", false))
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	b := &actionBackend{action: &api.Action{Href: "http://lfs.example.invalid/object"}}
+	assert.Nil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+	proxy.Close()
+	assert.Equal(t, "lfs.example.invalid", proxiedHost)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// downloadGroup lets concurrent requests for the same OID share a single
+// download. The first request fetches the object while later ones wait for
+// it and are then given their own link or copy of the result, since git-lfs
+// moves each completed file into place separately.
+type downloadGroup struct {
+	mu       sync.Mutex
+	inflight map[string]*inflightDownload
+}
+
+// inflightDownload is the shared state of one download. Its result fields
+// are written by the leading request before done is closed.
+type inflightDownload struct {
+	done     chan struct{}
+	path     string
+	tier     string
+	location string
+	err      error
+	// sharing counts waiters still to take their copy of path, which the
+	// leader must not report complete until they have.
+	sharing sync.WaitGroup
+}
+
+func newDownloadGroup() *downloadGroup {
+	return &downloadGroup{inflight: make(map[string]*inflightDownload)}
+}
+
+// join returns the download of oid, and true if the caller is the first to
+// ask for it and so must perform the download and then call finish. Other
+// callers must wait on done and then call sharing.Done.
+func (g *downloadGroup) join(oid string) (*inflightDownload, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if d, ok := g.inflight[oid]; ok {
+		d.sharing.Add(1)
+		return d, false
+	}
+	d := &inflightDownload{done: make(chan struct{})}
+	g.inflight[oid] = d
+	return d, true
+}
+
+// finish publishes the leader's result to any waiters and returns once they
+// have taken their copies. Requests for oid after this start afresh.
+func (g *downloadGroup) finish(oid string, d *inflightDownload) {
+	g.mu.Lock()
+	delete(g.inflight, oid)
+	g.mu.Unlock()
+	close(d.done)
+	d.sharing.Wait()
+}
+
+// shareDownload gives a waiting request its own file with the content of
+// the leader's download at path, hardlinked where possible.
+func shareDownload(path, oid string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), oid+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	name := tmp.Name()
+	tmp.Close()
+	os.Remove(name)
+	if err := os.Link(path, name); err == nil {
+		return name, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(name)
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
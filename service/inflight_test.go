@@ -0,0 +1,152 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowBackend serves one object after a delay, counting the requests.
+type slowBackend struct {
+	content []byte
+	delay   time.Duration
+	gets    int32
+}
+
+func (b *slowBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&b.gets, 1)
+	time.Sleep(b.delay)
+	return ioutil.NopCloser(bytes.NewReader(b.content)), nil
+}
+
+func (b *slowBackend) Put(oid string, r io.Reader, size int64) error {
+	return nil
+}
+
+func TestConcurrentDownloadsShared(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	content, oid := testObject()
+	backend := &slowBackend{content: content, delay: 300 * time.Millisecond}
+	providers := []provider{{cfg: baseDirConfig{path: "slow"}, backend: backend}}
+	tracker := newDownloadTracker()
+	downloads := newDownloadGroup()
+
+	var wg sync.WaitGroup
+	outputs := make([]bytes.Buffer, 2)
+	for i := range outputs {
+		wg.Add(1)
+		go func(stdout *bytes.Buffer) {
+			defer wg.Done()
+			var stderr bytes.Buffer
+			writer := bufio.NewWriter(stdout)
+			errWriter := bufio.NewWriter(&stderr)
+			retrieve(context.Background(), providers, gitDir, oid, int64(len(content)), false, nil, tracker, downloads, writer, errWriter)
+		}(&outputs[i])
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.gets), "the object should only be fetched once")
+
+	// Each request gets its own complete file, as git-lfs moves each one
+	paths := make(map[string]bool)
+	for i := range outputs {
+		path, ok := completionPaths(t, outputs[i].String())[oid]
+		if assert.True(t, ok, "request %d should complete", i) {
+			paths[path] = true
+			data, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data)
+		}
+	}
+	assert.Len(t, paths, 2)
+	assert.Empty(t, downloads.inflight, "finished downloads should be forgotten")
+
+	// A later request fetches again
+	var stdout, stderr bytes.Buffer
+	retrieve(context.Background(), providers, gitDir, oid, int64(len(content)), false, nil, tracker, downloads, bufio.NewWriter(&stdout), bufio.NewWriter(&stderr))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&backend.gets))
+}
+
+func TestConcurrentDownloadsShareErrors(t *testing.T) {
+	downloads := newDownloadGroup()
+	d, leader := downloads.join("abc")
+	assert.True(t, leader)
+	waiter, leader := downloads.join("abc")
+	assert.False(t, leader)
+	assert.Equal(t, d, waiter)
+
+	d.err = io.ErrUnexpectedEOF
+	go func() {
+		<-waiter.done
+		assert.Equal(t, io.ErrUnexpectedEOF, waiter.err)
+		waiter.sharing.Done()
+	}()
+	downloads.finish("abc", d)
+
+	_, leader = downloads.join("abc")
+	assert.True(t, leader, "a failed download isn't remembered")
+}
+
+func TestDownloadTempNamesConcurrent(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	content := bytes.Repeat([]byte("concurrent download content "), 1000)
+	src := filepath.Join(gitDir, "src")
+	assert.Nil(t, ioutil.WriteFile(src, content, 0644))
+	oid := calculateFileHash(t, src)
+
+	// Attempts at the same object run at once: a script writing it slowly,
+	// one writing garbage before failing, and streamed copies, some of them
+	// wrong. Each writes a file of its own, so none spoils another.
+	good := &scriptBackend{script: fmt.Sprintf("head -c 1000 %[1]q > \"$DEST\"; sleep 0.3; tail -c +1001 %[1]q >> \"$DEST\"", src)}
+	bad := &scriptBackend{script: "for i in 1 2 3 4 5; do echo garbage >> \"$DEST\"; sleep 0.1; done; exit 1"}
+	backends := []Backend{good, bad, good,
+		&slowBackend{content: content, delay: 100 * time.Millisecond},
+		&slowBackend{content: bytes.Repeat([]byte("x"), len(content)), delay: 100 * time.Millisecond},
+	}
+	errs := make([]error, len(backends))
+	paths := make([]string, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b Backend) {
+			defer wg.Done()
+			w := bufio.NewWriter(ioutil.Discard)
+			paths[i], errs[i] = download(context.Background(), b, gitDir, oid, int64(len(content)), w, w)
+		}(i, b)
+	}
+	wg.Wait()
+
+	for _, i := range []int{0, 2, 3} {
+		if assert.Nil(t, errs[i], "%d", i) {
+			got, err := ioutil.ReadFile(paths[i])
+			assert.Nil(t, err)
+			assert.Equal(t, content, got)
+		}
+	}
+	assert.NotNil(t, errs[1])
+	assert.ErrorIs(t, errs[4], errHashMismatch)
+
+	// Only the finished object is left
+	entries, err := ioutil.ReadDir(filepath.Join(gitDir, "lfs", "tmp"))
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, oid+".tmp", entries[0].Name())
+	}
+}
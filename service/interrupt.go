@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// errShuttingDown is returned when a transfer tries to start writing a temp
+// file after its session has been cancelled.
+var errShuttingDown = errors.New("adapter is shutting down")
+
+// tempRegistry records the temp files transfers are writing, so they can be
+// removed if the session is cancelled before the transfers clean up.
+type tempRegistry struct {
+	mu      sync.Mutex
+	paths   map[string]int
+	keep    map[string]string
+	stopped bool
+}
+
+func newTempRegistry() *tempRegistry {
+	return &tempRegistry{paths: make(map[string]int), keep: make(map[string]string)}
+}
+
+// tempFiles records the temp files of transfers outside a session, such as
+// those run by Retrieve and Store.
+var tempFiles = newTempRegistry()
+
+type tempsKey struct{}
+
+// withTemps returns a copy of ctx whose transfers record their temp files in
+// r, so a session can remove just its own.
+func withTemps(ctx context.Context, r *tempRegistry) context.Context {
+	return context.WithValue(ctx, tempsKey{}, r)
+}
+
+// tempsFor returns the registry transfers under ctx record temp files in.
+func tempsFor(ctx context.Context) *tempRegistry {
+	if r, ok := ctx.Value(tempsKey{}).(*tempRegistry); ok {
+		return r
+	}
+	return tempFiles
+}
+
+// track records path as being written until the returned func is called. It
+// fails once the registry has been cleared, so no new temp files are started
+// while the session stops.
+func (r *tempRegistry) track(path string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil, errShuttingDown
+	}
+	r.paths[path]++
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.paths[path]--; r.paths[path] <= 0 {
+			delete(r.paths, path)
+		}
+	}, nil
+}
+
+// trackResumable is track for a temp file that is left in place when the
+// session is cancelled, so a later transfer can carry on from it.
+func (r *tempRegistry) trackResumable(path string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil, errShuttingDown
+	}
+	return func() {}, nil
+}
+
+// trackResumableAs is trackResumable for a temp file written under a name of
+// its own, which is moved back to resumePath if the session is cancelled so
+// a later transfer can find it there.
+func (r *tempRegistry) trackResumableAs(path, resumePath string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return nil, errShuttingDown
+	}
+	r.keep[path] = resumePath
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.keep, path)
+	}, nil
+}
+
+// removeAll removes every temp file still being written, moves resumable
+// ones back to where they'll be resumed from, and stops any more being
+// tracked. It returns the number of files removed.
+func (r *tempRegistry) removeAll() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	removed := 0
+	for path := range r.paths {
+		if err := os.Remove(path); err == nil {
+			removed++
+		}
+	}
+	for path, resumePath := range r.keep {
+		os.Rename(path, resumePath)
+	}
+	r.paths = make(map[string]int)
+	r.keep = make(map[string]string)
+	return removed
+}
+
+// contextReader fails reads once ctx is cancelled, so copies from sources
+// that don't watch the context themselves stop promptly.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
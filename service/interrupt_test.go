@@ -0,0 +1,214 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+func TestServeContextCancelKeepsResumableDownload(t *testing.T) {
+	SetHTTPTimeout(0)
+	defer SetHTTPTimeout(defaultHTTPTimeout)
+
+	var dirs [2]string
+	for i := range dirs {
+		d, err := ioutil.TempDir("", "gitdir")
+		assert.Nil(t, err)
+		defer os.RemoveAll(d)
+		dirs[i] = d
+	}
+	gitDir, empty := dirs[0], dirs[1]
+	SetGitDir(gitDir)
+	defer SetGitDir("")
+
+	content, oid := testObject()
+	server := stallingServer(content)
+	defer server.Close()
+
+	stdin, input := io.Pipe()
+	defer input.Close()
+	var stdout, stderr bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeContext(ctx, empty, "", true, false, false, stdin, &stdout, &stderr)
+	}()
+	fmt.Fprintln(input, `{ "event": "init", "operation": "download", "remote": "origin", "concurrent": true, "concurrenttransfers": 3 }`)
+	fmt.Fprintf(input, `{ "event": "download", "oid": "%v", "size": %d, "action": { "href": %q } }`+"\n", oid, len(content), server.URL)
+
+	// Wait for the download to be half written, under a name of its own
+	var partPath string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		matches, _ := filepath.Glob(filepath.Join(gitDir, "lfs", "tmp", oid+".*.tmp"))
+		if len(matches) == 1 {
+			if stat, err := os.Stat(matches[0]); err == nil && stat.Size() > 0 {
+				partPath = matches[0]
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.FileExists(t, partPath)
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context didn't stop the session")
+	}
+
+	// The bytes received are kept where the next download resumes from
+	assert.NoFileExists(t, partPath)
+	kept, err := ioutil.ReadFile(filepath.Join(gitDir, "lfs", "tmp", oid+".tmp"))
+	assert.Nil(t, err)
+	assert.Equal(t, content[:len(content)/2], kept)
+}
+
+func TestServeContextCancel(t *testing.T) {
+	SetHTTPTimeout(0)
+	defer SetHTTPTimeout(defaultHTTPTimeout)
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	SetGitDir(gitDir)
+	defer SetGitDir("")
+
+	content, oid := testObject()
+	server := stallingServer(content)
+	defer server.Close()
+
+	// git-lfs never closes stdin, so only the context can stop the session
+	stdin, input := io.Pipe()
+	defer input.Close()
+	var stdout, stderr bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeContext(ctx, server.URL, "", false, false, false, stdin, &stdout, &stderr)
+	}()
+	fmt.Fprintln(input, `{ "event": "init", "operation": "download", "remote": "origin", "concurrent": true, "concurrenttransfers": 3 }`)
+	fmt.Fprintf(input, `{ "event": "download", "oid": "%v", "size": %d }`+"\n", oid, len(content))
+
+	var tempPath string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		matches, _ := filepath.Glob(filepath.Join(gitDir, "lfs", "tmp", oid+".*.tmp"))
+		if len(matches) == 1 {
+			if stat, err := os.Stat(matches[0]); err == nil && stat.Size() > 0 {
+				tempPath = matches[0]
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.FileExists(t, tempPath)
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context didn't stop the session")
+	}
+	assert.NoFileExists(t, tempPath)
+	matches, _ := filepath.Glob(filepath.Join(gitDir, "lfs", "tmp", "*"))
+	assert.Empty(t, matches)
+	assert.NoFileExists(t, filepath.Join(gitDir, "lfs", "objects", oid[0:2], oid[2:4], oid))
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+oid+`","error":`)
+
+	// Temp files can still be written by later sessions
+	done, err := tempFiles.track(tempPath)
+	if assert.Nil(t, err) {
+		done()
+	}
+}
+
+func TestInterruptKeepsResumableDownload(t *testing.T) {
+	SetHTTPTimeout(0)
+	defer SetHTTPTimeout(defaultHTTPTimeout)
+	defer func() { tempFiles = newTempRegistry() }()
+
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	content, oid := testObject()
+	server := stallingServer(content)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	writer, errWriter := bufio.NewWriter(&stdout), bufio.NewWriter(&stderr)
+	b := &actionBackend{action: &api.Action{Href: server.URL}}
+	downloaded := make(chan error, 1)
+	go func() {
+		_, err := download(ctx, b, gitDir, oid, int64(len(content)), writer, errWriter)
+		downloaded <- err
+	}()
+
+	var partPath string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		matches, _ := filepath.Glob(filepath.Join(gitDir, "lfs", "tmp", oid+".*.tmp"))
+		if len(matches) == 1 {
+			if stat, err := os.Stat(matches[0]); err == nil && stat.Size() > 0 {
+				partPath = matches[0]
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.FileExists(t, partPath)
+
+	// The partial download is kept where the next attempt resumes from
+	assert.Equal(t, 0, tempFiles.removeAll())
+	assert.NoFileExists(t, partPath)
+	kept, err := ioutil.ReadFile(filepath.Join(gitDir, "lfs", "tmp", oid+".tmp"))
+	assert.Nil(t, err)
+	assert.Equal(t, content[:len(content)/2], kept)
+
+	cancel()
+	select {
+	case err := <-downloaded:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context didn't stop the download")
+	}
+}
+
+func TestDirPutCancelRemovesTemp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirbackend")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content, oid := testObject()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := (&dirBackend{dir: dir, compression: "none"}).withReporter(reporter{ctx: ctx})
+	// Part of the content arrives, then the rest a byte at a time once released
+	src := &gatedReader{r: iotest.OneByteReader(bytes.NewReader(content[10:])), started: make(chan struct{}), release: make(chan struct{})}
+	putErr := make(chan error, 1)
+	go func() { putErr <- b.Put(oid, io.MultiReader(bytes.NewReader(content[:10]), src), int64(len(content))) }()
+	<-src.started
+	cancel()
+	close(src.release)
+
+	assert.ErrorIs(t, <-putErr, context.Canceled)
+	assert.NoFileExists(t, storagePath(dir, oid))
+	assert.NoFileExists(t, storagePath(dir, oid)+".tmp")
+}
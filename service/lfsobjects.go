@@ -0,0 +1,58 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// lfsObjectsBackend reads objects from a git-lfs object store, such as
+// another repository's .git/lfs/objects, so repositories on one machine can
+// share objects. git-lfs always keeps them uncompressed as objects/ab/cd/<oid>
+// whatever the configured layout, and downloads there only once complete,
+// so its tmp and incomplete folders are never looked in. The store belongs
+// to the other repository, so nothing is ever written to it.
+type lfsObjectsBackend struct {
+	dir string
+}
+
+// newLfsObjectsBackend returns the backend for path: the objects folder
+// itself, or a repository or .git folder holding one.
+func newLfsObjectsBackend(path string) *lfsObjectsBackend {
+	for _, sub := range []string{filepath.Join("lfs", "objects"), filepath.Join(".git", "lfs", "objects")} {
+		dir := filepath.Join(path, sub)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return &lfsObjectsBackend{dir: dir}
+		}
+	}
+	return &lfsObjectsBackend{dir: path}
+}
+
+func (b *lfsObjectsBackend) path(oid string) string {
+	return layoutPath(b.dir, oid, DefaultShardDepth)
+}
+
+func (b *lfsObjectsBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	p := b.path(oid)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s %w", p, errNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() || (size > 0 && stat.Size() != size) {
+		f.Close()
+		return nil, fmt.Errorf("%s %w: it is %d bytes rather than %d", p, errNotFound, stat.Size(), size)
+	}
+	return &sizedReader{f, stat.Size()}, nil
+}
+
+func (b *lfsObjectsBackend) Put(oid string, r io.Reader, size int64) error {
+	return fmt.Errorf("%v is a git-lfs object store, which is read-only", b.dir)
+}
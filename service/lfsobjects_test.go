@@ -0,0 +1,84 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLfsObjectsBackend(t *testing.T) {
+	repo, err := ioutil.TempDir("", "lfsobjects")
+	assert.Nil(t, err)
+	defer os.RemoveAll(repo)
+	lfsDir := filepath.Join(repo, ".git", "lfs")
+
+	content, oid := testObject()
+	size := int64(len(content))
+	stored := filepath.Join(lfsDir, "objects", oid[0:2], oid[2:4], oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(stored), 0755))
+	assert.Nil(t, ioutil.WriteFile(stored, content, 0644))
+
+	// Objects git-lfs is still downloading are only in its own temp folders
+	other := []byte("still downloading")
+	sum := sha256.Sum256(other)
+	otherOid := hex.EncodeToString(sum[:])
+	for _, sub := range []string{"tmp", "incomplete"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(lfsDir, sub), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(lfsDir, sub, otherOid), other[:5], 0644))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(lfsDir, sub, oid+"-123"), content[:5], 0644))
+	}
+
+	// The repository, its .git folder and the objects folder all work
+	for _, path := range []string{repo, filepath.Join(repo, ".git"), filepath.Join(lfsDir, "objects")} {
+		cfgs := parseBaseDirs("--layout=lfs " + path)
+		if !assert.Len(t, cfgs, 1) {
+			continue
+		}
+		b, ok := newBackend(cfgs[0]).(*lfsObjectsBackend)
+		if !assert.True(t, ok, path) {
+			continue
+		}
+		assert.Equal(t, filepath.Join(lfsDir, "objects"), b.dir)
+		rc, err := b.Get(oid, size)
+		if assert.Nil(t, err) {
+			got, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			assert.Equal(t, content, got)
+		}
+		_, err = b.Get(otherOid, int64(len(other)))
+		assert.ErrorIs(t, err, errNotFound)
+		_, err = b.Get(oid, size+1)
+		assert.ErrorIs(t, err, errNotFound)
+		assert.NotNil(t, b.Put(otherOid, bytes.NewReader(other), int64(len(other))))
+	}
+
+	// With other stores, it is read and never written
+	fallback, err := ioutil.TempDir("", "lfsobjects-fallback")
+	assert.Nil(t, err)
+	defer os.RemoveAll(fallback)
+	base := "--layout=lfs " + repo + ";" + fallback
+	path, err := Retrieve(Config{PullBaseDir: base}, oid, size)
+	if assert.Nil(t, err) {
+		os.Remove(path)
+	}
+	src := filepath.Join(fallback, "src")
+	assert.Nil(t, ioutil.WriteFile(src, other, 0644))
+	assert.Nil(t, Store(Config{PullBaseDir: base}, otherOid, src))
+	assert.FileExists(t, storagePath(fallback, otherOid))
+	assert.NoFileExists(t, filepath.Join(lfsDir, "objects", otherOid[0:2], otherOid[2:4], otherOid))
+}
+
+func TestParseBaseDirOptions(t *testing.T) {
+	cfgs := parseBaseDirs("--compression=lz4 --layout=lfs /a;--layout=lfs --compression=zstd /b;--compression=gzip;/c")
+	if assert.Len(t, cfgs, 3) {
+		assert.Equal(t, baseDirConfig{path: "/a", compression: "lz4", layout: "lfs"}, cfgs[0])
+		assert.Equal(t, baseDirConfig{path: "/b", compression: "zstd", layout: "lfs"}, cfgs[1])
+		assert.Equal(t, baseDirConfig{path: "/c", compression: "none"}, cfgs[2])
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Config describes the stores Retrieve and Store transfer objects with, in
+// the same form Serve takes them.
+//
+// Every other option, such as compression, verification, retries, the
+// cache, the OID hash, mirroring and dry runs, is process-global and set
+// with the Set functions. Those apply to every transfer in the process, so
+// they must not be changed while transfers run, and Retrieve and Store
+// can't be used with different values of them at the same time.
+type Config struct {
+	// PullBaseDir lists the stores objects are downloaded from, in order
+	PullBaseDir string
+	// PushBaseDir lists the stores objects are uploaded to; empty uses
+	// PullBaseDir
+	PushBaseDir string
+	// WriteAll uploads to every push store instead of the first that works
+	WriteAll bool
+	// GitDir is the repository whose LFS temp area downloads are written to;
+	// empty writes them to the system temp dir
+	GitDir string
+	// Log receives the messages Serve writes to stderr; nil discards them
+	Log io.Writer
+}
+
+func (cfg Config) pullProviders() []provider {
+	return newProviders(cfg.PullBaseDir)
+}
+
+func (cfg Config) pushProviders() []provider {
+	if cfg.PushBaseDir == "" {
+		return newProviders(cfg.PullBaseDir)
+	}
+	return newProviders(cfg.PushBaseDir)
+}
+
+// writers returns the writers transfers report to: the protocol messages are
+// dropped, and the log goes to cfg.Log.
+func (cfg Config) writers() (*bufio.Writer, *bufio.Writer) {
+	log := cfg.Log
+	if log == nil {
+		log = ioutil.Discard
+	}
+	return bufio.NewWriter(ioutil.Discard), bufio.NewWriter(log)
+}
+
+// Retrieve downloads oid from the first of cfg's pull stores that has it,
+// as Serve does for a download request, and returns the path of the file it
+// was written to. The caller owns the file and should move or remove it. LFS
+// actions only exist during a git-lfs transfer, so "@main" entries are
+// passed over.
+func Retrieve(cfg Config, oid string, size int64) (string, error) {
+	if writeOnly {
+		return "", fmt.Errorf("cannot download %q: adapter is write-only", oid)
+	}
+	if err := checkOid(oid); err != nil {
+		return "", err
+	}
+	writer, errWriter := cfg.writers()
+	path, _, _, err := retrieveFile(context.Background(), cfg.pullProviders(), cfg.GitDir, oid, size, false, nil, writer, errWriter)
+	return path, err
+}
+
+// Store uploads the file at path as oid to cfg's push stores, as Serve does
+// for an upload request: to the first that works, or to all of them with
+// cfg.WriteAll. An object already stored is not an error.
+func Store(cfg Config, oid, path string) error {
+	if readOnly {
+		return fmt.Errorf("cannot upload %q: adapter is read-only", oid)
+	}
+	if err := checkOid(oid); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	writer, errWriter := cfg.writers()
+	return store(context.Background(), cfg.pushProviders(), oid, info.Size(), false, cfg.WriteAll, nil, path, writer, errWriter)
+}
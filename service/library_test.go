@@ -0,0 +1,74 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreAndRetrieve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pull := filepath.Join(dir, "pull")
+	push := filepath.Join(dir, "push")
+	assert.Nil(t, os.Mkdir(pull, 0755))
+	assert.Nil(t, os.Mkdir(push, 0755))
+
+	content, oid := testObject()
+	src := filepath.Join(dir, "src")
+	assert.Nil(t, ioutil.WriteFile(src, content, 0644))
+
+	var log bytes.Buffer
+	cfg := Config{PullBaseDir: push + ";" + pull, PushBaseDir: push, Log: &log}
+	assert.Nil(t, Store(cfg, oid, src))
+	assert.FileExists(t, storagePath(push, oid))
+	assert.NoFileExists(t, storagePath(pull, oid))
+	// Storing it again is fine
+	assert.Nil(t, Store(cfg, oid, src))
+	assert.Contains(t, log.String(), "already stored")
+
+	path, err := Retrieve(cfg, oid, int64(len(content)))
+	if assert.Nil(t, err) {
+		defer os.Remove(path)
+		got, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, content, got)
+	}
+
+	// Without push stores, uploads go to the pull stores
+	assert.Nil(t, Store(Config{PullBaseDir: pull}, oid, src))
+	assert.FileExists(t, storagePath(pull, oid))
+
+	// Failures are returned rather than reported
+	_, err = Retrieve(Config{PullBaseDir: filepath.Join(dir, "empty")}, oid, int64(len(content)))
+	assert.True(t, errors.Is(err, errNotFound) || errors.Is(err, os.ErrNotExist), "%v", err)
+	assert.NotNil(t, Store(cfg, oid, filepath.Join(dir, "missing")))
+}
+
+func TestStoreWriteAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	assert.Nil(t, os.Mkdir(a, 0755))
+	assert.Nil(t, os.Mkdir(b, 0755))
+
+	content, oid := testObject()
+	src := filepath.Join(dir, "src")
+	assert.Nil(t, ioutil.WriteFile(src, content, 0644))
+
+	assert.Nil(t, Store(Config{PullBaseDir: a + ";" + b, WriteAll: true}, oid, src))
+	assert.FileExists(t, storagePath(a, oid))
+	assert.FileExists(t, storagePath(b, oid))
+
+	SetAccessMode(true, false)
+	defer SetAccessMode(false, false)
+	assert.NotNil(t, Store(Config{PullBaseDir: a}, oid, src))
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"io"
+	"time"
+)
+
+// ObjectInfo describes one object found in a store by ListStores.
+type ObjectInfo struct {
+	// OID is the object's SHA-256, taken from its file name.
+	OID string `json:"oid"`
+	// Path is where the object is stored, including the store's base path.
+	Path string `json:"path"`
+	// Compression is the compression mode given by the file's extension.
+	Compression string `json:"compression"`
+	// Size is the stored (possibly compressed) size in bytes.
+	Size int64 `json:"size"`
+	// OriginalSize and Stored come from the object's sidecar file, for
+	// objects stored in folders with --metadata.
+	OriginalSize int64      `json:"original_size,omitempty"`
+	Stored       *time.Time `json:"stored,omitempty"`
+}
+
+// ListStores returns every object in the local folder stores and rclone
+// remotes of each base dir string, whatever its compression or layout, in
+// path order within each store. Each rclone remote is listed with a single
+// recursive listing. Scripts, S3 and HTTP stores are skipped, as are
+// quarantined objects, and problems are written to errOut. The error is that
+// of the last store which couldn't be listed.
+func ListStores(baseDirs []string, errOut io.Writer) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	err := eachStore(baseDirs, "listed", errOut, func(root string, objects []storedObject) {
+		for _, o := range objects {
+			info := ObjectInfo{OID: o.oid, Path: o.String(), Compression: o.compression, Size: o.size}
+			if !o.rclone {
+				if m, err := readMetadata(o.metadataPath()); err == nil {
+					info.OriginalSize, info.Stored = m.Size, &m.Stored
+				}
+			}
+			infos = append(infos, info)
+		}
+	})
+	return infos, err
+}
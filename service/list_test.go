@@ -0,0 +1,50 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "list")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer SetShardDepth(DefaultShardDepth)
+
+	// Objects in two layouts and several compressions
+	want := make(map[string]ObjectInfo)
+	for i, compression := range []string{"none", "lz4", "zip", "none"} {
+		SetShardDepth(i % 3)
+		content := bytes.Repeat([]byte{byte('a' + i)}, 500+i)
+		sum := sha256.Sum256(content)
+		oid := hex.EncodeToString(sum[:])
+		b := &dirBackend{dir: dir, compression: compression}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+		p := storagePath(dir, oid) + compressionExt(compression)
+		stat, err := os.Stat(p)
+		assert.Nil(t, err)
+		want[oid] = ObjectInfo{OID: oid, Path: filepath.ToSlash(p), Compression: compression, Size: stat.Size()}
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+
+	var errOut bytes.Buffer
+	objects, err := ListStores([]string{dir, "--compression=lz4 " + dir}, &errOut)
+	assert.Nil(t, err)
+	assert.Empty(t, errOut.String())
+	assert.Len(t, objects, len(want))
+	for _, o := range objects {
+		assert.Equal(t, want[o.OID], o)
+	}
+
+	_, err = ListStores([]string{filepath.Join(dir, "missing"), "|./download.sh"}, &errOut)
+	assert.NotNil(t, err)
+	assert.Contains(t, errOut.String(), "Unable to list")
+	assert.Contains(t, errOut.String(), "Skipping ./download.sh")
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// logRecord is one transfer written to the log file.
+type logRecord struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	Event    string    `json:"event"`
+	Oid      string    `json:"oid"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration"` // seconds
+	Error    string    `json:"error,omitempty"`
+}
+
+// transferLogger appends a record of each transfer to a log file, kept
+// apart from the git-lfs protocol on stdout and the messages on stderr.
+type transferLogger struct {
+	mu     sync.Mutex
+	out    io.WriteCloser
+	asJSON bool
+}
+
+var transferLog *transferLogger
+
+// SetLogFile records each transfer in the file at path, appending to it,
+// as either "text" or "json" lines. An empty path stops logging.
+func SetLogFile(path, format string) error {
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	if transferLog != nil {
+		transferLog.out.Close()
+		transferLog = nil
+	}
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	transferLog = &transferLogger{out: f, asJSON: format == "json"}
+	return nil
+}
+
+// logTransfer records a transfer of oid started at start, which moved bytes
+// and failed with err if it isn't nil.
+func logTransfer(event, oid string, bytes int64, start time.Time, err error) {
+	l := transferLog
+	if l == nil {
+		return
+	}
+	rec := logRecord{
+		Time:     time.Now().UTC(),
+		Level:    "info",
+		Event:    event,
+		Oid:      oid,
+		Bytes:    bytes,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		rec.Level = "error"
+		rec.Error = err.Error()
+	}
+	var line []byte
+	if l.asJSON {
+		line, _ = json.Marshal(rec)
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s %-5s %s %s %d bytes in %.3fs", rec.Time.Format(time.RFC3339), rec.Level, rec.Event, rec.Oid, rec.Bytes, rec.Duration))
+		if rec.Error != "" {
+			line = append(line, ": "+rec.Error...)
+		}
+		line = append(line, '\n')
+	}
+	l.write(line)
+}
+
+// write appends line in one write, so lines from adapters sharing the file
+// don't interleave.
+func (l *transferLogger) write(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadJSONLog(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	logDir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logDir)
+
+	logPath := filepath.Join(logDir, "transfers.log")
+	assert.Nil(t, SetLogFile(logPath, "json"))
+	defer SetLogFile("", "")
+
+	var stdout, stderr bytes.Buffer
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	f, err := os.Open(logPath)
+	assert.Nil(t, err)
+	defer f.Close()
+	records := make(map[string]logRecord)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec logRecord
+		if assert.Nil(t, json.Unmarshal(scanner.Bytes(), &rec), scanner.Text()) && rec.Event != "summary" {
+			records[rec.Oid] = rec
+		}
+	}
+	assert.Len(t, records, len(setup.files))
+	for _, file := range setup.files {
+		rec, ok := records[file.oid]
+		if assert.True(t, ok, "no record for %v", file.oid) {
+			assert.Equal(t, "info", rec.Level)
+			assert.Equal(t, "download", rec.Event)
+			assert.Equal(t, file.size, rec.Bytes)
+			assert.Empty(t, rec.Error)
+			assert.False(t, rec.Time.IsZero())
+		}
+	}
+	// Nothing but the protocol goes to stdout
+	assert.NotContains(t, stdout.String(), `"level"`)
+}
+
+func TestLogFormat(t *testing.T) {
+	assert.NotNil(t, SetLogFile("", "xml"))
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// magicNumbers identifies compressed objects by their first bytes, for
+// stores written by other tools that don't name files by their compression.
+var magicNumbers = []struct {
+	compression string
+	magic       []byte
+}{
+	{"zip", []byte("PK\x03\x04")},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte("\xfd7zXZ\x00")},
+}
+
+// detectCompression returns the compression whose magic number header
+// starts with, or "" if it matches none.
+func detectCompression(header []byte) string {
+	for _, m := range magicNumbers {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression
+		}
+	}
+	return ""
+}
+
+// sniffCompression reads the start of f to detect its compression, then
+// rewinds it.
+func sniffCompression(f *os.File) (string, error) {
+	header := make([]byte, 6)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detectCompression(header[:n]), nil
+}
+
+// compressAlways disables storing incompressible uploads uncompressed.
+var compressAlways bool
+
+// SetCompressAlways makes stores with compression compress every upload,
+// even those whose start shows compression won't help, such as video, images
+// and archives, which are otherwise stored uncompressed.
+func SetCompressAlways(enabled bool) {
+	compressAlways = enabled
+}
+
+// incompressibleRatio is how small lz4 must make the sample of an upload,
+// relative to its size, for the upload to be compressed.
+const incompressibleRatio = 0.95
+
+// minSampleSize is the smallest upload sampleCompressible judges; smaller
+// ones are compressed as configured, since it makes little difference.
+const minSampleSize = 4096
+
+// sampleCompressible reads the first block of r and estimates whether
+// compressing it is worthwhile by compressing that with lz4's fast block
+// mode. It returns a reader over the whole of r again. Readers that can be
+// read at an offset, like files, are sampled without being consumed, so they
+// can still be reread from the start.
+func sampleCompressible(r io.Reader) (io.Reader, bool, error) {
+	sample := make([]byte, blockSize)
+	var n int
+	var err error
+	if ra, ok := r.(io.ReaderAt); ok {
+		n, err = ra.ReadAt(sample, 0)
+	} else {
+		n, err = io.ReadFull(r, sample)
+		r = io.MultiReader(bytes.NewReader(sample[:n]), r)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return r, true, err
+	}
+	if n < minSampleSize {
+		return r, true, nil
+	}
+	dst := make([]byte, lz4.CompressBlockBound(n))
+	c, err := lz4.CompressBlock(sample[:n], dst, nil)
+	if err != nil {
+		return r, true, nil
+	}
+	// lz4 gives 0 for data it can't compress at all
+	if c == 0 {
+		return r, false, nil
+	}
+	return r, float64(c) < incompressibleRatio*float64(n), nil
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+// bzip2TestObject is the content of testObject compressed with bzip2, which
+// there's no Go encoder for.
+var bzip2TestObject = []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x46\x4e\x50\x00\x00\x00\x02\x11\x80\x40" +
+	"\x00\x3e\x29\xd6\x00\x20\x00\x31\x00\x00\x08\x9a\x3d\x11\xb4\x6a\x18\x61\x91\x05" +
+	"\x88\xca\x29\xd7\x02\x9a\xa6\x79\xf8\xbb\x92\x29\xc2\x84\x82\x32\x72\x80\x00")
+
+// compressForTest returns content compressed in the given format. bzip2 is
+// only available for the content of testObject.
+func compressForTest(t *testing.T, compression string, content []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "zip":
+		zw := zip.NewWriter(&buf)
+		entry, err := zw.Create("object")
+		assert.Nil(t, err)
+		_, err = entry.Write(content)
+		assert.Nil(t, err)
+		assert.Nil(t, zw.Close())
+		return buf.Bytes()
+	case "lz4":
+		w = lz4.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		assert.Nil(t, err)
+		w = zw
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		xw, err := xz.NewWriter(&buf)
+		assert.Nil(t, err)
+		w = xw
+	case "bzip2":
+		if object, _ := testObject(); !bytes.Equal(content, object) {
+			t.Fatal("no bzip2 encoder for content other than testObject")
+		}
+		return bzip2TestObject
+	}
+	_, err := w.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDetectCompression(t *testing.T) {
+	content, _ := testObject()
+	for _, compression := range []string{"zip", "lz4", "zstd", "gzip", "bzip2", "xz"} {
+		assert.Equal(t, compression, detectCompression(compressForTest(t, compression, content)))
+	}
+	assert.Equal(t, "", detectCompression(content))
+	assert.Equal(t, "", detectCompression(nil))
+	assert.Equal(t, "", detectCompression([]byte{0x1f}))
+}
+
+func TestDirBackendDetectsCompression(t *testing.T) {
+	content, oid := testObject()
+	for _, compression := range []string{"zip", "lz4", "zstd", "gzip", "bzip2", "xz"} {
+		t.Run(compression, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "magic")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			// Stored by another tool as a plain <oid>, without an extension
+			path := storagePath(dir, oid)
+			assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+			assert.Nil(t, ioutil.WriteFile(path, compressForTest(t, compression, content), 0644))
+
+			for _, configured := range []string{"none", "lz4"} {
+				b := &dirBackend{dir: dir, compression: configured}
+				rc, err := b.Get(oid, int64(len(content)))
+				if assert.Nil(t, err) {
+					data, err := ioutil.ReadAll(rc)
+					rc.Close()
+					assert.Nil(t, err)
+					assert.Equal(t, content, data)
+				}
+			}
+		})
+	}
+
+	// A raw object of the expected size is never sniffed
+	dir, err := ioutil.TempDir("", "magic")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	raw := append([]byte{0x1f, 0x8b}, content...)
+	path := storagePath(dir, oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, raw, 0644))
+	rc, err := (&dirBackend{dir: dir, compression: "none"}).Get(oid, int64(len(raw)))
+	if assert.Nil(t, err) {
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, raw, data)
+	}
+}
+
+func TestUploadIncompressible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incompressible")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := &dirBackend{dir: dir, compression: "lz4"}
+
+	// A zip archive of random data, as a packed asset would be
+	random := make([]byte, 256*1024)
+	rand.Read(random)
+	content := compressForTest(t, "zip", random)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	size := int64(len(content))
+
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), size))
+	assert.NoFileExists(t, storagePath(dir, oid)+".lz4")
+	stored, err := ioutil.ReadFile(storagePath(dir, oid))
+	assert.Nil(t, err)
+	assert.Equal(t, content, stored)
+	assert.Equal(t, errAlreadyStored, b.Put(oid, bytes.NewReader(content), size))
+
+	// It downloads as it is, rather than being unpacked for its zip header
+	rc, err := b.Get(oid, size)
+	if assert.Nil(t, err) {
+		data, err := ioutil.ReadAll(rc)
+		assert.Nil(t, err)
+		assert.Equal(t, content, data)
+		rc.Close()
+	}
+
+	// Listing and verifying see it as uncompressed
+	objects, err := ListStores([]string{dir}, ioutil.Discard)
+	assert.Nil(t, err)
+	if assert.Len(t, objects, 1) {
+		assert.Equal(t, "none", objects[0].Compression)
+	}
+	bad, err := VerifyStores([]string{dir}, 1, false, ioutil.Discard)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, bad)
+	assert.Equal(t, "none", Exists("--compression=lz4 "+dir, []string{oid})[oid].Compression)
+
+	// Compressible uploads are still compressed, from files as well
+	compressible := bytes.Repeat([]byte("compressible "), 20000)
+	sum = sha256.Sum256(compressible)
+	oid2 := hex.EncodeToString(sum[:])
+	p := filepath.Join(dir, "upload")
+	assert.Nil(t, ioutil.WriteFile(p, compressible, 0644))
+	f, err := os.Open(p)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Put(oid2, f, int64(len(compressible))))
+	f.Close()
+	assert.FileExists(t, storagePath(dir, oid2)+".lz4")
+
+	// unless compression is forced
+	SetCompressAlways(true)
+	defer SetCompressAlways(false)
+	assert.Nil(t, os.RemoveAll(storagePath(dir, oid)))
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), size))
+	assert.FileExists(t, storagePath(dir, oid)+".lz4")
+}
+
+func TestDecompressBzip2AndXz(t *testing.T) {
+	content, oid := testObject()
+	for _, compression := range []string{"bzip2", "xz"} {
+		t.Run(compression, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "decompress")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			// Folders find the object under its extension
+			path := storagePath(dir, oid) + compressionExt(compression)
+			assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+			stored := compressForTest(t, compression, content)
+			assert.Nil(t, ioutil.WriteFile(path, stored, 0644))
+			rc, err := (&dirBackend{dir: dir, compression: compression}).Get(oid, int64(len(content)))
+			if assert.Nil(t, err) {
+				data, err := ioutil.ReadAll(rc)
+				assert.Nil(t, err)
+				assert.Equal(t, content, data)
+				rc.Close()
+			}
+
+			// and streams from remotes are decoded too
+			rc, err = decompressStream(compression, ioutil.NopCloser(bytes.NewReader(stored)), int64(len(stored)), oid)
+			if assert.Nil(t, err) {
+				data, err := ioutil.ReadAll(rc)
+				assert.Nil(t, err)
+				assert.Equal(t, content, data)
+				rc.Close()
+			}
+		})
+	}
+
+	// xz can be written as well, bzip2 can't
+	dir, err := ioutil.TempDir("", "decompress")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	roundTrip(t, &dirBackend{dir: dir, compression: "xz"})
+	err = (&dirBackend{dir: dir, compression: "bzip2"}).Put(oid, bytes.NewReader(content), int64(len(content)))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "read-only")
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metadataExt is the extension of the sidecar file describing an object in
+// a folder store, <oid>.meta next to the object itself.
+const metadataExt = ".meta"
+
+// objectMetadata is the content of an object's sidecar file.
+type objectMetadata struct {
+	OID string `json:"oid"`
+	// Size is the size of the object before compression.
+	Size        int64     `json:"size"`
+	Compression string    `json:"compression"`
+	Stored      time.Time `json:"stored"`
+}
+
+// storeMetadata enables writing sidecar files for objects stored in folders.
+var storeMetadata bool
+
+// SetStoreMetadata enables writing a <oid>.meta JSON file next to each object
+// stored in a folder, recording its original size, compression and when it
+// was stored. Downloads don't use it.
+func SetStoreMetadata(enabled bool) {
+	storeMetadata = enabled
+}
+
+// metadataPath returns the sidecar path for oid stored at objectPath,
+// whatever its compression extension.
+func metadataPath(objectPath, oid string) string {
+	return filepath.Join(filepath.Dir(objectPath), oid+metadataExt)
+}
+
+// metadataPath returns where the sidecar of an object in a folder store is,
+// if it has one.
+func (o storedObject) metadataPath() string {
+	return metadataPath(filepath.Join(o.root, filepath.FromSlash(o.rel)), o.oid)
+}
+
+// writeMetadata writes m to path through a temp file, so readers never see
+// a partial sidecar.
+func writeMetadata(path string, m objectMetadata) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	untrack, err := tempFiles.track(tempPath)
+	if err != nil {
+		return err
+	}
+	defer untrack()
+	f, err := storeFS.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil && durableWrites {
+		err = storeFS.Sync(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = retryFS(func() error { return storeFS.Rename(tempPath, path) })
+	}
+	if err != nil {
+		storeFS.Remove(tempPath)
+	}
+	return err
+}
+
+// readMetadata reads the sidecar at path.
+func readMetadata(path string) (objectMetadata, error) {
+	var m objectMetadata
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	SetStoreMetadata(true)
+	defer SetStoreMetadata(false)
+
+	content, oid := testObject()
+	b := &dirBackend{dir: dir, compression: "lz4"}
+	before := time.Now().UTC()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	// The sidecar describes the object stored next to it
+	objectPath := storagePath(dir, oid) + ".lz4"
+	metaPath := filepath.Join(filepath.Dir(objectPath), oid+".meta")
+	m, err := readMetadata(metaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, oid, m.OID)
+	assert.Equal(t, int64(len(content)), m.Size)
+	assert.Equal(t, "lz4", m.Compression)
+	assert.False(t, m.Stored.Before(before.Truncate(time.Second)))
+	assert.False(t, m.Stored.After(time.Now().UTC()))
+	assert.NoFileExists(t, metaPath+".tmp")
+
+	// Downloads ignore it, and so does listing, except to report it
+	rc, err := b.Get(oid, int64(len(content)))
+	assert.Nil(t, err)
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, content, got)
+	infos, err := ListStores([]string{dir}, io.Discard)
+	assert.Nil(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, int64(len(content)), infos[0].OriginalSize)
+		assert.True(t, m.Stored.Equal(*infos[0].Stored))
+	}
+
+	// Recompressing the object keeps it up to date
+	_, err = MigrateStores([]string{dir}, "zstd", 1, false, io.Discard)
+	assert.Nil(t, err)
+	m, err = readMetadata(metaPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "zstd", m.Compression)
+
+	// and pruning the object removes it
+	_, err = PruneStores([]string{dir}, OIDSet{}, 0, false, io.Discard)
+	assert.Nil(t, err)
+	assert.NoFileExists(t, metaPath)
+
+	// Without --metadata there is none
+	SetStoreMetadata(false)
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.NoFileExists(t, metaPath)
+}
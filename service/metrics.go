@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// cacheHits and cacheMisses count lookups in the read-through cache.
+var cacheHits, cacheMisses int64
+
+// compressedIn and compressedOut count the bytes of the uploads compressed
+// into folders, before and after compression.
+var compressedIn, compressedOut int64
+
+// byteCounter counts the bytes written through it.
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recordCompression adds an upload of oid compressed from in to out bytes to
+// the savings, logging it with the savings so far at debug level.
+func recordCompression(oid string, in, out int64, errWriter *bufio.Writer) {
+	totalIn := atomic.AddInt64(&compressedIn, in)
+	totalOut := atomic.AddInt64(&compressedOut, out)
+	if errWriter != nil {
+		util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Compressed %v from %d to %d bytes (%d%% saved), %d bytes saved in all\n",
+			oid, in, out, savedPercent(in, out), totalIn-totalOut), errWriter)
+	}
+}
+
+// savedPercent returns how much smaller out is than in, as a percentage;
+// negative if it's bigger.
+func savedPercent(in, out int64) int64 {
+	if in == 0 {
+		return 0
+	}
+	return (in - out) * 100 / in
+}
+
+// transferMetrics accumulates the throughput of a session, summarised when
+// git-lfs terminates it.
+type transferMetrics struct {
+	mu         sync.Mutex
+	start      time.Time
+	downloaded int
+	uploaded   int
+	failed     int
+	bytes      int64
+	// the cache and compression counters when the session started
+	cacheHits, cacheMisses      int64
+	compressedIn, compressedOut int64
+}
+
+func newTransferMetrics() *transferMetrics {
+	return &transferMetrics{
+		start:         time.Now(),
+		cacheHits:     atomic.LoadInt64(&cacheHits),
+		cacheMisses:   atomic.LoadInt64(&cacheMisses),
+		compressedIn:  atomic.LoadInt64(&compressedIn),
+		compressedOut: atomic.LoadInt64(&compressedOut),
+	}
+}
+
+// record counts a transfer of size bytes, which failed if err isn't nil.
+func (m *transferMetrics) record(event string, size int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil:
+		m.failed++
+		return
+	case event == "download":
+		m.downloaded++
+	case event == "upload":
+		m.uploaded++
+	}
+	m.bytes += size
+}
+
+// failures returns the number of transfers that failed.
+func (m *transferMetrics) failures() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed
+}
+
+// metricsSummary is the summary of a session, as written to the log file.
+type metricsSummary struct {
+	Time        time.Time `json:"time"`
+	Level       string    `json:"level"`
+	Event       string    `json:"event"`
+	Objects     int       `json:"objects"`
+	Downloaded  int       `json:"downloaded"`
+	Uploaded    int       `json:"uploaded"`
+	Failed      int       `json:"failed"`
+	Bytes       int64     `json:"bytes"`
+	Duration    float64   `json:"duration"` // seconds
+	MBPerSec    float64   `json:"mb_per_sec"`
+	CacheHits   int64     `json:"cache_hits"`
+	CacheMisses int64     `json:"cache_misses"`
+	// Compressed and Stored are the sizes of uploads compressed into
+	// folders, before and after compression.
+	Compressed int64 `json:"compressed_bytes,omitempty"`
+	Stored     int64 `json:"stored_bytes,omitempty"`
+}
+
+func (m *transferMetrics) summary() metricsSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := metricsSummary{
+		Time:        time.Now().UTC(),
+		Level:       "info",
+		Event:       "summary",
+		Objects:     m.downloaded + m.uploaded,
+		Downloaded:  m.downloaded,
+		Uploaded:    m.uploaded,
+		Failed:      m.failed,
+		Bytes:       m.bytes,
+		Duration:    time.Since(m.start).Seconds(),
+		CacheHits:   atomic.LoadInt64(&cacheHits) - m.cacheHits,
+		CacheMisses: atomic.LoadInt64(&cacheMisses) - m.cacheMisses,
+		Compressed:  atomic.LoadInt64(&compressedIn) - m.compressedIn,
+		Stored:      atomic.LoadInt64(&compressedOut) - m.compressedOut,
+	}
+	if s.Duration > 0 {
+		s.MBPerSec = float64(s.Bytes) / 1e6 / s.Duration
+	}
+	return s
+}
+
+// String formats the summary for stderr, e.g. "3 objects (2 downloaded,
+// 1 uploaded, 0 failed), 12.5 MB in 1.2s, 10.4 MB/s, cache hit rate 50%
+// (1 of 2), compression saved 4.1 MB of 8.2 MB (50%)". The cache and
+// compression are only mentioned if they were used.
+func (s metricsSummary) String() string {
+	msg := fmt.Sprintf("%d objects (%d downloaded, %d uploaded, %d failed), %.1f MB in %v, %.1f MB/s",
+		s.Objects, s.Downloaded, s.Uploaded, s.Failed, float64(s.Bytes)/1e6,
+		time.Duration(s.Duration*float64(time.Second)).Round(time.Millisecond), s.MBPerSec)
+	if lookups := s.CacheHits + s.CacheMisses; lookups > 0 {
+		msg += fmt.Sprintf(", cache hit rate %d%% (%d of %d)", s.CacheHits*100/lookups, s.CacheHits, lookups)
+	}
+	if s.Compressed > 0 {
+		msg += fmt.Sprintf(", compression saved %.1f MB of %.1f MB (%d%%)",
+			float64(s.Compressed-s.Stored)/1e6, float64(s.Compressed)/1e6, savedPercent(s.Compressed, s.Stored))
+	}
+	return msg
+}
+
+// printSummary writes the summary to stderr and to the log file if there is
+// one.
+func (m *transferMetrics) printSummary(errWriter *bufio.Writer) {
+	s := m.summary()
+	util.WriteToStderr(fmt.Sprintf("LFS: Transferred %v\n", s), errWriter)
+	if l := transferLog; l != nil {
+		var line []byte
+		if l.asJSON {
+			line, _ = json.Marshal(s)
+		} else {
+			line = []byte(fmt.Sprintf("%s %-5s summary %v", s.Time.Format(time.RFC3339), s.Level, s))
+		}
+		l.write(append(line, '\n'))
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+func TestTerminateSummary(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	logDir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logDir)
+	logPath := filepath.Join(logDir, "transfers.log")
+	assert.Nil(t, SetLogFile(logPath, "json"))
+	defer SetLogFile("", "")
+
+	// Every test file, and one that isn't stored
+	var input bytes.Buffer
+	initDownload(&input)
+	var total int64
+	for _, file := range setup.files {
+		addDownload(t, &input, file.oid, file.size)
+		total += file.size
+	}
+	addDownload(t, &input, strings.Repeat("f", 64), 100)
+	finishDownload(&input)
+
+	var stdout, stderr bytes.Buffer
+	Serve(setup.remotepath, setup.remotepath, false, false, false, &input, &stdout, &stderr)
+
+	expected := fmt.Sprintf("LFS: Transferred 3 objects (3 downloaded, 0 uploaded, 1 failed), %.1f MB in ", float64(total)/1e6)
+	assert.Contains(t, stderr.String(), expected)
+	assert.NotContains(t, stderr.String(), "cache hit rate")
+
+	// The same summary is the last line of the log
+	f, err := os.Open(logPath)
+	assert.Nil(t, err)
+	defer f.Close()
+	var last string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		last = scanner.Text()
+	}
+	var summary metricsSummary
+	assert.Nil(t, json.Unmarshal([]byte(last), &summary))
+	assert.Equal(t, "summary", summary.Event)
+	assert.Equal(t, 3, summary.Objects)
+	assert.Equal(t, 3, summary.Downloaded)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, total, summary.Bytes)
+}
+
+func TestSummaryCacheHitRate(t *testing.T) {
+	s := metricsSummary{Objects: 4, Downloaded: 4, Bytes: 2500000, Duration: 2, MBPerSec: 1.25, CacheHits: 3, CacheMisses: 1}
+	assert.Equal(t, "4 objects (4 downloaded, 0 uploaded, 0 failed), 2.5 MB in 2s, 1.2 MB/s, cache hit rate 75% (3 of 4)", s.String())
+}
+
+func TestCompressionSavings(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	util.SetStderrLevel(util.LevelDebug)
+	defer util.SetStderrLevel(util.LevelInfo)
+
+	base := "--compression=lz4 " + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	// Each object is logged with the size it was stored at
+	var in, out int64
+	for _, file := range setup.files {
+		stat, err := os.Stat(storagePath(setup.remotepath, file.oid) + ".lz4")
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Less(t, stat.Size(), file.size)
+		in += file.size
+		out += stat.Size()
+		assert.Contains(t, stderr.String(), fmt.Sprintf("Compressed %v from %d to %d bytes (%d%% saved), ",
+			file.oid, file.size, stat.Size(), (file.size-stat.Size())*100/file.size))
+	}
+	assert.Contains(t, stderr.String(), fmt.Sprintf(", compression saved %.1f MB of %.1f MB (%d%%)\n",
+		float64(in-out)/1e6, float64(in)/1e6, (in-out)*100/in))
+}
+
+func TestSummaryCompression(t *testing.T) {
+	s := metricsSummary{Objects: 2, Uploaded: 2, Bytes: 8000000, Duration: 2, MBPerSec: 4, Compressed: 8000000, Stored: 2000000}
+	assert.Equal(t, "2 objects (0 downloaded, 2 uploaded, 0 failed), 8.0 MB in 2s, 4.0 MB/s, compression saved 6.0 MB of 8.0 MB (75%)", s.String())
+}
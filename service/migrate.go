@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// extract decompresses the object into a local temp file, checking that its
+// content hashes to its OID. The caller must remove the file. Objects without
+// an extension are taken as they are first, as verify does, since an asset
+// may itself be a zip or gzip file; only if that doesn't match are they
+// decompressed by what their content looks like, as other tools may have
+// stored them compressed without an extension.
+func (o storedObject) extract() (*os.File, int64, error) {
+	f, size, err := o.extractAs(o.compression)
+	if err == nil || o.compression != "none" {
+		return f, size, err
+	}
+	if c := o.sniff(); c != "" {
+		if f, size, serr := o.extractAs(c); serr == nil {
+			return f, size, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// extractAs is extract for the object stored with compression.
+func (o storedObject) extractAs(compression string) (*os.File, int64, error) {
+	rc, err := o.open(compression)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp("", "elastic-git-storage")
+	if err != nil {
+		return nil, 0, err
+	}
+	hasher := newOidHash()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), rc)
+	if err == nil {
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != o.oid {
+			err = fmt.Errorf("content hashes to %v", sum)
+		}
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// migrate rewrites the object next to itself in the compression to, checks
+// the new copy decompresses to the same content, and only then removes the
+// original, so the object is always available under one name or the other.
+func (o storedObject) migrate(to string) error {
+	src, size, err := o.extract()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	dest := o
+	dest.rel = path.Join(path.Dir(o.rel), o.oid+compressionExt(to))
+	dest.compression = to
+	if o.rclone {
+		if _, err := storeToRclone(context.Background(), dest.String(), to, src, size, o.oid, nil); err != nil {
+			return err
+		}
+		if sum, err := dest.hash(to); err != nil {
+			deleteRclone(dest.String())
+			return fmt.Errorf("rewritten object doesn't match: %v", err)
+		} else if sum != o.oid {
+			deleteRclone(dest.String())
+			return fmt.Errorf("rewritten object hashes to %v", sum)
+		}
+		return o.remove()
+	}
+
+	tmp := dest
+	tmp.rel += ".tmp"
+	tmpPath := filepath.Join(o.root, filepath.FromSlash(tmp.rel))
+	mode := storeFileMode
+	if mode == 0 {
+		mode = 0644
+		if stat, err := os.Stat(filepath.Join(o.root, filepath.FromSlash(o.rel))); err == nil {
+			mode = stat.Mode()
+		}
+	}
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	err = compressStream(to, src, f, size, o.oid, nil)
+	if err == nil && durableWrites {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if sum, herr := tmp.hash(to); herr != nil {
+			err = fmt.Errorf("rewritten object doesn't match: %v", herr)
+		} else if sum != o.oid {
+			err = fmt.Errorf("rewritten object hashes to %v", sum)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(o.root, filepath.FromSlash(dest.rel)))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if m, err := readMetadata(o.metadataPath()); err == nil {
+		m.Compression = to
+		if err := writeMetadata(o.metadataPath(), m); err != nil {
+			return err
+		}
+	}
+	return o.remove()
+}
+
+// MigrateStores rewrites every object in the local folder stores and rclone
+// remotes of each base dir string into the compression mode to, one of
+// "none", "lz4", "zip", "zstd", "gzip", "xz" or "external". Objects stay in
+// the folder they were found in. Those already stored that way, or that
+// already have a copy stored that way alongside them, are skipped. jobs
+// objects are rewritten at once. With dryRun nothing is changed, but the
+// objects that would be are still listed. Progress and problems are written
+// to out. It returns the number of objects migrated, and the last error
+// encountered.
+func MigrateStores(baseDirs []string, to string, jobs int, dryRun bool, out io.Writer) (int, error) {
+	valid := false
+	for _, c := range extCompression {
+		valid = valid || c == to
+	}
+	if !valid {
+		err := fmt.Errorf("unknown compression %q", to)
+		fmt.Fprintln(out, err)
+		return 0, err
+	}
+	// Rather than fail every object in turn
+	if err := checkCompressionWritable(to); err != nil {
+		err = fmt.Errorf("cannot migrate to %v: %w", to, err)
+		fmt.Fprintln(out, err)
+		return 0, err
+	}
+
+	var lastErr error
+	migrated := 0
+	err := eachStore(baseDirs, "migrated", out, func(root string, objects []storedObject) {
+		present := make(map[string]bool, len(objects))
+		for _, o := range objects {
+			present[o.rel] = true
+		}
+		var pending []storedObject
+		for _, o := range objects {
+			if o.compression != to && !present[path.Join(path.Dir(o.rel), o.oid+compressionExt(to))] {
+				pending = append(pending, o)
+			}
+		}
+		if dryRun {
+			for _, o := range pending {
+				fmt.Fprintf(out, "Would migrate %v to %v\n", o, to)
+			}
+			migrated += len(pending)
+			fmt.Fprintf(out, "Would migrate %d of %d object(s) in %v to %v\n", len(pending), len(objects), root, to)
+			return
+		}
+
+		var mu sync.Mutex
+		n := 0
+		eachObject(pending, jobs, func(o storedObject) {
+			err := o.migrate(to)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(out, "Unable to migrate %v: %v\n", o, err)
+				lastErr = err
+				return
+			}
+			n++
+		})
+		migrated += n
+		fmt.Fprintf(out, "Migrated %d of %d object(s) in %v to %v\n", n, len(objects), root, to)
+	})
+	if err != nil {
+		lastErr = err
+	}
+	return migrated, lastErr
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	contents := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1000*(i+1))
+		sum := sha256.Sum256(content)
+		oid := hex.EncodeToString(sum[:])
+		contents[oid] = content
+		b := &dirBackend{dir: dir, compression: "none"}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	}
+	// One already compressed, which is left alone
+	for oid, content := range contents {
+		assert.Nil(t, os.Remove(storagePath(dir, oid)))
+		b := &dirBackend{dir: dir, compression: "lz4"}
+		assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+		break
+	}
+
+	assertStored := func(compression string) {
+		for oid, content := range contents {
+			p := storagePath(dir, oid)
+			for _, c := range []string{"none", "lz4"} {
+				if c == compression {
+					assert.FileExists(t, p+compressionExt(c))
+				} else {
+					assert.NoFileExists(t, p+compressionExt(c))
+				}
+			}
+			assert.NoFileExists(t, p+compressionExt(compression)+".tmp")
+			b := &dirBackend{dir: dir, compression: compression}
+			rc, err := b.Get(oid, int64(len(content)))
+			if assert.Nil(t, err) {
+				got, err := ioutil.ReadAll(rc)
+				rc.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, content, got)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	n, err := MigrateStores([]string{dir}, "lz4", 2, true, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Contains(t, out.String(), "Would migrate 4 of 5 object(s)")
+	assert.Equal(t, 4, countFiles(t, dir, ""))
+
+	out.Reset()
+	n, err = MigrateStores([]string{dir}, "lz4", 2, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Contains(t, out.String(), "Migrated 4 of 5 object(s)")
+	assertStored("lz4")
+
+	// Nothing left to do the second time
+	out.Reset()
+	n, err = MigrateStores([]string{dir}, "lz4", 2, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	out.Reset()
+	n, err = MigrateStores([]string{dir}, "none", 3, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assertStored("none")
+
+	_, err = MigrateStores([]string{dir}, "rar", 1, false, &out)
+	assert.EqualError(t, err, `unknown compression "rar"`)
+
+	// Modes that can only be read are refused before any store is listed
+	out.Reset()
+	_, err = MigrateStores([]string{dir}, "bzip2", 1, false, &out)
+	assert.EqualError(t, err, "cannot migrate to bzip2: bzip2 can only be read, not written")
+	assert.Equal(t, err.Error()+"\n", out.String())
+	assertStored("none")
+}
+
+func TestMigrateStoresSkipsCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content, oid := testObject()
+	b := &dirBackend{dir: dir, compression: "none"}
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	content[0] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(storagePath(dir, oid), content, 0644))
+
+	var out bytes.Buffer
+	n, err := MigrateStores([]string{dir}, "zstd", 1, false, &out)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, out.String(), "Unable to migrate")
+	assert.FileExists(t, storagePath(dir, oid))
+	assert.NoFileExists(t, storagePath(dir, oid)+".zst")
+}
+
+func TestMigrateStoresRawArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The asset is itself a gzip file, stored as it is
+	content, oid := archiveObject(t, "gzip")
+	b := &dirBackend{dir: dir, compression: "none"}
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	var out bytes.Buffer
+	n, err := VerifyStores([]string{dir}, 1, false, &out)
+	assert.Nil(t, err, out.String())
+	n, err = MigrateStores([]string{dir}, "lz4", 1, false, &out)
+	assert.Nil(t, err, out.String())
+	assert.Equal(t, 1, n)
+	assert.NoFileExists(t, storagePath(dir, oid))
+	rc, err := (&dirBackend{dir: dir, compression: "lz4"}).Get(oid, int64(len(content)))
+	if assert.Nil(t, err) {
+		got, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, content, got)
+	}
+}
+
+// archiveObject returns an asset which is itself compressed in the given
+// format, and its OID.
+func archiveObject(t *testing.T, compression string) ([]byte, string) {
+	object, _ := testObject()
+	content := compressForTest(t, compression, object)
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+// countFiles counts the files below dir with the given extension.
+func countFiles(t *testing.T, dir, ext string) int {
+	n := 0
+	assert.Nil(t, filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Ext(p) == ext {
+			n++
+		}
+		return err
+	}))
+	return n
+}
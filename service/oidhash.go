@@ -0,0 +1,102 @@
+package service
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// DefaultOidHash is the hash git-lfs computes OIDs with.
+const DefaultOidHash = "sha256"
+
+// oidHashes are the hashes OIDs can be computed with, by the name rclone's
+// hashsum also knows them by where it has them. BLAKE3 OIDs are its default
+// 256-bit digests.
+var oidHashes = map[string]func() hash.Hash{
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// rcloneHashes are the oidHashes rclone hashsum can compute. Remote objects
+// are hashed locally for any other.
+var rcloneHashes = map[string]bool{
+	"sha1":   true,
+	"sha256": true,
+	"sha512": true,
+}
+
+// maxOidLength is the length of the longest OID any of oidHashes produces,
+// in hex.
+const maxOidLength = sha512.Size * 2
+
+// oidHash is the name of the hash objects are verified against their OIDs
+// with, and newOidHash creates it.
+var (
+	oidHash    = DefaultOidHash
+	newOidHash = sha256.New
+)
+
+// SetOidHash sets the hash OIDs are computed with, for git-lfs builds that
+// don't use sha256. Every object transferred, verified or checked for
+// corruption is hashed with it, and OIDs of any other length are refused.
+func SetOidHash(name string) error {
+	name = strings.ToLower(name)
+	h, ok := oidHashes[name]
+	if !ok {
+		return fmt.Errorf("unknown OID hash %q, expected one of %v", name, strings.Join(OidHashes(), ", "))
+	}
+	oidHash, newOidHash = name, h
+	return nil
+}
+
+// OidHashes returns the names SetOidHash accepts, sorted.
+func OidHashes() []string {
+	var names []string
+	for name := range oidHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkOid returns an error unless oid is a digest of the OID hash in
+// lowercase hex. Storage paths are built from OIDs, so anything else, such
+// as one holding "../" from a buggy or malicious caller, could read or write
+// outside the store. A hex OID of the wrong length is the case when git-lfs
+// and the adapter disagree on the hash.
+func checkOid(oid string) error {
+	for i := 0; i < len(oid); i++ {
+		if c := oid[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("OID %q isn't a lowercase hex digest", oid)
+		}
+	}
+	if want := newOidHash().Size() * 2; len(oid) != want {
+		return fmt.Errorf("OID %q is %d characters long, but %v OIDs are %d; check --oid-hash", oid, len(oid), oidHash, want)
+	}
+	return nil
+}
+
+// fileHash returns the OID of the file at path.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := newOidHash()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"lukechampine.com/blake3"
+)
+
+func TestOidHashRoundTrip(t *testing.T) {
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+	defer SetOidHash(DefaultOidHash)
+
+	content := []byte("content hashed with the configured OID hash")
+	sum256 := sha256.Sum256(content)
+	sum512 := sha512.Sum512(content)
+	sumBlake3 := blake3.Sum256(content)
+	cases := []struct {
+		hash string
+		oid  string
+	}{
+		{"sha256", hex.EncodeToString(sum256[:])},
+		{"SHA512", hex.EncodeToString(sum512[:])},
+		{"blake3", hex.EncodeToString(sumBlake3[:])},
+	}
+	for _, c := range cases {
+		t.Run(c.hash, func(t *testing.T) {
+			assert.Nil(t, SetOidHash(c.hash))
+			dir, err := ioutil.TempDir("", "oidhash")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			src := filepath.Join(dir, "src")
+			assert.Nil(t, ioutil.WriteFile(src, content, 0644))
+			store := filepath.Join(dir, "store")
+			assert.Nil(t, os.Mkdir(store, 0755))
+
+			for _, base := range []string{store, "--compression=lz4 " + store} {
+				cfg := Config{PullBaseDir: base}
+				assert.Nil(t, Store(cfg, c.oid, src))
+				path, err := Retrieve(cfg, c.oid, int64(len(content)))
+				if assert.Nil(t, err) {
+					got, _ := ioutil.ReadFile(path)
+					assert.Equal(t, content, got)
+					os.Remove(path)
+				}
+			}
+
+			// Content that doesn't hash to the OID is refused
+			other := filepath.Join(dir, "other")
+			assert.Nil(t, ioutil.WriteFile(other, []byte("other content"), 0644))
+			err = Store(Config{PullBaseDir: store}, strings.Repeat("0", len(c.oid)), other)
+			assert.True(t, errors.Is(err, errHashMismatch) || (err != nil && strings.Contains(err.Error(), "hash")), "%v", err)
+		})
+	}
+}
+
+func TestOidHashRclone(t *testing.T) {
+	defer SetOidHash(DefaultOidHash)
+	count := installListingRclone(t)
+	dir, err := ioutil.TempDir("", "oidhash")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content := []byte("content hashed with the configured OID hash")
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "object"), content, 0644))
+
+	// rclone has no BLAKE3, so the object is read and hashed locally
+	assert.Nil(t, SetOidHash("blake3"))
+	sum := blake3.Sum256(content)
+	got, err := hashsumRclone("dummy:" + filepath.Join(dir, "object"))
+	assert.Nil(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), got)
+	assert.Equal(t, map[string]int{"cat": 1}, count())
+}
+
+func TestOidHashLength(t *testing.T) {
+	defer SetOidHash(DefaultOidHash)
+	assert.NotNil(t, SetOidHash("blake2"))
+	assert.Equal(t, DefaultOidHash, oidHash)
+
+	// sha256 OIDs
+	_, oid := testObject()
+	upload := setupUploadTest(t)
+	defer os.RemoveAll(upload.localpath)
+	defer os.RemoveAll(upload.remotepath)
+
+	assert.Nil(t, checkOid(oid))
+	assert.Nil(t, SetOidHash("sha1"))
+	err := checkOid(oid)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "--oid-hash")
+	}
+
+	// git-lfs is told the transfer failed rather than it failing to verify
+	var stdout, stderr bytes.Buffer
+	Serve(upload.remotepath, "", false, false, false, bytes.NewReader(upload.inputBuffer.Bytes()), &stdout, &stderr)
+	for _, file := range upload.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","error":{"code":33,`)
+		assert.NoFileExists(t, storagePath(upload.remotepath, file.oid))
+	}
+}
+
+func TestMalformedOids(t *testing.T) {
+	dir, err := ioutil.TempDir("", "malformedoid")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	gitDir := filepath.Join(dir, "git")
+	assert.Nil(t, os.Mkdir(gitDir, 0755))
+	SetGitDir(gitDir)
+	defer SetGitDir("")
+	store := filepath.Join(dir, "a", "b", "store")
+	assert.Nil(t, os.MkdirAll(store, 0755))
+
+	content, oid := testObject()
+	src := filepath.Join(dir, "src")
+	assert.Nil(t, ioutil.WriteFile(src, content, 0644))
+	// Stored where a traversing OID would be read from
+	escaped := filepath.Join(dir, "escaped")
+	assert.Nil(t, ioutil.WriteFile(escaped, content, 0644))
+
+	bad := []string{
+		"../../../../escaped",
+		"../../../../" + oid[:52],
+		"..\\..\\" + oid[:58],
+		strings.ToUpper(oid),
+		oid[:60] + "/../",
+		"ab",
+		"",
+	}
+	for _, o := range bad {
+		assert.NotNil(t, checkOid(o), o)
+		_, err := Retrieve(Config{PullBaseDir: store}, o, int64(len(content)))
+		assert.NotNil(t, err, o)
+		assert.NotNil(t, Store(Config{PullBaseDir: store}, o, src), o)
+		assert.Empty(t, Exists(store, []string{o}), o)
+	}
+	assert.Nil(t, checkOid(oid))
+
+	// Each is refused without touching the filesystem, and the session
+	// carries on with the requests after it
+	var input bytes.Buffer
+	initUpload(&input)
+	for _, o := range bad {
+		addUpload(t, &input, src, o, int64(len(content)))
+	}
+	addUpload(t, &input, src, oid, int64(len(content)))
+	finishUpload(&input)
+	var stdout, stderr bytes.Buffer
+	Serve(store, "", false, false, false, &input, &stdout, &stderr)
+	for _, o := range bad {
+		msg, _ := json.Marshal(o)
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":`+string(msg)+`,"error":{"code":33,`)
+	}
+	assert.FileExists(t, storagePath(store, oid))
+	assert.FileExists(t, src)
+
+	input.Reset()
+	initDownload(&input)
+	for _, o := range bad {
+		addDownload(t, &input, o, int64(len(content)))
+	}
+	finishDownload(&input)
+	stdout.Reset()
+	Serve(store, "", false, false, false, &input, &stdout, &stderr)
+	assert.Equal(t, len(bad), strings.Count(stdout.String(), `"error":{"code":33,`))
+
+	// Nothing was written outside the store, or anywhere but where the
+	// good OID belongs
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	assert.ElementsMatch(t, []string{src, escaped, storagePath(store, oid)}, files)
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+// DefaultProgressInterval is the default minimum time between progress
+// events for one transfer.
+const DefaultProgressInterval = 100 * time.Millisecond
+
+// progressInterval and progressBytes coalesce progress events: one is sent
+// once progressInterval has passed since the last, or once progressBytes more
+// have been transferred if that is set, whichever comes first.
+var progressInterval = DefaultProgressInterval
+var progressBytes int64
+
+// SetProgressInterval limits how often progress is reported to git-lfs for
+// each transfer: at most every interval, unless bytes more have been
+// transferred first. A zero interval reports every block copied, and zero
+// bytes leaves only the time limit. The final amount is always reported.
+func SetProgressInterval(interval time.Duration, bytes int64) {
+	if interval < 0 {
+		interval = 0
+	}
+	if bytes < 0 {
+		bytes = 0
+	}
+	progressInterval, progressBytes = interval, bytes
+}
+
+// progressReporter sends coalesced progress events for one object. Reports
+// of less progress than already made, as when a transfer is retried or fails
+// over, are ignored, so git-lfs never sees the total go backwards.
+type progressReporter struct {
+	oid       string
+	writer    *bufio.Writer
+	errWriter *bufio.Writer
+
+	mu       sync.Mutex
+	soFar    int64 // the most progress made
+	sent     int64 // the progress git-lfs has been told of
+	sentTime time.Time
+}
+
+func newProgressReporter(oid string, writer, errWriter *bufio.Writer) *progressReporter {
+	return &progressReporter{oid: oid, writer: writer, errWriter: errWriter, sentTime: time.Now()}
+}
+
+// callback is a copyCallback recording progress, and reporting it when due
+// or when the transfer has reached its expected size.
+func (p *progressReporter) callback(totalSize, readSoFar int64, readSinceLast int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if readSoFar <= p.soFar {
+		return nil
+	}
+	p.soFar = readSoFar
+	if (totalSize > 0 && readSoFar >= totalSize) ||
+		time.Since(p.sentTime) >= progressInterval ||
+		(progressBytes > 0 && p.soFar-p.sent >= progressBytes) {
+		p.send()
+	}
+	return nil
+}
+
+// finish reports progress up to size, if more than has been made so far,
+// then any progress not yet reported.
+func (p *progressReporter) finish(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if size > p.soFar {
+		p.soFar = size
+	}
+	p.send()
+}
+
+func (p *progressReporter) send() {
+	if p.soFar > p.sent {
+		api.SendProgress(p.oid, p.soFar, int(p.soFar-p.sent), p.writer, p.errWriter)
+		p.sent = p.soFar
+		p.sentTime = time.Now()
+	}
+}
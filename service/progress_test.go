@@ -0,0 +1,75 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+func TestProgressCoalescing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "progress")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	defer SetBlockSize(DefaultBlockSize)
+	defer SetProgressInterval(DefaultProgressInterval, 0)
+
+	// 64 MiB in 4 KiB blocks is 16384 callbacks
+	assert.Nil(t, SetBlockSize(4*1024))
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	b := &dirBackend{dir: dir, compression: "none"}
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	fetchEvents := func() []api.ProgressResponse {
+		var stdout, stderr bytes.Buffer
+		writer := bufio.NewWriter(&stdout)
+		errWriter := bufio.NewWriter(&stderr)
+		start := time.Now()
+		assert.Nil(t, fetch(context.Background(), b, gitDir, oid, int64(len(content)), writer, errWriter))
+		elapsed := time.Since(start)
+		writer.Flush()
+		events := progressEvents(t, stdout.String(), oid)
+		// At most one event per interval, plus the final one
+		if progressInterval > 0 && progressBytes == 0 {
+			assert.LessOrEqual(t, len(events), int(elapsed/progressInterval)+2)
+		}
+		var total int64
+		for _, e := range events {
+			total += int64(e.BytesSinceLast)
+		}
+		if assert.NotEmpty(t, events) {
+			assert.Equal(t, int64(len(content)), events[len(events)-1].BytesSoFar)
+		}
+		assert.Equal(t, int64(len(content)), total)
+		completeAt := strings.Index(stdout.String(), `"event":"complete"`)
+		assert.True(t, completeAt > strings.LastIndex(stdout.String(), `"event":"progress"`))
+		return events
+	}
+
+	SetProgressInterval(time.Hour, 0)
+	assert.Len(t, fetchEvents(), 1)
+
+	SetProgressInterval(time.Hour, 16*1024*1024)
+	assert.Len(t, fetchEvents(), 4)
+
+	SetProgressInterval(0, 0)
+	assert.Len(t, fetchEvents(), len(content)/(4*1024))
+
+	SetProgressInterval(DefaultProgressInterval, 0)
+	assert.Less(t, len(fetchEvents()), 100)
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// minOIDPrefix is the shortest OID prefix accepted in a list of live OIDs.
+// git lfs ls-files prints 10 characters unless given --long.
+const minOIDPrefix = 7
+
+var oidPrefixPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// OIDSet is a set of live OIDs, or prefixes of them, for PruneStores.
+type OIDSet map[string]bool
+
+// Contains reports whether oid, or any prefix of it, is in the set.
+func (s OIDSet) Contains(oid string) bool {
+	for n := minOIDPrefix; n <= len(oid); n++ {
+		if s[oid[:n]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadOIDs reads a list of live OIDs, one per line, taking the first field
+// of each so the output of git lfs ls-files can be used directly. Blank lines
+// and lines starting with # are ignored. Short OIDs are kept as prefixes,
+// which protects every object starting with them. Anything that isn't an OID
+// is an error, so that a wrong file can't cause the whole store to be pruned.
+func ReadOIDs(r io.Reader) (OIDSet, error) {
+	oids := make(OIDSet)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		oid := strings.ToLower(fields[0])
+		if len(oid) < minOIDPrefix || len(oid) > maxOidLength || !oidPrefixPattern.MatchString(oid) {
+			return nil, fmt.Errorf("line %d: %q is not an OID", line, fields[0])
+		}
+		oids[oid] = true
+	}
+	return oids, scanner.Err()
+}
+
+// remove deletes the object from its store.
+func (o storedObject) remove() error {
+	if o.rclone {
+		return deleteRclone(o.String())
+	}
+	return os.Remove(filepath.Join(o.root, filepath.FromSlash(o.rel)))
+}
+
+// PruneStores deletes every object in the local folder stores and rclone
+// remotes of each base dir string whose OID isn't in live, whatever its
+// compression or layout; a nil live keeps them all. Then, if maxSize is more
+// than zero, the least recently used objects in each folder store are
+// deleted until what's left takes up no more than maxSize bytes. Objects are
+// used when downloaded with access tracking on, or else when stored.
+// Scripts, S3 and HTTP stores are skipped, as are quarantined objects. With
+// dryRun nothing is deleted, but the objects that would be are still listed.
+// Progress and problems are written to out. It returns the number of objects
+// pruned, and the last error encountered.
+func PruneStores(baseDirs []string, live OIDSet, maxSize int64, dryRun bool, out io.Writer) (int, error) {
+	var lastErr error
+	pruned := 0
+	err := eachStore(baseDirs, "pruned", out, func(root string, objects []storedObject) {
+		n := 0
+		// prune removes o, saying so with verb, and returns whether it went
+		prune := func(o storedObject, verb, done string) bool {
+			if dryRun {
+				fmt.Fprintf(out, "Would %s %v\n", verb, o)
+				return true
+			}
+			if err := o.remove(); err != nil {
+				fmt.Fprintf(out, "Unable to remove %v: %v\n", o, err)
+				lastErr = err
+				return false
+			}
+			if !o.rclone {
+				os.Remove(o.metadataPath())
+				os.Remove(accessPath(filepath.Join(o.root, filepath.FromSlash(o.rel)), o.oid))
+			}
+			fmt.Fprintf(out, "%s %v\n", done, o)
+			return true
+		}
+
+		var remaining []storedObject
+		for _, o := range objects {
+			if live == nil || live.Contains(o.oid) {
+				remaining = append(remaining, o)
+			} else if prune(o, "remove", "Removed") {
+				n++
+			}
+		}
+
+		if maxSize > 0 && len(remaining) > 0 {
+			if remaining[0].rclone {
+				fmt.Fprintf(out, "Not applying the size limit to %v, access is only tracked in folders\n", root)
+			} else {
+				total := int64(0)
+				used := make(map[string]time.Time, len(remaining))
+				for _, o := range remaining {
+					total += o.size
+					used[o.rel] = o.lastAccess()
+				}
+				sort.SliceStable(remaining, func(i, j int) bool {
+					return used[remaining[i].rel].Before(used[remaining[j].rel])
+				})
+				for _, o := range remaining {
+					if total <= maxSize {
+						break
+					}
+					if prune(o, "evict", "Evicted") {
+						total -= o.size
+						n++
+					}
+				}
+			}
+		}
+		pruned += n
+		fmt.Fprintf(out, "Pruned %d of %d object(s) in %v\n", n, len(objects), root)
+	})
+	if err != nil {
+		lastErr = err
+	}
+	return pruned, lastErr
+}
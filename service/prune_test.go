@@ -0,0 +1,87 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOIDs(t *testing.T) {
+	full := strings.Repeat("ab", 32)
+	oids, err := ReadOIDs(strings.NewReader(
+		"# live objects\n\n" + full + " * big.bin\n0123456789 - other.bin\nFEDCBA9876\n"))
+	assert.Nil(t, err)
+	assert.Len(t, oids, 3)
+	assert.True(t, oids.Contains(full))
+	assert.True(t, oids.Contains("0123456789"+strings.Repeat("0", 54)))
+	assert.True(t, oids.Contains("fedcba9876"+strings.Repeat("0", 54)))
+	assert.False(t, oids.Contains(strings.Repeat("cd", 32)))
+
+	_, err = ReadOIDs(strings.NewReader(full + "\nbig.bin\n"))
+	assert.EqualError(t, err, `line 2: "big.bin" is not an OID`)
+	_, err = ReadOIDs(strings.NewReader("abc\n"))
+	assert.NotNil(t, err)
+}
+
+func TestPruneStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Two live and two dead objects in each compression
+	live := make(OIDSet)
+	var kept, dead []string
+	for i, compression := range []string{"none", "lz4", "zip", "zstd"} {
+		for j := 0; j < 4; j++ {
+			content := bytes.Repeat([]byte{byte('a' + i)}, 100+j)
+			sum := sha256.Sum256(content)
+			oid := hex.EncodeToString(sum[:])
+			b := &dirBackend{dir: dir, compression: compression}
+			assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+			p := storagePath(dir, oid) + compressionExt(compression)
+			assert.FileExists(t, p)
+			switch j {
+			case 0:
+				live[oid] = true
+				kept = append(kept, p)
+			case 1:
+				live[oid[:10]] = true
+				kept = append(kept, p)
+			default:
+				dead = append(dead, p)
+			}
+		}
+	}
+	// Files that aren't objects are never pruned
+	other := filepath.Join(dir, "README")
+	assert.Nil(t, ioutil.WriteFile(other, []byte("hello"), 0644))
+	kept = append(kept, other)
+
+	var out bytes.Buffer
+	n, err := PruneStores([]string{dir}, live, 0, true, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, len(dead), n)
+	assert.Contains(t, out.String(), "Would remove "+filepath.ToSlash(dead[0]))
+	for _, p := range append(kept, dead...) {
+		assert.FileExists(t, p)
+	}
+
+	out.Reset()
+	n, err = PruneStores([]string{dir, "--compression=lz4 " + dir}, live, 0, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, len(dead), n)
+	assert.Contains(t, out.String(), "Pruned 8 of 16 object(s)")
+	for _, p := range kept {
+		assert.FileExists(t, p)
+	}
+	for _, p := range dead {
+		assert.NoFileExists(t, p)
+	}
+}
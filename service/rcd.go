@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// useRcloneDaemon makes Serve start an rclone daemon for the session.
+var useRcloneDaemon bool
+
+// SetRcloneDaemon makes each session start one `rclone rcd` process and send
+// uploads, downloads, listings and deletes to its remote control API, rather
+// than starting an rclone process for each of them. Sessions fall back to
+// separate processes if the daemon can't be started.
+func SetRcloneDaemon(enabled bool) {
+	useRcloneDaemon = enabled
+}
+
+// usesRclone returns whether any of the stores in baseDir are rclone remotes.
+func usesRclone(baseDir string) bool {
+	for _, d := range splitBaseDirs(baseDir) {
+		if !d.script && util.IsRclonePath(d.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// rcdStartTimeout is how long the daemon has to start answering requests.
+var rcdStartTimeout = 10 * time.Second
+
+// rcloneDaemon is an `rclone rcd` process listening on a loopback address,
+// serving remote objects as well as the remote control API.
+type rcloneDaemon struct {
+	url    string
+	user   string
+	pass   string
+	client *http.Client
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// rcd is the daemon of the current session, nil when rclone operations run
+// as separate processes.
+var rcd *rcloneDaemon
+
+// startRcloneDaemon starts `rclone rcd` on a free loopback port, with
+// credentials of its own passed in its environment, and waits for it to
+// answer.
+func startRcloneDaemon() (*rcloneDaemon, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := &rcloneDaemon{
+		url:    "http://" + addr + "/",
+		user:   randomToken(),
+		pass:   randomToken(),
+		client: &http.Client{},
+		exited: make(chan struct{}),
+	}
+	d.cmd = rcloneCommand(bwlimitArgs("rcd", "--rc-addr", addr, "--rc-serve")...)
+	d.cmd.Env = append(os.Environ(), "RCLONE_RC_USER="+d.user, "RCLONE_RC_PASS="+d.pass)
+	if err := d.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		d.cmd.Wait()
+		close(d.exited)
+	}()
+
+	deadline := time.Now().Add(rcdStartTimeout)
+	for {
+		err := d.call("core/noop", nil, nil)
+		if err == nil {
+			return d, nil
+		}
+		select {
+		case <-d.exited:
+			return nil, fmt.Errorf("rclone rcd exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			d.stop()
+			return nil, fmt.Errorf("rclone rcd didn't start in %v: %v", rcdStartTimeout, err)
+		}
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stop shuts the daemon down, killing it if it doesn't exit promptly.
+func (d *rcloneDaemon) stop() {
+	if d.cmd == nil {
+		return
+	}
+	d.call("core/quit", nil, nil)
+	select {
+	case <-d.exited:
+	case <-time.After(5 * time.Second):
+		d.cmd.Process.Kill()
+		<-d.exited
+	}
+}
+
+// do sends req with the daemon's credentials, returning an error for any
+// response but 200 OK.
+func (d *rcloneDaemon) do(req *http.Request) (*http.Response, error) {
+	req.SetBasicAuth(d.user, d.pass)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		// The API explains errors in JSON, serving objects in plain text
+		var rcErr struct {
+			Error string `json:"error"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		msg := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &rcErr) == nil && rcErr.Error != "" {
+			msg = rcErr.Error
+		}
+		return nil, &httpStatusError{resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, msg)}
+	}
+	return resp, nil
+}
+
+// call runs an API method with params, decoding its answer into result if
+// that isn't nil.
+func (d *rcloneDaemon) call(method string, params, result interface{}) error {
+	if params == nil {
+		params = struct{}{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.url+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.do(req)
+	if err != nil {
+		return fmt.Errorf("rclone rc %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// splitRemote splits an rclone path into the filesystem the API addresses
+// and the path of a file within it, the last element.
+func splitRemote(p string) (string, string) {
+	if i := strings.LastIndexAny(p, `/\`); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	if i := strings.Index(p, ":"); i >= 0 {
+		return p[:i+1], p[i+1:]
+	}
+	return ".", p
+}
+
+// copyfile uploads the local file src to the rclone path dest, removing src
+// afterwards if move is set.
+func (d *rcloneDaemon) copyfile(src, dest string, move bool) error {
+	srcFs, srcRemote := filepath.Dir(src), filepath.Base(src)
+	dstFs, dstRemote := splitRemote(dest)
+	method := "operations/copyfile"
+	if move {
+		method = "operations/movefile"
+	}
+	return d.call(method, map[string]string{
+		"srcFs":     srcFs,
+		"srcRemote": srcRemote,
+		"dstFs":     dstFs,
+		"dstRemote": dstRemote,
+	}, nil)
+}
+
+// cat streams the content of the object at remote.
+func (d *rcloneDaemon) cat(remote string) (io.ReadCloser, error) {
+	fs, name := splitRemote(remote)
+	req, err := http.NewRequest(http.MethodGet, d.url+"["+url.PathEscape(fs)+"]/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// list returns the size of every file below remote, keyed by slash-separated
+// path relative to it.
+func (d *rcloneDaemon) list(remote string) (map[string]int64, error) {
+	var result struct {
+		List []struct {
+			Path string `json:"Path"`
+			Size int64  `json:"Size"`
+		} `json:"list"`
+	}
+	err := d.call("operations/list", map[string]interface{}{
+		"fs":     remote,
+		"remote": "",
+		"opt":    map[string]bool{"recurse": true, "filesOnly": true},
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(result.List))
+	for _, e := range result.List {
+		sizes[e.Path] = e.Size
+	}
+	return sizes, nil
+}
+
+// deletefile removes the object at remote.
+func (d *rcloneDaemon) deletefile(remote string) error {
+	fs, name := splitRemote(remote)
+	return d.call("operations/deletefile", map[string]string{"fs": fs, "remote": name}, nil)
+}
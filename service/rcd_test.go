@@ -0,0 +1,163 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubRcloneDaemon serves the parts of the rclone remote control API the
+// daemon is used for, over the local folders of "dummy:" remotes, counting
+// the requests for each method.
+func stubRcloneDaemon(t *testing.T) (*httptest.Server, map[string]int, *sync.Mutex) {
+	hits := make(map[string]int)
+	var mu sync.Mutex
+	local := func(fs, remote string) string {
+		return filepath.Join(strings.TrimPrefix(fs, "dummy:"), filepath.FromSlash(remote))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "u" || pass != "p" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		method := strings.TrimPrefix(r.URL.Path, "/")
+		if r.Method == http.MethodGet {
+			method = "serve"
+		}
+		mu.Lock()
+		hits[method]++
+		mu.Unlock()
+
+		var params map[string]string
+		switch method {
+		case "serve":
+			p := strings.TrimPrefix(r.URL.Path, "/[")
+			i := strings.Index(p, "]/")
+			http.ServeFile(w, r, local(p[:i], p[i+2:]))
+		case "operations/copyfile":
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&params))
+			src, err := os.Open(local(params["srcFs"], params["srcRemote"]))
+			assert.Nil(t, err)
+			defer src.Close()
+			dest := local(params["dstFs"], params["dstRemote"])
+			assert.Nil(t, os.MkdirAll(filepath.Dir(dest), 0755))
+			f, err := os.Create(dest)
+			assert.Nil(t, err)
+			io.Copy(f, src)
+			f.Close()
+			w.Write([]byte("{}"))
+		case "operations/list":
+			var req struct {
+				Fs string `json:"fs"`
+			}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+			type entry struct {
+				Path string
+				Size int64
+			}
+			list := []entry{}
+			root := local(req.Fs, "")
+			filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					rel, _ := filepath.Rel(root, p)
+					list = append(list, entry{filepath.ToSlash(rel), info.Size()})
+				}
+				return nil
+			})
+			json.NewEncoder(w).Encode(map[string]interface{}{"list": list})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"couldn't find method"}`))
+		}
+	}))
+	return server, hits, &mu
+}
+
+func TestRcloneDaemon(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	SetGitDir(setup.localpath)
+	defer SetGitDir("")
+
+	// The rclone binary only needs to check the remote is writable, and
+	// notes what it's asked to do
+	calls := filepath.Join(t.TempDir(), "calls")
+	scriptContent := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncase \"$1\" in\n" +
+		"  touch) : > \"${2#*:}\" ;;\n" +
+		"  deletefile) rm -f \"${2#*:}\" ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	server, hits, mu := stubRcloneDaemon(t)
+	defer server.Close()
+	rcd = &rcloneDaemon{url: server.URL + "/", user: "u", pass: "p", client: server.Client()}
+	defer func() { rcd = nil }()
+
+	base := "dummy:" + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	var downloads bytes.Buffer
+	initDownload(&downloads)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.FileExists(t, storagePath(setup.remotepath, file.oid))
+		addDownload(t, &downloads, file.oid, file.size)
+	}
+	finishDownload(&downloads)
+
+	stdout.Reset()
+	Serve(base, "", false, false, false, &downloads, &stdout, &stderr)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","path"`)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, len(setup.files), hits["operations/copyfile"])
+	assert.Equal(t, len(setup.files), hits["serve"])
+	assert.NotZero(t, hits["operations/list"])
+	b, _ := ioutil.ReadFile(calls)
+	assert.NotContains(t, string(b), "copyto")
+	assert.NotContains(t, string(b), "cat")
+	assert.NotContains(t, string(b), "lsjson")
+}
+
+func TestRcloneDaemonFallback(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// rclone rcd fails to start, but the commands themselves work
+	scriptContent := "#!/bin/sh\ncase \"$1\" in\n" +
+		"  copyto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; cp \"$2\" \"$dest\" ;;\n" +
+		"  touch) : > \"${2#*:}\" ;;\n" +
+		"  deletefile) rm -f \"${2#*:}\" ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	SetRcloneDaemon(true)
+	defer SetRcloneDaemon(false)
+
+	base := "dummy:" + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	assert.Contains(t, stderr.String(), "Unable to start rclone rcd")
+	assert.Nil(t, rcd)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.FileExists(t, storagePath(setup.remotepath, file.oid))
+	}
+}
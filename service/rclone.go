@@ -0,0 +1,472 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// rcloneBackend stores objects on an rclone remote ("remote:path") by
+// shelling out to the rclone binary.
+type rcloneBackend struct {
+	reporter
+	remote      string
+	compression string
+}
+
+func (b *rcloneBackend) withReporter(r reporter) Backend {
+	c := *b
+	c.reporter = r
+	return &c
+}
+
+func (b *rcloneBackend) checkWritable() error {
+	remote := fmt.Sprintf("%s/%s-%d", strings.TrimRight(b.remote, "/"), writeCheckName, os.Getpid())
+	release := acquireRclone()
+	defer release()
+	if out, err := rcloneCommand("touch", remote).CombinedOutput(); err != nil {
+		return fmt.Errorf("rclone touch failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return rcloneCommand("deletefile", remote).Run()
+}
+
+func (b *rcloneBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	if cacheDir != "" {
+		return openThroughCache(b.context(), b.remote, oid, size, b.compression)
+	}
+	rc, size, err := openRclone(b.context(), b.remote, oid, size, b.compression)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedReader{rc, size}, nil
+}
+
+func (b *rcloneBackend) Put(oid string, r io.Reader, size int64) error {
+	destPath := storagePath(b.remote, oid) + compressionExt(b.compression)
+	already, err := storeToRclone(b.context(), destPath, b.compression, r, size, oid, b.progress)
+	if err != nil {
+		return fmt.Errorf("error uploading %q via rclone: %w", oid, err)
+	}
+	if already {
+		return errAlreadyStored
+	}
+	return nil
+}
+
+// rcloneSem caps the number of rclone subprocesses running at once,
+// independently of how many transfers are in flight. nil means unlimited.
+var rcloneSem chan struct{}
+
+// SetRcloneMaxProcs limits the number of concurrent rclone invocations.
+// A value of zero or less removes the limit.
+func SetRcloneMaxProcs(n int) {
+	if n > 0 {
+		rcloneSem = make(chan struct{}, n)
+	} else {
+		rcloneSem = nil
+	}
+}
+
+// acquireRclone blocks until an rclone slot is available and returns the
+// function that releases it.
+func acquireRclone() func() {
+	sem := rcloneSem
+	if sem == nil {
+		return func() {}
+	}
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+// commandLog is where the rclone commands run are noted at trace verbosity.
+// Serve points it at stderr.
+var commandLog io.Writer
+
+// rcloneArgs are added to every rclone command.
+var rcloneArgs []string
+
+// SetRcloneArgs adds args, such as --config or --fast-list, to every rclone
+// command run. They follow the subcommand.
+func SetRcloneArgs(args []string) {
+	rcloneArgs = args
+}
+
+// rcloneCommand returns the rclone command with args, the first being the
+// subcommand, and the extra arguments set with SetRcloneArgs.
+func rcloneCommand(args ...string) *exec.Cmd {
+	return util.NewCmd("rclone", rcloneCommandArgs(args)...)
+}
+
+// rcloneCommandContext is like rcloneCommand, but the command is killed when
+// ctx is done, so a cancelled transfer doesn't leave rclone running.
+func rcloneCommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	return util.NewCmdContext(ctx, "rclone", rcloneCommandArgs(args)...)
+}
+
+func rcloneCommandArgs(args []string) []string {
+	if len(args) > 0 && len(rcloneArgs) > 0 {
+		args = append(append([]string{args[0]}, rcloneArgs...), args[1:]...)
+	}
+	if commandLog != nil && util.StderrEnabled(util.LevelTrace) {
+		util.WriteToStderrAt(util.LevelTrace, "Running rclone "+strings.Join(args, " ")+"\n", bufio.NewWriter(commandLog))
+	}
+	return args
+}
+
+func catRclone(remote string) ([]byte, error) {
+	stream, err := streamRclone(context.Background(), remote)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+// rcloneStream streams the output of `rclone cat` so that downloads report
+// progress as bytes arrive. Failure of the rclone process (for example a
+// missing object) is reported by Read in place of io.EOF. The rclone slot is
+// held until the stream has been fully read or closed.
+type rcloneStream struct {
+	cmd     *exec.Cmd
+	out     io.ReadCloser
+	release func()
+	done    bool
+	err     error
+}
+
+func streamRclone(ctx context.Context, remote string) (io.ReadCloser, error) {
+	if d := rcd; d != nil {
+		return d.cat(remote)
+	}
+	release := acquireRclone()
+	cmd := rcloneCommandContext(ctx, bwlimitArgs("cat", remote)...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		release()
+		return nil, err
+	}
+	return &rcloneStream{cmd: cmd, out: out, release: release}, nil
+}
+
+func (s *rcloneStream) Read(p []byte) (int, error) {
+	n, err := s.out.Read(p)
+	if err == io.EOF {
+		if werr := s.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (s *rcloneStream) Close() error {
+	s.out.Close()
+	return s.wait()
+}
+
+func (s *rcloneStream) wait() error {
+	if !s.done {
+		s.done = true
+		s.err = s.cmd.Wait()
+		s.release()
+	}
+	return s.err
+}
+
+// openRclone fetches an object from an rclone remote and returns a reader
+// over its decompressed content, together with its size (filled in from the
+// archive when the caller did not know it).
+func openRclone(ctx context.Context, base, oid string, size int64, compression string) (io.ReadCloser, int64, error) {
+	remote, compression, ok := rcloneListings.locate(ctx, base, oid, size, compression)
+	if !ok {
+		return nil, 0, fmt.Errorf("rclone path %w", errNotFound)
+	}
+	stream, err := streamRclone(ctx, remote)
+	if err != nil {
+		return nil, 0, fmt.Errorf("rclone path %w", errNotFound)
+	}
+	rc, err := decompressStream(compression, stream, size, oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sr, ok := rc.(*sizedReader); ok && size == 0 {
+		size = sr.size
+	}
+	return rc, size, nil
+}
+
+func storeToRclone(ctx context.Context, destPath, compression string, r io.Reader, size int64, oid string, cb copyCallback) (already bool, err error) {
+	if compression == "none" {
+		if remoteSize, ok := rcloneListings.stat(destPath, oid); ok && remoteSize == size {
+			if !verifyExisting {
+				return true, nil
+			}
+			if sum, err := hashsumRclone(destPath); err == nil && sum == oid {
+				return true, nil
+			}
+		}
+	}
+	// Keep the listing in step with what the upload leaves behind
+	defer func() {
+		if err == nil {
+			rcloneListings.stored(destPath, oid, size)
+		} else {
+			rcloneListings.removed(destPath, oid)
+		}
+	}()
+
+	compressed := compressionExt(compression) != ""
+	if compressed && rcloneStreamUploads {
+		// Stream through compression straight into rclone without staging.
+		// The source can only be read once, so it is hashed on the way
+		// through and the upload removed if it didn't match.
+		srcHash := newOidHash()
+		sent, err := rcatRclone(ctx, destPath, compression, io.TeeReader(throttle(r), srcHash), size, oid, cb)
+		if err != nil {
+			return false, err
+		}
+		if verifyUploads {
+			if sum := hex.EncodeToString(srcHash.Sum(nil)); sum != oid {
+				deleteRclone(destPath)
+				return false, fmt.Errorf("%w for %q: content hashes to %v", errHashMismatch, oid, sum)
+			}
+		}
+		return false, verifyRcloneUpload(destPath, oid, sent)
+	}
+
+	fromPath, cleanup, err := sourcePath(r)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup()
+
+	if verifyUploads {
+		sum, err := fileHash(fromPath)
+		if err != nil {
+			return false, err
+		}
+		if sum != oid {
+			return false, fmt.Errorf("%w for %q: content hashes to %v", errHashMismatch, oid, sum)
+		}
+	}
+
+	src := fromPath
+	var tmp *os.File
+	if compressed {
+		tmp, err = os.CreateTemp("", "elastic-git-storage")
+		if err != nil {
+			return false, err
+		}
+		defer os.Remove(tmp.Name())
+		srcf, err := os.Open(fromPath)
+		if err != nil {
+			tmp.Close()
+			return false, err
+		}
+		err = compressStream(compression, srcf, tmp, size, oid, nil)
+		srcf.Close()
+		if err != nil {
+			tmp.Close()
+			return false, err
+		}
+		if err := tmp.Close(); err != nil {
+			return false, err
+		}
+		src = tmp.Name()
+	}
+
+	// The expected remote hash is that of the file actually sent, which is
+	// the compressed temp file when compression is enabled.
+	expected := oid
+	if verifyUploads && src != fromPath {
+		if expected, err = fileHash(src); err != nil {
+			return false, err
+		}
+	}
+
+	// Staging files of our own can be moved rather than copied, freeing the
+	// space as soon as they're sent
+	_, inPlace := r.(*os.File)
+	staged := src != fromPath || !inPlace
+	if err := copytoRclone(ctx, src, destPath, size, moveUploads && staged, cb); err != nil {
+		return false, err
+	}
+
+	return false, verifyRcloneUpload(destPath, oid, expected)
+}
+
+// bwlimitArgs adds the bandwidth limit, if any, to the arguments of an
+// rclone command that moves object data itself.
+func bwlimitArgs(args ...string) []string {
+	if maxBandwidth > 0 {
+		args = append(args, fmt.Sprintf("--bwlimit=%dB", maxBandwidth))
+	}
+	return args
+}
+
+// rclonePercent matches the percentage in rclone's one-line stats output,
+// e.g. "Transferred:   1.250 MiB / 2.500 MiB, 50%, 1.2 MiB/s, ETA 1s".
+var rclonePercent = regexp.MustCompile(`(\d+)%`)
+
+// copytoRclone uploads src with `rclone copyto`, or `rclone moveto` if move
+// is set, translating rclone's progress output into callbacks in terms of
+// the source size.
+func copytoRclone(ctx context.Context, src, destPath string, size int64, move bool, cb copyCallback) error {
+	subcommand := "copyto"
+	if move {
+		subcommand = "moveto"
+	}
+	if d := rcd; d != nil {
+		// The API reports no progress, only when the copy is done
+		if err := d.copyfile(src, destPath, move); err != nil {
+			return err
+		}
+		if cb != nil {
+			cb(size, size, int(size))
+		}
+		return nil
+	}
+	release := acquireRclone()
+	defer release()
+	if cb == nil {
+		return rcloneCommandContext(ctx, bwlimitArgs(subcommand, src, destPath)...).Run()
+	}
+	cmd := rcloneCommandContext(ctx, bwlimitArgs(subcommand, src, destPath, "--progress", "--stats-one-line")...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var soFar int64
+	scanner := bufio.NewScanner(out)
+	scanner.Split(scanStatsLines)
+	for scanner.Scan() {
+		m := rclonePercent.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		pct, _ := strconv.ParseInt(m[1], 10, 64)
+		if n := size * pct / 100; n > soFar {
+			cb(size, n, int(n-soFar))
+			soFar = n
+		}
+	}
+	// Drain anything left so rclone never blocks on a full pipe
+	io.Copy(io.Discard, out)
+	return cmd.Wait()
+}
+
+// scanStatsLines splits rclone output on either carriage returns or
+// newlines, since interactive progress redraws the line with \r.
+func scanStatsLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// rcatRclone compresses src on the fly and pipes it to
+// `rclone rcat destPath`. It returns the OID hash of the bytes sent so the
+// upload can be verified.
+func rcatRclone(ctx context.Context, destPath, compression string, src io.Reader, size int64, oid string, cb copyCallback) (string, error) {
+	pr, pw := io.Pipe()
+	hasher := newOidHash()
+	compressErr := make(chan error, 1)
+	go func() {
+		err := compressStream(compression, src, io.MultiWriter(pw, hasher), size, oid, cb)
+		pw.CloseWithError(err)
+		compressErr <- err
+	}()
+
+	release := acquireRclone()
+	cmd := rcloneCommandContext(ctx, "rcat", destPath)
+	cmd.Stdin = pr
+	err := cmd.Run()
+	release()
+	// Unblock the compressor if rclone exited without reading everything
+	pr.Close()
+	if cerr := <-compressErr; cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// verifyRcloneUpload checks the remote object hashes to expected when upload
+// verification is enabled, removing it on mismatch.
+func verifyRcloneUpload(destPath, oid, expected string) error {
+	if !verifyUploads {
+		return nil
+	}
+	sum, err := hashsumRclone(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to verify upload: %v", err)
+	}
+	if sum != expected {
+		deleteRclone(destPath)
+		return fmt.Errorf("%w for %q after upload: remote hashes to %v", errHashMismatch, oid, sum)
+	}
+	return nil
+}
+
+// hashsumRclone returns the OID hash of a remote object, downloading it to
+// compute the hash if the backend does not support that hash natively, or
+// rclone doesn't know the hash at all.
+func hashsumRclone(remote string) (string, error) {
+	release := acquireRclone()
+	defer release()
+	if !rcloneHashes[oidHash] {
+		return catHashRclone(remote)
+	}
+	cmd := rcloneCommand("hashsum", oidHash, "--download", remote)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no hash returned for %v", remote)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// catHashRclone hashes a remote object as rclone cat streams it.
+func catHashRclone(remote string) (string, error) {
+	cmd := rcloneCommand("cat", remote)
+	hasher := newOidHash()
+	cmd.Stdout = hasher
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func deleteRclone(remote string) error {
+	if d := rcd; d != nil {
+		return d.deletefile(remote)
+	}
+	release := acquireRclone()
+	defer release()
+	return rcloneCommand("deletefile", remote).Run()
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// installFakeRclone puts an executable rclone running script first on PATH
+// for the rest of the test. The fake is a shell script, so the test is
+// skipped on Windows.
+func installFakeRclone(t *testing.T, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a fake rclone shell script")
+	}
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "rclone"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRcloneArgs(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	installFakeRclone(t, "#!/bin/sh\necho \"$*\" >> "+calls+"\nprintf hello\n")
+
+	SetRcloneArgs([]string{"--config", "/etc/rclone.conf", "--fast-list"})
+	defer SetRcloneArgs(nil)
+
+	content, err := catRclone("dummy:bucket/object")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+	assert.Nil(t, copytoRclone(context.Background(), "/tmp/object", "dummy:bucket/object", 5, false, nil))
+
+	b, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Equal(t, "cat --config /etc/rclone.conf --fast-list dummy:bucket/object\n"+
+		"copyto --config /etc/rclone.conf --fast-list /tmp/object dummy:bucket/object\n", string(b))
+}
+
+func TestUploadRcloneVerifyExisting(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// hashsum gets the real hash of everything but objects of 650 bytes
+	calls := filepath.Join(t.TempDir(), "calls")
+	scriptContent := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncase \"$1\" in\n" +
+		"  copyto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; cp \"$2\" \"$dest\" ;;\n" +
+		"  touch) : > \"${2#*:}\" ;;\n" +
+		"  deletefile) rm -f \"${2#*:}\" ;;\n" +
+		"  hashsum) p=${4#*:}\n    if [ \"$(stat -c %s \"$p\")\" = 650 ]; then echo \"0000  $p\"; else sha256sum \"$p\"; fi ;;\n" +
+		"  lsjson) cd \"${4#*:}\" || exit 1\n    printf '['\n    sep=''\n    find . -type f | while read -r f; do\n      printf '%s{\"Path\":\"%s\",\"Size\":%s}' \"$sep\" \"${f#./}\" \"$(stat -c %s \"$f\")\"\n      sep=','\n    done\n    printf ']\\n' ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	// Every object is already stored
+	for _, file := range setup.files {
+		content, err := ioutil.ReadFile(file.path)
+		assert.Nil(t, err)
+		destPath := storagePath(setup.remotepath, file.oid)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(destPath), 0755))
+		assert.Nil(t, ioutil.WriteFile(destPath, content, 0644))
+	}
+
+	SetVerifyExisting(true)
+	defer SetVerifyExisting(false)
+	base := "dummy:" + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	// but only the one the remote hashes wrongly is sent again
+	b, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Equal(t, len(setup.files), strings.Count(string(b), "hashsum"))
+	assert.Equal(t, 1, strings.Count(string(b), "copyto"))
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+	}
+}
+
+func TestUploadRcloneMove(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	calls := filepath.Join(t.TempDir(), "calls")
+	scriptContent := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncase \"$1\" in\n" +
+		"  copyto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; cp \"$2\" \"$dest\" ;;\n" +
+		"  moveto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; mv \"$2\" \"$dest\" ;;\n" +
+		"  touch) : > \"${2#*:}\" ;;\n" +
+		"  deletefile) rm -f \"${2#*:}\" ;;\n" +
+		"  hashsum) sha256sum \"${4#*:}\" ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	SetMoveUploads(true)
+	defer SetMoveUploads(false)
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	// The first object is uploaded from where git-lfs keeps it, which must
+	// never be removed
+	canonical := setup.files[0]
+	content, err := ioutil.ReadFile(canonical.path)
+	assert.Nil(t, err)
+	canonical.path = filepath.Join(setup.localpath, "lfs", "objects", canonical.oid[0:2], canonical.oid[2:4], canonical.oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(canonical.path), 0755))
+	assert.Nil(t, ioutil.WriteFile(canonical.path, content, 0644))
+	var input bytes.Buffer
+	initUpload(&input)
+	addUpload(t, &input, canonical.path, canonical.oid, canonical.size)
+	for _, file := range setup.files[1:] {
+		addUpload(t, &input, file.path, file.oid, file.size)
+	}
+	finishUpload(&input)
+
+	base := "--compression=lz4 dummy:" + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, &input, &stdout, &stderr)
+
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.FileExists(t, storagePath(setup.remotepath, file.oid)+".lz4")
+	}
+	b, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Equal(t, len(setup.files), strings.Count(string(b), "moveto"))
+	assert.NotContains(t, string(b), "copyto")
+
+	assert.FileExists(t, canonical.path)
+	for _, file := range setup.files[1:] {
+		assert.NoFileExists(t, file.path)
+	}
+}
+
+func TestDownloadRcloneZipSpooled(t *testing.T) {
+	remote, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(remote)
+	spool, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(spool)
+
+	scriptContent := "#!/bin/sh\ncase \"$1\" in\n" +
+		"  cat) cat \"${2#*:}\" ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+	// Spool files go to the temp dir
+	origTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", spool)
+	defer os.Setenv("TMPDIR", origTmp)
+
+	// An object of random data, stored in a zip archive without compression
+	const size = 32 * 1024 * 1024
+	content := make([]byte, size)
+	rand.Read(content)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	zipPath := storagePath(remote, oid) + ".zip"
+	assert.Nil(t, os.MkdirAll(filepath.Dir(zipPath), 0755))
+	f, err := os.Create(zipPath)
+	assert.Nil(t, err)
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: oid, Method: zip.Store})
+	assert.Nil(t, err)
+	_, err = w.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, f.Close())
+	content = nil
+
+	var input bytes.Buffer
+	initDownload(&input)
+	addDownload(t, &input, oid, size)
+	finishDownload(&input)
+
+	base := "--compression=zip dummy:" + remote
+	var stdout, stderr bytes.Buffer
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	Serve(base, base, false, false, false, &input, &stdout, &stderr)
+	runtime.ReadMemStats(&after)
+
+	paths := completionPaths(t, stdout.String())
+	if assert.Contains(t, paths, oid, stderr.String()) {
+		assert.Equal(t, oid, calculateFileHash(t, paths[oid]))
+		os.Remove(paths[oid])
+	}
+	// The archive never had to be held in memory
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/4))
+	// and its spool file is gone
+	entries, err := ioutil.ReadDir(spool)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// rcloneListing is the recursive listing of one folder of an rclone remote,
+// taken the first time an upload below it needs to know what's there, or
+// cut from the listing of a whole remote warmed for downloads.
+type rcloneListing struct {
+	once  sync.Once
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+// rcloneListingCache holds the listings of the top-level shard folders of
+// rclone remotes uploaded to, so that a push of many objects runs one rclone
+// process per folder to see which are already stored rather than one per
+// object. Objects written or deleted afterwards update the listing.
+type rcloneListingCache struct {
+	mu     sync.Mutex
+	dirs   map[string]*rcloneListing
+	warmed map[string]*rcloneWarmup
+}
+
+// rcloneWarmup is the listing of a whole remote taken for downloads; ok is
+// set once it has been spread across the folder listings.
+type rcloneWarmup struct {
+	once sync.Once
+	ok   bool
+}
+
+var rcloneListings = newRcloneListingCache()
+
+func newRcloneListingCache() *rcloneListingCache {
+	return &rcloneListingCache{dirs: make(map[string]*rcloneListing), warmed: make(map[string]*rcloneWarmup)}
+}
+
+// reset forgets every listing, so a new session sees objects others have
+// stored since.
+func (c *rcloneListingCache) reset() {
+	c.mu.Lock()
+	c.dirs = make(map[string]*rcloneListing)
+	c.warmed = make(map[string]*rcloneWarmup)
+	c.mu.Unlock()
+}
+
+// listingDir returns the folder whose listing covers destPath, the object
+// oid is stored at, and the path of the object relative to it: the first
+// shard folder below the remote, or the remote itself in the flat layout.
+func listingDir(destPath, oid string) (string, string) {
+	dir := filepath.Dir(destPath)
+	for i := 1; i < shardDepth && 2*i+2 <= len(oid); i++ {
+		dir = filepath.Dir(dir)
+	}
+	rel, err := filepath.Rel(dir, destPath)
+	if err != nil {
+		rel = filepath.Base(destPath)
+	}
+	return dir, filepath.ToSlash(rel)
+}
+
+// listing returns the listing of dir, taking it if this is the first time
+// it's needed. A folder that can't be listed, usually because nothing has
+// been stored there yet, is treated as empty; at worst an object already
+// stored is uploaded again.
+func (c *rcloneListingCache) listing(dir string) *rcloneListing {
+	c.mu.Lock()
+	l, ok := c.dirs[dir]
+	if !ok {
+		l = &rcloneListing{}
+		c.dirs[dir] = l
+	}
+	c.mu.Unlock()
+	l.once.Do(func() {
+		// Folders of a warmed remote that weren't in its listing are empty
+		if c.isWarmed(dir) {
+			l.sizes = make(map[string]int64)
+			return
+		}
+		sizes, err := listRclone(dir)
+		if err != nil {
+			sizes = make(map[string]int64)
+		}
+		l.sizes = sizes
+	})
+	return l
+}
+
+// stat returns the size of the object oid stored at destPath, and whether
+// it's there at all.
+func (c *rcloneListingCache) stat(destPath, oid string) (int64, bool) {
+	dir, rel := listingDir(destPath, oid)
+	l := c.listing(dir)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size, ok := l.sizes[rel]
+	return size, ok
+}
+
+// stored records that size bytes were written to destPath, if its folder
+// has been listed.
+func (c *rcloneListingCache) stored(destPath, oid string, size int64) {
+	c.update(destPath, oid, func(sizes map[string]int64, rel string) { sizes[rel] = size })
+}
+
+// removed records that destPath was deleted, if its folder has been listed.
+func (c *rcloneListingCache) removed(destPath, oid string) {
+	c.update(destPath, oid, func(sizes map[string]int64, rel string) { delete(sizes, rel) })
+}
+
+func (c *rcloneListingCache) update(destPath, oid string, f func(map[string]int64, string)) {
+	dir, rel := listingDir(destPath, oid)
+	c.mu.Lock()
+	l, ok := c.dirs[dir]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	// Wait for a listing being taken, so it can't overwrite this
+	l.once.Do(func() { l.sizes = make(map[string]int64) })
+	l.mu.Lock()
+	f(l.sizes, rel)
+	l.mu.Unlock()
+}
+
+// warm lists the whole of remote the first time it's asked to, and spreads
+// the listing across the folders below it, so that the downloads of a
+// session can tell an object isn't there without running rclone to fetch
+// it. It reports whether the listing was taken; if it couldn't be, each
+// object is fetched as before.
+func (c *rcloneListingCache) warm(remote string) bool {
+	c.mu.Lock()
+	w, ok := c.warmed[remote]
+	if !ok {
+		w = &rcloneWarmup{}
+		c.warmed[remote] = w
+	}
+	c.mu.Unlock()
+	w.once.Do(func() {
+		sizes, err := listRclone(remote)
+		if err != nil {
+			return
+		}
+		byDir := make(map[string]map[string]int64)
+		for rel, size := range sizes {
+			dir, inDir := listingDir(filepath.Join(remote, filepath.FromSlash(rel)), path.Base(rel))
+			if byDir[dir] == nil {
+				byDir[dir] = make(map[string]int64)
+			}
+			byDir[dir][inDir] = size
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for dir, sizes := range byDir {
+			// Folders uploads have already listed are kept, as they may
+			// have been written to since
+			if _, ok := c.dirs[dir]; !ok {
+				l := &rcloneListing{sizes: sizes}
+				l.once.Do(func() {})
+				c.dirs[dir] = l
+			}
+		}
+		w.ok = true
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return w.ok
+}
+
+// isWarmed reports whether dir is within a remote listed by warm.
+func (c *rcloneListingCache) isWarmed(dir string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if w, ok := c.warmed[dir]; ok && w.ok {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// locate returns where on the remote base the object oid is, and what it is
+// compressed with. In a download session the remote's listing is warmed and
+// says which is there: the object stored with compression or, as folder
+// stores also read, stored as it is, so that only that one is fetched. ok
+// is false if neither is. Outside a session nothing would ever refresh the
+// listing, so it isn't taken and the object is assumed to be stored with
+// compression.
+func (c *rcloneListingCache) locate(ctx context.Context, base, oid string, size int64, compression string) (remote, stored string, ok bool) {
+	remote = storagePath(base, oid) + compressionExt(compression)
+	if (reporter{ctx: ctx}).session().operation != "download" || !c.warm(base) {
+		return remote, compression, true
+	}
+	if listed, ok := c.stat(remote, oid); ok && (compression != "none" || size <= 0 || listed == size) {
+		return remote, compression, true
+	}
+	if plain := storagePath(base, oid); plain != remote {
+		if listed, ok := c.stat(plain, oid); ok && (size <= 0 || listed == size) {
+			return plain, "none", true
+		}
+	}
+	return "", "", false
+}
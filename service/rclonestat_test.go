@@ -0,0 +1,179 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadRcloneListsOnce(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	assert.Nil(t, SetShardDepth(0))
+	defer SetShardDepth(DefaultShardDepth)
+
+	// The fake rclone notes each command it runs in calls
+	calls := filepath.Join(t.TempDir(), "calls")
+	scriptContent := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncase \"$1\" in\n" +
+		"  copyto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; cp \"$2\" \"$dest\" ;;\n" +
+		"  touch) : > \"${2#*:}\" ;;\n" +
+		"  deletefile) rm -f \"${2#*:}\" ;;\n" +
+		"  lsjson) [ \"$2\" = \"-R\" ] || exit 1\n    cd \"${4#*:}\" || exit 1\n    printf '['\n    sep=''\n    find . -type f | while read -r f; do\n      printf '%s{\"Path\":\"%s\",\"Size\":%s}' \"$sep\" \"${f#./}\" \"$(stat -c %s \"$f\")\"\n      sep=','\n    done\n    printf ']\\n' ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	// One object is already stored
+	stored := setup.files[0]
+	content, err := ioutil.ReadFile(stored.path)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(setup.remotepath, stored.oid), content, 0644))
+
+	// count returns how many times each rclone command ran since last time
+	count := func() map[string]int {
+		b, _ := ioutil.ReadFile(calls)
+		os.Remove(calls)
+		n := make(map[string]int)
+		for _, c := range strings.Fields(string(b)) {
+			n[c]++
+		}
+		return n
+	}
+
+	base := "dummy:" + setup.remotepath
+	for _, copies := range []int{len(setup.files) - 1, 0} {
+		var stdout, stderr bytes.Buffer
+		Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+		for _, file := range setup.files {
+			assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+			assert.FileExists(t, filepath.Join(setup.remotepath, file.oid))
+		}
+		n := count()
+		assert.Equal(t, 1, n["lsjson"], "one listing for every upload")
+		assert.Equal(t, copies, n["copyto"])
+	}
+}
+
+// installListingRclone puts a fake rclone on PATH which can cat and list,
+// unless NO_LIST is set, and returns a func counting how many times each
+// command ran since it was last called.
+func installListingRclone(t *testing.T) func() map[string]int {
+	calls := filepath.Join(t.TempDir(), "calls")
+	scriptContent := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncase \"$1\" in\n" +
+		"  cat) cat \"${2#*:}\" ;;\n" +
+		"  lsjson) [ -z \"$NO_LIST\" ] && [ \"$2\" = \"-R\" ] || exit 1\n    cd \"${4#*:}\" || exit 1\n    printf '['\n    sep=''\n    find . -type f | while read -r f; do\n      printf '%s{\"Path\":\"%s\",\"Size\":%s}' \"$sep\" \"${f#./}\" \"$(stat -c %s \"$f\")\"\n      sep=','\n    done\n    printf ']\\n' ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	return func() map[string]int {
+		b, _ := ioutil.ReadFile(calls)
+		os.Remove(calls)
+		n := make(map[string]int)
+		for _, c := range strings.Fields(string(b)) {
+			n[c]++
+		}
+		return n
+	}
+}
+
+func TestDownloadRcloneWarmListing(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	count := installListingRclone(t)
+
+	// The rclone remote has only the first object; the folder after it
+	// has them all
+	remote, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(remote)
+	first := setup.files[0]
+	content, err := ioutil.ReadFile(storagePath(setup.remotepath, first.oid))
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(storagePath(remote, first.oid)), 0755))
+	assert.Nil(t, ioutil.WriteFile(storagePath(remote, first.oid), content, 0644))
+
+	serve := func() {
+		var stdout, stderr bytes.Buffer
+		base := "dummy:" + remote + ";" + setup.remotepath
+		Serve(base, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+		paths := completionPaths(t, stdout.String())
+		for _, file := range setup.files {
+			if assert.NotEmpty(t, paths[file.oid]) {
+				assert.Equal(t, file.oid, calculateFileHash(t, paths[file.oid]))
+				os.Remove(paths[file.oid])
+			}
+		}
+	}
+
+	// Without a listing, every object is looked for with rclone cat
+	os.Setenv("NO_LIST", "1")
+	serve()
+	os.Unsetenv("NO_LIST")
+	n := count()
+	assert.Equal(t, 1, n["lsjson"])
+	assert.Equal(t, len(setup.files), n["cat"])
+
+	// With one, only the object that's there is
+	serve()
+	n = count()
+	assert.Equal(t, 1, n["lsjson"], "one listing for the session")
+	assert.Equal(t, 1, n["cat"])
+
+	// Libraries have no session to refresh it, so don't list
+	path, err := Retrieve(Config{PullBaseDir: "dummy:" + remote}, first.oid, first.size)
+	if assert.Nil(t, err) {
+		os.Remove(path)
+	}
+	n = count()
+	assert.Equal(t, 0, n["lsjson"])
+	assert.Equal(t, 1, n["cat"])
+}
+
+func TestDownloadRcloneVariant(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	count := installListingRclone(t)
+
+	// The compressed remote holds one object compressed and another stored
+	// as it is; the folder after it has them all
+	remote, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(remote)
+	for i, file := range setup.files[:2] {
+		content, err := ioutil.ReadFile(storagePath(setup.remotepath, file.oid))
+		assert.Nil(t, err)
+		dest := storagePath(remote, file.oid)
+		if i == 0 {
+			content = compressForTest(t, "lz4", content)
+			dest += ".lz4"
+		}
+		assert.Nil(t, os.MkdirAll(filepath.Dir(dest), 0755))
+		assert.Nil(t, ioutil.WriteFile(dest, content, 0644))
+	}
+
+	var stdout, stderr bytes.Buffer
+	base := "--compression=lz4 dummy:" + remote + ";" + setup.remotepath
+	Serve(base, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		if assert.NotEmpty(t, paths[file.oid]) {
+			assert.Equal(t, file.oid, calculateFileHash(t, paths[file.oid]))
+			os.Remove(paths[file.oid])
+		}
+	}
+	// Each object the remote holds is fetched once, whichever way it's
+	// stored, and the others not at all
+	n := count()
+	assert.Equal(t, 1, n["lsjson"])
+	assert.Equal(t, 2, n["cat"])
+	assert.Equal(t, 2, strings.Count(stderr.String(), "<- dummy"))
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3API is the subset of the S3 client used by s3Backend, so tests can
+// substitute a fake. Uploads go through the SDK's upload manager, which
+// switches to a multipart upload for large objects.
+type s3API interface {
+	manager.UploadAPIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// s3Backend stores objects in an S3 bucket ("s3://bucket/prefix") through
+// the AWS SDK rather than rclone. Keys use the same sharded layout as local
+// stores, below the prefix.
+type s3Backend struct {
+	reporter
+	bucket      string
+	prefix      string
+	compression string
+	client      s3API
+	// err records a failure to set up the client, reported on each use.
+	err error
+}
+
+// newS3Backend creates a backend for an s3:// path. Credentials and region
+// come from the standard AWS environment variables, shared config files and
+// instance roles.
+func newS3Backend(path, compression string) *s3Backend {
+	bucket, prefix := parseS3Path(path)
+	b := &s3Backend{bucket: bucket, prefix: prefix, compression: compression}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		b.err = fmt.Errorf("unable to load AWS configuration: %v", err)
+		return b
+	}
+	b.client = s3.NewFromConfig(cfg)
+	return b
+}
+
+// parseS3Path splits "s3://bucket/prefix" into its bucket and key prefix.
+func parseS3Path(path string) (string, string) {
+	rest := path[len("s3://"):]
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	return bucket, strings.Trim(prefix, "/")
+}
+
+func (b *s3Backend) withReporter(r reporter) Backend {
+	c := *b
+	c.reporter = r
+	return &c
+}
+
+// key returns the object key for oid, matching storagePath.
+func (b *s3Backend) key(oid string) string {
+	return filepath.ToSlash(storagePath(b.prefix, oid)) + compressionExt(b.compression)
+}
+
+// stat returns the stored size of oid.
+func (b *s3Backend) stat(oid string) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	out, err := b.client.HeadObject(b.context(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(oid)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+func (b *s3Backend) Get(oid string, size int64) (io.ReadCloser, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	out, err := b.client.GetObject(b.context(), &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(oid)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decompressStream(b.compression, out.Body, aws.ToInt64(out.ContentLength), oid)
+}
+
+func (b *s3Backend) Put(oid string, r io.Reader, size int64) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.compression == "none" {
+		if stored, err := b.stat(oid); err == nil && stored == size {
+			return errAlreadyStored
+		}
+	}
+
+	src := throttle(r)
+	hasher := newOidHash()
+	if verifyUploads {
+		src = io.TeeReader(src, hasher)
+	}
+
+	var body io.Reader
+	var pr *io.PipeReader
+	compressErr := make(chan error, 1)
+	if b.compression == "none" {
+		body = &progressReader{r: src, size: size, cb: b.progress}
+		compressErr <- nil
+	} else {
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
+		go func() {
+			err := compressStream(b.compression, src, pw, size, oid, b.progress)
+			pw.CloseWithError(err)
+			compressErr <- err
+		}()
+		body = pr
+	}
+
+	key := b.key(oid)
+	_, err := manager.NewUploader(b.client).Upload(b.context(), &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	if pr != nil {
+		// Unblock the compressor if the upload stopped reading early
+		pr.Close()
+	}
+	if cerr := <-compressErr; cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading %q to s3://%v/%v: %w", oid, b.bucket, key, err)
+	}
+
+	if verifyUploads {
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != oid {
+			b.client.DeleteObject(b.context(), &s3.DeleteObjectInput{
+				Bucket: aws.String(b.bucket),
+				Key:    aws.String(key),
+			})
+			return fmt.Errorf("%w for %q: content hashes to %v", errHashMismatch, oid, sum)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an in-memory stand-in for the S3 client, keyed by bucket/key.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string][][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), parts: make(map[string][][]byte)}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(aws.ToString(in.Bucket) + "/" + aws.ToString(in.Key))}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := aws.ToString(in.UploadId)
+	n := int(aws.ToInt32(in.PartNumber))
+	for len(f.parts[id]) < n {
+		f.parts[id] = append(f.parts[id], nil)
+	}
+	f.parts[id][n-1] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", n))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := aws.ToString(in.UploadId)
+	f.objects[id] = bytes.Join(f.parts[id], nil)
+	delete(f.parts, id)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.parts, aws.ToString(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.ToString(in.Bucket)+"/"+aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestParseS3Path(t *testing.T) {
+	bucket, prefix := parseS3Path("s3://my-bucket/some/prefix/")
+	assert.Equal(t, "my-bucket", bucket)
+	assert.Equal(t, "some/prefix", prefix)
+
+	bucket, prefix = parseS3Path("s3://my-bucket")
+	assert.Equal(t, "my-bucket", bucket)
+	assert.Equal(t, "", prefix)
+}
+
+func TestS3Backend(t *testing.T) {
+	for _, compression := range []string{"none", "zip", "lz4", "zstd", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			client := newFakeS3()
+			b := &s3Backend{bucket: "bucket", prefix: "lfs/objects", compression: compression, client: client}
+			roundTrip(t, b)
+
+			// Keys use the same sharding as local stores
+			_, oid := testObject()
+			key := filepath.ToSlash(storagePath("lfs/objects", oid)) + compressionExt(compression)
+			assert.Equal(t, "lfs/objects/"+oid[0:2]+"/"+oid[2:4]+"/"+oid+compressionExt(compression), key)
+			_, ok := client.objects["bucket/"+key]
+			assert.True(t, ok, "object should be stored at %v", key)
+		})
+	}
+
+	client := newFakeS3()
+	b := &s3Backend{bucket: "bucket", compression: "none", client: client}
+	content, oid := testObject()
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	_, ok := client.objects["bucket/"+oid[0:2]+"/"+oid[2:4]+"/"+oid]
+	assert.True(t, ok, "an empty prefix should start keys at the shard folders")
+	assert.Equal(t, errAlreadyStored, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	_, err := b.Get("0000000000000000000000000000000000000000000000000000000000000000", 0)
+	assert.NotNil(t, err)
+}
+
+func TestS3BackendMultipart(t *testing.T) {
+	client := newFakeS3()
+	b := &s3Backend{bucket: "bucket", compression: "none", client: client}
+
+	// Larger than the upload manager's minimum part size
+	content := bytes.Repeat([]byte("0123456789abcdef"), 400*1024)
+	oid := "abcdef0123456789"
+	var reported int64
+	bound := b.withReporter(reporter{progress: func(totalSize, readSoFar int64, readSinceLast int) error {
+		reported = readSoFar
+		return nil
+	}})
+	assert.Nil(t, bound.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Equal(t, int64(len(content)), reported)
+	assert.Equal(t, content, client.objects["bucket/"+b.key(oid)])
+}
+
+func TestS3BackendVerify(t *testing.T) {
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	client := newFakeS3()
+	b := &s3Backend{bucket: "bucket", compression: "lz4", client: client}
+	content, _ := testObject()
+	oid := "0000000000000000000000000000000000000000000000000000000000000000"
+	assert.NotNil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	assert.Len(t, client.objects, 0, "mismatched upload should be removed")
+}
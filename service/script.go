@@ -0,0 +1,428 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// scriptProgressEnv names the environment variable holding the path of a
+// file that transfer scripts may append progress to, one line per update in
+// the form "progress <bytes>", where bytes is the total transferred so far.
+// Scripts which never write to it get a single progress event on completion.
+const scriptProgressEnv = "PROGRESS_FILE"
+
+// scriptProgressInterval is how often the progress file is polled.
+const scriptProgressInterval = 100 * time.Millisecond
+
+// scriptTimeout limits how long a transfer script may run; zero means no
+// limit.
+var scriptTimeout time.Duration
+
+// SetScriptTimeout sets the time limit for each run of a transfer script.
+// Zero or negative values remove the limit.
+func SetScriptTimeout(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	scriptTimeout = d
+}
+
+// scriptOutput controls whether the stdout and stderr of transfer scripts
+// are copied to the adapter's stderr.
+var scriptOutput bool
+
+// SetScriptOutput sets whether transfer script output is copied to stderr,
+// where git-lfs includes it in its trace output.
+func SetScriptOutput(enabled bool) {
+	scriptOutput = enabled
+}
+
+// checkScripts controls whether objects uploaded by scripts are read back
+// to check they were stored.
+var checkScripts bool
+
+// SetCheckScripts sets whether each upload by a transfer script that exits
+// zero is read back through the same script afterwards, so one that exits
+// zero without storing anything fails the transfer. It costs a download
+// per upload, and needs scripts that handle downloads too, so is off by
+// default.
+func SetCheckScripts(enabled bool) {
+	checkScripts = enabled
+}
+
+// scriptOutputLimit caps how much output is kept from a single script run.
+const scriptOutputLimit = 64 * 1024
+
+// cappedBuffer keeps the first scriptOutputLimit bytes written to it and
+// discards the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := scriptOutputLimit - c.buf.Len(); len(p) > room {
+		c.buf.Write(p[:room])
+		c.truncated = true
+	} else {
+		c.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// writeScriptOutput copies captured script output to errWriter, prefixing
+// each line with "[script]".
+func writeScriptOutput(output *cappedBuffer, errWriter *bufio.Writer) {
+	text := strings.TrimRight(output.buf.String(), "\r\n")
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(text, "\n") {
+		errWriter.WriteString("[script] " + strings.TrimRight(line, "\r") + "\n")
+	}
+	if output.truncated {
+		errWriter.WriteString(fmt.Sprintf("[script] (output truncated after %d bytes)\n", scriptOutputLimit))
+	}
+	errWriter.Flush()
+}
+
+// scriptShell is the interpreter and leading arguments used to run transfer
+// scripts, which are appended as the final argument. Empty means the
+// platform default, "sh -c", or "cmd /C" on Windows.
+var scriptShell []string
+
+// shellArgs gives the argument convention for interpreters named on their
+// own, keyed by executable name without extension.
+var shellArgs = map[string][]string{
+	"sh":         {"-c"},
+	"bash":       {"-c"},
+	"zsh":        {"-c"},
+	"dash":       {"-c"},
+	"ksh":        {"-c"},
+	"cmd":        {"/C"},
+	"pwsh":       {"-NoProfile", "-NonInteractive", "-Command"},
+	"powershell": {"-NoProfile", "-NonInteractive", "-Command"},
+}
+
+// powerShells are the PowerShell executables .ps1 scripts are run with, in
+// order of preference.
+var powerShells = []string{"pwsh", "powershell"}
+
+// ps1Args are the arguments .ps1 scripts are given to PowerShell with. Only
+// these bypass the execution policy, which would otherwise refuse to run
+// the script on a default Windows install; a shell chosen with
+// --script-shell keeps whatever policy is set.
+var ps1Args = []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command"}
+
+// SetScriptShell sets the interpreter for transfer scripts. shell is either
+// the name or path of a known shell (sh, bash, zsh, dash, ksh, cmd, pwsh or
+// powershell), which is given its usual argument for running a command, or
+// a full command line such as "bash -eu -c" to which the script is appended
+// as the last argument. An empty shell restores the platform default. It
+// returns an error if the interpreter can't be found.
+func SetScriptShell(shell string) error {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		scriptShell = nil
+		return nil
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return fmt.Errorf("script shell %q not found: %v", fields[0], err)
+	}
+	if len(fields) == 1 {
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(fields[0]), filepath.Ext(fields[0])))
+		args, ok := shellArgs[name]
+		if !ok {
+			return fmt.Errorf("unknown script shell %q, give its arguments too, e.g. %q", fields[0], fields[0]+" -c")
+		}
+		fields = append(fields, args...)
+	}
+	scriptShell = fields
+	return nil
+}
+
+// shellCommand returns the command line that runs script.
+func shellCommand(script string) []string {
+	if len(scriptShell) > 0 {
+		return append(append([]string{}, scriptShell...), script)
+	}
+	// cmd can't run PowerShell scripts, so without a shell chosen they are
+	// given to PowerShell when it is installed. The call operator lets the
+	// script's path be quoted.
+	if strings.EqualFold(filepath.Ext(scriptName(script)), ".ps1") {
+		for _, ps := range powerShells {
+			if path, err := exec.LookPath(ps); err == nil {
+				return append(append([]string{path}, ps1Args...), "& "+script)
+			}
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/C", script}
+	}
+	return []string{"sh", "-c", script}
+}
+
+// scriptName returns the program script runs: its first word, or the
+// quoted string it starts with.
+func scriptName(script string) string {
+	script = strings.TrimSpace(script)
+	if script != "" && (script[0] == '"' || script[0] == '\'') {
+		if end := strings.IndexByte(script[1:], script[0]); end >= 0 {
+			return script[1 : end+1]
+		}
+	}
+	if fields := strings.Fields(script); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// runScript runs a transfer script through the configured shell. If the script
+// exceeds scriptTimeout or ctx is cancelled, it is killed along with any
+// processes it started. The script's combined stdout and stderr are written
+// to output if it is not nil.
+func runScript(ctx context.Context, script string, env map[string]string, output io.Writer) error {
+	if scriptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scriptTimeout)
+		defer cancel()
+	}
+	command := shellCommand(script)
+	cmd := util.NewCmdContext(ctx, command[0], command[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	if output != nil {
+		cmd.Stdout = output
+		cmd.Stderr = output
+		// Don't wait forever on output from a killed script's leftovers
+		cmd.WaitDelay = time.Second
+	}
+	err := cmd.Run()
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("script timed out after %v: %q", scriptTimeout, script)
+	case ctx.Err() != nil:
+		return fmt.Errorf("script cancelled: %q", script)
+	}
+	return err
+}
+
+// runScriptWithProgress runs a transfer script, forwarding any progress it
+// writes to the file named by scriptProgressEnv to cb. It reports whether the
+// script emitted any progress so callers can fall back to a single event.
+// When scriptOutput is enabled, the script's output is copied to errWriter
+// once it has finished.
+func runScriptWithProgress(ctx context.Context, script string, env map[string]string, size int64, cb copyCallback, errWriter *bufio.Writer) (bool, error) {
+	pf, err := os.CreateTemp("", "elastic-git-storage-progress")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(pf.Name())
+	defer pf.Close()
+	env[scriptProgressEnv] = pf.Name()
+
+	// Output is written out after the script ends, from this goroutine, as
+	// errWriter is also used for progress messages
+	var output io.Writer
+	if scriptOutput && errWriter != nil {
+		captured := &cappedBuffer{}
+		defer writeScriptOutput(captured, errWriter)
+		output = captured
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runScript(ctx, script, env, output)
+	}()
+
+	reader := bufio.NewReader(pf)
+	var soFar int64
+	reported := false
+	forward := func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				// Partial line: rewind so it is re-read once complete
+				if len(line) > 0 {
+					pf.Seek(-int64(len(line)), io.SeekCurrent)
+					reader.Reset(pf)
+				}
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "progress" {
+				continue
+			}
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || n <= soFar {
+				continue
+			}
+			reported = true
+			if cb != nil {
+				cb(size, n, int(n-soFar))
+			}
+			soFar = n
+		}
+	}
+
+	ticker := time.NewTicker(scriptProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			forward()
+			return reported, err
+		case <-ticker.C:
+			forward()
+		}
+	}
+}
+
+// scriptBackend transfers objects by running a user-supplied shell command.
+// The script's environment is the adapter's own plus:
+//
+//	OID          the object ID
+//	SIZE         the object size in bytes
+//	OID_PATH     the sharded path of the object relative to a store root,
+//	             e.g. "ab/cd/abcd...", without any compression extension
+//	EVENT        "download" or "upload", for this transfer
+//	OPERATION    the operation git-lfs started the adapter for, from init
+//	REMOTE       the git remote git-lfs is transferring with, from init
+//	DEST         downloads only: the file to write the object to
+//	FROM         uploads only: the file to read the object from
+//	COMPRESSION  the configured compression mode, if any, for scripts that
+//	             store compressed copies
+//	PROGRESS_FILE
+//	             a file the script may append progress lines to; see
+//	             scriptProgressEnv
+//
+// OPERATION and REMOTE are empty if git-lfs did not send them.
+type scriptBackend struct {
+	reporter
+	script      string
+	compression string
+}
+
+func (b *scriptBackend) withReporter(r reporter) Backend {
+	c := *b
+	c.reporter = r
+	return &c
+}
+
+func (b *scriptBackend) env(event, oid string, size int64) map[string]string {
+	s := b.session()
+	env := map[string]string{
+		"OID":       oid,
+		"SIZE":      fmt.Sprintf("%d", size),
+		"EVENT":     event,
+		"OPERATION": s.operation,
+		"REMOTE":    s.remote,
+	}
+	if len(oid) >= 4 {
+		env["OID_PATH"] = storagePath("", oid)
+	}
+	if b.compression != "" {
+		env["COMPRESSION"] = b.compression
+	}
+	return env
+}
+
+// getFile runs the script to download oid directly to dest. Whatever a
+// failed script wrote there is removed, so the next store starts clean
+// rather than the LFS action taking it for a download to resume.
+func (b *scriptBackend) getFile(oid string, size int64, dest string) error {
+	env := b.env("download", oid, size)
+	env["DEST"] = dest
+	_, err := runScriptWithProgress(b.context(), b.script, env, size, b.progress, b.errWriter)
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+func (b *scriptBackend) Get(oid string, size int64) (io.ReadCloser, error) {
+	tmp, err := os.CreateTemp("", "elastic-git-storage")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	if err := b.getFile(oid, size, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &readCloser{f, func() error {
+		defer os.Remove(f.Name())
+		return f.Close()
+	}}, nil
+}
+
+func (b *scriptBackend) Put(oid string, r io.Reader, size int64) error {
+	fromPath, cleanup, err := sourcePath(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	env := b.env("upload", oid, size)
+	env["FROM"] = fromPath
+	_, err = runScriptWithProgress(b.context(), b.script, env, size, b.progress, b.errWriter)
+	if err != nil || !checkScripts {
+		return err
+	}
+	return b.checkStored(oid, size)
+}
+
+// checkStored reads oid back through the script after it was uploaded, and
+// returns an error unless it comes back whole: all of it with
+// --verify-uploads, otherwise just its size. It is how a script that exits
+// zero without storing anything is caught.
+func (b *scriptBackend) checkStored(oid string, size int64) error {
+	tmp, err := os.CreateTemp("", "elastic-git-storage")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	env := b.env("download", oid, size)
+	env["DEST"] = tmp.Name()
+	if _, err := runScriptWithProgress(b.context(), b.script, env, size, nil, b.errWriter); err != nil {
+		return fmt.Errorf("script exited zero but %q can't be read back from it: %v", oid, err)
+	}
+	stat, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if stat.Size() != size {
+		return fmt.Errorf("script exited zero but %q reads back as %d bytes rather than %d", oid, stat.Size(), size)
+	}
+	if verifyUploads {
+		sum, err := fileHash(tmp.Name())
+		if err != nil {
+			return err
+		}
+		if sum != oid {
+			return fmt.Errorf("%w for %q: it reads back from the script hashing to %v", errHashMismatch, oid, sum)
+		}
+	}
+	return nil
+}
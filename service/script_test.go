@@ -0,0 +1,279 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptProgress(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	srcDir, err := ioutil.TempDir("", "src")
+	assert.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+
+	content := []byte("0123456789")
+	srcFile := filepath.Join(srcDir, "file")
+	assert.Nil(t, ioutil.WriteFile(srcFile, content, 0644))
+	oid := calculateFileHash(t, srcFile)
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	script := fmt.Sprintf("echo 'progress 3' >> \"$%[1]s\"; sleep 0.3; echo 'progress 7' >> \"$%[1]s\"; cp %[2]s \"$DEST\"; echo 'progress 10' >> \"$%[1]s\"", scriptProgressEnv, srcFile)
+	assert.Nil(t, fetch(context.Background(), &scriptBackend{script: script}, gitDir, oid, int64(len(content)), writer, errWriter))
+
+	events := progressEvents(t, stdout.String(), oid)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, int64(3), events[0].BytesSoFar)
+		assert.Equal(t, 3, events[0].BytesSinceLast)
+		assert.Equal(t, int64(7), events[1].BytesSoFar)
+		assert.Equal(t, 4, events[1].BytesSinceLast)
+		assert.Equal(t, int64(10), events[2].BytesSoFar)
+	}
+
+	// A script that reports nothing still gets a single final event
+	stdout.Reset()
+	script = fmt.Sprintf("cp %s \"$DEST\"", srcFile)
+	assert.Nil(t, fetch(context.Background(), &scriptBackend{script: script}, gitDir, oid, int64(len(content)), writer, errWriter))
+	events = progressEvents(t, stdout.String(), oid)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, int64(len(content)), events[0].BytesSoFar)
+	}
+
+	// What a failing script wrote is removed, so the next store starts clean
+	tempPath, err := downloadTempPath(gitDir, oid)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(tempPath))
+	script = "echo partial > \"$DEST\"; exit 1"
+	assert.NotNil(t, fetch(context.Background(), &scriptBackend{script: script}, gitDir, oid, int64(len(content)), writer, errWriter))
+	entries, err := ioutil.ReadDir(filepath.Dir(tempPath))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestScriptDownloadChecked(t *testing.T) {
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	content, oid := testObject()
+
+	var stdout, stderr bytes.Buffer
+	writer, errWriter := bufio.NewWriter(&stdout), bufio.NewWriter(&stderr)
+	tempPath, err := downloadTempPath(gitDir, oid)
+	assert.Nil(t, err)
+
+	// A script that succeeds without writing the whole object fails it
+	script := "printf partial > \"$DEST\""
+	_, err = download(context.Background(), &scriptBackend{script: script}, gitDir, oid, int64(len(content)), writer, errWriter)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "short read")
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(tempPath))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	// as does one writing the wrong bytes, even at the right size
+	script = "head -c \"$SIZE\" /dev/zero > \"$DEST\""
+	_, err = download(context.Background(), &scriptBackend{script: script}, gitDir, oid, int64(len(content)), writer, errWriter)
+	assert.ErrorIs(t, err, errHashMismatch)
+	entries, err = ioutil.ReadDir(filepath.Dir(tempPath))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestScriptTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh and sleep")
+	}
+	SetScriptTimeout(200 * time.Millisecond)
+	defer SetScriptTimeout(0)
+
+	dir, err := ioutil.TempDir("", "scripttimeout")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	// The background child must be killed along with the shell, or it would
+	// create the marker once the sleep finishes
+	script := fmt.Sprintf("(sleep 1; touch %q) & sleep 30; wait", marker)
+	start := time.Now()
+	err = runScript(context.Background(), script, map[string]string{}, nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "timed out")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second, "script should be killed at the timeout")
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.NoFileExists(t, marker)
+
+	// Scripts that finish in time are unaffected
+	assert.Nil(t, runScript(context.Background(), "exit 0", map[string]string{}, nil))
+}
+
+func TestScriptOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+
+	_, oid := testObject()
+	script := "echo checking credentials; echo 'auth failed: token expired' >&2; exit 1"
+
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+
+	// Off by default
+	assert.NotNil(t, fetch(context.Background(), &scriptBackend{script: script}, gitDir, oid, 10, writer, errWriter))
+	assert.NotContains(t, stderr.String(), "token expired")
+
+	SetScriptOutput(true)
+	defer SetScriptOutput(false)
+	assert.NotNil(t, fetch(context.Background(), &scriptBackend{script: script}, gitDir, oid, 10, writer, errWriter))
+	assert.Contains(t, stderr.String(), "[script] checking credentials\n")
+	assert.Contains(t, stderr.String(), "[script] auth failed: token expired\n")
+}
+
+func TestScriptEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir, err := ioutil.TempDir("", "scriptenv")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "log")
+	srcPath := filepath.Join(dir, "object")
+	content, oid := testObject()
+	assert.Nil(t, ioutil.WriteFile(srcPath, content, 0644))
+
+	record := fmt.Sprintf(`|echo "$EVENT $OPERATION $REMOTE $OID_PATH" >> %q`, logPath)
+
+	var input bytes.Buffer
+	initUpload(&input)
+	addUpload(t, &input, srcPath, oid, int64(len(content)))
+	finishUpload(&input)
+	var stdout, stderr bytes.Buffer
+	Serve(record, record, false, false, false, &input, &stdout, &stderr)
+
+	// Downloads see the session of the init message too
+	ctx := withSession(context.Background(), session{operation: "download", remote: "upstream"})
+	var dlOut, dlErr bytes.Buffer
+	script := fmt.Sprintf(`echo "$EVENT $OPERATION $REMOTE $OID_PATH" >> %q && cp %q "$DEST"`, logPath, srcPath)
+	assert.Nil(t, fetch(ctx, &scriptBackend{script: script}, dir, oid, int64(len(content)), bufio.NewWriter(&dlOut), bufio.NewWriter(&dlErr)))
+
+	data, err := ioutil.ReadFile(logPath)
+	assert.Nil(t, err)
+	oidPath := filepath.Join(oid[0:2], oid[2:4], oid)
+	assert.Equal(t, "upload upload origin "+oidPath+"\n"+"download download upstream "+oidPath+"\n", string(data))
+}
+
+func TestScriptShell(t *testing.T) {
+	defer SetScriptShell("")
+
+	assert.NotNil(t, SetScriptShell("no-such-shell-elastic-git-storage"))
+	assert.Nil(t, scriptShell, "a failed setting should leave the default in place")
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	dir, err := ioutil.TempDir("", "scriptshell")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	// Arrays and [[ ]] are bash features that plain sh may reject
+	script := fmt.Sprintf(`parts=(a b c); [[ ${#parts[@]} -eq 3 ]] && echo "${parts[1]}" > %q`, out)
+
+	assert.Nil(t, SetScriptShell("bash"))
+	assert.Equal(t, []string{"bash", "-c", script}, shellCommand(script))
+	assert.Nil(t, runScript(context.Background(), script, map[string]string{}, nil))
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "b\n", string(data))
+
+	// A full command line is used as given
+	assert.Nil(t, SetScriptShell("bash -e -c"))
+	assert.NotNil(t, runScript(context.Background(), "false; true", map[string]string{}, nil))
+
+	if sh, err := exec.LookPath("sh"); err == nil {
+		assert.Nil(t, SetScriptShell(sh))
+		assert.Equal(t, []string{sh, "-c", "x"}, shellCommand("x"))
+	}
+}
+
+func TestPowerShellScriptDetection(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a stand-in pwsh shell script")
+	}
+	dir, err := ioutil.TempDir("", "pwsh")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	t.Setenv("PATH", dir)
+	pwsh := filepath.Join(dir, "pwsh")
+	args := []string{pwsh, "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command"}
+
+	// Without PowerShell installed, .ps1 scripts go to the default shell
+	assert.Equal(t, []string{"sh", "-c", "store.ps1"}, shellCommand("store.ps1"))
+
+	assert.Nil(t, ioutil.WriteFile(pwsh, []byte("#!/bin/sh\n"), 0755))
+	assert.Equal(t, append(args, "& store.ps1 -Verbose"), shellCommand("store.ps1 -Verbose"))
+	assert.Equal(t, append(args, `& "C:\My Scripts\Store.PS1"`), shellCommand(`"C:\My Scripts\Store.PS1"`))
+	assert.Equal(t, []string{"sh", "-c", "store.sh ps1"}, shellCommand("store.sh ps1"))
+
+	// A chosen shell is always used, and PowerShell chosen that way keeps
+	// the execution policy
+	defer SetScriptShell("")
+	scriptShell = []string{"bash", "-c"}
+	assert.Equal(t, []string{"bash", "-c", "store.ps1"}, shellCommand("store.ps1"))
+	assert.Nil(t, SetScriptShell("pwsh"))
+	assert.Equal(t, []string{"pwsh", "-NoProfile", "-NonInteractive", "-Command", "store.ps1"}, shellCommand("store.ps1"))
+}
+
+func TestPowerShellStoreScript(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("PowerShell scripts are run by default on Windows only")
+	}
+	dir, err := ioutil.TempDir("", "pwshstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	remote := filepath.Join(dir, "remote")
+	assert.Nil(t, os.Mkdir(remote, 0755))
+	content, oid := testObject()
+	fromPath := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(fromPath, content, 0644))
+
+	// The object's details are $env: variables
+	script := filepath.Join(dir, "store script.ps1")
+	body := fmt.Sprintf(`$stored = Join-Path '%s' $env:OID
+if ($env:EVENT -eq 'upload') {
+    if ((Get-Item -LiteralPath $env:FROM).Length -ne [int64]$env:SIZE) { exit 1 }
+    Copy-Item -LiteralPath $env:FROM -Destination $stored
+} else {
+    Copy-Item -LiteralPath $stored -Destination $env:DEST
+}
+`, remote)
+	assert.Nil(t, ioutil.WriteFile(script, []byte(body), 0644))
+
+	b := &scriptBackend{script: `"` + script + `"`}
+	assert.Nil(t, put(context.Background(), b, oid, fromPath, int64(len(content)), nil, nil))
+	data, err := ioutil.ReadFile(filepath.Join(remote, oid))
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+}
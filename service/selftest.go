@@ -0,0 +1,211 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// selfTestPrefix starts the name of the folder below a store that SelfTest
+// writes its object to, followed by a random suffix.
+const selfTestPrefix = ".elastic-git-storage-selftest-"
+
+// selfTestSize is the size of the random object SelfTest stores.
+const selfTestSize = 4096
+
+// SelfTest stores a small random object in every store of each base dir
+// string and reads it back, writing a line to out for each store saying
+// whether it passed, and what to check if it didn't. Folders, rclone remotes
+// and S3 buckets are tested in a folder of their own below the store which
+// is removed afterwards, so the real objects are never touched. Scripts are
+// handed the object like any other and have no way to delete it; HTTP
+// stores are read-only and only have to answer. The main entry is skipped,
+// since the LFS action only exists during a git-lfs transfer. It returns the
+// number of stores that failed.
+func SelfTest(baseDirs []string, out io.Writer) int {
+	content := make([]byte, selfTestSize)
+	rand.Read(content)
+	hasher := newOidHash()
+	hasher.Write(content)
+	oid := hex.EncodeToString(hasher.Sum(nil))
+	folder := selfTestPrefix + randomToken()
+
+	failed := 0
+	seen := make(map[baseDirConfig]bool)
+	for _, baseDir := range baseDirs {
+		for _, cfg := range parseBaseDirs(baseDir) {
+			if seen[cfg] {
+				continue
+			}
+			seen[cfg] = true
+			name := selfTestName(cfg)
+			if cfg.main {
+				fmt.Fprintf(out, "skipped %v: only git-lfs can provide it, during a transfer\n", name)
+				continue
+			}
+			err := selfTestStore(cfg, folder, oid, content)
+			if err == nil {
+				fmt.Fprintf(out, "ok      %v\n", name)
+				continue
+			}
+			failed++
+			fmt.Fprintf(out, "FAILED  %v: %v\n", name, err)
+			fmt.Fprintf(out, "        %v\n", selfTestHint(cfg, err))
+		}
+	}
+	return failed
+}
+
+// selfTestName describes the store cfg configures in SelfTest's report.
+func selfTestName(cfg baseDirConfig) string {
+	switch {
+	case cfg.main:
+		return "LFS action (" + mainEntry + ")"
+	case cfg.script:
+		return "script " + cfg.path
+	}
+	var kind string
+	switch newBackend(cfg).(type) {
+	case *s3Backend:
+		kind = "s3"
+	case *httpBackend:
+		kind = "http"
+	case *lfsObjectsBackend:
+		kind = "git-lfs objects"
+	case *rcloneBackend:
+		kind = "rclone"
+	default:
+		kind = "folder"
+	}
+	if cfg.compression != "none" {
+		return fmt.Sprintf("%v %v (%v)", kind, cfg.path, cfg.compression)
+	}
+	return kind + " " + cfg.path
+}
+
+// selfTestStore stores content as oid through the store cfg configures,
+// below folder where the store has folders, reads it back and removes it.
+func selfTestStore(cfg baseDirConfig, folder, oid string, content []byte) error {
+	size := int64(len(content))
+	var cleanup func() error
+	b := newBackend(cfg)
+	switch b := b.(type) {
+	case *httpBackend:
+		// Nothing can be stored, but a missing object shows the store answers
+		rc, err := b.Get(oid, size)
+		if err == nil {
+			rc.Close()
+			return nil
+		}
+		var httpErr *httpStatusError
+		if errors.As(err, &httpErr) && httpErr.code == 404 {
+			return nil
+		}
+		return fmt.Errorf("unable to reach the store: %w", err)
+	case *lfsObjectsBackend:
+		// Nothing may be stored in another repository's objects
+		if info, err := os.Stat(b.dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%v is not a folder", b.dir)
+		}
+		return nil
+	case *dirBackend:
+		if info, err := os.Stat(b.dir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%v is not a folder", b.dir)
+		}
+		b.dir = filepath.Join(b.dir, folder)
+		cleanup = func() error { return os.RemoveAll(b.dir) }
+	case *rcloneBackend:
+		if strings.HasSuffix(b.remote, ":") {
+			b.remote += folder
+		} else {
+			b.remote = strings.TrimRight(b.remote, "/") + "/" + folder
+		}
+		cleanup = func() error { return purgeRclone(b.remote) }
+	case *s3Backend:
+		b.prefix = path.Join(b.prefix, folder)
+		cleanup = func() error {
+			if b.err != nil {
+				return nil
+			}
+			_, err := b.client.DeleteObject(b.context(), &s3.DeleteObjectInput{
+				Bucket: aws.String(b.bucket),
+				Key:    aws.String(b.key(oid)),
+			})
+			return err
+		}
+	}
+
+	err := selfTestRoundTrip(b, oid, content)
+	if cleanup != nil {
+		if cerr := cleanup(); cerr != nil && err == nil {
+			err = fmt.Errorf("unable to remove the test object: %w", cerr)
+		}
+	}
+	return err
+}
+
+// selfTestRoundTrip stores content as oid in b and checks that the same
+// content comes back.
+func selfTestRoundTrip(b Backend, oid string, content []byte) error {
+	size := int64(len(content))
+	if err := b.Put(oid, bytes.NewReader(content), size); err != nil && err != errAlreadyStored {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	rc, err := b.Get(oid, size)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("%w: downloaded %d bytes which don't match the %d uploaded", errHashMismatch, len(got), len(content))
+	}
+	return nil
+}
+
+// selfTestHint suggests what to check about the store cfg configures after
+// it failed with err.
+func selfTestHint(cfg baseDirConfig, err error) string {
+	if cfg.script {
+		return "Check the script stores $FROM as $OID on upload and writes it to $DEST on download; --script-output shows what it prints"
+	}
+	if errors.Is(err, errHashMismatch) {
+		return "Check the --compression setting matches what the store holds"
+	}
+	switch newBackend(cfg).(type) {
+	case *s3Backend:
+		return "Check the bucket exists and AWS credentials allowing access to it are set up"
+	case *httpBackend:
+		return "Check the URL and that the server is running"
+	case *rcloneBackend:
+		return "Check the remote is listed by `rclone listremotes` and can be written to, e.g. with `rclone touch`"
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return "Check the path in lfs.folderstore.pull or lfs.folderstore.push; the folder must exist"
+	}
+	return "Check the folder can be written to by this user"
+}
+
+// purgeRclone removes remote and everything below it.
+func purgeRclone(remote string) error {
+	release := acquireRclone()
+	defer release()
+	return rcloneCommand("purge", remote).Run()
+}
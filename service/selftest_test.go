@@ -0,0 +1,81 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-selftest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	folder := filepath.Join(dir, "folder")
+	remote := filepath.Join(dir, "remote")
+	assert.Nil(t, os.Mkdir(folder, 0755))
+	assert.Nil(t, os.Mkdir(remote, 0755))
+	// An object already stored must be left alone
+	existing := storagePath(folder, strings.Repeat("ab", 32))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(existing), 0755))
+	assert.Nil(t, ioutil.WriteFile(existing, []byte("keep"), 0644))
+
+	calls := filepath.Join(t.TempDir(), "calls")
+	scriptContent := "#!/bin/sh\necho \"$1\" >> " + calls + "\ncase \"$1\" in\n" +
+		"  copyto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; cp \"$2\" \"$dest\" ;;\n" +
+		"  cat) cat \"${2#*:}\" ;;\n" +
+		"  purge) rm -rf \"${2#*:}\" ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, scriptContent)
+
+	missing := filepath.Join(dir, "missing")
+	var out bytes.Buffer
+	failed := SelfTest([]string{
+		folder + ";--compression=lz4 " + folder + ";@main",
+		"dummy:" + remote + ";" + folder + ";" + missing,
+	}, &out)
+
+	assert.Equal(t, 1, failed)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 6) {
+		assert.Equal(t, "ok      folder "+folder, lines[0])
+		assert.Equal(t, "ok      folder "+folder+" (lz4)", lines[1])
+		assert.Equal(t, "skipped LFS action (@main): only git-lfs can provide it, during a transfer", lines[2])
+		assert.Equal(t, "ok      rclone dummy:"+remote, lines[3])
+		assert.True(t, strings.HasPrefix(lines[4], "FAILED  folder "+missing+": "), lines[4])
+		assert.Contains(t, lines[5], "the folder must exist")
+	}
+	b, err := ioutil.ReadFile(calls)
+	assert.Nil(t, err)
+	assert.Equal(t, "lsjson\ncopyto\ncat\npurge\n", string(b))
+
+	// Nothing is left behind, and nothing else is touched
+	entries, err := ioutil.ReadDir(folder)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.FileExists(t, existing)
+	entries, err = ioutil.ReadDir(remote)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+	assert.NoDirExists(t, missing)
+}
+
+func TestSelfTestMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-selftest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The script stores nothing and downloads the wrong content
+	script := filepath.Join(dir, "store.sh")
+	assert.Nil(t, ioutil.WriteFile(script, []byte("#!/bin/sh\n[ \"$EVENT\" = download ] && echo wrong > \"$DEST\"\nexit 0\n"), 0755))
+
+	var out bytes.Buffer
+	failed := SelfTest([]string{"|" + script}, &out)
+	assert.Equal(t, 1, failed)
+	assert.Contains(t, out.String(), "FAILED  script "+script+": ")
+	assert.Contains(t, out.String(), "writes it to $DEST on download")
+}
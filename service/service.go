@@ -3,18 +3,28 @@ package service
 import (
 	"archive/zip"
 	"bufio"
-	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
 
 	"github.com/sinbad/lfs-folderstore/api"
 	"github.com/sinbad/lfs-folderstore/util"
@@ -24,17 +34,33 @@ type baseDirConfig struct {
 	path        string
 	compression string
 	script      bool
+	// main marks where the LFS action of each request comes in the order
+	main bool
+	// layout is "lfs" for a git-lfs object store, and empty otherwise
+	layout string
 }
 
+// mainEntry is the base directory entry standing for the main LFS server,
+// through the action git-lfs gives with each request, e.g.
+// "/mnt/share;@main;remote:lfs" tries it after the share and before rclone.
+const mainEntry = "@main"
+
 // tierName returns a human-readable name for a provider path.
 // Local filesystem paths are labelled "local cache"; rclone remotes
 // (which contain a colon that is not a Windows drive letter) are
 // labelled with the remote name portion (e.g. "WebDAV" from
-// "webdav:bucket/path"); script providers are labelled "script".
+// "webdav:bucket/path"); natively handled URLs are labelled with their
+// scheme (e.g. "S3"); script providers are labelled "script".
 func tierName(cfg baseDirConfig) string {
+	if cfg.main {
+		return "LFS action"
+	}
 	if cfg.script {
 		return "script"
 	}
+	if scheme := util.URLScheme(cfg.path); scheme != "" {
+		return strings.ToUpper(scheme)
+	}
 	if util.IsRclonePath(cfg.path) {
 		// Extract the rclone remote name before the colon.
 		if idx := strings.Index(cfg.path, ":"); idx > 0 {
@@ -133,259 +159,842 @@ func (t *downloadTracker) tierSummary() string {
 	return strings.Join(parts, ", ")
 }
 
+// DefaultMaxLine is the default limit on the length of a request line from
+// git-lfs.
+const DefaultMaxLine = 1024 * 1024
+
+// minMaxLine keeps the limit above the length of any ordinary request.
+const minMaxLine = 4 * 1024
+
+// maxLine is the longest request line Serve accepts.
+var maxLine = DefaultMaxLine
+
+// SetMaxLine sets the longest request line, in bytes, accepted from git-lfs.
+// Requests carrying actions with many headers can exceed the default.
+func SetMaxLine(n int) error {
+	if n < minMaxLine {
+		return fmt.Errorf("max line %d is less than %d", n, minMaxLine)
+	}
+	maxLine = n
+	return nil
+}
+
+// terminateGrace is how long in-flight transfers are given to finish once
+// the adapter is told to terminate before they are cancelled.
+var terminateGrace = 30 * time.Second
+
+// minSize and maxSize bound the sizes of the objects the stores are used
+// for; zero means no bound.
+var minSize, maxSize int64
+
+// SetSizeRange limits the stores to objects of at least min and at most max
+// bytes, zero meaning no limit, so that objects not worth keeping there go
+// straight to the LFS remote through the action git-lfs gives. Where there
+// is no action, the stores are used after all so the object can still be
+// transferred.
+func SetSizeRange(min, max int64) error {
+	if min < 0 || max < 0 {
+		return fmt.Errorf("object size limits can't be negative")
+	}
+	if max > 0 && min > max {
+		return fmt.Errorf("minimum object size %d is more than the maximum %d", min, max)
+	}
+	minSize, maxSize = min, max
+	return nil
+}
+
+// actionOnly returns just the main entry of providers when an object of
+// size bytes is outside the size range and can be transferred through the
+// action a, as it can if useAction is set or providers have a main entry;
+// otherwise providers as they are.
+func actionOnly(providers []provider, size int64, useAction bool, a *api.Action, errWriter *bufio.Writer) []provider {
+	if (size >= minSize && (maxSize == 0 || size <= maxSize)) || a == nil || !(useAction || hasMain(providers)) {
+		return providers
+	}
+	util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Passing over the stores for an object of %d bytes, outside the size range\n", size), errWriter)
+	for _, p := range providers {
+		if p.cfg.main {
+			return []provider{p}
+		}
+	}
+	return withMain(nil)
+}
+
+// readOnly and writeOnly restrict the adapter to downloads or to uploads.
+var readOnly, writeOnly bool
+
+// SetAccessMode restricts the adapter to downloads (readOnly) or to uploads
+// (writeOnly). Requests of the other kind are refused with a transfer error
+// and nothing is read or written for them. Setting both is an error.
+func SetAccessMode(ro, wo bool) error {
+	if ro && wo {
+		return fmt.Errorf("read-only and write-only modes can't be combined")
+	}
+	readOnly, writeOnly = ro, wo
+	return nil
+}
+
 // Serve starts the protocol server
 // usePullAction/usePushAction indicate whether to fall back to LFS actions
 // for downloads and uploads respectively.
-func Serve(pullBaseDir, pushBaseDir string, usePullAction, usePushAction, writeAll bool, stdin io.Reader, stdout, stderr io.Writer) {
+// Transfers are processed by a pool of workers sized from the init message's
+// concurrenttransfers; terminate waits for in-flight transfers, cancelling
+// HTTP work that is still running after terminateGrace.
+// Each failed transfer is reported to git-lfs as it happens, and the session
+// carries on; once it ends, an error is returned if anything went wrong, for
+// callers that want to exit with an error. It wraps ErrTransfersFailed if
+// any transfer failed, including requests for events the adapter doesn't
+// know, ErrInitFailed if an init message was answered with an error, and
+// the error reading requests, such as bufio.ErrTooLong, if they couldn't
+// all be read.
+func Serve(pullBaseDir, pushBaseDir string, usePullAction, usePushAction, writeAll bool, stdin io.Reader, stdout, stderr io.Writer) error {
+	return ServeContext(context.Background(), pullBaseDir, pushBaseDir, usePullAction, usePushAction, writeAll, stdin, stdout, stderr)
+}
 
-	scanner := bufio.NewScanner(stdin)
-	// Allow requests larger than the default 64 KB limit by raising the
-	// maximum token size to 1 MB.
-	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
-	writer := bufio.NewWriter(stdout)
-	errWriter := bufio.NewWriter(stderr)
+// ServeContext is like Serve, but stops when ctx is done as well as when
+// stdin ends, for programs that host the adapter and need to stop it. The
+// transfers in flight are cancelled, their HTTP requests, rclone commands
+// and scripts aborted, and the temp files they were writing removed before
+// it returns ctx's error; partial downloads that can be resumed are kept.
+// Signals are left to the caller, which can stop the session on Ctrl-C by
+// passing a context from signal.NotifyContext.
+func ServeContext(parent context.Context, pullBaseDir, pushBaseDir string, usePullAction, usePushAction, writeAll bool, stdin io.Reader, stdout, stderr io.Writer) error {
 
+	scanner := bufio.NewScanner(stdin)
+	// Allow requests larger than the default 64 KB limit, up to maxLine
+	initial := 64 * 1024
+	if maxLine < initial {
+		initial = maxLine
+	}
+	scanner.Buffer(make([]byte, initial), maxLine)
+	out := util.NewSyncWriter(stdout)
+	errOut := util.NewSyncWriter(stderr)
+	writer := bufio.NewWriter(out)
+	errWriter := bufio.NewWriter(errOut)
+	commandLog = errOut
+	defer func() { commandLog = nil }()
+
+	// Without a repository, downloads go to the temp dir instead
 	gitDir, err := gitDir()
 	if err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to retrieve git dir: %v\n", err), errWriter)
-		return
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to retrieve git dir, downloading to %v: %v\n", downloadTempDir(""), err), errWriter)
+		gitDir = ""
 	}
 
+	checkTempVolume(gitDir, errWriter)
+	baseDirs := []string{pullBaseDir}
+	if pushBaseDir != "" && pushBaseDir != pullBaseDir {
+		baseDirs = append(baseDirs, pushBaseDir)
+	}
+	for _, baseDir := range baseDirs {
+		for _, dup := range duplicateBaseDirs(baseDir) {
+			util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Warning: %q is listed more than once in %q, only the first is used\n", dup, baseDir), errWriter)
+		}
+	}
+	rcloneListings.reset()
+	if useRcloneDaemon && usesRclone(pullBaseDir+";"+pushBaseDir) {
+		if d, err := startRcloneDaemon(); err != nil {
+			util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to start rclone rcd, running rclone for each operation instead: %v\n", err), errWriter)
+		} else {
+			rcd = d
+			defer func() {
+				rcd = nil
+				d.stop()
+			}()
+		}
+	}
+	cleanDownloadTemp(gitDir, errWriter)
+
 	tracker := newDownloadTracker()
+	metrics := newTransferMetrics()
+	downloads := newDownloadGroup()
+
+	// Cancelled to abort in-flight HTTP work still running once the
+	// shutdown grace period has passed, or when parent is done
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// The temp files this session's transfers are writing, removed if it's
+	// cancelled rather than left behind
+	temps := newTempRegistry()
+	ctx = withTemps(ctx, temps)
+	served := make(chan struct{})
+	defer close(served)
+
+	// Transfers run the same code as Retrieve and Store, along with the
+	// protocol messages and LFS actions only a git-lfs session has
+	cfg := Config{PullBaseDir: pullBaseDir, PushBaseDir: pushBaseDir, WriteAll: writeAll, GitDir: gitDir}
+	pullProviders := cfg.pullProviders()
+	pushProviders := cfg.pushProviders()
+
+	// sessionCtx carries the operation and remote from the init message.
+	// It is only replaced while no workers are running.
+	sessionCtx := ctx
+	transfer := func(req *api.Request, writer, errWriter *bufio.Writer) {
+		defer failOnPanic(req, metrics, writer, errWriter)
+		ctx := sessionCtx
+		if err := checkOid(req.Oid); err != nil {
+			api.SendTransferError(req.Oid, codeInvalidOid, fmt.Sprintf("Cannot transfer %q: %v", req.Oid, err), writer, errWriter)
+			metrics.record(req.Event, req.Size, err)
+			return
+		}
+		switch req.Event {
+		case "download":
+			if writeOnly {
+				api.SendTransferError(req.Oid, codeAccessMode, fmt.Sprintf("Cannot download %q: adapter is write-only", req.Oid), writer, errWriter)
+				metrics.record(req.Event, req.Size, errors.New("adapter is write-only"))
+				return
+			}
+			err := retrieve(ctx, pullProviders, cfg.GitDir, req.Oid, req.Size, usePullAction, req.Action, tracker, downloads, writer, errWriter)
+			metrics.record(req.Event, req.Size, err)
+		case "upload":
+			if readOnly {
+				api.SendTransferError(req.Oid, codeAccessMode, fmt.Sprintf("Cannot upload %q: adapter is read-only", req.Oid), writer, errWriter)
+				metrics.record(req.Event, req.Size, errors.New("adapter is read-only"))
+				return
+			}
+			util.WriteToStderr(fmt.Sprintf("Received upload request for %s\n", req.Oid), errWriter)
+			err := store(ctx, pushProviders, req.Oid, req.Size, usePushAction, cfg.WriteAll, req.Action, req.Path, writer, errWriter)
+			metrics.record(req.Event, req.Size, err)
+		}
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	var jobs chan *api.Request
+	var wg sync.WaitGroup
+	startWorkers := func(n int) {
+		if n < 1 {
+			n = 1
+		}
+		jobs = make(chan *api.Request)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(jobs <-chan *api.Request) {
+				defer wg.Done()
+				// Each worker has its own buffers over the shared SyncWriters
+				// so every message is emitted as one intact line.
+				writer := bufio.NewWriter(out)
+				errWriter := bufio.NewWriter(errOut)
+				for req := range jobs {
+					transfer(req, writer, errWriter)
+				}
+			}(jobs)
+		}
+	}
+	stopWorkers := func() {
+		if jobs != nil {
+			close(jobs)
+			wg.Wait()
+			jobs = nil
+		}
+	}
+	// shutdown waits for in-flight transfers, cancelling any that are still
+	// running after terminateGrace, such as requests to a hung server.
+	shutdown := func() {
+		timer := time.AfterFunc(terminateGrace, cancel)
+		stopWorkers()
+		timer.Stop()
+	}
+	defer shutdown()
+
+	// Requests are read on their own goroutine so a cancelled context is
+	// noticed while waiting on git-lfs. The reader is left blocked on stdin
+	// if so; there is no way to interrupt it.
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-served:
+				return
+			}
+		}
+	}()
+
+	// initErr is the first init failure, kept for the error returned
+	var initErr error
+requests:
+	for {
+		var line string
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				break requests
+			}
+			line = l
+		case <-parent.Done():
+			// Temp files are removed straight away, in case a transfer is
+			// slow to notice; other sessions in the process carry on
+			cancel()
+			removed := temps.removeAll()
+			shutdown()
+			util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Stopping elastic-git-storage custom adapter: %v, removed %d temp file(s)\n", parent.Err(), removed), errWriter)
+			return parent.Err()
+		}
 		var req api.Request
 
 		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			util.WriteToStderr(fmt.Sprintf("Unable to parse request: %v\n", line), errWriter)
+			util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to parse request: %v\n", line), errWriter)
 			continue
 		}
 
 		switch req.Event {
 		case "init":
 			resp := &api.InitResponse{}
+			// A push to stores that can't be written fails at once rather
+			// than object by object
+			var writeErr error
+			if req.Operation == "upload" && !readOnly && !dryRun {
+				writeErr = checkWritable(pushProviders)
+			}
 			if len(pullBaseDir) == 0 {
-				resp.Error = &api.TransferError{Code: 9, Message: "Base directory not specified, check config"}
+				resp.Error = &api.TransferError{Code: codeNoBaseDir, Message: "Base directory not specified, check config"}
+			} else if writeErr != nil {
+				resp.Error = &api.TransferError{Code: codeNotWritable, Message: fmt.Sprintf("Upload destination is not writable: %v", writeErr)}
 			} else {
 				util.WriteToStderr(fmt.Sprintf("Initialised elastic-git-storage custom adapter for %s\n", req.Operation), errWriter)
 			}
+			if resp.Error != nil && initErr == nil {
+				initErr = fmt.Errorf("%w: %s", ErrInitFailed, resp.Error.Message)
+			}
+			stopWorkers()
+			sessionCtx = withSession(ctx, session{operation: req.Operation, remote: req.Remote})
+			workers := 1
+			if req.Concurrent {
+				workers = req.ConcurrentTransfers
+			}
+			startWorkers(workers)
 			api.SendResponse(resp, writer, errWriter)
-		case "download":
-			retrieve(pullBaseDir, gitDir, req.Oid, req.Size, usePullAction, req.Action, tracker, writer, errWriter)
-		case "upload":
-			util.WriteToStderr(fmt.Sprintf("Received upload request for %s\n", req.Oid), errWriter)
-			if len(pushBaseDir) == 0 {
-				pushBaseDir = pullBaseDir
+		case "download", "upload":
+			if jobs == nil {
+				startWorkers(1)
+			}
+			select {
+			case jobs <- &req:
+			case <-parent.Done():
+				// Picked up at the top of the loop
 			}
-			store(pushBaseDir, req.Oid, req.Size, usePushAction, writeAll, req.Action, req.Path, writer, errWriter)
 		case "terminate":
+			shutdown()
 			tracker.printSummary(errWriter)
+			metrics.printSummary(errWriter)
 			util.WriteToStderr("Terminating elastic-git-storage custom adapter gracefully.\n", errWriter)
 			break
+		default:
+			// Newer git-lfs versions may send events this adapter doesn't
+			// know. Ones about an object are failed so git-lfs doesn't wait
+			// on them forever.
+			util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Warning: ignoring unknown event %q\n", req.Event), errWriter)
+			if req.Oid != "" {
+				msg := fmt.Sprintf("Unsupported event %q for %q", req.Event, req.Oid)
+				api.SendTransferError(req.Oid, codeUnknownEvent, msg, writer, errWriter)
+				metrics.record(req.Event, req.Size, errors.New(msg))
+			}
 		}
 	}
+	// The scanner can't continue past a line that is too long, so rather
+	// than appear to hang, say why the adapter is stopping
+	errs := []error{initErr}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Request from git-lfs is longer than %d bytes, stopping; raise the limit with --max-line\n", maxLine), errWriter)
+		errs = append(errs, fmt.Errorf("request longer than %d bytes: %w", maxLine, err))
+	} else if err != nil {
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to read requests from git-lfs: %v\n", err), errWriter)
+		errs = append(errs, fmt.Errorf("unable to read requests: %w", err))
+	}
+
+	// Transfers still running if git-lfs went without terminating count too
+	shutdown()
+	if n := metrics.failures(); n > 0 {
+		errs = append(errs, fmt.Errorf("%d %w", n, ErrTransfersFailed))
+	}
+	return errors.Join(errs...)
+}
+
+// failOnPanic recovers from a panic transferring req and fails the transfer
+// instead, so a bug tripped by one object, such as a malformed OID reaching
+// code that assumed it was checked, doesn't take down the session and every
+// transfer queued behind it. It must be deferred.
+func failOnPanic(req *api.Request, metrics *transferMetrics, writer, errWriter *bufio.Writer) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unexpected error transferring %q: %v\n%s", req.Oid, r, debug.Stack()), errWriter)
+	api.SendTransferError(req.Oid, codeUnexpected, fmt.Sprintf("Unexpected error transferring %q: %v", req.Oid, r), writer, errWriter)
+	metrics.record(req.Event, req.Size, fmt.Errorf("%v", r))
+}
 
+// compressionExt returns the file extension used for objects stored with
+// the given compression mode.
+func compressionExt(compression string) string {
+	switch compression {
+	case "zip":
+		return ".zip"
+	case "lz4":
+		return ".lz4"
+	case "zstd":
+		return ".zst"
+	case "gzip":
+		return ".gz"
+	case "bzip2":
+		return ".bz2"
+	case "xz":
+		return ".xz"
+	case "external":
+		return ".z"
+	}
+	return ""
+}
+
+// DefaultShardDepth is the number of two-character folder levels objects
+// are stored under, the same split git-lfs uses.
+const DefaultShardDepth = 2
+
+// maxShardDepth uses every character of a SHA-256 OID for folders.
+const maxShardDepth = 32
+
+// shardDepth is the number of folder levels in the storage layout.
+var shardDepth = DefaultShardDepth
+
+// SetShardDepth sets how many two-character folder levels objects are stored
+// under, e.g. 3 for "ab/cd/ef/<oid>", or 0 for a flat layout with every
+// object directly in the base dir. Every client of a store must use the same
+// depth. Depths outside 0-32 are rejected and the current depth is left
+// unchanged.
+func SetShardDepth(depth int) error {
+	if depth < 0 || depth > maxShardDepth {
+		return fmt.Errorf("shard depth %d out of range 0-%d", depth, maxShardDepth)
+	}
+	shardDepth = depth
+	return nil
+}
+
+// normalizeCase stores objects under lower case paths, and has lookups in
+// local folders find folders of any case.
+var normalizeCase bool
+
+// SetNormalizeCase makes the folders and names objects are stored under
+// lower case whatever the case of the OID, so clients converge on one place
+// for each object. Downloads from local folders also look in folders that
+// differ only in case, as mixed tooling on case-insensitive shares creates.
+func SetNormalizeCase(enabled bool) {
+	normalizeCase = enabled
 }
 
 func storagePath(baseDir string, oid string) string {
-	// Use same folder split as lfs itself
-	fld := filepath.Join(baseDir, oid[0:2], oid[2:4])
-	return filepath.Join(fld, oid)
+	return layoutPath(baseDir, oid, shardDepth)
+}
+
+// layoutPath returns where oid is stored below baseDir in the layout with
+// the given shard depth.
+func layoutPath(baseDir, oid string, depth int) string {
+	if normalizeCase {
+		oid = strings.ToLower(oid)
+	}
+	// Split into folders of two OID characters per level, like lfs itself
+	// does by default. OIDs too short for every level get fewer.
+	parts := []string{baseDir}
+	for i := 0; i < depth && 2*i+2 <= len(oid); i++ {
+		parts = append(parts, oid[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, oid)...)
+}
+
+// layoutPaths returns the places oid may be stored below baseDir: the
+// configured layout first, then the default sharded and the flat layouts
+// objects may have been written in before it was changed. New objects are
+// only ever written to the first.
+func layoutPaths(baseDir, oid string) []string {
+	paths := []string{storagePath(baseDir, oid)}
+	for _, depth := range []int{DefaultShardDepth, 0} {
+		if depth != shardDepth {
+			paths = append(paths, layoutPath(baseDir, oid, depth))
+		}
+	}
+	if normalizeCase {
+		for _, p := range paths {
+			paths = append(paths, foldedPaths(baseDir, p)...)
+		}
+	}
+	return paths
+}
+
+// foldedPaths returns the paths that differ from p below baseDir only in
+// the case of their folders, where such folders exist.
+func foldedPaths(baseDir, p string) []string {
+	rel, err := filepath.Rel(baseDir, p)
+	if err != nil {
+		return nil
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	dirs := []string{baseDir}
+	for _, part := range parts[:len(parts)-1] {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if e.IsDir() && strings.EqualFold(e.Name(), part) {
+					next = append(next, filepath.Join(dir, e.Name()))
+				}
+			}
+		}
+		dirs = next
+	}
+	var folded []string
+	for _, dir := range dirs {
+		if f := filepath.Join(dir, parts[len(parts)-1]); f != p {
+			folded = append(folded, f)
+		}
+	}
+	return folded
+}
+
+// tempDir overrides where downloads are written before git-lfs moves them
+// into place. Empty means the repository's lfs/tmp folder.
+var tempDir string
+
+// SetTempDir sets the folder downloads are written to, creating it if
+// needed. Empty restores the default of the repository's lfs/tmp folder, or
+// the system temp dir outside a repository. It returns an error if the folder
+// can't be written to.
+func SetTempDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("unable to create temp dir %q: %v", dir, err)
+		}
+		f, err := os.CreateTemp(dir, "probe-*")
+		if err != nil {
+			return fmt.Errorf("temp dir %q is not writable: %v", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	tempDir = dir
+	return nil
+}
+
+// checkTempVolume warns if an explicit temp dir is on a different volume
+// from the repository's LFS objects, where git-lfs has to copy each download
+// into place instead of renaming it, or can't move it at all.
+func checkTempVolume(gitDir string, errWriter *bufio.Writer) {
+	if tempDir == "" || gitDir == "" {
+		return
+	}
+	objects := filepath.Join(gitDir, "lfs", "objects")
+	if !dirExists(objects) {
+		objects = gitDir
+	}
+	if same, err := util.SameVolume(tempDir, objects); err == nil && !same {
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Warning: temp dir %v is on a different volume from %v, moving downloads into place may be slow or fail\n", tempDir, objects), errWriter)
+	}
+}
+
+// downloadTempDir returns the folder downloads for the repository at gitDir
+// are written to. The repository's own folder is preferred so that
+// git-lfs's final rename works; it won't if TEMP is on another drive.
+func downloadTempDir(gitDir string) string {
+	if tempDir != "" {
+		return tempDir
+	}
+	if gitDir == "" {
+		return os.TempDir()
+	}
+	// gitDir is the .git folder, objects live under lfs/ so use its tmp
+	return filepath.Join(gitDir, "lfs", "tmp")
 }
 
 func downloadTempPath(gitDir string, oid string) (string, error) {
-	// Download to a subfolder of repo so that git-lfs's final rename can work
-	// It won't work if TEMP is on another drive otherwise
-	// basedir is the objects/ folder, so use the tmp folder
-	tmpfld := filepath.Join(gitDir, "lfs", "tmp")
+	tmpfld := downloadTempDir(gitDir)
 	if err := os.MkdirAll(tmpfld, os.ModePerm); err != nil {
 		return "", err
 	}
 	return filepath.Join(tmpfld, fmt.Sprintf("%v.tmp", oid)), nil
 }
 
-func retrieve(baseDir, gitDir, oid string, size int64, useAction bool, a *api.Action, tracker *downloadTracker, writer, errWriter *bufio.Writer) {
+// partTempPath returns a name of its own for one attempt at writing the
+// temp file tempPath, next to it.
+func partTempPath(tempPath string) string {
+	return fmt.Sprintf("%v.%v.tmp", strings.TrimSuffix(tempPath, ".tmp"), randomToken()[:8])
+}
 
-	dirs := splitBaseDirs(baseDir)
+// retrieve downloads oid for git-lfs from the first provider that has it,
+// falling back to the action if allowed. Concurrent requests for the same
+// OID share one download through downloads. The error is that reported to
+// git-lfs, if any.
+func retrieve(ctx context.Context, providers []provider, gitDir, oid string, size int64, useAction bool, a *api.Action, tracker *downloadTracker, downloads *downloadGroup, writer, errWriter *bufio.Writer) error {
+
+	start := time.Now()
+	d, leader := downloads.join(oid)
+	if leader {
+		d.path, d.tier, d.location, d.err = retrieveFile(ctx, providers, gitDir, oid, size, useAction, a, writer, errWriter)
+		downloads.finish(oid, d)
+	} else {
+		util.WriteToStderr(fmt.Sprintf("Waiting for download of %s already in progress\n", oid), errWriter)
+		<-d.done
+	}
+
+	path, err := d.path, d.err
+	if !leader {
+		if err == nil {
+			path, err = shareDownload(d.path, oid)
+		}
+		d.sharing.Done()
+		if err == nil {
+			api.SendProgress(oid, size, int(size), writer, errWriter)
+		}
+	}
+	if err != nil {
+		logTransfer("download", oid, 0, start, err)
+		api.SendTransferError(oid, errorCode(err, 3), fmt.Sprintf("Unable to retrieve %q: %v", oid, err), writer, errWriter)
+		return err
+	}
+	tracker.record(oid, d.tier, d.location, errWriter)
+	logTransfer("download", oid, size, start, nil)
+	sendComplete(oid, path, writer, errWriter)
+	return nil
+}
+
+// retrieveFile downloads oid to the git-lfs temp area, trying each provider
+// in order, with the action last if useAction and it has no place of its
+// own, and returns the file along with the tier and location it came from.
+func retrieveFile(ctx context.Context, providers []provider, gitDir, oid string, size int64, useAction bool, a *api.Action, writer, errWriter *bufio.Writer) (string, string, string, error) {
+	providers = actionOnly(providers, size, useAction, a, errWriter)
+
+	if distributeUploads {
+		providers = distributeOrder(oid, providers)
+	}
+	if useAction {
+		providers = withMain(providers)
+	}
 	var lastErr error
-	for i, d := range dirs {
-		var err error
-		if d.script {
-			err = tryRetrieveScript(d.path, gitDir, oid, size, d.compression, writer, errWriter)
-		} else {
-			err = tryRetrieveDir(d.path, gitDir, oid, size, d.compression, writer, errWriter)
+	for i, p := range providers {
+		b := p.backendFor(a)
+		if b == nil {
+			continue
 		}
+		// Objects past their TTL are only passed over when the action can
+		// fetch them instead
+		if eb, ok := b.(expiringBackend); ok && objectTTL > 0 && a != nil && hasMain(providers[i+1:]) {
+			expired, err := eb.expired(oid)
+			if err != nil {
+				util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to remove expired %s: %v\n", oid, err), errWriter)
+			}
+			if expired {
+				util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Passing over %s in %s, stored more than %v ago\n", oid, describeBackend(b, oid), objectTTL), errWriter)
+				lastErr = fmt.Errorf("object expired")
+				continue
+			}
+		}
+		util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Downloading %s from %s\n", oid, describeBackend(b, oid)), errWriter)
+		path, err := download(ctx, b, gitDir, oid, size, writer, errWriter)
 		if err == nil {
-			tier := tierName(d)
-			tracker.record(oid, tier, d.path, errWriter)
-			return
+			// Best effort: a store that can't record it is still usable
+			if ar, ok := b.(accessRecorder); ok && trackAccess {
+				if err := ar.recordAccess(oid); err != nil {
+					util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Unable to record access to %s: %v\n", oid, err), errWriter)
+				}
+			}
+			if p.cfg.main {
+				return path, tierName(p.cfg), "remote", nil
+			}
+			return path, tierName(p.cfg), p.cfg.path, nil
 		}
-		if i == 0 && len(dirs) > 1 {
-			util.WriteToStderr(fmt.Sprintf("LFS: primary provider unavailable for %s, falling back to provider %d: %s\n", oid, i+2, dirs[i+1].path), errWriter)
+		if i == 0 && len(providers) > 1 {
+			util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("LFS: primary provider unavailable for %s, falling back to provider %d: %s\n", oid, i+2, providers[i+1].cfg.path), errWriter)
 		}
 		lastErr = err
 	}
 
-	if useAction && a != nil {
-		if err := retrieveFromAction(a, gitDir, oid, size, writer, errWriter); err == nil {
-			tracker.record(oid, "LFS action", "remote", errWriter)
-			return
-		} else {
-			lastErr = err
-		}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("object %w", errNotFound)
 	}
+	return "", "", "", lastErr
+}
 
-	if lastErr == nil {
-		lastErr = fmt.Errorf("object not found")
+// distributeIndex deterministically assigns an OID to one of n
+// destinations. OIDs are hex digests so their leading bits are already
+// uniformly distributed.
+func distributeIndex(oid string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	prefix := oid
+	if len(prefix) > 8 {
+		prefix = prefix[:8]
+	}
+	v, err := strconv.ParseUint(prefix, 16, 32)
+	if err != nil {
+		h := fnv.New32a()
+		h.Write([]byte(oid))
+		v = uint64(h.Sum32())
 	}
-	api.SendTransferError(oid, 3, fmt.Sprintf("Unable to retrieve %q: %v", oid, lastErr), writer, errWriter)
+	return int(v % uint64(n))
 }
 
+// distributeOrder returns dirs with the OID's assigned destination moved to
+// the front, leaving the rest in their configured order as fallbacks.
+func distributeOrder(oid string, dirs []provider) []provider {
+	idx := distributeIndex(oid, len(dirs))
+	if idx == 0 {
+		return dirs
+	}
+	ordered := make([]provider, 0, len(dirs))
+	ordered = append(ordered, dirs[idx])
+	ordered = append(ordered, dirs[:idx]...)
+	return append(ordered, dirs[idx+1:]...)
+}
+
+// LocalDir returns the folder baseDir names if it's a single uncompressed
+// folder store, classified as transfers will classify it, so callers can
+// check it exists. Lists of stores, scripts, compressed stores, rclone
+// remotes and URLs return false.
+func LocalDir(baseDir string) (string, bool) {
+	if strings.Contains(baseDir, ";") || strings.Contains(baseDir, "--compression=") {
+		return "", false
+	}
+	dirs := splitBaseDirs(baseDir)
+	if len(dirs) != 1 {
+		return "", false
+	}
+	if _, ok := newBackend(dirs[0]).(*dirBackend); !ok {
+		return "", false
+	}
+	return dirs[0].path, true
+}
+
+// splitBaseDirs returns the stores in baseDir, leaving out any main entry.
 func splitBaseDirs(baseDir string) []baseDirConfig {
+	var dirs []baseDirConfig
+	for _, cfg := range parseBaseDirs(baseDir) {
+		if !cfg.main {
+			dirs = append(dirs, cfg)
+		}
+	}
+	return dirs
+}
+
+// parseBaseDirs returns the entries of baseDir in order, including any
+// main entry. Surrounding whitespace and empty entries, as in "a;;b", are
+// dropped, as are repeats of an entry, which would only be tried again.
+func parseBaseDirs(baseDir string) []baseDirConfig {
+	dirs, _ := parseBaseDirEntries(baseDir)
+	return dirs
+}
+
+// duplicateBaseDirs returns the entries parseBaseDirs drops from baseDir
+// for repeating an earlier one, in order.
+func duplicateBaseDirs(baseDir string) []string {
+	_, dups := parseBaseDirEntries(baseDir)
+	return dups
+}
+
+// parseBaseDirEntries returns the distinct entries of baseDir in order, and
+// the paths of those left out as repeats. An entry only repeats another
+// with the same options, so one folder stored both plain and compressed
+// counts twice.
+func parseBaseDirEntries(baseDir string) ([]baseDirConfig, []string) {
 	parts := strings.Split(baseDir, ";")
 	var dirs []baseDirConfig
+	var dups []string
+	seen := make(map[baseDirConfig]bool)
 	for _, p := range parts {
 		p = strings.TrimSpace(p)
 		if p == "" {
 			continue
 		}
 		cfg := baseDirConfig{compression: "none"}
-		if strings.HasPrefix(p, "--compression=") {
+		// Options come first, in any order
+		for strings.HasPrefix(p, "--compression=") || strings.HasPrefix(p, "--layout=") {
 			sp := strings.SplitN(p, " ", 2)
-			cfg.compression = strings.TrimPrefix(sp[0], "--compression=")
+			if strings.HasPrefix(sp[0], "--compression=") {
+				cfg.compression = strings.TrimPrefix(sp[0], "--compression=")
+			} else {
+				cfg.layout = strings.TrimPrefix(sp[0], "--layout=")
+			}
 			if len(sp) > 1 {
 				p = strings.TrimSpace(sp[1])
 			} else {
-				continue
+				p = ""
 			}
 		}
+		if p == "" {
+			continue
+		}
 		if strings.HasPrefix(p, "|") {
 			cfg.script = true
 			p = strings.TrimPrefix(p, "|")
 		}
 		cfg.path = strings.Trim(p, "'")
-		dirs = append(dirs, cfg)
-	}
-	return dirs
-}
-
-func tryRetrieveDir(dir, gitDir, oid string, size int64, compression string, writer, errWriter *bufio.Writer) error {
-	if util.IsRclonePath(dir) {
-		return retrieveFromRclone(dir, gitDir, oid, size, compression, writer, errWriter)
-	}
-
-	filePath := storagePath(dir, oid)
-	switch compression {
-	case "zip":
-		if _, err := os.Stat(filePath + ".zip"); err == nil {
-			return retrieveFromZip(filePath+".zip", gitDir, oid, size, writer, errWriter)
-		}
-	case "lz4":
-		if _, err := os.Stat(filePath + ".lz4"); err == nil {
-			return retrieveFromLz4(filePath+".lz4", gitDir, oid, size, writer, errWriter)
-		}
-	default:
-		if stat, err := os.Stat(filePath); err == nil && stat.Mode().IsRegular() {
-			f, err := os.Open(filePath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			return saveToTempFromReader(f, stat.Size(), gitDir, oid, writer, errWriter)
+		cfg.main = cfg.path == mainEntry && !cfg.script
+		if seen[cfg] {
+			dups = append(dups, cfg.path)
+			continue
 		}
+		seen[cfg] = true
+		dirs = append(dirs, cfg)
 	}
-
-	return fmt.Errorf("%s not found", filePath)
+	return dirs, dups
 }
 
-func tryRetrieveScript(script, gitDir, oid string, size int64, compression string, writer, errWriter *bufio.Writer) error {
-	tempPath, err := downloadTempPath(gitDir, oid)
-	if err != nil {
-		return err
-	}
-	env := map[string]string{
-		"OID":  oid,
-		"DEST": tempPath,
-		"SIZE": fmt.Sprintf("%d", size),
-	}
-	if compression != "" {
-		env["COMPRESSION"] = compression
-	}
-	if err := runScript(script, env); err != nil {
-		return err
-	}
-	stat, err := os.Stat(tempPath)
-	if err != nil {
-		return err
-	}
-	api.SendProgress(oid, stat.Size(), int(stat.Size()), writer, errWriter)
-	complete := &api.TransferResponse{Event: "complete", Oid: oid, Path: tempPath, Error: nil}
-	if err := api.SendResponse(complete, writer, errWriter); err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
-	}
-	return nil
-}
+// saveToTempFromReader writes the object read from r to the git-lfs temp
+// area, reporting progress, and returns the path of the file. The content
+// must hash to oid. It is written under a name of its own and only renamed
+// to the object's temp name once verified, so a failed or concurrent
+// attempt never leaves part of an object where the next one looks.
+func saveToTempFromReader(ctx context.Context, r io.Reader, size int64, gitDir, oid string, writer, errWriter *bufio.Writer) (string, error) {
 
-func retrieveFromAction(a *api.Action, gitDir, oid string, size int64, writer, errWriter *bufio.Writer) error {
-	req, err := http.NewRequest("GET", a.Href, nil)
+	dlfilename, err := downloadTempPath(gitDir, oid)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("error creating temp dir: %w", err)
 	}
-	for k, v := range a.Header {
-		req.Header.Set(k, v)
-	}
-	resp, err := http.DefaultClient.Do(req)
+	partname := partTempPath(dlfilename)
+	untrack, err := tempsFor(ctx).track(partname)
 	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("http error: %v", resp.Status)
-	}
-	if size == 0 && resp.ContentLength > 0 {
-		size = resp.ContentLength
-	}
-	return saveToTempFromReader(resp.Body, size, gitDir, oid, writer, errWriter)
-}
-
-func saveToTempFromReader(r io.Reader, size int64, gitDir, oid string, writer, errWriter *bufio.Writer) error {
-
-	dlfilename, err := downloadTempPath(gitDir, oid)
-	if err != nil {
-		return fmt.Errorf("error creating temp dir: %v", err)
+		return "", err
 	}
-	dlFile, err := os.OpenFile(dlfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	defer untrack()
+	dlFile, err := os.OpenFile(partname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		return fmt.Errorf("error creating temp file: %v", err)
+		return "", fmt.Errorf("error creating temp file: %w", err)
 	}
 	defer dlFile.Close()
 
-	cb := func(totalSize, readSoFar int64, readSinceLast int) error {
-		api.SendProgress(oid, readSoFar, readSinceLast, writer, errWriter)
-		return nil
-	}
+	progress := newProgressReporter(oid, writer, errWriter)
 
-	if err := copyReader(size, r, dlFile, cb); err != nil {
+	// Hash the bytes as they stream through so corrupted objects are never
+	// reported to git-lfs as complete.
+	hasher := newOidHash()
+	if err := copyReader(size, io.TeeReader(throttle(r), hasher), dlFile, progress.callback); err != nil {
 		dlFile.Close()
-		os.Remove(dlfilename)
-		return err
+		os.Remove(partname)
+		return "", err
 	}
 
 	if err := dlFile.Close(); err != nil {
-		os.Remove(dlfilename)
-		return err
+		os.Remove(partname)
+		return "", err
 	}
 
-	complete := &api.TransferResponse{Event: "complete", Oid: oid, Path: dlfilename, Error: nil}
-	if err := api.SendResponse(complete, writer, errWriter); err != nil {
-		util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != oid {
+		os.Remove(partname)
+		return "", fmt.Errorf("%w: expected %v, got %v", errHashMismatch, oid, sum)
 	}
-	return nil
+	if err := os.Rename(partname, dlfilename); err != nil {
+		os.Remove(partname)
+		return "", err
+	}
+	progress.finish(0)
+	return dlfilename, nil
 }
 
+// copyReader copies src to dst until EOF. When size is known (> 0) the
+// stream must contain exactly that many bytes; a size of zero is tolerated
+// for sources which cannot report it up front.
 func copyReader(size int64, src io.Reader, dst *os.File, cb copyCallback) error {
-	const blockSize = 4 * 1024 * 16
 	buf := make([]byte, blockSize)
 	var readSoFar int64
 	for {
@@ -395,6 +1004,9 @@ func copyReader(size int64, src io.Reader, dst *os.File, cb copyCallback) error
 				return werr
 			}
 			readSoFar += int64(n)
+			if size > 0 && readSoFar > size {
+				return fmt.Errorf("received more data than expected: %d bytes, expected %d", readSoFar, size)
+			}
 			if cb != nil {
 				cb(size, readSoFar, n)
 			}
@@ -406,102 +1018,78 @@ func copyReader(size int64, src io.Reader, dst *os.File, cb copyCallback) error
 			return err
 		}
 	}
+	if size > 0 && readSoFar < size {
+		return fmt.Errorf("short read: received %d bytes, expected %d", readSoFar, size)
+	}
 	return nil
 }
 
-func retrieveFromZip(path, gitDir, oid string, size int64, writer, errWriter *bufio.Writer) error {
-	zr, err := zip.OpenReader(path)
-	if err != nil {
-		return err
-	}
-	defer zr.Close()
-	if len(zr.File) == 0 {
-		return fmt.Errorf("zip file empty")
-	}
-	zf := zr.File[0]
-	rc, err := zf.Open()
-	if err != nil {
-		return err
-	}
-	defer rc.Close()
-	if size == 0 {
-		size = int64(zf.UncompressedSize64)
-	}
-	return saveToTempFromReader(rc, size, gitDir, oid, writer, errWriter)
-}
+type copyCallback func(totalSize int64, readSoFar int64, readSinceLast int) error
 
-func retrieveFromLz4(path, gitDir, oid string, size int64, writer, errWriter *bufio.Writer) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+// DefaultBlockSize is the default size of each read when copying objects,
+// which is also how often progress is reported.
+const DefaultBlockSize = 4 * 1024 * 16
+
+// minBlockSize and maxBlockSize bound SetBlockSize.
+const (
+	minBlockSize = 4 * 1024
+	maxBlockSize = 64 * 1024 * 1024
+)
+
+// blockSize is the size of each read by the copy functions.
+var blockSize = DefaultBlockSize
+
+// SetBlockSize sets the size of each read when copying objects, between
+// 4 KiB and 64 MiB. Larger blocks suit high-latency network shares, and
+// smaller ones give finer-grained progress.
+func SetBlockSize(n int) error {
+	if n < minBlockSize || n > maxBlockSize {
+		return fmt.Errorf("block size must be between %d and %d bytes, got %d", minBlockSize, maxBlockSize, n)
 	}
-	defer f.Close()
-	lr := lz4.NewReader(f)
-	return saveToTempFromReader(lr, size, gitDir, oid, writer, errWriter)
+	blockSize = n
+	return nil
 }
 
-func retrieveFromRclone(base, gitDir, oid string, size int64, compression string, writer, errWriter *bufio.Writer) error {
-	remote := storagePath(base, oid)
-	switch compression {
-	case "zip":
-		if data, err := catRclone(remote + ".zip"); err == nil {
-			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
-			if err != nil {
-				return err
-			}
-			if len(zr.File) == 0 {
-				return fmt.Errorf("zip file empty")
-			}
-			rc, err := zr.File[0].Open()
-			if err != nil {
-				return err
-			}
-			defer rc.Close()
-			if size == 0 {
-				size = int64(zr.File[0].UncompressedSize64)
-			}
-			return saveToTempFromReader(rc, size, gitDir, oid, writer, errWriter)
-		}
-	case "lz4":
-		if data, err := catRclone(remote + ".lz4"); err == nil {
-			lr := lz4.NewReader(bytes.NewReader(data))
-			return saveToTempFromReader(lr, size, gitDir, oid, writer, errWriter)
-		}
-	default:
-		if data, err := catRclone(remote); err == nil {
-			return saveToTempFromReader(bytes.NewReader(data), size, gitDir, oid, writer, errWriter)
-		}
+// maxBandwidth caps the combined rate of every transfer in bytes per second,
+// through bandwidthLimiter. Zero means unlimited.
+var maxBandwidth int64
+var bandwidthLimiter *util.RateLimiter
+
+// SetMaxBandwidth limits the combined throughput of all transfers to
+// bytesPerSec, shared between concurrent transfers. rclone is given the same
+// limit with --bwlimit for the copies it makes itself. Zero or negative
+// values remove the limit.
+func SetMaxBandwidth(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		maxBandwidth, bandwidthLimiter = 0, nil
+		return
 	}
-	return fmt.Errorf("rclone path not found")
+	maxBandwidth, bandwidthLimiter = bytesPerSec, util.NewRateLimiter(bytesPerSec)
 }
 
-func catRclone(remote string) ([]byte, error) {
-	cmd := util.NewCmd("rclone", "cat", remote)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		return nil, err
+// throttle paces reads from r to the bandwidth limit, if there is one. It
+// is applied once per transfer, where data enters or leaves a store.
+func throttle(r io.Reader) io.Reader {
+	if bandwidthLimiter == nil {
+		return r
 	}
-	return out.Bytes(), nil
+	return util.LimitReader(r, bandwidthLimiter)
 }
 
-type copyCallback func(totalSize int64, readSoFar int64, readSinceLast int) error
-
-func copyFileContents(size int64, src, dst *os.File, cb copyCallback) error {
-	// copy file in chunks (4K is usual block size of disks)
-	const blockSize int64 = 4 * 1024 * 16
-
+func copyFileContents(size int64, src io.Reader, dst io.Writer, cb copyCallback) error {
 	// Read precisely the correct number of bytes
 	bytesLeft := size
 	for bytesLeft > 0 {
-		nextBlock := blockSize
+		nextBlock := int64(blockSize)
 		if nextBlock > bytesLeft {
 			nextBlock = bytesLeft
 		}
 		n, err := io.CopyN(dst, src, nextBlock)
 		bytesLeft -= n
-		if err != nil && err != io.EOF {
+		if err == io.EOF {
+			return fmt.Errorf("short read: received %d bytes, expected %d", size-bytesLeft, size)
+		}
+		if err != nil {
 			return err
 		}
 		readSoFar := size - bytesLeft
@@ -513,7 +1101,6 @@ func copyFileContents(size int64, src, dst *os.File, cb copyCallback) error {
 }
 
 func copyData(size int64, src io.Reader, dst io.Writer, cb copyCallback) error {
-	const blockSize = 4 * 1024 * 16
 	buf := make([]byte, blockSize)
 	var readSoFar int64
 	for {
@@ -537,7 +1124,7 @@ func copyData(size int64, src io.Reader, dst io.Writer, cb copyCallback) error {
 	return nil
 }
 
-func compressToZip(src *os.File, dst *os.File, size int64, name string, cb copyCallback) error {
+func compressToZip(src io.Reader, dst io.Writer, size int64, name string, cb copyCallback) error {
 	zw := zip.NewWriter(dst)
 	w, err := zw.Create(name)
 	if err != nil {
@@ -553,8 +1140,182 @@ func compressToZip(src *os.File, dst *os.File, size int64, name string, cb copyC
 	return nil
 }
 
-func compressToLz4(src *os.File, dst *os.File, size int64, cb copyCallback) error {
+// verifyUploads enables hashing of uploaded content against its OID before
+// the object is made visible in the store.
+var verifyUploads bool
+
+// SetVerifyUploads enables or disables upload hash verification.
+func SetVerifyUploads(enabled bool) {
+	verifyUploads = enabled
+}
+
+// verifyExisting enables hashing objects already stored at the right size
+// before skipping their upload.
+var verifyExisting bool
+
+// SetVerifyExisting makes uploads check that an uncompressed object already
+// stored at the expected size hashes to its OID before skipping it, and
+// replace it if it doesn't, rather than trusting the size alone.
+func SetVerifyExisting(enabled bool) {
+	verifyExisting = enabled
+}
+
+// resumeUploads enables carrying on uploads to folders from the partial
+// temp file an interrupted attempt left.
+var resumeUploads bool
+
+// SetResumeUploads makes uploads of uncompressed objects to folders carry on
+// from the temp file an interrupted attempt left, rather than copying the
+// whole object again. Temp files are then kept when a transfer fails or the
+// adapter is interrupted, and a resumed object is always hashed before it
+// is stored.
+func SetResumeUploads(enabled bool) {
+	resumeUploads = enabled
+}
+
+// moveUploads moves uploads into stores instead of copying them.
+var moveUploads bool
+
+// SetMoveUploads makes rclone uploads move the files they stage rather than
+// copy them, and once an upload has been stored and verified, removes its
+// source, unless that's an object in a git-lfs object store.
+func SetMoveUploads(enabled bool) {
+	moveUploads = enabled
+}
+
+// removeSource deletes the file an upload of oid was read from, after it has
+// been stored, if that's enabled and safe: the stored content must have been
+// verified, so skipped uploads only count with verifyExisting, and git-lfs's
+// own copy of an object, in its object store, is always kept.
+func removeSource(fromPath, oid string, skipped bool, errWriter *bufio.Writer) {
+	if dryRun || !moveUploads || !verifyUploads || (skipped && !verifyExisting) {
+		return
+	}
+	if inLfsObjects(fromPath, oid) {
+		util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Keeping %v, it's in the git-lfs object store\n", fromPath), errWriter)
+		return
+	}
+	if err := os.Remove(fromPath); err != nil {
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to remove %v after storing it: %v\n", fromPath, err), errWriter)
+	}
+}
+
+// inLfsObjects returns whether path is where git-lfs keeps oid: below the
+// repository's lfs/objects, or anywhere in the objects/<aa>/<bb>/<oid> layout
+// it uses, which also covers object stores moved with lfs.storage.
+func inLfsObjects(path, oid string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+	if len(oid) >= 4 && strings.HasSuffix(filepath.ToSlash(abs), "/objects/"+oid[0:2]+"/"+oid[2:4]+"/"+oid) {
+		return true
+	}
+	dir, err := gitDir()
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Join(dir, "lfs", "objects"), abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// linkUploads makes uncompressed local stores hardlink uploaded objects
+// instead of copying them when source and store share a filesystem.
+var linkUploads bool
+
+// SetLinkUploads enables or disables hardlinking of uploads.
+func SetLinkUploads(enabled bool) {
+	linkUploads = enabled
+}
+
+// durableWrites makes local stores fsync each object before renaming it
+// into place, and the directory after, so a crash can't leave a truncated
+// object behind.
+var durableWrites = true
+
+// SetDurableWrites enables or disables syncing objects written to local
+// stores.
+func SetDurableWrites(enabled bool) {
+	durableWrites = enabled
+}
+
+// reflinkUploads makes uncompressed local stores try a copy-on-write clone
+// of uploaded objects before falling back to a normal copy.
+var reflinkUploads bool
+
+// SetReflinkUploads enables or disables reflink cloning of uploads.
+func SetReflinkUploads(enabled bool) {
+	reflinkUploads = enabled
+}
+
+// rcloneStreamUploads makes compressed uploads to rclone remotes stream
+// through `rclone rcat` instead of staging a compressed temp file.
+var rcloneStreamUploads bool
+
+// SetRcloneStreamUploads enables or disables streaming compressed uploads.
+func SetRcloneStreamUploads(enabled bool) {
+	rcloneStreamUploads = enabled
+}
+
+// mirrorUploads makes uploads write to every configured destination and
+// only report success if all of them succeed.
+var mirrorUploads bool
+
+// SetMirrorUploads enables or disables mirroring uploads to all destinations.
+func SetMirrorUploads(enabled bool) {
+	mirrorUploads = enabled
+}
+
+// distributeUploads spreads objects across the configured destinations by
+// OID instead of filling the first; downloads look in the same place first.
+var distributeUploads bool
+
+// SetDistributeUploads enables or disables OID-based distribution.
+func SetDistributeUploads(enabled bool) {
+	distributeUploads = enabled
+}
+
+// lz4Levels maps the user-facing compression level (0-9) to lz4 levels.
+// Level 0 is lz4's fast mode; 1-9 trade increasing CPU for ratio.
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4,
+	lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// lz4Level is the level used when compressing uploads with lz4.
+var lz4Level = lz4.Fast
+
+// SetCompressLevel sets the lz4 compression level used for uploads. Levels
+// outside 0-9 are rejected and the current level is left unchanged.
+func SetCompressLevel(level int) error {
+	if level < 0 || level >= len(lz4Levels) {
+		return fmt.Errorf("compression level %d out of range 0-%d", level, len(lz4Levels)-1)
+	}
+	lz4Level = lz4Levels[level]
+	return nil
+}
+
+// maxCompressJobs bounds SetCompressJobs.
+const maxCompressJobs = 256
+
+// lz4Jobs is how many goroutines compress the blocks of each lz4 upload.
+var lz4Jobs = runtime.NumCPU()
+
+// SetCompressJobs sets how many blocks of an upload lz4 compresses at once,
+// from 1 to 256. It defaults to the number of CPUs.
+func SetCompressJobs(n int) error {
+	if n < 1 || n > maxCompressJobs {
+		return fmt.Errorf("compression jobs %d out of range 1-%d", n, maxCompressJobs)
+	}
+	lz4Jobs = n
+	return nil
+}
+
+func compressToLz4(src io.Reader, dst io.Writer, size int64, cb copyCallback) error {
 	lw := lz4.NewWriter(dst)
+	if err := lw.Apply(lz4.CompressionLevelOption(lz4Level), lz4.ConcurrencyOption(lz4Jobs)); err != nil {
+		return err
+	}
 	if err := copyData(size, src, lw, cb); err != nil {
 		lw.Close()
 		return err
@@ -565,318 +1326,352 @@ func compressToLz4(src *os.File, dst *os.File, size int64, cb copyCallback) erro
 	return nil
 }
 
-func store(baseDir string, oid string, size int64, useAction bool, writeAll bool, a *api.Action, fromPath string, writer, errWriter *bufio.Writer) {
-	statFrom, err := os.Stat(fromPath)
+func compressToZstd(src io.Reader, dst io.Writer, size int64, cb copyCallback) error {
+	zw, err := zstd.NewWriter(dst)
 	if err != nil {
-		api.SendTransferError(oid, 13, fmt.Sprintf("Cannot stat %q: %v", fromPath, err), writer, errWriter)
-		return
+		return err
 	}
-
-	if useAction && a != nil {
-		if err := uploadViaAction(a, fromPath, statFrom.Size()); err != nil {
-			api.SendTransferError(oid, 21, fmt.Sprintf("Error uploading %q via action: %v", oid, err), writer, errWriter)
-			return
-		}
+	if err := copyData(size, src, zw, cb); err != nil {
+		zw.Close()
+		return err
 	}
-
-	dirs := splitBaseDirs(baseDir)
-
-	if writeAll {
-		// Fan-out: write to ALL destinations, succeed if at least one works
-		anySuccess := false
-		var lastErr error
-		for _, d := range dirs {
-			var err error
-			if d.script {
-				err = storeUsingScript(d.path, d.compression, oid, statFrom, fromPath, true, writer, errWriter)
-			} else {
-				err = storeToDir(d.path, d.compression, oid, statFrom, fromPath, true, writer, errWriter)
-			}
-			if err != nil {
-				if util.IsRclonePath(d.path) {
-					util.WriteToStderr(fmt.Sprintf("WARNING: Failed to write to %v: %v. If this is a WebDAV remote, the dynamic platform address may need refreshing. Run: automation/RefreshRcloneTunnelUrl.ps1 or use the Unity Editor 'Refresh Tunnel URL' button.\n", d.path, err), errWriter)
-				} else {
-					util.WriteToStderr(fmt.Sprintf("Warning: failed to store %v to %v: %v\n", oid, d.path, err), errWriter)
-				}
-				lastErr = err
-			} else {
-				anySuccess = true
-			}
-		}
-		if !anySuccess {
-			errMsg := fmt.Sprintf("Unable to store %q to any destination: %v", oid, lastErr)
-			hasRcloneDest := false
-			for _, d := range dirs {
-				if util.IsRclonePath(d.path) {
-					hasRcloneDest = true
-					break
-				}
-			}
-			if hasRcloneDest {
-				util.WriteToStderr("WARNING: All destinations failed and at least one was an rclone/WebDAV remote. The dynamic platform address may need refreshing. Run: automation/RefreshRcloneTunnelUrl.ps1 or use the Unity Editor 'Refresh Tunnel URL' button.\n", errWriter)
-			}
-			api.SendTransferError(oid, 20, errMsg, writer, errWriter)
-			return
-		}
-		// Send one completion message for the successful fan-out
-		api.SendProgress(oid, statFrom.Size(), int(statFrom.Size()), writer, errWriter)
-		complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-		if err := api.SendResponse(complete, writer, errWriter); err != nil {
-			util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
-		}
-		return
+	if err := zw.Close(); err != nil {
+		return err
 	}
+	return nil
+}
 
-	// Fail-over: stop on first success (original behavior)
-	var lastErr error
-	for _, d := range dirs {
-		var err error
-		if d.script {
-			err = storeUsingScript(d.path, d.compression, oid, statFrom, fromPath, false, writer, errWriter)
-		} else {
-			err = storeToDir(d.path, d.compression, oid, statFrom, fromPath, false, writer, errWriter)
-		}
-		if err == nil {
-			return
-		}
-		lastErr = err
-	}
-	hasRcloneDest := false
-	for _, d := range dirs {
-		if util.IsRclonePath(d.path) {
-			hasRcloneDest = true
-			break
-		}
+func compressToXz(src io.Reader, dst io.Writer, size int64, cb copyCallback) error {
+	xw, err := xz.NewWriter(dst)
+	if err != nil {
+		return err
 	}
-	if hasRcloneDest {
-		util.WriteToStderr("WARNING: All destinations failed and at least one was an rclone/WebDAV remote. The dynamic platform address may need refreshing. Run: automation/RefreshRcloneTunnelUrl.ps1 or use the Unity Editor 'Refresh Tunnel URL' button.\n", errWriter)
+	if err := copyData(size, src, xw, cb); err != nil {
+		xw.Close()
+		return err
 	}
-	api.SendTransferError(oid, 20, fmt.Sprintf("Unable to store %q: %v", oid, lastErr), writer, errWriter)
+	return xw.Close()
 }
 
-func storeUsingScript(script string, compression string, oid string, statFrom os.FileInfo, fromPath string, silent bool, writer, errWriter *bufio.Writer) error {
-	env := map[string]string{
-		"OID":  oid,
-		"FROM": fromPath,
-		"SIZE": fmt.Sprintf("%d", statFrom.Size()),
-	}
-	if compression != "" {
-		env["COMPRESSION"] = compression
-	}
-	if err := runScript(script, env); err != nil {
+func compressToGzip(src io.Reader, dst io.Writer, size int64, cb copyCallback) error {
+	gw := gzip.NewWriter(dst)
+	if err := copyData(size, src, gw, cb); err != nil {
+		gw.Close()
 		return err
 	}
-	if !silent {
-		api.SendProgress(oid, statFrom.Size(), int(statFrom.Size()), writer, errWriter)
-		complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-		if err := api.SendResponse(complete, writer, errWriter); err != nil {
-			util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
-		}
+	return gw.Close()
+}
+
+// checkCompressionWritable returns an error if objects can't be written in
+// the given compression mode: bzip2, which can only be read, or external
+// without a command to compress with.
+func checkCompressionWritable(compression string) error {
+	switch {
+	case compression == "bzip2":
+		return errors.New("bzip2 can only be read, not written")
+	case compression == "external" && compressCmd == "":
+		return errors.New("external compression needs --compress-cmd")
 	}
 	return nil
 }
 
-func storeToDir(baseDir, compression string, oid string, statFrom os.FileInfo, fromPath string, silent bool, writer, errWriter *bufio.Writer) error {
-	destPath := storagePath(baseDir, oid)
+// compressStream writes src to dst using the given compression mode, or
+// copies it unchanged when compression is "none". name is the entry name
+// used inside zip archives.
+func compressStream(compression string, src io.Reader, dst io.Writer, size int64, name string, cb copyCallback) error {
 	switch compression {
 	case "zip":
-		destPath += ".zip"
+		return compressToZip(src, dst, size, name, cb)
 	case "lz4":
-		destPath += ".lz4"
-	}
-	if util.IsRclonePath(baseDir) {
-		already, err := storeToRclone(destPath, compression, statFrom, fromPath, oid)
-		if err != nil {
-			return fmt.Errorf("error uploading %q via rclone: %v", oid, err)
+		return compressToLz4(src, dst, size, cb)
+	case "zstd":
+		return compressToZstd(src, dst, size, cb)
+	case "gzip":
+		return compressToGzip(src, dst, size, cb)
+	case "xz":
+		return compressToXz(src, dst, size, cb)
+	case "bzip2":
+		// The standard library only decodes bzip2
+		return errors.New("bzip2 stores are read-only, use another compression for uploads")
+	case "external":
+		return compressExternal(src, dst, size, cb)
+	}
+	return copyFileContents(size, src, dst, cb)
+}
+
+// zipEntry picks the entry holding the object called name from a zip
+// archive: the one with that name, or that base name, else the first regular
+// file. Archives packed by other tools may hold several objects, or a
+// manifest alongside the object.
+func zipEntry(files []*zip.File, name string) (*zip.File, error) {
+	var first *zip.File
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
 		}
-		if already {
-			util.WriteToStderr(fmt.Sprintf("Skipping %v, already stored", oid), errWriter)
+		if f.Name == name || path.Base(f.Name) == name {
+			return f, nil
 		}
-		if !silent {
-			api.SendProgress(oid, statFrom.Size(), int(statFrom.Size()), writer, errWriter)
-			complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-			if err := api.SendResponse(complete, writer, errWriter); err != nil {
-				util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
-			}
+		if first == nil {
+			first = f
 		}
-		return nil
 	}
-
-	statDest, err := os.Stat(destPath)
-	if err == nil && compression == "none" && statFrom.Size() == statDest.Size() {
-		util.WriteToStderr(fmt.Sprintf("Skipping %v, already stored", oid), errWriter)
-		if !silent {
-			api.SendProgress(oid, statFrom.Size(), int(statFrom.Size()), writer, errWriter)
-			complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-			if err := api.SendResponse(complete, writer, errWriter); err != nil {
-				util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
-			}
-		}
-		return nil
+	if first == nil {
+		return nil, fmt.Errorf("zip file has no entry for %v", name)
 	}
+	return first, nil
+}
 
-	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-		return fmt.Errorf("Cannot create dir %q: %v", filepath.Dir(destPath), err)
-	}
+// zipEntryReader reads a zip entry, reporting a corrupt one clearly. The
+// archive/zip reader checks the entry's CRC-32 once it has been read to the
+// end and fails the final read if it doesn't match.
+type zipEntryReader struct {
+	io.ReadCloser
+	name string
+}
 
-	tempPath := fmt.Sprintf("%v.tmp", destPath)
-	if _, err := os.Stat(tempPath); err == nil {
-		if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("Cannot remove existing temp file %q: %v", tempPath, err)
-		}
+func (r *zipEntryReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, zip.ErrChecksum) {
+		err = fmt.Errorf("zip entry %q is corrupt: %w", r.name, err)
 	}
+	return n, err
+}
 
-	srcf, err := os.OpenFile(fromPath, os.O_RDONLY, 0644)
+// spoolZip copies the zip archive read from rc to a temp file, since reading
+// it needs random access, and returns a reader over the entry for name as
+// openZip does. Closing the reader removes the file.
+func spoolZip(rc io.ReadCloser, name string) (io.ReadCloser, error) {
+	defer rc.Close()
+	tmp, err := os.CreateTemp("", "elastic-git-storage-zip")
 	if err != nil {
-		return fmt.Errorf("Cannot read data from %q: %v", fromPath, err)
+		return nil, err
+	}
+	remove := func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, rc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
 	}
-	defer srcf.Close()
-
-	dstf, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, statFrom.Mode())
 	if err != nil {
-		return fmt.Errorf("Cannot open temp file for writing %q: %v", tempPath, err)
+		remove()
+		return nil, err
 	}
-
-	var cb copyCallback
-	if !silent {
-		cb = func(totalSize, readSoFar int64, readSinceLast int) error {
-			api.SendProgress(oid, readSoFar, readSinceLast, writer, errWriter)
-			return nil
-		}
+	entry, err := openZip(tmp.Name(), name)
+	if err != nil {
+		remove()
+		return nil, err
 	}
+	sr := entry.(*sizedReader)
+	return &sizedReader{&readCloser{sr, func() error {
+		defer remove()
+		return sr.Close()
+	}}, sr.size}, nil
+}
 
-	var copyErr error
+// decompressStream wraps rc, the stored form of an object, in a reader over
+// its original content. Zip archives need random access so are spooled to a
+// temp file first, and the entry for name is read from them. storedSize is
+// reported as the size of uncompressed objects.
+func decompressStream(compression string, rc io.ReadCloser, storedSize int64, name string) (io.ReadCloser, error) {
 	switch compression {
 	case "zip":
-		copyErr = compressToZip(srcf, dstf, statFrom.Size(), oid, cb)
+		return spoolZip(rc, name)
 	case "lz4":
-		copyErr = compressToLz4(srcf, dstf, statFrom.Size(), cb)
-	default:
-		copyErr = copyFileContents(statFrom.Size(), srcf, dstf, cb)
-	}
-	if copyErr != nil {
-		dstf.Close()
-		os.Remove(tempPath)
-		return fmt.Errorf("Error writing temp file %q: %v", tempPath, copyErr)
-	}
-
-	dstf.Close()
-	if err := os.Rename(tempPath, destPath); err != nil {
-		os.Remove(tempPath)
-		return fmt.Errorf("Error moving temp file to final location: %v", err)
-	}
-
-	if !silent {
-		complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-		if err := api.SendResponse(complete, writer, errWriter); err != nil {
-			util.WriteToStderr(fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
+		return &readCloser{lz4.NewReader(rc), rc.Close}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return &readCloser{zr, func() error {
+			zr.Close()
+			return rc.Close()
+		}}, nil
+	case "gzip":
+		gr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return &readCloser{gr, func() error {
+			gr.Close()
+			return rc.Close()
+		}}, nil
+	case "bzip2":
+		return &readCloser{bzip2.NewReader(rc), rc.Close}, nil
+	case "xz":
+		xr, err := xz.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
 		}
+		return &readCloser{xr, rc.Close}, nil
+	case "external":
+		return decompressExternal(rc)
 	}
-	return nil
+	return &sizedReader{rc, storedSize}, nil
 }
 
-func uploadViaAction(a *api.Action, fromPath string, size int64) error {
-	f, err := os.Open(fromPath)
-	if err != nil {
+// store uploads the object at fromPath to the providers, which may include
+// the action in a place of its own. With useAction and no such place, it goes
+// to the action first as well as to the providers. The error is that
+// reported to git-lfs, if any.
+func store(ctx context.Context, providers []provider, oid string, size int64, useAction bool, writeAll bool, a *api.Action, fromPath string, writer, errWriter *bufio.Writer) error {
+	start := time.Now()
+	// fail reports and logs a failed upload
+	fail := func(code int, msg string) error {
+		err := errors.New(msg)
+		logTransfer("upload", oid, 0, start, err)
+		api.SendTransferError(oid, code, msg, writer, errWriter)
 		return err
 	}
-	defer f.Close()
 
-	req, err := http.NewRequest("PUT", a.Href, f)
-	if err != nil {
-		return err
-	}
-	req.ContentLength = size
-	for k, v := range a.Header {
-		req.Header.Set(k, v)
-	}
-	resp, err := http.DefaultClient.Do(req)
+	statFrom, err := os.Stat(fromPath)
 	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("http error: %v", resp.Status)
-	}
-	return nil
-}
-
-func storeToRclone(destPath, compression string, statFrom os.FileInfo, fromPath, oid string) (bool, error) {
-	if size, err := statRclone(destPath); err == nil && compression == "none" {
-		if size == statFrom.Size() {
-			return true, nil
+		return fail(errorCode(err, 13), fmt.Sprintf("Cannot stat %q: %v", fromPath, err))
+	}
+	providers = actionOnly(providers, size, useAction, a, errWriter)
+
+	// Bytes are only reported to git-lfs once, so uploads that are retried,
+	// fail over or go to several destinations don't overshoot the size.
+	reporter := newProgressReporter(oid, writer, errWriter)
+	progress := reporter.callback
+	// complete reports any progress still owed, for backends which did their
+	// work without streaming (links, scripts that report nothing), and then
+	// the completion itself.
+	complete := func() {
+		reporter.finish(statFrom.Size())
+		logTransfer("upload", oid, statFrom.Size(), start, nil)
+		sendComplete(oid, "", writer, errWriter)
+	}
+
+	if useAction && a != nil && !hasMain(providers) {
+		b := &actionBackend{action: a}
+		util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Uploading %s to %s\n", oid, describeBackend(b, oid)), errWriter)
+		if err := put(ctx, b, oid, fromPath, statFrom.Size(), progress, errWriter); err != nil {
+			return fail(errorCode(err, 21), fmt.Sprintf("Error uploading %q via action: %v", oid, err))
 		}
 	}
 
-	src := fromPath
-	var tmp *os.File
-	var err error
-	if compression == "zip" || compression == "lz4" {
-		tmp, err = os.CreateTemp("", "elastic-git-storage")
-		if err != nil {
-			return false, err
+	if writeAll || mirrorUploads {
+		// Fan-out: write to ALL destinations, succeed if at least one works
+		// (or, when mirroring, only if every one works)
+		anySuccess := false
+		skipped := false
+		var lastErr error
+		var failed []string
+		for _, p := range providers {
+			b := p.backendFor(a)
+			if b == nil {
+				lastErr = errNoAction
+				continue
+			}
+			util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Uploading %s to %s\n", oid, describeBackend(b, oid)), errWriter)
+			err := put(ctx, b, oid, fromPath, statFrom.Size(), nil, errWriter)
+			if err == errAlreadyStored {
+				util.WriteToStderr(fmt.Sprintf("Skipping %v, already stored", oid), errWriter)
+				skipped = true
+				err = nil
+			}
+			if err != nil {
+				if util.IsRclonePath(p.cfg.path) {
+					util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("WARNING: Failed to write to %v: %v. If this is a WebDAV remote, the dynamic platform address may need refreshing. Run: automation/RefreshRcloneTunnelUrl.ps1 or use the Unity Editor 'Refresh Tunnel URL' button.\n", p.cfg.path, err), errWriter)
+				} else {
+					util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Warning: failed to store %v to %v: %v\n", oid, p.cfg.path, err), errWriter)
+				}
+				lastErr = err
+				failed = append(failed, p.cfg.path)
+			} else {
+				anySuccess = true
+			}
 		}
-		defer os.Remove(tmp.Name())
-		srcf, err := os.Open(fromPath)
-		if err != nil {
-			tmp.Close()
-			return false, err
+		if mirrorUploads && anySuccess && len(failed) > 0 {
+			errMsg := fmt.Sprintf("Stored %q to %d of %d destinations; failed: %v: %v", oid, len(providers)-len(failed), len(providers), strings.Join(failed, ", "), lastErr)
+			return fail(22, errMsg)
 		}
-		if compression == "zip" {
-			err = compressToZip(srcf, tmp, statFrom.Size(), oid, nil)
-		} else {
-			err = compressToLz4(srcf, tmp, statFrom.Size(), nil)
+		if !anySuccess {
+			errMsg := fmt.Sprintf("Unable to store %q to any destination: %v", oid, lastErr)
+			if hasRcloneProvider(providers) {
+				util.WriteToStderrAt(util.LevelWarn, "WARNING: All destinations failed and at least one was an rclone/WebDAV remote. The dynamic platform address may need refreshing. Run: automation/RefreshRcloneTunnelUrl.ps1 or use the Unity Editor 'Refresh Tunnel URL' button.\n", errWriter)
+			}
+			return fail(errorCode(lastErr, 20), errMsg)
 		}
-		srcf.Close()
-		if err != nil {
-			tmp.Close()
-			return false, err
+		// Send one completion message for the successful fan-out
+		complete()
+		removeSource(fromPath, oid, skipped, errWriter)
+		return nil
+	}
+
+	// Fail-over: stop on first success (original behavior). When
+	// distributing, the OID's assigned destination is tried first.
+	if distributeUploads {
+		providers = distributeOrder(oid, providers)
+	}
+	var lastErr error
+	for _, p := range providers {
+		b := p.backendFor(a)
+		if b == nil {
+			lastErr = errNoAction
+			continue
 		}
-		if err := tmp.Close(); err != nil {
-			return false, err
+		util.WriteToStderrAt(util.LevelDebug, fmt.Sprintf("Uploading %s to %s\n", oid, describeBackend(b, oid)), errWriter)
+		err := put(ctx, b, oid, fromPath, statFrom.Size(), progress, errWriter)
+		skipped := err == errAlreadyStored
+		if skipped {
+			util.WriteToStderr(fmt.Sprintf("Skipping %v, already stored", oid), errWriter)
+			err = nil
 		}
-		src = tmp.Name()
+		if err == nil {
+			complete()
+			removeSource(fromPath, oid, skipped, errWriter)
+			return nil
+		}
+		lastErr = err
 	}
-
-	cmd := util.NewCmd("rclone", "copyto", src, destPath)
-	if err := cmd.Run(); err != nil {
-		return false, err
+	if hasRcloneProvider(providers) {
+		util.WriteToStderrAt(util.LevelWarn, "WARNING: All destinations failed and at least one was an rclone/WebDAV remote. The dynamic platform address may need refreshing. Run: automation/RefreshRcloneTunnelUrl.ps1 or use the Unity Editor 'Refresh Tunnel URL' button.\n", errWriter)
 	}
-	return false, nil
+	return fail(errorCode(lastErr, 20), fmt.Sprintf("Unable to store %q: %v", oid, lastErr))
 }
 
-func statRclone(remote string) (int64, error) {
-	cmd := util.NewCmd("rclone", "lsjson", remote)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return 0, err
-	}
-	var entries []struct {
-		Size int64 `json:"Size"`
-	}
-	if err := json.Unmarshal(out.Bytes(), &entries); err != nil {
-		return 0, err
-	}
-	if len(entries) == 0 {
-		return 0, fmt.Errorf("file not found")
+// sendComplete reports a finished transfer to git-lfs. path is the
+// downloaded file for downloads and empty for uploads.
+func sendComplete(oid, path string, writer, errWriter *bufio.Writer) {
+	complete := &api.TransferResponse{Event: "complete", Oid: oid, Path: path, Error: nil}
+	if err := api.SendResponse(complete, writer, errWriter); err != nil {
+		util.WriteToStderrAt(util.LevelWarn, fmt.Sprintf("Unable to send completion message: %v\n", err), errWriter)
 	}
-	return entries[0].Size, nil
 }
 
-func runScript(script string, env map[string]string) error {
-	cmd := util.NewCmd("sh", "-c", script)
-	if runtime.GOOS == "windows" {
-		cmd = util.NewCmd("cmd", "/C", script)
-	}
-	cmd.Env = os.Environ()
-	for k, v := range env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+func hasRcloneProvider(providers []provider) bool {
+	for _, p := range providers {
+		if util.IsRclonePath(p.cfg.path) {
+			return true
+		}
 	}
-	return cmd.Run()
+	return false
 }
 
+// gitDirOverride, if set, is used as the git dir instead of looking it up.
+var gitDirOverride string
+
+// SetGitDir sets the repository's git dir, skipping the lookup through the
+// GIT_DIR environment variable and git. Empty restores the lookup.
+func SetGitDir(dir string) {
+	gitDirOverride = dir
+}
+
+// gitDir returns the absolute path of the repository's git dir: the one
+// set by SetGitDir, else $GIT_DIR, else whatever git reports, which costs a
+// subprocess.
 func gitDir() (string, error) {
+	if gitDirOverride != "" {
+		return absPath(gitDirOverride)
+	}
+	if dir := os.Getenv("GIT_DIR"); dir != "" {
+		return absPath(dir)
+	}
 	cmd := util.NewCmd("git", "rev-parse", "--git-dir")
 	out, err := cmd.Output()
 	if err != nil {
@@ -4,20 +4,29 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4/v4"
 
 	"github.com/sinbad/lfs-folderstore/api"
+	"github.com/sinbad/lfs-folderstore/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -57,6 +66,16 @@ func TestStoragePath(t *testing.T) {
 			args: args{baseDir: `/home/bob/`, oid: "123456789abcdef"},
 			want: filepath.Join(`/home/bob`, "12", "34", "123456789abcdef"),
 		},
+		{
+			name: "Short OID",
+			args: args{baseDir: `/home/bob/`, oid: "ab"},
+			want: filepath.Join(`/home/bob`, "ab", "ab"),
+		},
+		{
+			name: "Empty OID",
+			args: args{baseDir: `/home/bob/`, oid: ""},
+			want: filepath.Join(`/home/bob`),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -67,6 +86,136 @@ func TestStoragePath(t *testing.T) {
 	}
 }
 
+func TestLocalDir(t *testing.T) {
+	for path, want := range map[string]string{
+		"/mnt/lfs":                   "/mnt/lfs",
+		"/mnt/with:colon":            "/mnt/with:colon",
+		"'/mnt/quoted'":              "/mnt/quoted",
+		"relative/lfs":               "relative/lfs",
+		"remote:lfs":                 "",
+		"'remote:lfs'":               "",
+		":s3:bucket":                 "",
+		"remote,param=x:lfs":         "",
+		"s3://bucket/lfs":            "",
+		"https://host/lfs":           "",
+		"|/usr/bin/lfs-script":       "",
+		"/mnt/a;/mnt/b":              "",
+		"--compression=lz4 /mnt/lfs": "",
+	} {
+		dir, ok := LocalDir(path)
+		assert.Equal(t, want, dir, path)
+		assert.Equal(t, want != "", ok, path)
+
+		// Whatever the command checks exists is what transfers use as a folder
+		if !strings.ContainsAny(path, ";") {
+			_, isDir := newBackend(splitBaseDirs(path)[0]).(*dirBackend)
+			assert.Equal(t, isDir && !strings.Contains(path, "--compression="), ok, path)
+		}
+	}
+}
+
+func TestParseBaseDirsCleansEntries(t *testing.T) {
+	cfgs := parseBaseDirs(" /a ;;/b; ;/a;\t--compression=lz4 /a;@main;/b ;@main;|script;|script;")
+	var paths []string
+	for _, cfg := range cfgs {
+		paths = append(paths, cfg.path)
+	}
+	assert.Equal(t, []string{"/a", "/b", "/a", mainEntry, "script"}, paths)
+	assert.Equal(t, "lz4", cfgs[2].compression)
+	assert.Equal(t, []string{"/a", "/b", mainEntry}, duplicateBaseDirs(" /a ;;/b; ;/a;\t--compression=lz4 /a;@main;/b ;@main"))
+	assert.Empty(t, duplicateBaseDirs("/a;;/b;"))
+	assert.Empty(t, parseBaseDirs(" ; ;"))
+	assert.Len(t, splitBaseDirs("dir;;dir"), 1)
+
+	// Each store is tried once, and the repeat is reported
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	missing := filepath.Join(setup.localpath, "missing")
+	base := missing + ";;" + setup.remotepath + "; " + missing + " "
+	// Once, when the push stores are the same, as the command passes them
+	for _, push := range []string{"", base} {
+		var stdout, stderr bytes.Buffer
+		Serve(base, push, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+		for _, file := range setup.files {
+			assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","path":`)
+		}
+		assert.Equal(t, 1, strings.Count(stderr.String(), "listed more than once"), push)
+		assert.Contains(t, stderr.String(), fmt.Sprintf("%q is listed more than once", missing))
+	}
+
+	// and for each when they differ
+	var stdout, stderr bytes.Buffer
+	Serve(base, missing+";"+missing, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	assert.Equal(t, 2, strings.Count(stderr.String(), "listed more than once"))
+}
+
+func TestShardDepth(t *testing.T) {
+	defer SetShardDepth(DefaultShardDepth)
+	oid := "123456789abcdef"
+
+	assert.Equal(t, filepath.Join("/store", "12", "34", oid), storagePath("/store", oid))
+	assert.Nil(t, SetShardDepth(1))
+	assert.Equal(t, filepath.Join("/store", "12", oid), storagePath("/store", oid))
+	assert.Nil(t, SetShardDepth(3))
+	assert.Equal(t, filepath.Join("/store", "12", "34", "56", oid), storagePath("/store", oid))
+
+	// Depth 0 is the flat layout
+	assert.Nil(t, SetShardDepth(0))
+	assert.Equal(t, filepath.Join("/store", oid), storagePath("/store", oid))
+	assert.Nil(t, SetShardDepth(3))
+
+	// Short OIDs get as many levels as they have characters for
+	assert.Equal(t, filepath.Join("/store", "ab", "abc"), storagePath("/store", "abc"))
+
+	// Depths that would take more than the whole OID are refused
+	assert.NotNil(t, SetShardDepth(-1))
+	assert.NotNil(t, SetShardDepth(33))
+	assert.Equal(t, 3, shardDepth)
+
+	// Stores and downloads agree on the layout
+	dir, err := ioutil.TempDir("", "sharded")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	_, oid = testObject()
+	roundTrip(t, &dirBackend{dir: dir, compression: "lz4"})
+	assert.FileExists(t, filepath.Join(dir, oid[0:2], oid[2:4], oid[4:6], oid+".lz4"))
+	assert.Contains(t, Exists("--compression=lz4 "+dir, []string{oid}), oid)
+}
+
+func TestDownloadAfterLayoutChange(t *testing.T) {
+	defer SetShardDepth(DefaultShardDepth)
+	content, oid := testObject()
+
+	for _, change := range []struct{ from, to int }{{2, 3}, {2, 0}, {0, 2}, {0, 3}} {
+		t.Run(fmt.Sprintf("%d to %d", change.from, change.to), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "layout")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			b := &dirBackend{dir: dir, compression: "lz4"}
+
+			assert.Nil(t, SetShardDepth(change.from))
+			assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+			oldPath := storagePath(dir, oid) + ".lz4"
+
+			// Still found under the old layout after switching
+			assert.Nil(t, SetShardDepth(change.to))
+			rc, err := b.Get(oid, int64(len(content)))
+			if assert.Nil(t, err) {
+				data, err := ioutil.ReadAll(rc)
+				rc.Close()
+				assert.Nil(t, err)
+				assert.Equal(t, content, data)
+			}
+
+			// New uploads go to the configured layout
+			os.Remove(oldPath)
+			assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+			assert.FileExists(t, storagePath(dir, oid)+".lz4")
+		})
+	}
+}
+
 func addUpload(t *testing.T, buf *bytes.Buffer, path, oid string, size int64) {
 	req := &api.Request{
 		Event:  "upload",
@@ -198,6 +347,87 @@ func TestUploadZip(t *testing.T) {
 	}
 }
 
+func TestAccessMode(t *testing.T) {
+	defer SetAccessMode(false, false)
+	assert.NotNil(t, SetAccessMode(true, true))
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// A read-only adapter refuses uploads without writing anything
+	assert.Nil(t, SetAccessMode(true, false))
+	var stdout, stderr bytes.Buffer
+	Serve(setup.remotepath, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","error":{"code":30`)
+		assert.NoFileExists(t, storagePath(setup.remotepath, file.oid))
+	}
+
+	// A write-only adapter stores them but refuses downloads
+	assert.Nil(t, SetAccessMode(false, true))
+	stdout.Reset()
+	Serve(setup.remotepath, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	var input bytes.Buffer
+	initDownload(&input)
+	for _, file := range setup.files {
+		assert.FileExists(t, storagePath(setup.remotepath, file.oid))
+		addDownload(t, &input, file.oid, file.size)
+	}
+	finishDownload(&input)
+	stdout.Reset()
+	Serve(setup.remotepath, "", false, false, false, &input, &stdout, &stderr)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","error":{"code":30`)
+	}
+	assert.Contains(t, stdout.String(), "write-only")
+}
+
+func TestUploadNotWritable(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	// Not a folder that can be created either, by the uploads git-lfs would
+	// no longer send after a failed init
+	notDir := filepath.Join(setup.remotepath, "file")
+	assert.Nil(t, ioutil.WriteFile(notDir, nil, 0644))
+	missing := filepath.Join(notDir, "missing")
+
+	initResponse := func(push string) string {
+		var stdout, stderr bytes.Buffer
+		Serve(setup.remotepath, push, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+		line, _, _ := strings.Cut(stdout.String(), "\n")
+		return line
+	}
+
+	// The push is refused at init, before any object is sent
+	resp := initResponse(missing)
+	assert.Contains(t, resp, `{"error":{"code":32,"message":"Upload destination is not writable: cannot write to `+missing)
+
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(setup.remotepath, "readonly")
+		assert.Nil(t, os.Mkdir(readOnly, 0555))
+		resp = initResponse(readOnly)
+		assert.Contains(t, resp, `"code":32`)
+		assert.NoDirExists(t, filepath.Join(readOnly, setup.files[0].oid[0:2]))
+	}
+
+	// One writable destination is enough to fail over to, unless mirroring
+	uploadDir := filepath.Join(setup.remotepath, "uploads")
+	assert.Nil(t, os.Mkdir(uploadDir, 0755))
+	assert.Equal(t, "{}", initResponse(missing+";"+uploadDir))
+	SetMirrorUploads(true)
+	defer SetMirrorUploads(false)
+	assert.Contains(t, initResponse(missing+";"+uploadDir), `"code":32`)
+
+	// and nothing is left behind by the check
+	entries, err := os.ReadDir(uploadDir)
+	assert.Nil(t, err)
+	for _, e := range entries {
+		assert.False(t, strings.HasPrefix(e.Name(), writeCheckName), e.Name())
+	}
+}
+
 func TestUploadLz4(t *testing.T) {
 
 	setup := setupUploadTest(t)
@@ -232,23 +462,86 @@ func TestUploadLz4(t *testing.T) {
 	}
 }
 
-func TestUploadRclone(t *testing.T) {
+func TestUploadZstd(t *testing.T) {
 
 	setup := setupUploadTest(t)
 	defer os.RemoveAll(setup.localpath)
 	defer os.RemoveAll(setup.remotepath)
 
-	scriptDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-rclone")
-	assert.Nil(t, err)
-	defer os.RemoveAll(scriptDir)
+	base := "--compression=zstd " + setup.remotepath
 
-	scriptPath := filepath.Join(scriptDir, "rclone")
-	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"copyto\" ]; then\n  src=\"$2\"\n  dest=${3#*:}\n  mkdir -p \"$(dirname \"$dest\")\"\n  cp \"$src\" \"$dest\"\nelif [ \"$1\" = \"lsjson\" ]; then\n  p=${2#*:}\n  if [ -f \"$p\" ]; then\n    size=$(stat -c %s \"$p\")\n    printf '[{\"Name\":\"%s\",\"Size\":%s}]\\n' \"$(basename \"$p\")\" \"$size\"\n  else\n    exit 1\n  fi\nfi\n"
-	assert.Nil(t, ioutil.WriteFile(scriptPath, []byte(scriptContent), 0755))
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"progress","oid":"`+file.oid)
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid)
+
+		expectedPath := filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid+".zst")
+		assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+
+		f, err := os.Open(expectedPath)
+		assert.Nil(t, err)
+		zr, err := zstd.NewReader(f)
+		assert.Nil(t, err)
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, zr)
+		assert.Nil(t, err)
+		zr.Close()
+		f.Close()
+		assert.Equal(t, file.size, int64(buf.Len()))
+		sum := sha256.Sum256(buf.Bytes())
+		assert.Equal(t, file.oid, hex.EncodeToString(sum[:]))
+	}
+}
+
+func TestUploadGzip(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	base := "--compression=gzip " + setup.remotepath
 
-	origPath := os.Getenv("PATH")
-	os.Setenv("PATH", scriptDir+string(os.PathListSeparator)+origPath)
-	defer os.Setenv("PATH", origPath)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"progress","oid":"`+file.oid)
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid)
+
+		expectedPath := filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid+".gz")
+		assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+
+		f, err := os.Open(expectedPath)
+		assert.Nil(t, err)
+		zr, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, zr)
+		assert.Nil(t, err)
+		zr.Close()
+		f.Close()
+		assert.Equal(t, file.size, int64(buf.Len()))
+		sum := sha256.Sum256(buf.Bytes())
+		assert.Equal(t, file.oid, hex.EncodeToString(sum[:]))
+	}
+}
+
+func TestUploadRclone(t *testing.T) {
+
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"copyto\" ]; then\n  src=\"$2\"\n  dest=${3#*:}\n  mkdir -p \"$(dirname \"$dest\")\"\n  cp \"$src\" \"$dest\"\nelif [ \"$1\" = \"lsjson\" ]; then\n  p=${2#*:}\n  if [ -f \"$p\" ]; then\n    size=$(stat -c %s \"$p\")\n    printf '[{\"Name\":\"%s\",\"Size\":%s}]\\n' \"$(basename \"$p\")\" \"$size\"\n  else\n    exit 1\n  fi\nfi\n"
+	installFakeRclone(t, scriptContent)
 
 	base := "dummy:" + setup.remotepath
 
@@ -273,6 +566,32 @@ func TestUploadRclone(t *testing.T) {
 	}
 }
 
+func TestUploadVerifyExisting(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// A corrupt copy of the first object is already stored at its size
+	corrupt := setup.files[0]
+	destPath := storagePath(setup.remotepath, corrupt.oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(destPath), 0755))
+	assert.Nil(t, ioutil.WriteFile(destPath, make([]byte, corrupt.size), 0644))
+
+	// Trusting sizes alone it's left as it is
+	var stdout, stderr bytes.Buffer
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	assert.NotEqual(t, corrupt.oid, calculateFileHash(t, destPath))
+
+	SetVerifyExisting(true)
+	defer SetVerifyExisting(false)
+	stdout.Reset()
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.Equal(t, file.oid, calculateFileHash(t, storagePath(setup.remotepath, file.oid)))
+	}
+}
+
 type testFile struct {
 	path string
 	size int64
@@ -407,6 +726,94 @@ func TestDownload(t *testing.T) {
 
 }
 
+func TestDownloadVerbosity(t *testing.T) {
+	defer util.SetStderrLevel(util.LevelInfo)
+	serve := func(level util.Level) (string, []testFile) {
+		setup := setupDownloadTest(t)
+		defer os.RemoveAll(setup.localpath)
+		defer os.RemoveAll(setup.remotepath)
+		util.SetStderrLevel(level)
+		var stdout, stderr bytes.Buffer
+		Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+		for _, file := range setup.files {
+			assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid)
+		}
+		return stderr.String(), setup.files
+	}
+
+	// Quiet leaves out the messages for each object, and the rest
+	stderr, files := serve(util.LevelWarn)
+	assert.Empty(t, stderr)
+
+	stderr, files = serve(util.LevelInfo)
+	for _, file := range files {
+		assert.Contains(t, stderr, "Sent message {\"event\":\"complete\",\"oid\":\""+file.oid)
+		assert.NotContains(t, stderr, "Downloading "+file.oid)
+	}
+
+	stderr, files = serve(util.LevelDebug)
+	for _, file := range files {
+		assert.Contains(t, stderr, "Downloading "+file.oid+" from folder ")
+	}
+}
+
+func TestUnknownEvent(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	file := setup.files[0]
+
+	var input bytes.Buffer
+	initDownload(&input)
+	fmt.Fprintf(&input, `{ "event": "checkout", "oid": "%v", "size": %d }`+"\n", file.oid, file.size)
+	input.WriteString(`{ "event": "hello" }` + "\n")
+	addDownload(t, &input, file.oid, file.size)
+	finishDownload(&input)
+
+	var stdout, stderr bytes.Buffer
+	Serve(setup.remotepath, setup.remotepath, false, false, false, &input, &stdout, &stderr)
+
+	assert.Contains(t, stderr.String(), `Warning: ignoring unknown event "checkout"`)
+	assert.Contains(t, stderr.String(), `Warning: ignoring unknown event "hello"`)
+	// The event about an object is failed, the other has nothing to answer
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Equal(t, `{}`, lines[0])
+	var resp api.TransferResponse
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &resp))
+	assert.Equal(t, "complete", resp.Event)
+	assert.Equal(t, file.oid, resp.Oid)
+	if assert.NotNil(t, resp.Error) {
+		assert.Equal(t, 31, resp.Error.Code)
+	}
+	// and the download after them still happens
+	assert.Contains(t, lines[len(lines)-1], `{"event":"complete","oid":"`+file.oid+`","path":"`)
+}
+
+func TestMaxLine(t *testing.T) {
+	assert.NotNil(t, SetMaxLine(100))
+	assert.Nil(t, SetMaxLine(4096))
+	defer SetMaxLine(DefaultMaxLine)
+
+	var input bytes.Buffer
+	initDownload(&input)
+	req := &api.Request{
+		Event:  "download",
+		Oid:    strings.Repeat("a", 64),
+		Size:   10,
+		Action: &api.Action{Href: "http://example.com/" + strings.Repeat("x", 5000)},
+	}
+	b, err := json.Marshal(req)
+	assert.Nil(t, err)
+	input.Write(append(b, '\n'))
+	finishDownload(&input)
+
+	var stdout, stderr bytes.Buffer
+	Serve("dummy", "", false, false, false, &input, &stdout, &stderr)
+
+	assert.Equal(t, "{}\n", stdout.String())
+	assert.Contains(t, stderr.String(), "Request from git-lfs is longer than 4096 bytes, stopping; raise the limit with --max-line")
+}
+
 func TestDownloadFallback(t *testing.T) {
 	setup := setupDownloadTest(t)
 	defer os.RemoveAll(setup.localpath)
@@ -434,6 +841,86 @@ func TestDownloadFallback(t *testing.T) {
 	}
 }
 
+func TestDownloadCorruptFallback(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	SetGitDir(gitDir)
+	defer SetGitDir("")
+
+	// The first store has a truncated lz4 copy of every object, which
+	// decompresses part way before failing
+	corruptDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-corrupt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(corruptDir)
+	for _, file := range setup.files {
+		content, err := ioutil.ReadFile(storagePath(setup.remotepath, file.oid))
+		assert.Nil(t, err)
+		compressed := compressForTest(t, "lz4", content)
+		p := storagePath(corruptDir, file.oid) + ".lz4"
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.Nil(t, ioutil.WriteFile(p, compressed[:len(compressed)*2/3], 0644))
+	}
+
+	base := "--compression=lz4 " + corruptDir + ";" + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	paths := completionPaths(t, stdout.String())
+	var want []string
+	for _, file := range setup.files {
+		tempPath, ok := paths[file.oid]
+		if assert.True(t, ok, stderr.String()) {
+			assert.Equal(t, file.oid, calculateFileHash(t, tempPath))
+			want = append(want, filepath.Base(tempPath))
+		}
+		assert.Contains(t, stderr.String(), "primary provider unavailable for "+file.oid)
+	}
+	// Nothing is left of the failed attempts
+	entries, err := ioutil.ReadDir(filepath.Join(gitDir, "lfs", "tmp"))
+	assert.Nil(t, err)
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	assert.ElementsMatch(t, want, got)
+}
+
+func TestDownloadSizeMismatch(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// The first store has a copy of every object under the right path, but
+	// one byte short
+	shortDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-short")
+	assert.Nil(t, err)
+	defer os.RemoveAll(shortDir)
+	for _, file := range setup.files {
+		content, err := ioutil.ReadFile(storagePath(setup.remotepath, file.oid))
+		assert.Nil(t, err)
+		p := storagePath(shortDir, file.oid)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.Nil(t, ioutil.WriteFile(p, content[:len(content)-1], 0644))
+	}
+
+	base := shortDir + ";" + setup.remotepath
+	var stdout, stderr bytes.Buffer
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		tempPath, ok := paths[file.oid]
+		if assert.True(t, ok) {
+			assert.Equal(t, file.oid, calculateFileHash(t, tempPath))
+		}
+		assert.Contains(t, stderr.String(), fmt.Sprintf("Passing over %v, it is %d bytes rather than %d", storagePath(shortDir, file.oid), file.size-1, file.size))
+	}
+}
+
 func TestDownloadZip(t *testing.T) {
 	setup := setupDownloadTest(t)
 	defer os.RemoveAll(setup.localpath)
@@ -469,6 +956,46 @@ func TestDownloadZip(t *testing.T) {
 	}
 }
 
+func TestDownloadHTTP(t *testing.T) {
+	for _, compression := range []string{"none", "lz4"} {
+		t.Run(compression, func(t *testing.T) {
+			setup := setupDownloadTest(t)
+			defer os.RemoveAll(setup.localpath)
+			defer os.RemoveAll(setup.remotepath)
+
+			if compression == "lz4" {
+				for i, file := range setup.files {
+					lz4Path := file.path + ".lz4"
+					assert.Nil(t, createLz4FromFile(file.path, lz4Path))
+					os.Remove(file.path)
+					setup.files[i].path = lz4Path
+				}
+			}
+
+			server := httptest.NewServer(http.FileServer(http.Dir(setup.remotepath)))
+			defer server.Close()
+
+			base := "--compression=" + compression + " " + server.URL + "/"
+
+			var stdout bytes.Buffer
+			var stderr bytes.Buffer
+
+			Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+			paths := completionPaths(t, stdout.String())
+			for _, file := range setup.files {
+				tempPath, ok := paths[file.oid]
+				if assert.True(t, ok, "%v should complete", file.oid) {
+					assert.Equal(t, file.oid, calculateFileHash(t, tempPath))
+				}
+			}
+		})
+	}
+
+	b := &httpBackend{base: "http://localhost/lfs", compression: "none"}
+	assert.NotNil(t, b.Put("abcdef", bytes.NewReader(nil), 0), "HTTP stores are read-only")
+}
+
 func TestDownloadLz4(t *testing.T) {
 	setup := setupDownloadTest(t)
 	defer os.RemoveAll(setup.localpath)
@@ -503,24 +1030,23 @@ func TestDownloadLz4(t *testing.T) {
 	}
 }
 
-func TestDownloadRclone(t *testing.T) {
+func TestDownloadZstd(t *testing.T) {
 	setup := setupDownloadTest(t)
 	defer os.RemoveAll(setup.localpath)
 	defer os.RemoveAll(setup.remotepath)
 
-	scriptDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-rclone")
-	assert.Nil(t, err)
-	defer os.RemoveAll(scriptDir)
-
-	scriptPath := filepath.Join(scriptDir, "rclone")
-	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"cat\" ]; then\n  p=${2#*:}\n  cat \"$p\"\nfi\n"
-	assert.Nil(t, ioutil.WriteFile(scriptPath, []byte(scriptContent), 0755))
+	for i, file := range setup.files {
+		zstPath := file.path + ".zst"
+		assert.Nil(t, createZstdFromFile(file.path, zstPath))
+		os.Remove(file.path)
+		setup.files[i].path = zstPath
+	}
 
-	origPath := os.Getenv("PATH")
-	os.Setenv("PATH", scriptDir+string(os.PathListSeparator)+origPath)
-	defer os.Setenv("PATH", origPath)
+	emptyDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-empty")
+	assert.Nil(t, err)
+	defer os.RemoveAll(emptyDir)
 
-	base := "dummy:" + setup.remotepath
+	base := emptyDir + ";--compression=zstd " + setup.remotepath
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -538,18 +1064,117 @@ func TestDownloadRclone(t *testing.T) {
 	}
 }
 
-func addDownload(t *testing.T, buf *bytes.Buffer, oid string, size int64) {
-	req := &api.Request{
-		Event:  "download",
-		Oid:    oid,
-		Size:   size,
-		Action: &api.Action{},
+func TestDownloadGzip(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	for i, file := range setup.files {
+		gzPath := file.path + ".gz"
+		assert.Nil(t, createGzipFromFile(file.path, gzPath))
+		os.Remove(file.path)
+		setup.files[i].path = gzPath
 	}
-	b, err := json.Marshal(req)
+
+	emptyDir, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-empty")
 	assert.Nil(t, err)
-	b = append(b, '\n')
+	defer os.RemoveAll(emptyDir)
 
-	buf.Write(b)
+	base := emptyDir + ";--compression=gzip " + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		tempPath, ok := paths[file.oid]
+		assert.True(t, ok)
+		s, _ := os.Stat(tempPath)
+		assert.Equal(t, file.size, s.Size())
+		oid := calculateFileHash(t, tempPath)
+		assert.Equal(t, file.oid, oid)
+	}
+}
+
+func TestZstdRoundTripRclone(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"copyto\" ]; then\n  src=\"$2\"\n  dest=${3#*:}\n  mkdir -p \"$(dirname \"$dest\")\"\n  cp \"$src\" \"$dest\"\nelif [ \"$1\" = \"lsjson\" ]; then\n  exit 1\nelif [ \"$1\" = \"cat\" ]; then\n  p=${2#*:}\n  cat \"$p\"\nfi\n"
+	installFakeRclone(t, scriptContent)
+
+	base := "--compression=zstd dummy:" + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	var downloadBuf bytes.Buffer
+	initDownload(&downloadBuf)
+	for _, file := range setup.files {
+		expectedPath := filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid+".zst")
+		assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+		addDownload(t, &downloadBuf, file.oid, file.size)
+	}
+	finishDownload(&downloadBuf)
+
+	stdout.Reset()
+	stderr.Reset()
+	Serve(base, base, false, false, false, bytes.NewReader(downloadBuf.Bytes()), &stdout, &stderr)
+
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		tempPath, ok := paths[file.oid]
+		assert.True(t, ok)
+		s, _ := os.Stat(tempPath)
+		assert.Equal(t, file.size, s.Size())
+		oid := calculateFileHash(t, tempPath)
+		assert.Equal(t, file.oid, oid)
+	}
+}
+
+func TestDownloadRclone(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"cat\" ]; then\n  p=${2#*:}\n  cat \"$p\"\nfi\n"
+	installFakeRclone(t, scriptContent)
+
+	base := "dummy:" + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		tempPath, ok := paths[file.oid]
+		assert.True(t, ok)
+		s, _ := os.Stat(tempPath)
+		assert.Equal(t, file.size, s.Size())
+		oid := calculateFileHash(t, tempPath)
+		assert.Equal(t, file.oid, oid)
+	}
+}
+
+func addDownload(t *testing.T, buf *bytes.Buffer, oid string, size int64) {
+	req := &api.Request{
+		Event:  "download",
+		Oid:    oid,
+		Size:   size,
+		Action: &api.Action{},
+	}
+	b, err := json.Marshal(req)
+	assert.Nil(t, err)
+	b = append(b, '\n')
+
+	buf.Write(b)
 }
 
 func initDownload(buf *bytes.Buffer) {
@@ -629,7 +1254,7 @@ func createTestFile(t *testing.T, size int64, path string) string {
 		233, 239, 241, 251,
 	}
 
-	oidHash := sha256.New()
+	oidHash := newOidHash()
 
 	bytesLeft := size
 	byteSnippetLen := int64(len(byteSnippet))
@@ -648,7 +1273,7 @@ func createTestFile(t *testing.T, size int64, path string) string {
 }
 
 func calculateFileHash(t *testing.T, filepath string) string {
-	hasher := sha256.New()
+	hasher := newOidHash()
 	f, err := os.OpenFile(filepath, os.O_RDONLY, 0644)
 	assert.Nil(t, err)
 	defer f.Close()
@@ -677,8 +1302,8 @@ func TestRetrieveScript(t *testing.T) {
 	errWriter := bufio.NewWriter(&stderr)
 
 	script := fmt.Sprintf("cp %s \"$DEST\"", srcFile)
-	oid := "123456"
-	err = tryRetrieveScript(script, gitDir, oid, int64(len(content)), "", writer, errWriter)
+	oid := calculateFileHash(t, srcFile)
+	err = fetch(context.Background(), &scriptBackend{script: script}, gitDir, oid, int64(len(content)), writer, errWriter)
 	assert.Nil(t, err)
 
 	dest, err := downloadTempPath(gitDir, oid)
@@ -688,6 +1313,111 @@ func TestRetrieveScript(t *testing.T) {
 	assert.Equal(t, string(content), string(data))
 }
 
+func TestShortOid(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	SetGitDir(setup.localpath)
+	defer SetGitDir("")
+
+	// As from a corrupt pointer file, followed by requests that are fine
+	var input bytes.Buffer
+	initDownload(&input)
+	addDownload(t, &input, "ab", 5)
+	for _, file := range setup.files {
+		addDownload(t, &input, file.oid, file.size)
+	}
+	finishDownload(&input)
+	var stdout, stderr bytes.Buffer
+	Serve(setup.remotepath, "", false, false, false, &input, &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"ab","error":{"code":33,`)
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		assert.NotEmpty(t, paths[file.oid], file.oid)
+	}
+}
+
+func TestServeReportsFailures(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+	SetGitDir(setup.localpath)
+	defer SetGitDir("")
+
+	var stdout, stderr bytes.Buffer
+	assert.Nil(t, Serve(setup.remotepath, "", false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr))
+
+	// An object no store has fails on its own, and the session with it
+	missing := strings.Repeat("0", 64)
+	var input bytes.Buffer
+	initDownload(&input)
+	addDownload(t, &input, missing, 5)
+	for _, file := range setup.files {
+		addDownload(t, &input, file.oid, file.size)
+	}
+	finishDownload(&input)
+	stdout.Reset()
+	err := Serve(setup.remotepath, "", false, false, false, &input, &stdout, &stderr)
+	assert.ErrorIs(t, err, ErrTransfersFailed)
+	assert.EqualError(t, err, "1 transfer(s) failed")
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+missing+`","error":{"code":404,`)
+	paths := completionPaths(t, stdout.String())
+	for _, file := range setup.files {
+		assert.NotEmpty(t, paths[file.oid], file.oid)
+	}
+
+	// So does an object in an event the adapter doesn't know
+	input.Reset()
+	initDownload(&input)
+	input.WriteString(`{"event":"prefetch","oid":"` + setup.files[0].oid + `","size":5}` + "\n")
+	finishDownload(&input)
+	err = Serve(setup.remotepath, "", false, false, false, &input, &stdout, &stderr)
+	assert.ErrorIs(t, err, ErrTransfersFailed)
+
+	// A session that can't start, for want of a store or one it can write
+	notDir := filepath.Join(setup.localpath, "file")
+	assert.Nil(t, ioutil.WriteFile(notDir, nil, 0644))
+	for _, base := range []string{"", filepath.Join(notDir, "missing")} {
+		input.Reset()
+		initUpload(&input)
+		finishUpload(&input)
+		err = Serve(base, "", false, false, false, &input, &stdout, &stderr)
+		assert.ErrorIs(t, err, ErrInitFailed, base)
+		assert.NotErrorIs(t, err, ErrTransfersFailed, base)
+	}
+
+	// Requests that can't all be read
+	assert.Nil(t, SetMaxLine(4096))
+	defer SetMaxLine(DefaultMaxLine)
+	input.Reset()
+	initDownload(&input)
+	input.WriteString(`{"event":"download","oid":"` + strings.Repeat("a", 5000) + "\"}\n")
+	finishDownload(&input)
+	err = Serve(setup.remotepath, "", false, false, false, &input, &stdout, &stderr)
+	assert.ErrorIs(t, err, bufio.ErrTooLong)
+}
+
+func TestFailOnPanic(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	writer := bufio.NewWriter(&stdout)
+	errWriter := bufio.NewWriter(&stderr)
+	metrics := newTransferMetrics()
+	req := &api.Request{Event: "download", Oid: "ab", Size: 5}
+	assert.NotPanics(t, func() {
+		defer failOnPanic(req, metrics, writer, errWriter)
+		_ = req.Oid[2:4]
+	})
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"ab","error":{"code":34,"message":"Unexpected error transferring \"ab\": runtime error: slice bounds out of range`)
+	assert.Contains(t, stderr.String(), "service.TestFailOnPanic")
+
+	// Transfers that don't panic are left alone
+	stdout.Reset()
+	func() {
+		defer failOnPanic(req, metrics, writer, errWriter)
+	}()
+	assert.Empty(t, stdout.String())
+}
+
 func TestStoreScript(t *testing.T) {
 	remoteDir, err := ioutil.TempDir("", "remote")
 	assert.Nil(t, err)
@@ -701,16 +1431,9 @@ func TestStoreScript(t *testing.T) {
 	content := []byte("world")
 	err = ioutil.WriteFile(fromPath, content, 0644)
 	assert.Nil(t, err)
-	stat, err := os.Stat(fromPath)
-	assert.Nil(t, err)
-
-	var stdout, stderr bytes.Buffer
-	writer := bufio.NewWriter(&stdout)
-	errWriter := bufio.NewWriter(&stderr)
-
 	oid := "abcdef"
 	script := fmt.Sprintf("cp \"$FROM\" %s/$OID", remoteDir)
-	err = storeUsingScript(script, "", oid, stat, fromPath, false, writer, errWriter)
+	err = put(context.Background(), &scriptBackend{script: script}, oid, fromPath, int64(len(content)), nil, nil)
 	assert.Nil(t, err)
 
 	dest := filepath.Join(remoteDir, oid)
@@ -719,6 +1442,50 @@ func TestStoreScript(t *testing.T) {
 	assert.Equal(t, string(content), string(data))
 }
 
+func TestStoreScriptNotStored(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir, err := ioutil.TempDir("", "scriptstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	content, oid := testObject()
+	fromPath := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(fromPath, content, 0644))
+	size := int64(len(content))
+
+	SetCheckScripts(true)
+	defer SetCheckScripts(false)
+
+	// Exits zero, but never stores anything
+	err = put(context.Background(), &scriptBackend{script: "true"}, oid, fromPath, size, nil, nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "reads back as 0 bytes")
+	}
+	// Stores only part of it
+	partial := fmt.Sprintf(`if [ "$EVENT" = download ]; then head -c 5 %q > "$DEST"; fi`, fromPath)
+	assert.NotNil(t, put(context.Background(), &scriptBackend{script: partial}, oid, fromPath, size, nil, nil))
+	// Stores other content of the same size
+	SetVerifyUploads(true)
+	other := fmt.Sprintf(`if [ "$EVENT" = download ]; then head -c %d /dev/zero > "$DEST"; fi`, size)
+	assert.ErrorIs(t, put(context.Background(), &scriptBackend{script: other}, oid, fromPath, size, nil, nil), errHashMismatch)
+	SetVerifyUploads(false)
+
+	// git-lfs is told the upload failed
+	var input bytes.Buffer
+	initUpload(&input)
+	addUpload(t, &input, fromPath, oid, size)
+	finishUpload(&input)
+	var stdout, stderr bytes.Buffer
+	Serve("|true", "", false, false, false, &input, &stdout, &stderr)
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+oid+`","error":{"code":20,`)
+	assert.FileExists(t, fromPath)
+
+	// Unless scripts aren't checked
+	SetCheckScripts(false)
+	assert.Nil(t, put(context.Background(), &scriptBackend{script: "true"}, oid, fromPath, size, nil, nil))
+}
+
 func completionPaths(t *testing.T, stdout string) map[string]string {
 	paths := make(map[string]string)
 	scanner := bufio.NewScanner(strings.NewReader(stdout))
@@ -745,6 +1512,105 @@ func TestServeHandlesLargeRequests(t *testing.T) {
 	assert.Contains(t, stderr.String(), "Terminating elastic-git-storage custom adapter gracefully.")
 }
 
+func TestServeWithoutGitDir(t *testing.T) {
+	store, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(store)
+	content, oid := testObject()
+	assert.Nil(t, (&dirBackend{dir: store, compression: "none"}).Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	// Not a repository, so downloads fall back to the system temp dir
+	t.Setenv("GIT_DIR", filepath.Join(store, "missing"))
+
+	var input bytes.Buffer
+	initDownload(&input)
+	addDownload(t, &input, oid, int64(len(content)))
+	finishDownload(&input)
+
+	var stdout, stderr bytes.Buffer
+	Serve(store, "", false, false, false, &input, &stdout, &stderr)
+
+	assert.Contains(t, stderr.String(), "Unable to retrieve git dir")
+	path, ok := completionPaths(t, stdout.String())[oid]
+	if assert.True(t, ok) {
+		defer os.Remove(path)
+		assert.Equal(t, filepath.Join(os.TempDir(), oid+".tmp"), path)
+		assert.Equal(t, oid, calculateFileHash(t, path))
+	}
+}
+
+func TestServeTempDir(t *testing.T) {
+	store, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(store)
+	content, oid := testObject()
+	assert.Nil(t, (&dirBackend{dir: store, compression: "none"}).Put(oid, bytes.NewReader(content), int64(len(content))))
+
+	tmp := filepath.Join(store, "downloads")
+	assert.Nil(t, SetTempDir(tmp))
+	defer SetTempDir("")
+
+	var input bytes.Buffer
+	initDownload(&input)
+	addDownload(t, &input, oid, int64(len(content)))
+	finishDownload(&input)
+
+	var stdout, stderr bytes.Buffer
+	Serve(store, "", false, false, false, &input, &stdout, &stderr)
+
+	path, ok := completionPaths(t, stdout.String())[oid]
+	if assert.True(t, ok) {
+		assert.Equal(t, filepath.Join(tmp, oid+".tmp"), path)
+		assert.Equal(t, oid, calculateFileHash(t, path))
+	}
+
+	// A temp dir that can't be created is refused, keeping the previous one
+	notDir := filepath.Join(store, "file")
+	assert.Nil(t, ioutil.WriteFile(notDir, nil, 0644))
+	assert.NotNil(t, SetTempDir(filepath.Join(notDir, "tmp")))
+	assert.Equal(t, tmp, downloadTempDir(""))
+}
+
+func TestGitDirFromEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git is a shell script")
+	}
+	scriptDir, err := ioutil.TempDir("", "fakegit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(scriptDir)
+	logPath := filepath.Join(scriptDir, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$1\" >> %q\nexit 1\n", logPath)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(scriptDir, "git"), []byte(script), 0755))
+	t.Setenv("PATH", scriptDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	repo, err := ioutil.TempDir("", "repo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(repo)
+	want, err := filepath.EvalSymlinks(repo)
+	assert.Nil(t, err)
+
+	t.Setenv("GIT_DIR", repo)
+	dir, err := gitDir()
+	assert.Nil(t, err)
+	assert.Equal(t, want, dir)
+	assert.Equal(t, 0, countCalls(t, logPath), "git should not be run when GIT_DIR is set")
+
+	// An explicit git dir wins over the environment
+	SetGitDir(scriptDir)
+	defer SetGitDir("")
+	dir, err = gitDir()
+	assert.Nil(t, err)
+	want, _ = filepath.EvalSymlinks(scriptDir)
+	assert.Equal(t, want, dir)
+
+	// Otherwise git is asked
+	SetGitDir("")
+	t.Setenv("GIT_DIR", "")
+	_, err = gitDir()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, countCalls(t, logPath))
+}
+
 func createZipFromFile(src, dest string) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -788,3 +1654,695 @@ func createLz4FromFile(src, dest string) error {
 	}
 	return nil
 }
+
+func createGzipFromFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := gzip.NewWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func createZstdFromFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := zstd.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func TestRcloneMaxProcs(t *testing.T) {
+	notes := t.TempDir()
+	lockDir := filepath.Join(notes, "running")
+	overlapLog := filepath.Join(notes, "overlap")
+	scriptContent := fmt.Sprintf("#!/bin/sh\nif ! mkdir %q 2>/dev/null; then\n  echo overlap >> %q\n  exit 0\nfi\nsleep 0.05\nrmdir %q\n", lockDir, overlapLog, lockDir)
+	installFakeRclone(t, scriptContent)
+
+	SetRcloneMaxProcs(1)
+	defer SetRcloneMaxProcs(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			catRclone("dummy:object")
+		}()
+	}
+	wg.Wait()
+
+	_, err := os.Stat(overlapLog)
+	assert.True(t, os.IsNotExist(err), "rclone invocations must not overlap")
+}
+
+func TestCompressLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elastic-git-storage-level")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Text-like input with plenty of long-range repetition so that the
+	// higher levels have something to find that the fast mode skips.
+	var content bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&content, "line %d value %d %d\n", i%977, i*7%131, i%13)
+	}
+	srcPath := filepath.Join(dir, "src")
+	assert.Nil(t, ioutil.WriteFile(srcPath, content.Bytes(), 0644))
+
+	compressedSize := func(level int) int64 {
+		assert.Nil(t, SetCompressLevel(level))
+		src, err := os.Open(srcPath)
+		assert.Nil(t, err)
+		defer src.Close()
+		dst, err := os.Create(filepath.Join(dir, fmt.Sprintf("level%d.lz4", level)))
+		assert.Nil(t, err)
+		defer dst.Close()
+		assert.Nil(t, compressToLz4(src, dst, int64(content.Len()), nil))
+		stat, err := dst.Stat()
+		assert.Nil(t, err)
+		return stat.Size()
+	}
+	defer SetCompressLevel(0)
+
+	fast := compressedSize(0)
+	best := compressedSize(9)
+	assert.NotEqual(t, fast, best)
+	assert.Less(t, best, fast)
+
+	assert.NotNil(t, SetCompressLevel(10))
+	assert.NotNil(t, SetCompressLevel(-1))
+}
+
+// lz4TestContent returns data spanning several lz4 blocks, compressible
+// enough to be realistic without being trivial.
+func lz4TestContent() []byte {
+	var content bytes.Buffer
+	rnd := rand.New(rand.NewSource(1))
+	for content.Len() < 20*1024*1024 {
+		fmt.Fprintf(&content, "line %d value %x\n", rnd.Intn(100000), rnd.Int63())
+	}
+	return content.Bytes()
+}
+
+func TestCompressJobs(t *testing.T) {
+	content := lz4TestContent()
+	defer SetCompressJobs(runtime.NumCPU())
+
+	for _, jobs := range []int{1, 4} {
+		assert.Nil(t, SetCompressJobs(jobs))
+		var compressed bytes.Buffer
+		assert.Nil(t, compressToLz4(bytes.NewReader(content), &compressed, int64(len(content)), nil))
+		data, err := ioutil.ReadAll(lz4.NewReader(&compressed))
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(content, data), "jobs %d must round-trip", jobs)
+	}
+
+	assert.NotNil(t, SetCompressJobs(0))
+	assert.NotNil(t, SetCompressJobs(maxCompressJobs+1))
+	assert.Equal(t, 4, lz4Jobs)
+}
+
+// BenchmarkCompressLz4 compares compressing with one job to one per CPU;
+// run with -bench CompressLz4 to see the throughput of each.
+func BenchmarkCompressLz4(b *testing.B) {
+	content := lz4TestContent()
+	defer SetCompressJobs(runtime.NumCPU())
+	for _, jobs := range []int{1, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			SetCompressJobs(jobs)
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				if err := compressToLz4(bytes.NewReader(content), ioutil.Discard, int64(len(content)), nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadHashMismatch(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// Corrupt the first object so its content no longer matches its name
+	corrupt := setup.files[0]
+	assert.Nil(t, ioutil.WriteFile(corrupt.path, bytes.Repeat([]byte{0xff}, int(corrupt.size)), 0644))
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	paths := completionPaths(t, stdout.String())
+	assert.Equal(t, "", paths[corrupt.oid], "corrupt object must not complete with a path")
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+corrupt.oid+`","error":`)
+	assert.Contains(t, stdout.String(), "hash mismatch")
+	for _, file := range setup.files[1:] {
+		assert.NotEqual(t, "", paths[file.oid])
+	}
+}
+
+func TestUploadVerify(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	// Claim the last file has the oid of the first, so its content mismatches
+	bad := setup.files[len(setup.files)-1]
+	badOid := setup.files[0].oid
+	var commandBuf bytes.Buffer
+	initUpload(&commandBuf)
+	for _, file := range setup.files[:len(setup.files)-1] {
+		addUpload(t, &commandBuf, file.path, file.oid, file.size)
+	}
+	finishUpload(&commandBuf)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+
+	for _, file := range setup.files[:len(setup.files)-1] {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.FileExists(t, filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid))
+	}
+
+	// Mismatched upload to a fresh store must fail and leave nothing behind
+	otherStore, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(otherStore)
+
+	commandBuf.Reset()
+	initUpload(&commandBuf)
+	addUpload(t, &commandBuf, bad.path, badOid, bad.size)
+	finishUpload(&commandBuf)
+	stdout.Reset()
+	stderr.Reset()
+
+	Serve(otherStore, otherStore, false, false, false, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+badOid+`","error":`)
+	assert.Contains(t, stdout.String(), "hash mismatch")
+	destPath := filepath.Join(otherStore, badOid[0:2], badOid[2:4], badOid)
+	assert.NoFileExists(t, destPath)
+	assert.NoFileExists(t, destPath+".tmp")
+}
+
+func TestUploadVerifyRclone(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// hashsum reports a bogus hash for anything once the "corrupt" marker exists
+	corruptMarker := filepath.Join(t.TempDir(), "corrupt")
+	scriptContent := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = \"copyto\" ]; then\n  dest=${3#*:}\n  mkdir -p \"$(dirname \"$dest\")\"\n  cp \"$2\" \"$dest\"\nelif [ \"$1\" = \"hashsum\" ]; then\n  p=${4#*:}\n  if [ -f %q ]; then\n    echo \"deadbeef  $(basename \"$p\")\"\n  else\n    sha256sum \"$p\"\n  fi\nelif [ \"$1\" = \"deletefile\" ]; then\n  rm -f \"${2#*:}\"\nelse\n  exit 1\nfi\n", corruptMarker)
+	installFakeRclone(t, scriptContent)
+
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	base := "dummy:" + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		assert.FileExists(t, filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid))
+	}
+
+	// Same uploads to a new location with a remote reporting the wrong hash
+	assert.Nil(t, ioutil.WriteFile(corruptMarker, nil, 0644))
+	otherStore, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(otherStore)
+	base = "dummy:" + otherStore
+	stdout.Reset()
+	stderr.Reset()
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","error":`)
+		assert.NoFileExists(t, filepath.Join(otherStore, file.oid[0:2], file.oid[2:4], file.oid))
+	}
+}
+
+func TestCopyReaderSize(t *testing.T) {
+	dst, err := ioutil.TempFile("", "elastic-git-storage-copy")
+	assert.Nil(t, err)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	content := []byte("0123456789")
+	assert.Nil(t, copyReader(int64(len(content)), bytes.NewReader(content), dst, nil))
+	// Unknown size is tolerated
+	assert.Nil(t, copyReader(0, bytes.NewReader(content), dst, nil))
+
+	err = copyReader(int64(len(content))+5, bytes.NewReader(content), dst, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "short read")
+
+	err = copyReader(int64(len(content))-5, bytes.NewReader(content), dst, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "more data than expected")
+}
+
+func TestBlockSize(t *testing.T) {
+	defer SetBlockSize(DefaultBlockSize)
+	assert.NotNil(t, SetBlockSize(1024))
+	assert.NotNil(t, SetBlockSize(128*1024*1024))
+	assert.Equal(t, DefaultBlockSize, blockSize)
+	assert.Nil(t, SetBlockSize(8*1024))
+
+	content := make([]byte, 50000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	var calls []int
+	var last int64
+	cb := func(totalSize, readSoFar int64, readSinceLast int) error {
+		assert.Equal(t, int64(len(content)), totalSize)
+		calls = append(calls, readSinceLast)
+		last = readSoFar
+		return nil
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, copyFileContents(int64(len(content)), bytes.NewReader(content), &buf, cb))
+	assert.Equal(t, content, buf.Bytes())
+	assert.Equal(t, []int{8192, 8192, 8192, 8192, 8192, 8192, 848}, calls)
+	assert.Equal(t, int64(len(content)), last)
+
+	// A source shorter than promised is an error, not an endless wait
+	buf.Reset()
+	err := copyFileContents(int64(len(content))+1, bytes.NewReader(content), &buf, nil)
+	assert.EqualError(t, err, fmt.Sprintf("short read: received %d bytes, expected %d", len(content), len(content)+1))
+
+	dst, err := ioutil.TempFile("", "elastic-git-storage-copy")
+	assert.Nil(t, err)
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	calls = nil
+	assert.Nil(t, copyReader(int64(len(content)), bytes.NewReader(content), dst, cb))
+	assert.Equal(t, []int{8192, 8192, 8192, 8192, 8192, 8192, 848}, calls)
+	assert.Equal(t, int64(len(content)), last)
+	written, err := ioutil.ReadFile(dst.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, content, written)
+}
+
+func TestDownloadShortRead(t *testing.T) {
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// Declare a larger size than the stored object actually decompresses to
+	file := setup.files[0]
+	assert.Nil(t, createLz4FromFile(file.path, file.path+".lz4"))
+	var commandBuf bytes.Buffer
+	initDownload(&commandBuf)
+	addDownload(t, &commandBuf, file.oid, file.size+100)
+	finishDownload(&commandBuf)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	base := "--compression=lz4 " + setup.remotepath
+	Serve(base, base, false, false, false, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","error":`)
+	assert.Contains(t, stdout.String(), "short read")
+}
+
+func TestDownloadConcurrent(t *testing.T) {
+	gitpath, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-local")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitpath)
+	storepath, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(storepath)
+
+	var commandBuf bytes.Buffer
+	initDownload(&commandBuf)
+	var files []testFile
+	for i := 0; i < 12; i++ {
+		path := filepath.Join(storepath, fmt.Sprintf("file%d", i))
+		size := int64(4*1024*16*(i%4) + 100 + i)
+		oid := createTestFile(t, size, path)
+		finalLocation := filepath.Join(storepath, oid[0:2], oid[2:4], oid)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(finalLocation), 0755))
+		assert.Nil(t, os.Rename(path, finalLocation))
+		files = append(files, testFile{path: finalLocation, size: size, oid: oid})
+		addDownload(t, &commandBuf, oid, size)
+	}
+	finishDownload(&commandBuf)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(storepath, storepath, false, false, false, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+
+	// Every line must be a whole JSON message
+	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+	for scanner.Scan() {
+		assert.True(t, json.Valid(scanner.Bytes()), "invalid protocol line: %q", scanner.Text())
+	}
+
+	paths := completionPaths(t, stdout.String())
+	for _, file := range files {
+		tempPath, ok := paths[file.oid]
+		assert.True(t, ok)
+		oid := calculateFileHash(t, tempPath)
+		assert.Equal(t, file.oid, oid)
+	}
+	assert.Contains(t, stderr.String(), "LFS: Complete -- 12 files")
+}
+
+func TestUploadLink(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	SetLinkUploads(true)
+	defer SetLinkUploads(false)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	stdoutStr := stdout.String()
+	for _, file := range setup.files {
+		assert.Contains(t, stdoutStr, `{"event":"complete","oid":"`+file.oid+`"}`)
+
+		expectedPath := filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid)
+		assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+		assert.Equal(t, file.oid, calculateFileHash(t, expectedPath))
+
+		// Both temp dirs live under os.TempDir so should share a filesystem
+		srcStat, err := os.Stat(file.path)
+		assert.Nil(t, err)
+		dstStat, err := os.Stat(expectedPath)
+		assert.Nil(t, err)
+		assert.True(t, os.SameFile(srcStat, dstStat), "stored object should be a hardlink of the source")
+	}
+}
+
+func TestUploadReflinkFallback(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// Only meaningful where the temp filesystem can't clone (tmpfs, ext4)
+	probe := filepath.Join(setup.remotepath, "reflink-probe")
+	if err := util.Reflink(setup.files[0].path, probe); err == nil {
+		os.Remove(probe)
+		t.Skip("temp filesystem supports reflinks, fallback path not reachable")
+	}
+
+	SetReflinkUploads(true)
+	defer SetReflinkUploads(false)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(setup.remotepath, setup.remotepath, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	assert.Contains(t, stderr.String(), "copying instead")
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		expectedPath := filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid)
+		assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+		assert.Equal(t, file.oid, calculateFileHash(t, expectedPath))
+		assert.NoFileExists(t, expectedPath+".tmp")
+	}
+}
+
+func TestUploadReflinkHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	SetReflinkUploads(true)
+	defer SetReflinkUploads(false)
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	content, oid := testObject()
+	src := filepath.Join(t.TempDir(), "src")
+	assert.Nil(t, ioutil.WriteFile(src, append(content, '!'), 0644))
+	f, err := os.Open(src)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	// Corrupt content is reported as such, not as a missing feature to copy
+	// around
+	var stderr bytes.Buffer
+	b := (&dirBackend{dir: dir, compression: "none"}).withReporter(reporter{errWriter: bufio.NewWriter(&stderr)})
+	assert.ErrorIs(t, b.Put(oid, f, int64(len(content))+1), errHashMismatch)
+	assert.NotContains(t, stderr.String(), "copying instead")
+	assert.NoFileExists(t, storagePath(dir, oid))
+}
+
+func TestUploadRcloneRcat(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// copyto deliberately fails so only the streaming path can succeed
+	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"rcat\" ]; then\n  dest=${2#*:}\n  mkdir -p \"$(dirname \"$dest\")\"\n  cat > \"$dest\"\nelif [ \"$1\" = \"hashsum\" ]; then\n  sha256sum \"${4#*:}\"\nelse\n  exit 1\nfi\n"
+	installFakeRclone(t, scriptContent)
+
+	SetRcloneStreamUploads(true)
+	defer SetRcloneStreamUploads(false)
+	SetVerifyUploads(true)
+	defer SetVerifyUploads(false)
+
+	base := "--compression=lz4 dummy:" + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+
+		expectedPath := filepath.Join(setup.remotepath, file.oid[0:2], file.oid[2:4], file.oid+".lz4")
+		assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+
+		f, err := os.Open(expectedPath)
+		assert.Nil(t, err)
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, lz4.NewReader(f))
+		assert.Nil(t, err)
+		f.Close()
+		sum := sha256.Sum256(buf.Bytes())
+		assert.Equal(t, file.oid, hex.EncodeToString(sum[:]))
+	}
+}
+
+func progressEvents(t *testing.T, stdout, oid string) []api.ProgressResponse {
+	var events []api.ProgressResponse
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		var resp api.ProgressResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err == nil && resp.Event == "progress" && resp.Oid == oid {
+			events = append(events, resp)
+		}
+	}
+	return events
+}
+
+func TestRcloneProgress(t *testing.T) {
+	// Report every block so streaming progress is visible
+	SetProgressInterval(0, 0)
+	defer SetProgressInterval(DefaultProgressInterval, 0)
+	setup := setupDownloadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	// copyto reports progress in rclone's one-line stats format
+	scriptContent := "#!/bin/sh\nif [ \"$1\" = \"cat\" ]; then\n  cat \"${2#*:}\"\nelif [ \"$1\" = \"copyto\" ]; then\n  dest=${3#*:}\n  mkdir -p \"$(dirname \"$dest\")\"\n  printf 'Transferred: 0 B / 1 MiB, 0%%, 0 B/s, ETA -\\r'\n  printf 'Transferred: 512 KiB / 1 MiB, 50%%, 1 MiB/s, ETA 1s\\r'\n  cp \"$2\" \"$dest\"\n  printf 'Transferred: 1 MiB / 1 MiB, 100%%, 1 MiB/s, ETA 0s\\n'\nelse\n  exit 1\nfi\n"
+	installFakeRclone(t, scriptContent)
+
+	base := "dummy:" + setup.remotepath
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	// The multi-block object must report progress incrementally
+	large := setup.files[1]
+	events := progressEvents(t, stdout.String(), large.oid)
+	assert.Greater(t, len(events), 1)
+	assert.Equal(t, large.size, events[len(events)-1].BytesSoFar)
+
+	// Upload the same object to a new remote path and check the stats
+	// output was translated into progress
+	otherStore, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(otherStore)
+
+	var commandBuf bytes.Buffer
+	initUpload(&commandBuf)
+	addUpload(t, &commandBuf, large.path, large.oid, large.size)
+	finishUpload(&commandBuf)
+	stdout.Reset()
+	stderr.Reset()
+
+	base = "dummy:" + otherStore
+	Serve(base, base, false, false, false, bytes.NewReader(commandBuf.Bytes()), &stdout, &stderr)
+
+	events = progressEvents(t, stdout.String(), large.oid)
+	assert.Greater(t, len(events), 1)
+	assert.Equal(t, large.size/2, events[0].BytesSoFar)
+	assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+large.oid+`"}`)
+}
+
+func TestUploadMirror(t *testing.T) {
+	setup := setupUploadTest(t)
+	defer os.RemoveAll(setup.localpath)
+	defer os.RemoveAll(setup.remotepath)
+
+	secondStore, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(secondStore)
+
+	SetMirrorUploads(true)
+	defer SetMirrorUploads(false)
+
+	base := setup.remotepath + ";" + secondStore
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		for _, store := range []string{setup.remotepath, secondStore} {
+			expectedPath := filepath.Join(store, file.oid[0:2], file.oid[2:4], file.oid)
+			assert.FileExistsf(t, expectedPath, "Store file must exist: %v", expectedPath)
+			assert.Equal(t, file.oid, calculateFileHash(t, expectedPath))
+		}
+	}
+
+	// A destination that can't be written (a plain file) makes the mirror fail
+	blocker := filepath.Join(setup.localpath, "not-a-dir")
+	assert.Nil(t, ioutil.WriteFile(blocker, []byte("x"), 0644))
+	thirdStore, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+	assert.Nil(t, err)
+	defer os.RemoveAll(thirdStore)
+	base = thirdStore + ";" + blocker
+
+	stdout.Reset()
+	stderr.Reset()
+	Serve(base, base, false, false, false, bytes.NewReader(setup.inputBuffer.Bytes()), &stdout, &stderr)
+
+	for _, file := range setup.files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`","error":`)
+		assert.FileExists(t, filepath.Join(thirdStore, file.oid[0:2], file.oid[2:4], file.oid))
+	}
+	assert.Contains(t, stdout.String(), "1 of 2 destinations")
+}
+
+func TestUploadDistribute(t *testing.T) {
+	gitpath, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-local")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitpath)
+
+	var stores []string
+	for i := 0; i < 3; i++ {
+		store, err := ioutil.TempDir(os.TempDir(), "elastic-git-storage-test-remote")
+		assert.Nil(t, err)
+		defer os.RemoveAll(store)
+		stores = append(stores, store)
+	}
+	base := strings.Join(stores, ";")
+
+	SetDistributeUploads(true)
+	defer SetDistributeUploads(false)
+
+	var uploadBuf, downloadBuf bytes.Buffer
+	initUpload(&uploadBuf)
+	initDownload(&downloadBuf)
+	var files []testFile
+	for i := 0; i < 60; i++ {
+		path := filepath.Join(gitpath, fmt.Sprintf("file%d", i))
+		size := int64(100 + i)
+		oid := createTestFile(t, size, path)
+		files = append(files, testFile{path: path, size: size, oid: oid})
+		addUpload(t, &uploadBuf, path, oid, size)
+		addDownload(t, &downloadBuf, oid, size)
+	}
+	finishUpload(&uploadBuf)
+	finishDownload(&downloadBuf)
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	Serve(base, base, false, false, false, bytes.NewReader(uploadBuf.Bytes()), &stdout, &stderr)
+
+	counts := make([]int, len(stores))
+	for _, file := range files {
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+file.oid+`"}`)
+		found := 0
+		for i, store := range stores {
+			if _, err := os.Stat(filepath.Join(store, file.oid[0:2], file.oid[2:4], file.oid)); err == nil {
+				counts[i]++
+				found++
+				assert.Equal(t, distributeIndex(file.oid, len(stores)), i)
+			}
+		}
+		assert.Equal(t, 1, found, "object must land in exactly one store")
+	}
+	for _, c := range counts {
+		assert.Greater(t, c, 5, "distribution too uneven: %v", counts)
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	Serve(base, base, false, false, false, bytes.NewReader(downloadBuf.Bytes()), &stdout, &stderr)
+
+	assert.NotContains(t, stderr.String(), "falling back")
+	paths := completionPaths(t, stdout.String())
+	for _, file := range files {
+		tempPath, ok := paths[file.oid]
+		if assert.True(t, ok) {
+			assert.Equal(t, file.oid, calculateFileHash(t, tempPath))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"os"
+	"time"
+)
+
+// objectTTL is how long objects in folder stores are served for before
+// they're treated as missing, when the LFS action can fetch them instead.
+// Zero means forever.
+var objectTTL time.Duration
+
+// removeExpired deletes expired objects from folder stores when they're
+// passed over.
+var removeExpired bool
+
+// SetObjectTTL makes downloads pass over objects stored in a folder longer
+// ago than ttl, fetching them through the LFS action instead, so stores used
+// as caches are refreshed from the main remote. Without an action to fall
+// back on, objects are always served however old they are. With remove the
+// expired objects are also deleted from the store.
+func SetObjectTTL(ttl time.Duration, remove bool) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	objectTTL, removeExpired = ttl, remove
+}
+
+// expiringBackend is implemented by backends whose objects can expire.
+type expiringBackend interface {
+	// expired returns whether oid is stored and older than objectTTL,
+	// removing it if removeExpired is set.
+	expired(oid string) (bool, error)
+}
+
+func (b *dirBackend) expired(oid string) (bool, error) {
+	for _, p := range layoutPaths(b.dir, oid) {
+		for _, name := range []string{p + compressionExt(b.compression), p} {
+			stat, err := os.Stat(name)
+			if err != nil {
+				continue
+			}
+			if time.Since(stat.ModTime()) <= objectTTL {
+				return false, nil
+			}
+			if removeExpired {
+				if err := os.Remove(name); err != nil {
+					return true, err
+				}
+				os.Remove(metadataPath(name, oid))
+				os.Remove(accessPath(name, oid))
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sinbad/lfs-folderstore/api"
+)
+
+func TestObjectTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttl")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	gitDir, err := ioutil.TempDir("", "gitdir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(gitDir)
+	SetGitDir(gitDir)
+	defer SetGitDir("")
+	defer SetObjectTTL(0, false)
+
+	content, oid := testObject()
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	b := &dirBackend{dir: dir, compression: "none"}
+	assert.Nil(t, b.Put(oid, bytes.NewReader(content), int64(len(content))))
+	objectPath := storagePath(dir, oid)
+	aged := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(objectPath, aged, aged))
+
+	// download requests the object with the main remote's action to fall
+	// back on, if pullMain, and returns how many times the action was used
+	download := func(pullMain bool) int32 {
+		atomic.StoreInt32(&fetches, 0)
+		var input bytes.Buffer
+		initDownload(&input)
+		req, err := json.Marshal(&api.Request{Event: "download", Oid: oid, Size: int64(len(content)), Action: &api.Action{Href: server.URL + "/" + oid}})
+		assert.Nil(t, err)
+		input.Write(append(req, '\n'))
+		finishDownload(&input)
+		var stdout, stderr bytes.Buffer
+		Serve(dir, "", pullMain, false, false, &input, &stdout, &stderr)
+		assert.Contains(t, stdout.String(), `{"event":"complete","oid":"`+oid+`","path"`)
+		return atomic.LoadInt32(&fetches)
+	}
+
+	// Without a TTL the folder serves it, however old
+	assert.Equal(t, int32(0), download(true))
+
+	// With one, an aged object is fetched from the main remote instead
+	SetObjectTTL(time.Hour, false)
+	assert.Equal(t, int32(1), download(true))
+	assert.FileExists(t, objectPath)
+
+	// but only if there is one to fall back on
+	assert.Equal(t, int32(0), download(false))
+
+	// Newer objects are still served from the folder
+	assert.Nil(t, os.Chtimes(objectPath, time.Now(), time.Now()))
+	assert.Equal(t, int32(0), download(true))
+
+	// Expired objects can be removed as they are passed over
+	assert.Nil(t, os.Chtimes(objectPath, aged, aged))
+	SetObjectTTL(time.Hour, true)
+	assert.Equal(t, int32(1), download(true))
+	assert.NoFileExists(t, objectPath)
+}
@@ -0,0 +1,280 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sinbad/lfs-folderstore/util"
+)
+
+// QuarantineDir is the folder below a store root that corrupt objects are
+// moved to, keeping their relative path, so they are no longer served.
+const QuarantineDir = ".quarantine"
+
+// objectFileName matches stored objects: an OID and any compression
+// extension. Temp files, lock files and anything else are skipped.
+var objectFileName = regexp.MustCompile(`^([0-9a-f]{40,128})(\.zip|\.lz4|\.zst|\.gz|\.bz2|\.xz|\.z)?$`)
+
+// extCompression maps the extensions compressionExt adds back to their
+// compression mode.
+var extCompression = map[string]string{
+	"":     "none",
+	".zip": "zip",
+	".lz4": "lz4",
+	".zst": "zstd",
+	".gz":  "gzip",
+	".bz2": "bzip2",
+	".xz":  "xz",
+	".z":   "external",
+}
+
+// storedObject is one object found in a store by VerifyStores.
+type storedObject struct {
+	root        string
+	rel         string // slash-separated, relative to root
+	oid         string
+	compression string
+	rclone      bool
+	size        int64 // stored size
+}
+
+func (o storedObject) String() string {
+	return path.Join(filepath.ToSlash(o.root), o.rel)
+}
+
+// open returns a reader over the object's content, decompressed as
+// compression says.
+func (o storedObject) open(compression string) (io.ReadCloser, error) {
+	if o.rclone {
+		stream, err := streamRclone(context.Background(), o.String())
+		if err != nil {
+			return nil, err
+		}
+		return decompressStream(compression, stream, 0, o.oid)
+	}
+	p := filepath.Join(o.root, filepath.FromSlash(o.rel))
+	if compression == "zip" {
+		return openZip(p, o.oid)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return decompressStream(compression, f, 0, o.oid)
+}
+
+// hash returns the SHA-256 of the object's content, decompressed as
+// compression says.
+func (o storedObject) hash(compression string) (string, error) {
+	rc, err := o.open(compression)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	hasher := newOidHash()
+	if _, err := io.Copy(hasher, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// sniff detects the compression of an object stored without an extension.
+func (o storedObject) sniff() string {
+	rc, err := o.open("none")
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	header, _ := bufio.NewReader(rc).Peek(6)
+	return detectCompression(header)
+}
+
+// verify checks that the object's content hashes to its OID.
+func (o storedObject) verify() error {
+	sum, err := o.hash(o.compression)
+	if err == nil && sum == o.oid {
+		return nil
+	}
+	if o.compression == "none" {
+		// Other tools may have stored it compressed without an extension,
+		// which downloads accept too
+		if c := o.sniff(); c != "" {
+			if sum, err := o.hash(c); err == nil && sum == o.oid {
+				return nil
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("content hashes to %v", sum)
+}
+
+// quarantine moves the object below QuarantineDir in its store.
+func (o storedObject) quarantine() error {
+	if o.rclone {
+		release := acquireRclone()
+		defer release()
+		return rcloneCommand("moveto", o.String(), path.Join(filepath.ToSlash(o.root), QuarantineDir, o.rel)).Run()
+	}
+	dest := filepath.Join(o.root, QuarantineDir, filepath.FromSlash(o.rel))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(o.root, filepath.FromSlash(o.rel)), dest)
+}
+
+// listObjects returns every object stored below a folder or rclone remote,
+// whatever its layout, except those already quarantined.
+func listObjects(root string) ([]storedObject, error) {
+	var objects []storedObject
+	add := func(rel string, size int64, rclone bool) {
+		if strings.HasPrefix(rel, QuarantineDir+"/") {
+			return
+		}
+		m := objectFileName.FindStringSubmatch(path.Base(rel))
+		if m == nil {
+			return
+		}
+		objects = append(objects, storedObject{root, rel, m[1], extCompression[m[2]], rclone, size})
+	}
+	if util.IsRclonePath(root) {
+		sizes, err := listRclone(root)
+		if err != nil {
+			return nil, err
+		}
+		for rel, size := range sizes {
+			add(rel, size, true)
+		}
+		sort.Slice(objects, func(i, j int) bool { return objects[i].rel < objects[j].rel })
+		return objects, nil
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == QuarantineDir || d.Name() == lockDir) {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed since the folder was read
+				return nil
+			} else if err != nil {
+				return err
+			}
+			add(filepath.ToSlash(rel), info.Size(), false)
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// eachObject calls fn for every object, jobs at a time, and waits for them
+// all to finish.
+func eachObject(objects []storedObject, jobs int, fn func(storedObject)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	var wg sync.WaitGroup
+	work := make(chan storedObject)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range work {
+				fn(o)
+			}
+		}()
+	}
+	for _, o := range objects {
+		work <- o
+	}
+	close(work)
+	wg.Wait()
+}
+
+// eachStore lists the objects in each distinct local folder store and rclone
+// remote of the base dir strings and passes them to fn. Scripts, S3, HTTP and
+// git-lfs object stores are skipped with a note saying they can't be acted
+// on. Stores that can't be listed are reported to out, and the last such
+// error returned.
+func eachStore(baseDirs []string, action string, out io.Writer, fn func(root string, objects []storedObject)) error {
+	var lastErr error
+	seen := make(map[string]bool)
+	for _, baseDir := range baseDirs {
+		for _, cfg := range splitBaseDirs(baseDir) {
+			if seen[cfg.path] {
+				continue
+			}
+			seen[cfg.path] = true
+			if cfg.script || util.URLScheme(cfg.path) != "" {
+				fmt.Fprintf(out, "Skipping %v: only folders and rclone remotes can be %v\n", cfg.path, action)
+				continue
+			}
+			if cfg.layout == "lfs" {
+				fmt.Fprintf(out, "Skipping %v: git-lfs object stores belong to their repository\n", cfg.path)
+				continue
+			}
+			objects, err := listObjects(cfg.path)
+			if err != nil {
+				fmt.Fprintf(out, "Unable to list %v: %v\n", cfg.path, err)
+				lastErr = err
+				continue
+			}
+			fn(cfg.path, objects)
+		}
+	}
+	return lastErr
+}
+
+// VerifyStores rehashes every object in the local folder stores and rclone
+// remotes of each base dir string, decompressing them first, and reports
+// those whose content doesn't match the OID they are stored under. Scripts,
+// S3 and HTTP stores are skipped. jobs objects are checked at once. With fix,
+// corrupt objects are moved below QuarantineDir in their store. Progress and
+// problems are written to out. It returns the number of corrupt objects, and
+// an error if any store couldn't be listed.
+func VerifyStores(baseDirs []string, jobs int, fix bool, out io.Writer) (int, error) {
+	bad := 0
+	err := eachStore(baseDirs, "verified", out, func(root string, objects []storedObject) {
+		var mu sync.Mutex
+		eachObject(objects, jobs, func(o storedObject) {
+			err := o.verify()
+			if err == nil {
+				return
+			}
+			msg := fmt.Sprintf("Corrupt object %v: %v", o, err)
+			if fix {
+				if qerr := o.quarantine(); qerr != nil {
+					msg += fmt.Sprintf(" (unable to quarantine: %v)", qerr)
+				} else {
+					msg += " (quarantined)"
+				}
+			}
+			mu.Lock()
+			bad++
+			fmt.Fprintln(out, msg)
+			mu.Unlock()
+		})
+		fmt.Fprintf(out, "Verified %d object(s) in %v\n", len(objects), root)
+	})
+	return bad, err
+}
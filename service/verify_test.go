@@ -0,0 +1,103 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyStore creates a store holding good objects in several formats and
+// one corrupt object, returning the corrupt object's OID.
+func verifyStore(t *testing.T, dir string) string {
+	for i, compression := range []string{"none", "lz4", "zip", "zstd"} {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+		sum := sha256.Sum256(content)
+		b := &dirBackend{dir: dir, compression: compression}
+		assert.Nil(t, b.Put(hex.EncodeToString(sum[:]), bytes.NewReader(content), int64(len(content))))
+	}
+
+	// gzipped by another tool without an extension, which downloads accept
+	content := []byte("gzipped elsewhere")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	p := storagePath(dir, oid)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+	assert.Nil(t, ioutil.WriteFile(p, compressForTest(t, "gzip", content), 0644))
+
+	content, bad := testObject()
+	assert.Nil(t, (&dirBackend{dir: dir, compression: "none"}).Put(bad, bytes.NewReader(content), int64(len(content))))
+	content[0] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(storagePath(dir, bad), content, 0644))
+
+	// Not objects, so never checked
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+	assert.Nil(t, ioutil.WriteFile(storagePath(dir, bad)+".tmp", []byte("partial"), 0644))
+	return bad
+}
+
+func TestVerifyStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	bad := verifyStore(t, dir)
+
+	var out bytes.Buffer
+	n, err := VerifyStores([]string{dir}, 3, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, out.String(), "Corrupt object "+filepath.ToSlash(storagePath(dir, bad)))
+	assert.Contains(t, out.String(), "Verified 6 object(s)")
+	assert.FileExists(t, storagePath(dir, bad))
+
+	// Fixing moves the corrupt object aside, after which the store is clean
+	out.Reset()
+	n, err = VerifyStores([]string{dir}, 3, true, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, out.String(), "(quarantined)")
+	assert.NoFileExists(t, storagePath(dir, bad))
+	assert.FileExists(t, storagePath(filepath.Join(dir, QuarantineDir), bad))
+
+	out.Reset()
+	n, err = VerifyStores([]string{dir}, 1, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, out.String(), "Verified 5 object(s)")
+
+	// Stores that can't be listed are reported as errors
+	_, err = VerifyStores([]string{filepath.Join(dir, "missing")}, 1, false, &out)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyStoresRclone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	bad := verifyStore(t, dir)
+
+	script := "#!/bin/sh\ncase \"$1\" in\n" +
+		"  lsjson) cd \"${4#*:}\" || exit 1\n    printf '['\n    sep=''\n    find . -type f | while read -r f; do\n      printf '%s{\"Path\":\"%s\",\"Size\":%s}' \"$sep\" \"${f#./}\" \"$(stat -c %s \"$f\")\"\n      sep=','\n    done\n    printf ']\\n' ;;\n" +
+		"  cat) cat \"${2#*:}\" ;;\n" +
+		"  moveto) dest=${3#*:}; mkdir -p \"$(dirname \"$dest\")\"; mv \"${2#*:}\" \"$dest\" ;;\n" +
+		"  *) exit 1 ;;\nesac\n"
+	installFakeRclone(t, script)
+
+	var out bytes.Buffer
+	n, err := VerifyStores([]string{"dummy:" + dir}, 2, true, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, out.String(), "(quarantined)")
+	assert.FileExists(t, storagePath(filepath.Join(dir, QuarantineDir), bad))
+
+	out.Reset()
+	n, err = VerifyStores([]string{"dummy:" + dir}, 2, false, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, out.String(), "Verified 5 object(s)")
+}
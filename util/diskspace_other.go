@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package util
+
+import "errors"
+
+// FreeSpace is not supported on this platform and always returns an error.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space query not supported on this platform")
+}
+
+// SameVolume is not supported on this platform and always returns an error.
+func SameVolume(a, b string) (bool, error) {
+	return false, errors.New("volume query not supported on this platform")
+}
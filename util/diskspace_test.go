@@ -0,0 +1,37 @@
+package util
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeSpace(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "windows":
+	default:
+		t.Skip("free space not supported on " + runtime.GOOS)
+	}
+	free, err := FreeSpace(os.TempDir())
+	assert.Nil(t, err)
+	assert.True(t, free > 0)
+
+	_, err = FreeSpace("/no/such/path/for/free/space")
+	assert.NotNil(t, err)
+}
+
+func TestSameVolume(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "windows":
+	default:
+		t.Skip("volume query not supported on " + runtime.GOOS)
+	}
+	same, err := SameVolume(os.TempDir(), os.TempDir())
+	assert.Nil(t, err)
+	assert.True(t, same)
+
+	_, err = SameVolume(os.TempDir(), "/no/such/path/for/volume")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package util
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the number of bytes available to this user on the
+// filesystem holding path.
+func FreeSpace(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// SameVolume reports whether the existing paths a and b are on the same
+// filesystem, so that a file can be renamed from one to the other.
+func SameVolume(a, b string) (bool, error) {
+	var sa, sb unix.Stat_t
+	if err := unix.Stat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(b, &sb); err != nil {
+		return false, err
+	}
+	return sa.Dev == sb.Dev, nil
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// FreeSpace returns the number of bytes available to this user on the
+// volume holding path.
+func FreeSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
+
+// SameVolume reports whether the existing paths a and b are on the same
+// volume, so that a file can be renamed from one to the other.
+func SameVolume(a, b string) (bool, error) {
+	va, err := volumePath(a)
+	if err != nil {
+		return false, err
+	}
+	vb, err := volumePath(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(va, vb), nil
+}
+
+// volumePath returns the mount point of the volume holding path.
+func volumePath(path string) (string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p, &buf[0], uint32(len(buf))); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buf), nil
+}
@@ -0,0 +1,40 @@
+package util
+
+import "os"
+
+// LockFile takes an exclusive advisory lock on the file at path, creating it
+// if needed, and blocks until the lock is available. The returned function
+// removes the file and releases the lock; it must always be called. Locks
+// are released by the operating system if the process dies.
+//
+// The lock only excludes other callers of LockFile, in this or any other
+// process, that use the same path. An error is returned if the filesystem
+// doesn't support locking.
+func LockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// The previous holder may have removed the file while we waited, in
+		// which case our lock is on an orphan and we must start again
+		held, err1 := f.Stat()
+		current, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(held, current) {
+			return func() {
+				// Remove while still locked, so waiters notice and retry.
+				// Windows can't remove files others have open, which leaves
+				// the lock file for the next writer to reuse.
+				os.Remove(path)
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		unlockFile(f)
+		f.Close()
+	}
+}
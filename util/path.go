@@ -1,18 +1,54 @@
 package util
 
 import (
+	"regexp"
 	"runtime"
 	"strings"
 )
 
-// IsRclonePath returns true if the path refers to an rclone remote.
-// A colon (":") indicates an rclone path, except when it denotes a
-// Windows drive letter (e.g., "C:").
+// urlSchemes are the URL-style path prefixes handled natively rather than by
+// rclone, in the form "<scheme>://".
+var urlSchemes = []string{"s3", "http", "https"}
+
+// URLScheme returns the scheme of path (e.g. "s3" for "s3://bucket/prefix")
+// if it is one of the URL-style locations handled natively, or "" otherwise.
+func URLScheme(path string) string {
+	for _, scheme := range urlSchemes {
+		if strings.HasPrefix(strings.ToLower(path), scheme+"://") {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// rcloneRemote matches the start of an rclone path up to the colon ending
+// its remote: a configured remote name ("remote:") or an on-the-fly backend
+// (":s3:"), either optionally followed by connection string parameters
+// ("remote,param=value:"). Names are letters, digits, "_", ".", "+", "@",
+// "-" and inner spaces, not starting with "-", as rclone allows.
+var rcloneRemote = regexp.MustCompile(`^(:?[\p{L}\p{N}_.+@]([\p{L}\p{N}_. +@-]*[\p{L}\p{N}_.+@-])?)(,[^:/\\]*)?:`)
+
+// genericURL matches any "<scheme>://" URL, which rclone doesn't accept.
+var genericURL = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*://`)
+
+// IsRclonePath returns true if the path refers to an rclone remote, such as
+// "remote:bucket/path" or ":s3:bucket". URLs (e.g. "https://host/path"),
+// Windows drive letters (e.g. "C:\lfs") and paths with a separator before
+// their first colon (e.g. "/mnt/a:b" or "\\?\C:\lfs") are not.
 func IsRclonePath(path string) bool {
+	if URLScheme(path) != "" || genericURL.MatchString(path) {
+		return false
+	}
 	if runtime.GOOS == "windows" {
 		if len(path) >= 2 && path[1] == ':' {
 			return false
 		}
 	}
-	return strings.Contains(path, ":")
+	return rcloneRemote.MatchString(path)
+}
+
+// IsRemotePath returns true if the path refers to remote storage, either an
+// rclone remote or a natively handled URL, rather than a local directory.
+func IsRemotePath(path string) bool {
+	return URLScheme(path) != "" || IsRclonePath(path)
 }
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathClassification(t *testing.T) {
+	assert.True(t, IsRclonePath("remote:bucket/path"))
+	assert.False(t, IsRclonePath("/local/store"))
+	assert.False(t, IsRclonePath("s3://bucket/prefix"))
+	assert.False(t, IsRclonePath("S3://bucket"))
+
+	assert.Equal(t, "s3", URLScheme("s3://bucket/prefix"))
+	assert.Equal(t, "", URLScheme("s3:bucket/prefix"))
+	assert.Equal(t, "", URLScheme("/local/store"))
+	assert.Equal(t, "https", URLScheme("https://cdn.example.com/lfs"))
+	assert.Equal(t, "http", URLScheme("http://localhost:8080/lfs"))
+	assert.False(t, IsRclonePath("https://cdn.example.com/lfs"))
+
+	assert.True(t, IsRemotePath("s3://bucket"))
+	assert.True(t, IsRemotePath("remote:bucket"))
+	assert.False(t, IsRemotePath("/local/store"))
+}
+
+func TestIsRclonePath(t *testing.T) {
+	for _, p := range []string{
+		"remote:",
+		"remote:bucket/path",
+		"my remote:path",
+		"gdrive.2@work:lfs",
+		"s3:bucket/prefix",
+		":s3:bucket",
+		"remote,provider=AWS:bucket",
+		":local,case_insensitive=true:/tmp",
+	} {
+		assert.True(t, IsRclonePath(p), p)
+	}
+	for _, p := range []string{
+		"",
+		"/local/store",
+		"relative/store",
+		"/mnt/with:colon",
+		"./a:b",
+		"https://cdn.example.com/lfs",
+		"ftp://host/lfs",
+		"file:///tmp/lfs",
+		`\\server\share\lfs`,
+		`\\?\C:\lfs`,
+		"-remote:path",
+		" remote:path",
+		"remote :path",
+	} {
+		assert.False(t, IsRclonePath(p), p)
+	}
+
+	// A single letter before the colon is a drive on Windows only
+	assert.Equal(t, runtime.GOOS != "windows", IsRclonePath(`C:\lfs`))
+	assert.Equal(t, runtime.GOOS != "windows", IsRclonePath("c:lfs"))
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package util
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// NewCmdContext is like NewCmd, but the command runs in its own process group
+// and when ctx is done the whole group is killed, so processes the command
+// started don't outlive it.
+func NewCmdContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the combined throughput of every
+// reader sharing it. Tokens accrue at the configured rate, up to one
+// second's worth, and each byte read spends one. Readers that overspend
+// sleep off their debt, so concurrent transfers share the rate between them.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSec bytes per second.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+// Wait blocks until n more bytes may be transferred.
+func (l *RateLimiter) Wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
+
+// LimitReader returns a reader over r whose reads are paced by l.
+func LimitReader(r io.Reader, l *RateLimiter) io.Reader {
+	return &limitedReader{r, l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.l.Wait(n)
+	}
+	return n, err
+}
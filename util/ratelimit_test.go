@@ -0,0 +1,35 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 200 * 1024
+	data := make([]byte, rate/2)
+
+	// Half a second's worth, read by each of two readers sharing a limit,
+	// takes about a second in total
+	l := NewRateLimiter(rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, LimitReader(bytes.NewReader(data), l))
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(data)), n)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 800*time.Millisecond, "took %v", elapsed)
+	assert.True(t, elapsed < 3*time.Second, "took %v", elapsed)
+}
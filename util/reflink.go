@@ -0,0 +1,21 @@
+package util
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ErrReflinkUnsupported is returned by Reflink on platforms without
+// copy-on-write file clone support.
+var ErrReflinkUnsupported = errors.New("reflink not supported on this platform")
+
+// IsReflinkUnsupported reports whether err from Reflink means the files
+// can't be cloned, because the platform or filesystem doesn't support it or
+// they are on different filesystems, rather than that something went wrong.
+func IsReflinkUnsupported(err error) bool {
+	return errors.Is(err, ErrReflinkUnsupported) ||
+		errors.Is(err, syscall.EOPNOTSUPP) ||
+		errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.EINVAL)
+}
@@ -0,0 +1,11 @@
+//go:build darwin
+
+package util
+
+import "golang.org/x/sys/unix"
+
+// Reflink creates dst as a copy-on-write clone of src using clonefile(2),
+// which is supported by APFS. dst must not already exist.
+func Reflink(src, dst string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
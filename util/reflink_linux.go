@@ -0,0 +1,38 @@
+//go:build linux
+
+package util
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reflink creates dst as a copy-on-write clone of src using the FICLONE
+// ioctl, which is supported by Btrfs, XFS and similar filesystems. dst must
+// not already exist. On failure dst is removed and the error returned.
+func Reflink(src, dst string) error {
+	srcf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcf.Close()
+	stat, err := srcf.Stat()
+	if err != nil {
+		return err
+	}
+	dstf, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, stat.Mode())
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(dstf.Fd()), int(srcf.Fd())); err != nil {
+		dstf.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := dstf.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package util
+
+// Reflink is not supported on this platform and always returns
+// ErrReflinkUnsupported.
+func Reflink(src, dst string) error {
+	return ErrReflinkUnsupported
+}
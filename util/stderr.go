@@ -5,8 +5,44 @@ import (
 	"strings"
 )
 
+// Level is the verbosity of a message written to stderr. Messages are only
+// written when their level is no higher than the one set by SetStderrLevel.
+type Level int
+
+const (
+	// LevelWarn is for warnings and errors, written even when quiet
+	LevelWarn Level = iota
+	// LevelInfo is for the progress of the session and each transfer
+	LevelInfo
+	// LevelDebug is for where each transfer is resolved to
+	LevelDebug
+	// LevelTrace is for the external commands run
+	LevelTrace
+)
+
+var stderrLevel = LevelInfo
+
+// SetStderrLevel sets the most verbose level of message written to stderr.
+// The default is LevelInfo.
+func SetStderrLevel(level Level) {
+	stderrLevel = level
+}
+
+// StderrEnabled returns whether messages at level are written to stderr.
+func StderrEnabled(level Level) bool {
+	return level <= stderrLevel
+}
+
 // WriteToStderr is for when you need to print extra information
 func WriteToStderr(msg string, errWriter *bufio.Writer) {
+	WriteToStderrAt(LevelInfo, msg, errWriter)
+}
+
+// WriteToStderrAt writes msg if messages at level are enabled.
+func WriteToStderrAt(level Level, msg string, errWriter *bufio.Writer) {
+	if !StderrEnabled(level) {
+		return
+	}
 	if !strings.HasSuffix(msg, "\n") {
 		msg = msg + "\n"
 	}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"io"
+	"sync"
+)
+
+// SyncWriter serialises writes to an underlying writer so that it can be
+// shared between goroutines. Give each goroutine its own bufio.Writer on top
+// of a SyncWriter: every protocol message is written and flushed as a whole,
+// and a flush from an otherwise empty bufio.Writer always reaches the
+// underlying writer in a single Write call, so complete lines are emitted
+// atomically and never interleave.
+type SyncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewSyncWriter returns a SyncWriter wrapping w.
+func NewSyncWriter(w io.Writer) *SyncWriter {
+	return &SyncWriter{w: w}
+}
+
+// Write writes p to the underlying writer while holding the lock.
+func (s *SyncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
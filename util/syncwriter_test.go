@@ -0,0 +1,51 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncWriterConcurrentMessages(t *testing.T) {
+	var out bytes.Buffer
+	sw := NewSyncWriter(&out)
+
+	const goroutines = 16
+	const messages = 200
+	// Some messages exceed the default bufio size to cover direct writes
+	padding := strings.Repeat("x", 5000)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			writer := bufio.NewWriter(sw)
+			for i := 0; i < messages; i++ {
+				msg := map[string]interface{}{"event": "progress", "goroutine": g, "seq": i}
+				if i%10 == 0 {
+					msg["padding"] = padding
+				}
+				b, err := json.Marshal(msg)
+				assert.Nil(t, err)
+				WriteToStderr(string(b), writer)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	lines := 0
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+		assert.True(t, json.Valid(scanner.Bytes()), fmt.Sprintf("invalid line %d", lines))
+	}
+	assert.Equal(t, goroutines*messages, lines)
+}